@@ -0,0 +1,298 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PortRange is an inclusive range of TCP ports, for
+// Config.ActivePortRange.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// Listen for the server's data connection and tell the server where with
+// EPRT or PORT (see Config.ActiveTransfers).
+func (pconn *persistentConn) openActiveDataConn() (net.Conn, error) {
+	local, ok := pconn.controlConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, ftpError{err: fmt.Errorf("can't listen for active transfers on %s", pconn.controlConn.LocalAddr())}
+	}
+
+	remote, ok := pconn.controlConn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, ftpError{err: fmt.Errorf("can't accept active transfers from %s", pconn.controlConn.RemoteAddr())}
+	}
+
+	listenIP := local.IP
+	if ip := net.ParseIP(pconn.config.LocalAddr); ip != nil && !ip.IsUnspecified() {
+		listenIP = ip
+	}
+
+	ln, err := listenInRange(listenIP, pconn.config.ActivePortRange)
+	if err != nil {
+		return nil, ftpError{err: err}
+	}
+
+	addr := ln.Addr().(*net.TCPAddr)
+	pconn.debug("listening for data connection on %s", addr)
+
+	if err := pconn.requestActive(addr); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return &activeDataConn{
+		ln:       ln,
+		serverIP: remote.IP,
+		timeout:  pconn.config.ConnectTimeout,
+		pconn:    pconn,
+	}, nil
+}
+
+// Tell the server to connect to "addr" for the next transfer. Try EPRT
+// first, falling back to PORT for IPv4 addresses.
+func (pconn *persistentConn) requestActive(addr *net.TCPAddr) error {
+	if !pconn.eprtUnsupported {
+		code, msg, err := pconn.sendCommand("EPRT %s", formatEPRT(addr))
+		if err != nil {
+			return err
+		}
+
+		if code == replyCommandOkay {
+			return nil
+		}
+
+		if addr.IP.To4() == nil {
+			return ftpError{code: code, msg: msg}
+		}
+
+		pconn.debug("server refused EPRT, trying PORT: %d-%s", code, msg)
+
+		if commandNotSupportedReply(code) {
+			pconn.eprtUnsupported = true
+		}
+	}
+
+	if addr.IP.To4() == nil {
+		return ftpError{err: errors.New("server doesn't support EPRT, and PORT doesn't work over IPv6")}
+	}
+
+	port, err := formatPORT(addr.String())
+	if err != nil {
+		return err
+	}
+
+	return pconn.sendCommandExpected(replyCommandOkay, "PORT %s", port)
+}
+
+// Format "addr" as an EPRT argument, e.g. "|1|127.0.0.1|1025|".
+func formatEPRT(addr *net.TCPAddr) string {
+	proto := 2
+	if addr.IP.To4() != nil {
+		proto = 1
+	}
+
+	return fmt.Sprintf("|%d|%s|%d|", proto, addr.IP, addr.Port)
+}
+
+// Listen on "ip" on a free port in "ports", or any port if the range is
+// empty.
+func listenInRange(ip net.IP, ports PortRange) (net.Listener, error) {
+	if ports.Min <= 0 && ports.Max <= 0 {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+
+	min, max := ports.Min, ports.Max
+	if max == 0 {
+		max = min
+	}
+
+	if min <= 0 || max < min || max > 65535 {
+		return nil, fmt.Errorf("invalid port range %d-%d", ports.Min, ports.Max)
+	}
+
+	// start somewhere random so concurrent transfers don't all collide
+	count := max - min + 1
+	start := rand.Intn(count)
+
+	var err error
+	for i := 0; i < count; i++ {
+		port := min + (start+i)%count
+
+		var ln net.Listener
+		ln, err = net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return ln, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free port in %d-%d: %s", min, max, err)
+}
+
+// A data connection the server opens to us. The connection is accepted
+// when it's first used, since the server only connects once it gets the
+// transfer command. Deadlines set before then apply once it's accepted.
+type activeDataConn struct {
+	ln       net.Listener
+	serverIP net.IP
+	timeout  time.Duration
+	pconn    *persistentConn
+
+	once sync.Once
+
+	mu            sync.Mutex
+	conn          net.Conn
+	err           error
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (a *activeDataConn) accept() (net.Conn, error) {
+	a.once.Do(func() {
+		conn, err := a.acceptServer()
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if err == nil && a.closed {
+			conn.Close()
+			conn, err = nil, ftpError{err: fmt.Errorf("data connection closed")}
+		}
+
+		if err == nil {
+			conn.SetReadDeadline(a.readDeadline)
+			conn.SetWriteDeadline(a.writeDeadline)
+		}
+
+		a.conn, a.err = conn, err
+	})
+
+	return a.conn, a.err
+}
+
+// Wait for the server to connect, ignoring connections from anyone else.
+func (a *activeDataConn) acceptServer() (net.Conn, error) {
+	defer a.ln.Close()
+
+	if tl, ok := a.ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(a.timeout))
+	}
+
+	for {
+		conn, err := a.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, ftpError{
+					err:       fmt.Errorf("server didn't open data connection within %s", a.timeout),
+					timeout:   true,
+					temporary: true,
+				}
+			}
+			return nil, ftpError{err: err}
+		}
+
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !addr.IP.Equal(a.serverIP) {
+			a.pconn.debug("rejecting data connection from %s (expected %s)", conn.RemoteAddr(), a.serverIP)
+			conn.Close()
+			continue
+		}
+
+		a.pconn.debug("accepted data connection from %s", conn.RemoteAddr())
+		return conn, nil
+	}
+}
+
+// The active data connection "dc" is, or that TLS is layered on.
+func activeConnOf(dc net.Conn) (*activeDataConn, bool) {
+	if tc, ok := dc.(interface{ NetConn() net.Conn }); ok {
+		dc = tc.NetConn()
+	}
+
+	a, ok := dc.(*activeDataConn)
+	return a, ok
+}
+
+func (a *activeDataConn) Read(buf []byte) (int, error) {
+	conn, err := a.accept()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(buf)
+}
+
+func (a *activeDataConn) Write(buf []byte) (int, error) {
+	conn, err := a.accept()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(buf)
+}
+
+func (a *activeDataConn) Close() error {
+	a.mu.Lock()
+	a.closed = true
+	conn := a.conn
+	a.mu.Unlock()
+
+	a.ln.Close()
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (a *activeDataConn) LocalAddr() net.Addr {
+	return a.ln.Addr()
+}
+
+func (a *activeDataConn) RemoteAddr() net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn != nil {
+		return a.conn.RemoteAddr()
+	}
+	return &net.TCPAddr{IP: a.serverIP}
+}
+
+func (a *activeDataConn) SetDeadline(t time.Time) error {
+	if err := a.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return a.SetWriteDeadline(t)
+}
+
+func (a *activeDataConn) SetReadDeadline(t time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.readDeadline = t
+	if a.conn != nil {
+		return a.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (a *activeDataConn) SetWriteDeadline(t time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.writeDeadline = t
+	if a.conn != nil {
+		return a.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
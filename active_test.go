@@ -0,0 +1,301 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActiveTransfers(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.data["MLSD dir"] = "type=file;size=11;modify=20150216084148; file\r\n"
+
+	// find some free ports
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	minPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	ports := PortRange{minPort, minPort + 10}
+
+	c, err := DialConfig(Config{ActiveTransfers: true, ActivePortRange: ports}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	if err := c.Store("upload", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["upload"]); got != "data" {
+		t.Errorf("got %q", got)
+	}
+
+	entries, err := c.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "file" {
+		t.Errorf("got %v", entries)
+	}
+
+	var eprts int
+	for _, cmd := range server.receivedCommands() {
+		switch {
+		case strings.HasPrefix(cmd, "EPRT "):
+			eprts++
+
+			parts := strings.Split(cmd, "|")
+			port, _ := strconv.Atoi(parts[3])
+			if parts[1] != "1" || parts[2] != "127.0.0.1" || port < ports.Min || port > ports.Max {
+				t.Errorf("unexpected %q", cmd)
+			}
+		case cmd == "EPSV" || cmd == "PASV":
+			t.Errorf("unexpected %s", cmd)
+		}
+	}
+
+	if eprts != 3 {
+		t.Errorf("expected 3 EPRTs, got %d", eprts)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestActiveTransfersEmptyFile(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR empty"] = ""
+
+	c, err := DialConfig(Config{ActiveTransfers: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// nothing is ever written to the data connection
+	if err := c.Store("empty", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	got, ok := server.stored["empty"]
+	server.mu.Unlock()
+
+	if !ok || len(got) != 0 {
+		t.Errorf("got %q (stored %v)", got, ok)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("empty", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("got %q", buf.String())
+	}
+
+	if got := c.PoolStats(); got.Open != 1 || got.Idle != 1 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestActiveTransfersPORT(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.handlers["EPRT"] = func(fc *fakeConn, arg string) {
+		fc.reply(502, "not implemented")
+	}
+
+	c, err := DialConfig(Config{ActiveTransfers: true, ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("file", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != "hello world" {
+			t.Errorf("got %q", buf.String())
+		}
+	}
+
+	var eprts, ports int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "EPRT ") {
+			eprts++
+		} else if strings.HasPrefix(cmd, "PORT 127,0,0,1,") {
+			ports++
+		}
+	}
+
+	// EPRT isn't tried again
+	if eprts != 1 || ports != 2 {
+		t.Errorf("expected 1 EPRT and 2 PORTs, got %d and %d", eprts, ports)
+	}
+}
+
+func TestActiveTransfersServerAddress(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		switch arg {
+		case "never":
+			// never connects
+			fc.activeAddr = ""
+			fc.reply(150, "here it comes")
+		case "intruder":
+			// someone else connects first
+			dialer := net.Dialer{
+				LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")},
+				Timeout:   time.Second,
+			}
+			if conn, err := dialer.Dial("tcp", fc.activeAddr); err == nil {
+				conn.Write([]byte("evil"))
+				defer conn.Close()
+			}
+			fc.sendData("hello world")
+		}
+	}
+
+	c, err := DialConfig(Config{ActiveTransfers: true, Timeout: 200 * time.Millisecond}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("intruder", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	err = c.Retrieve("never", ioutil.Discard)
+	if te, ok := err.(interface{ Timeout() bool }); !ok || !te.Timeout() {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestListenInRange(t *testing.T) {
+	for _, ports := range []PortRange{{-1, 5}, {10, 5}, {1, 70000}} {
+		if ln, err := listenInRange(net.ParseIP("127.0.0.1"), ports); err == nil {
+			ln.Close()
+			t.Errorf("%v: expected error", ports)
+		}
+	}
+
+	// taken
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	if ln2, err := listenInRange(net.ParseIP("127.0.0.1"), PortRange{port, port}); err == nil {
+		ln2.Close()
+		t.Error("expected error")
+	}
+}
+
+func TestActiveTransfersIPv6(t *testing.T) {
+	server, err := newFakeServerOn("[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6:", err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+
+	c, err := DialConfig(Config{ActiveTransfers: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	var eprts int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "EPRT |2|::1|") {
+			eprts++
+		} else if strings.HasPrefix(cmd, "PORT") || strings.HasPrefix(cmd, "EPRT") {
+			t.Errorf("unexpected %s", cmd)
+		}
+	}
+
+	if eprts != 1 {
+		t.Errorf("expected 1 EPRT, got %d", eprts)
+	}
+
+	// no falling back to PORT
+	server.handlers["EPRT"] = func(fc *fakeConn, arg string) {
+		fc.reply(502, "not implemented")
+	}
+
+	if err := c.Retrieve("file", ioutil.Discard); err == nil {
+		t.Error("expected error")
+	}
+
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "PORT") {
+			t.Errorf("unexpected %s", cmd)
+		}
+	}
+}
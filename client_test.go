@@ -6,7 +6,14 @@ package goftp
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -148,3 +155,1895 @@ func TestPooling(t *testing.T) {
 		t.Error("Leaked a connection")
 	}
 }
+
+func TestMLSTFacts(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.features = []string{"MLST type*;size*;modify*;perm;UNIX.mode;UNIX.owner;"}
+	server.replies["OPTS MLST type;size;modify;perm;UNIX.mode;"] = fakeReply{200, "MLST OPTS type;size;modify;UNIX.mode;"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	features, err := c.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "type*;size*;modify*;perm;UNIX.mode*;UNIX.owner;"; features["MLST"] != exp {
+		t.Errorf("expected %s, got %s", exp, features["MLST"])
+	}
+
+	// server rejecting OPTS is fine
+	server.replies["OPTS MLST type;size;modify;"] = fakeReply{501, "nope"}
+
+	c, err = DialConfig(Config{MLSTFacts: []string{"type", "size", "modify"}}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	features, err = c.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "type*;size*;modify*;perm;UNIX.mode;UNIX.owner;"; features["MLST"] != exp {
+		t.Errorf("expected %s, got %s", exp, features["MLST"])
+	}
+}
+
+func TestQuoteSite(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["XQUOTA"] = fakeReply{211, "Quota:\nused 10%\nEnd"}
+	server.replies["SITE SYMLINK a b"] = fakeReply{200, "symlink created"}
+	server.replies["SITE UTIME x"] = fakeReply{501, "bad arguments"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, msg, err := c.Quote("XQUOTA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != 211 || msg != "Quota:\nused 10%\nEnd" {
+		t.Errorf("got %d %q", code, msg)
+	}
+
+	// error replies aren't errors
+	if code, _, err := c.Quote("BOGUS"); err != nil || code != 502 {
+		t.Errorf("got %d, %v", code, err)
+	}
+
+	if _, _, err := c.Quote("NOOP\r\nDELE x"); err == nil {
+		t.Error("expected error")
+	}
+
+	if msg, err := c.Site("SYMLINK a b"); err != nil || msg != "symlink created" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+
+	if _, err := c.Site("UTIME x"); err == nil || err.(Error).Code() != 501 {
+		t.Errorf("got %v", err)
+	}
+
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "DELE") {
+			t.Errorf("unexpected %s", cmd)
+		}
+	}
+}
+
+func TestAccount(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["PASS secret"] = fakeReply{332, "need account"}
+	server.replies["ACCT dept42"] = fakeReply{230, "logged in"}
+
+	log := new(bytes.Buffer)
+
+	config := Config{
+		User:     "user",
+		Password: "secret",
+		Account:  "dept42",
+		Logger:   log,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+
+	if !strings.Contains(log.String(), "ACCT ******") || strings.Contains(log.String(), "dept42") {
+		t.Errorf("account not redacted:\n%s", log)
+	}
+
+	// the server wants an account we don't have
+	config.Account = ""
+	config.Logger = nil
+
+	c, err = DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Getwd(); !errors.Is(err, ErrAccountRequired) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestPostLoginCommands(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["OPTS UTF8 ON"] = fakeReply{200, "UTF8 on"}
+	server.replies["SITE SBUFSIZE 1024"] = fakeReply{200, "ok"}
+
+	config := Config{
+		PostLoginCommands: []string{"OPTS UTF8 ON", "SITE SBUFSIZE 1024"},
+		Logger:            ioutil.Discard,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+
+	cmds := strings.Join(server.receivedCommands(), ",")
+	if !strings.Contains(cmds, "PASS anonymous,") || !strings.Contains(cmds, ",OPTS UTF8 ON,SITE SBUFSIZE 1024,PWD") {
+		t.Errorf("got %s", cmds)
+	}
+
+	// failures discard the connection
+	config.PostLoginCommands = []string{"CWD /jail"}
+	server.mu.Lock()
+	server.replies["CWD /jail"] = fakeReply{550, "no such directory"}
+	server.mu.Unlock()
+
+	c, err = DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Getwd()
+	if ftpErr, ok := err.(Error); !ok || ftpErr.Code() != 550 {
+		t.Errorf("got %v", err)
+	}
+
+	if c.numOpenConns() != 0 {
+		t.Errorf("%d connections open", c.numOpenConns())
+	}
+}
+
+func TestServiceNotReady(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// greets "notReady" connections with 120
+	var (
+		mu       sync.Mutex
+		notReady int
+		greeting = "Service ready in 2 minutes"
+	)
+
+	server.mu.Lock()
+	server.greet = func() fakeReply {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if notReady == 0 {
+			return fakeReply{220, "ready"}
+		}
+
+		notReady--
+		return fakeReply{120, greeting}
+	}
+	server.mu.Unlock()
+
+	setNotReady := func(n int, msg string) {
+		mu.Lock()
+		notReady, greeting = n, msg
+		mu.Unlock()
+	}
+
+	// no waiting
+	setNotReady(1, "Service ready in 2 minutes")
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Getwd()
+
+	var notReadyErr *ServiceNotReadyError
+	if !errors.Is(err, ErrServiceNotReady) || !errors.As(err, &notReadyErr) || notReadyErr.Delay != 2*time.Minute {
+		t.Errorf("got %v", err)
+	}
+
+	c.Close()
+
+	// waiting it out, for as long as the server didn't say
+	setNotReady(1, "Down for maintenance")
+
+	c, err = DialConfig(Config{MaxServiceWait: 100 * time.Millisecond}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Now()
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(t0); elapsed < 100*time.Millisecond {
+		t.Errorf("only waited %s", elapsed)
+	}
+
+	c.Close()
+
+	// the delay is too long
+	setNotReady(1, "Service ready in 2 minutes")
+
+	c, err = DialConfig(Config{MaxServiceWait: time.Minute}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Getwd(); !errors.Is(err, ErrServiceNotReady) {
+		t.Errorf("got %v", err)
+	}
+
+	c.Close()
+
+	// the wait can be canceled
+	setNotReady(1, "Service ready in 2 minutes")
+
+	c, err = DialConfig(Config{MaxServiceWait: time.Hour}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.getIdleConnContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseReadyDelay(t *testing.T) {
+	cases := []struct {
+		msg  string
+		want time.Duration
+	}{
+		{"Service ready in 2 minutes", 2 * time.Minute},
+		{"Service ready in 5", 5 * time.Minute},
+		{"Try again in 30 seconds", 30 * time.Second},
+		{"Back in 1 hour", time.Hour},
+		{"Down for maintenance", 0},
+		{"Node 3 is down, ready in 10 sec", 10 * time.Second},
+		{"Node 3 is down", 0},
+		{"Retry within 5 minutes", 0},
+	}
+
+	for _, tc := range cases {
+		if got := parseReadyDelay(tc.msg); got != tc.want {
+			t.Errorf("%q: got %s", tc.msg, got)
+		}
+	}
+}
+
+func TestTLSFakeServer(t *testing.T) {
+	for _, mode := range []TLSMode{TLSExplicit, TLSImplicit} {
+		server, err := newFakeTLSServer(mode == TLSImplicit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.close()
+
+		server.data["RETR file"] = "hello world"
+
+		config := Config{
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			TLSMode:   mode,
+		}
+
+		c, err := DialConfig(config, server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("file", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != "hello world" {
+			t.Errorf("got %q", buf.String())
+		}
+
+		if err := c.Store("upload", strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		}
+
+		server.mu.Lock()
+		if got := string(server.stored["upload"]); got != "data" {
+			t.Errorf("got %q", got)
+		}
+		server.mu.Unlock()
+
+		var sawAuth, sawProt bool
+		for _, cmd := range server.receivedCommands() {
+			switch cmd {
+			case "AUTH TLS":
+				sawAuth = true
+			case "PROT P":
+				sawProt = true
+			}
+		}
+
+		if sawAuth != (mode == TLSExplicit) || !sawProt {
+			t.Errorf("mode %d: AUTH TLS %v, PROT P %v", mode, sawAuth, sawProt)
+		}
+
+		c.Close()
+	}
+}
+
+func TestTLSConnectionState(t *testing.T) {
+	for _, mode := range []TLSMode{TLSExplicit, TLSImplicit} {
+		server, err := newFakeTLSServer(mode == TLSImplicit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.close()
+
+		server.data["RETR file"] = "hello world"
+
+		var (
+			mu       sync.Mutex
+			channels []string
+		)
+
+		config := Config{
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			TLSMode:   mode,
+			ConnectionHooks: &ConnectionHooks{
+				OnTLSConnectionState: func(channel string, state tls.ConnectionState) {
+					if !state.HandshakeComplete || state.Version == 0 || state.CipherSuite == 0 || len(state.PeerCertificates) == 0 {
+						t.Errorf("%s: got %+v", channel, state)
+					}
+
+					mu.Lock()
+					channels = append(channels, channel)
+					mu.Unlock()
+				},
+			},
+		}
+
+		c, err := DialConfig(config, server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Retrieve("file", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Store("upload", strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+
+		mu.Lock()
+		if !reflect.DeepEqual(channels, []string{"control", "data", "data"}) {
+			t.Errorf("mode %d: got %q", mode, channels)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestTLSSessionReuse(t *testing.T) {
+	for _, mode := range []TLSMode{TLSExplicit, TLSImplicit} {
+		server, err := newFakeTLSServer(mode == TLSImplicit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.close()
+
+		server.mu.Lock()
+		server.requireTLSReuse = true
+		server.mu.Unlock()
+
+		server.data["RETR file"] = "hello world"
+
+		config := Config{
+			TLSConfig:          &tls.Config{InsecureSkipVerify: true},
+			TLSMode:            mode,
+			ConnectionsPerHost: 2,
+		}
+
+		c, err := DialConfig(config, server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// hold one connection so the transfers below use a second one
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			buf := new(bytes.Buffer)
+			if err := c.Retrieve("file", buf); err != nil {
+				t.Fatalf("mode %d: %s", mode, err)
+			}
+
+			if buf.String() != "hello world" {
+				t.Errorf("got %q", buf.String())
+			}
+
+			if err := c.Store("upload", strings.NewReader("data")); err != nil {
+				t.Fatalf("mode %d: %s", mode, err)
+			}
+		}
+
+		c.returnConn(pconn)
+		c.Close()
+	}
+}
+
+func TestTLSClearControlChannel(t *testing.T) {
+	for _, mode := range []TLSMode{TLSExplicit, TLSImplicit} {
+		server, err := newFakeTLSServer(mode == TLSImplicit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.close()
+
+		server.data["RETR file"] = "hello world"
+
+		// note whether each PWD arrived in plaintext
+		var plainPWD []bool
+		server.handlers["PWD"] = func(fc *fakeConn, arg string) {
+			_, isTLS := fc.conn.(*tls.Conn)
+			server.mu.Lock()
+			plainPWD = append(plainPWD, !isTLS)
+			server.mu.Unlock()
+			fc.reply(257, `"/" is the current directory`)
+		}
+
+		config := Config{
+			TLSConfig:           &tls.Config{InsecureSkipVerify: true},
+			TLSMode:             mode,
+			ClearControlChannel: true,
+		}
+
+		c, err := DialConfig(config, server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatalf("mode %d: %s", mode, err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("file", buf); err != nil {
+			t.Fatalf("mode %d: %s", mode, err)
+		}
+
+		if buf.String() != "hello world" {
+			t.Errorf("got %q", buf.String())
+		}
+
+		server.mu.Lock()
+		if !reflect.DeepEqual(plainPWD, []bool{true}) {
+			t.Errorf("mode %d: got %v", mode, plainPWD)
+		}
+		server.mu.Unlock()
+
+		c.Close()
+
+		// servers refusing CCC fail the connection
+		server.mu.Lock()
+		server.replies["CCC"] = fakeReply{500, "no CCC"}
+		server.mu.Unlock()
+
+		c, err = DialConfig(config, server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Getwd()
+		if ftpErr, ok := err.(Error); !ok || ftpErr.Code() != 500 {
+			t.Errorf("mode %d: got %v", mode, err)
+		}
+
+		c.Close()
+	}
+}
+
+func TestTLSDataProtection(t *testing.T) {
+	server, err := newFakeTLSServer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.data["MLSD dir"] = "type=file;size=11;modify=20150216084148; file\r\n"
+
+	config := Config{
+		TLSConfig:          &tls.Config{InsecureSkipVerify: true},
+		ListDataProtection: DataClear,
+		ConnectionsPerHost: 1,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake server's data connections only use TLS after "PROT P", so
+	// a mismatch fails the operation
+	for _, op := range []string{"list", "list", "retr", "retr", "list"} {
+		if op == "list" {
+			if _, err := c.ReadDir("dir"); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			buf := new(bytes.Buffer)
+			if err := c.Retrieve("file", buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != "hello world" {
+				t.Errorf("got %q", buf.String())
+			}
+		}
+	}
+
+	var prots []string
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "PROT ") {
+			prots = append(prots, cmd)
+		}
+	}
+
+	if !reflect.DeepEqual(prots, []string{"PROT P", "PROT C", "PROT P", "PROT C"}) {
+		t.Errorf("got %v", prots)
+	}
+
+	c.Close()
+
+	// mixed levels on concurrent connections
+	config.ConnectionsPerHost = 3
+	c, err = DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(list bool) {
+			defer wg.Done()
+
+			if list {
+				if _, err := c.ReadDir("dir"); err != nil {
+					t.Error(err)
+				}
+			} else if err := c.Retrieve("file", ioutil.Discard); err != nil {
+				t.Error(err)
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+}
+
+func TestTLSAuthSSLFallback(t *testing.T) {
+	server, err := newFakeTLSServer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["AUTH TLS"] = fakeReply{500, "unknown command"}
+
+	auths := func() []string {
+		var got []string
+		for _, cmd := range server.receivedCommands() {
+			if strings.HasPrefix(cmd, "AUTH ") {
+				got = append(got, cmd)
+			}
+		}
+		return got
+	}
+
+	config := Config{
+		TLSConfig:          &tls.Config{InsecureSkipVerify: true},
+		ConnectionsPerHost: 2,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// hold one connection so the next operation opens another
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.returnConn(pconn)
+
+	// the second connection goes straight to AUTH SSL
+	if got := auths(); !reflect.DeepEqual(got, []string{"AUTH TLS", "AUTH SSL", "AUTH SSL"}) {
+		t.Errorf("got %v", got)
+	}
+
+	// forcing AUTH TLS fails with the server's reply
+	config.TLSAuth = TLSAuthTLS
+	c2, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	_, err = c2.Getwd()
+	if ftpErr, ok := err.(Error); !ok || ftpErr.Code() != 500 {
+		t.Errorf("got %v", err)
+	}
+
+	// neither works
+	server.replies["AUTH SSL"] = fakeReply{502, "no TLS here"}
+	config.TLSAuth = TLSAuthAuto
+	c3, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+
+	_, err = c3.Getwd()
+	if err == nil || !strings.Contains(err.Error(), "500-unknown command") || !strings.Contains(err.Error(), "502-no TLS here") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+
+	var (
+		mu    sync.Mutex
+		dials []string
+	)
+
+	config := Config{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("expected a deadline")
+			}
+
+			mu.Lock()
+			dials = append(dials, addr)
+			mu.Unlock()
+
+			// the control connection is a pipe to the fake server
+			if addr == server.addr() {
+				client, serverSide := net.Pipe()
+				go server.handle(serverSide)
+				return client, nil
+			}
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(dials) != 2 || dials[0] != server.addr() || !strings.HasPrefix(dials[1], "127.0.0.1:") {
+		t.Errorf("got %v", dials)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := DialConfigContext(ctx, Config{}, "localhost"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v", err)
+	}
+
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// the first login hangs
+	var hung bool
+	server.handlers["USER"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		hang := !hung
+		hung = true
+		server.mu.Unlock()
+
+		if hang {
+			time.Sleep(time.Second)
+		}
+		fc.reply(230, "logged in")
+	}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	t0 := time.Now()
+	if _, err := c.ReadDirContext(ctx, ""); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+
+	if time.Since(t0) > 500*time.Millisecond {
+		t.Errorf("took %s", time.Since(t0))
+	}
+
+	// the half logged in connection wasn't kept
+	if c.numOpenConns() != 0 {
+		t.Errorf("%d connections open", c.numOpenConns())
+	}
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slow dial is abandoned too
+	config := Config{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	c, err = DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	t0 = time.Now()
+	if err := c.RetrieveContext(ctx, "file", new(bytes.Buffer)); err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+
+	if time.Since(t0) > 500*time.Millisecond {
+		t.Errorf("took %s", time.Since(t0))
+	}
+}
+
+func TestSplitTimeouts(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// slower than ConnectTimeout, but not CommandTimeout
+	server.handlers["PWD"] = func(fc *fakeConn, arg string) {
+		time.Sleep(100 * time.Millisecond)
+		fc.reply(257, `"/" is the current directory`)
+	}
+
+	// takes longer than either
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
+		}
+
+		fc.reply(150, "here it comes")
+		for i := 0; i < 6; i++ {
+			dc.Write([]byte("slow "))
+			time.Sleep(50 * time.Millisecond)
+		}
+		dc.Close()
+		fc.reply(226, "done")
+	}
+
+	var slowDial bool
+
+	config := Config{
+		Timeout:        10 * time.Second,
+		ConnectTimeout: 50 * time.Millisecond,
+		CommandTimeout: 200 * time.Millisecond,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if slowDial {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != strings.Repeat("slow ", 6) {
+		t.Errorf("got %q", buf.String())
+	}
+
+	slowDial = true
+
+	c2, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	t0 := time.Now()
+	if _, err := c2.Getwd(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v", err)
+	}
+
+	if time.Since(t0) > time.Second {
+		t.Errorf("took %s", time.Since(t0))
+	}
+}
+
+func TestTransferTimeout(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	// trickles data, never finishing
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
+		}
+
+		fc.reply(150, "here it comes")
+		for {
+			if _, err := dc.Write([]byte("slow ")); err != nil {
+				break
+			}
+
+			select {
+			case <-unblock:
+				dc.Close()
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		dc.Close()
+	}
+
+	// the transfer never stalls, but runs past Timeout
+	config := Config{
+		Timeout:        200 * time.Millisecond,
+		CommandTimeout: time.Second,
+		StallTimeout:   time.Second,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	t0 := time.Now()
+	err = c.Retrieve("file", ioutil.Discard)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if !errors.Is(err, ErrTransferTimeout) {
+		t.Errorf("got %v", err)
+	}
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("got %v", err)
+	}
+
+	if d := time.Since(t0); d > 700*time.Millisecond {
+		t.Errorf("took %s", d)
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+
+	for _, active := range []bool{false, true} {
+		config := Config{
+			LocalAddr:       "127.0.0.2",
+			ActiveTransfers: active,
+		}
+
+		c, err := DialConfig(config, server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Retrieve("file", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+	}
+
+	server.mu.Lock()
+	peers := server.peers
+	server.mu.Unlock()
+
+	// a control and a data connection for each mode
+	if len(peers) != 4 {
+		t.Fatalf("got %v", peers)
+	}
+
+	for _, peer := range peers {
+		if !strings.HasPrefix(peer, "127.0.0.2:") {
+			t.Errorf("connection from %s", peer)
+		}
+	}
+
+	for _, addr := range []string{"bogus", "192.0.2.1"} {
+		if _, err := DialConfig(Config{LocalAddr: addr}, server.addr()); err == nil {
+			t.Errorf("%s: expected error", addr)
+		}
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	c, err := DialConfig(Config{MaxConnections: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	held, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.PoolStats(); got != (PoolStats{MaxConnections: 1, Open: 1}) {
+		t.Errorf("got %+v", got)
+	}
+
+	// waiters are served in order
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			pconn, err := c.getIdleConn()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+
+			c.returnConn(pconn)
+		}(i)
+
+		for c.PoolStats().Waiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	c.returnConn(held)
+	wg.Wait()
+
+	if !reflect.DeepEqual(order, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("got %v", order)
+	}
+
+	if got := c.PoolStats(); got != (PoolStats{MaxConnections: 1, Open: 1, Idle: 1}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	config := Config{
+		ConnectionsPerHost: 1,
+		PoolWaitTimeout:    50 * time.Millisecond,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	held, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Getwd()
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("got %v", err)
+	}
+
+	if got := c.PoolStats().Waiting; got != 0 {
+		t.Errorf("got %d waiting", got)
+	}
+
+	c.returnConn(held)
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close wakes waiters
+	held, err = c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.config.PoolWaitTimeout = 0
+
+	done := make(chan error)
+	go func() {
+		_, err := c.getIdleConn()
+		done <- err
+	}()
+
+	for c.PoolStats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Close()
+
+	if err := <-done; err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	c, err := DialConfig(Config{IdleTimeout: 50 * time.Millisecond}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	controlConns := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.peers)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := controlConns(); got != 1 {
+		t.Errorf("expected 1 connection, got %d", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := controlConns(); got != 2 {
+		t.Errorf("expected 2 connections, got %d", got)
+	}
+
+	// the server may not have read QUIT yet
+	quits := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if cmd == "QUIT" {
+				n++
+			}
+		}
+		return n
+	}
+
+	for start := time.Now(); quits() == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := quits(); got != 1 {
+		t.Errorf("expected 1 QUIT, got %d", got)
+	}
+
+	if got := c.PoolStats(); got.Open != 1 || got.Idle != 1 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	var (
+		mu      sync.Mutex
+		reasons []string
+	)
+
+	config := Config{
+		MaxConnectionAge: 200 * time.Millisecond,
+		ConnectionHooks: &ConnectionHooks{
+			OnConnClosed: func(reason string) {
+				mu.Lock()
+				reasons = append(reasons, reason)
+				mu.Unlock()
+			},
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	controlConns := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.peers)
+	}
+
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// jittered by up to 10%
+	if age := time.Until(pconn.retireAt); age < 170*time.Millisecond || age > 220*time.Millisecond {
+		t.Errorf("retiring in %s", age)
+	}
+
+	// in use connections aren't cut off
+	time.Sleep(250 * time.Millisecond)
+
+	if got := c.PoolStats(); got.Open != 1 {
+		t.Errorf("got %+v", got)
+	}
+
+	if _, _, err := pconn.sendCommand("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+
+	// but aren't reused once returned
+	c.returnConn(pconn)
+
+	if got := c.PoolStats(); got.Open != 0 {
+		t.Errorf("got %+v", got)
+	}
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nor if they got too old while idle
+	time.Sleep(250 * time.Millisecond)
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := controlConns(); got != 3 {
+		t.Errorf("expected 3 connections, got %d", got)
+	}
+
+	mu.Lock()
+	if len(reasons) != 2 || reasons[0] != "max age" || reasons[1] != "max age" {
+		t.Errorf("got %q", reasons)
+	}
+	mu.Unlock()
+}
+
+func TestKeepaliveInterval(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	c, err := DialConfig(Config{KeepaliveInterval: 20 * time.Millisecond, ConnectionsPerHost: 2}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noops := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if cmd == "NOOP" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// one idle connection, and one in use
+	idle, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busy, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.returnConn(idle)
+
+	time.Sleep(100 * time.Millisecond)
+
+	if noops() < 2 {
+		t.Errorf("expected keepalives, got %d", noops())
+	}
+
+	// the busy connection wasn't touched
+	if _, _, err := busy.sendCommand("PWD"); err != nil {
+		t.Fatal(err)
+	}
+	c.returnConn(busy)
+
+	// a connection failing its keepalive is closed
+	server.mu.Lock()
+	server.replies["NOOP"] = fakeReply{421, "going away"}
+	server.mu.Unlock()
+
+	for start := time.Now(); c.PoolStats().Open > 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := c.PoolStats(); got.Open != 0 || got.Idle != 0 {
+		t.Errorf("got %+v", got)
+	}
+
+	c.Close()
+
+	// no keepalives after Close
+	n := noops()
+	time.Sleep(50 * time.Millisecond)
+	if noops() != n {
+		t.Error("keepalives after Close")
+	}
+}
+
+func TestTestOnBorrow(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	var lastConn *fakeConn
+	server.handlers["PWD"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		lastConn = fc
+		server.mu.Unlock()
+		fc.reply(257, `"/" is the current directory`)
+	}
+
+	c, err := DialConfig(Config{TestOnBorrow: 20 * time.Millisecond}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	noops := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if cmd == "NOOP" {
+				n++
+			}
+		}
+		return n
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// recently used connections aren't checked
+	if got := noops(); got != 0 {
+		t.Errorf("expected no NOOPs, got %d", got)
+	}
+
+	// the server drops the connection while it's idle
+	server.mu.Lock()
+	lastConn.conn.Close()
+	server.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	if len(server.peers) != 2 {
+		t.Errorf("expected a new connection, got %v", server.peers)
+	}
+	server.mu.Unlock()
+
+	// a healthy idle connection passes the check
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := noops(); got != 1 {
+		t.Errorf("expected 1 NOOP, got %d", got)
+	}
+}
+
+func TestMinIdleConnections(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	config := Config{
+		MinIdleConnections: 2,
+		ConnectionsPerHost: 3,
+		IdleTimeout:        200 * time.Millisecond,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	waitFor := func(open, idle int) {
+		t.Helper()
+
+		var stats PoolStats
+		for i := 0; i < 100; i++ {
+			stats = c.PoolStats()
+			if stats.Open == open && stats.Idle == idle {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d open and %d idle, got %+v", open, idle, stats)
+	}
+
+	// opened in the background
+	waitFor(2, 2)
+
+	// taking one gets it replaced
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(3, 2)
+
+	c.returnConn(pconn)
+
+	// expired connections are replaced too
+	time.Sleep(400 * time.Millisecond)
+
+	waitFor(2, 2)
+
+	server.mu.Lock()
+	if len(server.peers) < 5 {
+		t.Errorf("expected expired connections to be replaced, got %v", server.peers)
+	}
+	server.mu.Unlock()
+
+	// Warm reports failures
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	var (
+		mu    sync.Mutex
+		fails int
+	)
+
+	config.ConnectionHooks = &ConnectionHooks{
+		OnDial: func(addr string, dur time.Duration, err error) {
+			mu.Lock()
+			if err != nil {
+				fails++
+			}
+			mu.Unlock()
+		},
+	}
+
+	c2, err := DialConfig(config, down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	if err := c2.Warm(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+
+	mu.Lock()
+	if fails < 1 {
+		t.Errorf("got %d failed dials", fails)
+	}
+	mu.Unlock()
+}
+
+func TestMinIdleConnectionsBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	var (
+		mu    sync.Mutex
+		dials int
+	)
+
+	config := Config{
+		MinIdleConnections: 1,
+		HostBackoff:        50 * time.Millisecond,
+		ConnectionHooks: &ConnectionHooks{
+			OnDial: func(addr string, dur time.Duration, err error) {
+				mu.Lock()
+				dials++
+				mu.Unlock()
+			},
+		},
+	}
+
+	c, err := DialConfig(config, down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// retried after 50ms, 100ms, 200ms, 400ms... rather than every 50ms
+	time.Sleep(600 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if dials < 2 || dials > 5 {
+		t.Errorf("got %d dials", dials)
+	}
+}
+
+func TestClose(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a connection in use is waited for
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.returnConn(pconn)
+	}()
+
+	t0 := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(t0) < 50*time.Millisecond {
+		t.Error("Close didn't wait for the connection in use")
+	}
+
+	if c.numOpenConns() != 0 {
+		t.Errorf("%d connections still open", c.numOpenConns())
+	}
+
+	// the server reads QUIT asynchronously
+	quits := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if cmd == "QUIT" {
+				n++
+			}
+		}
+		return n
+	}
+
+	for i := 0; i < 50 && quits() < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := quits(); got != 1 {
+		t.Errorf("expected 1 QUIT, got %d", got)
+	}
+
+	if _, err := c.Getwd(); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("got %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %s", err)
+	}
+
+	// connections still in use when the context is done get closed anyway
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pconn, err = c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.CloseContext(ctx); err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+
+	if _, _, err := pconn.sendCommand("NOOP"); err == nil {
+		t.Error("expected error on closed connection")
+	}
+
+	c.returnConn(pconn)
+
+	if c.numOpenConns() != 0 {
+		t.Errorf("%d connections still open", c.numOpenConns())
+	}
+}
+
+func TestConnectionHooksDataDial(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "lorem ipsum"
+
+	var (
+		mu    sync.Mutex
+		dials []string
+	)
+
+	config := Config{
+		ConnectionHooks: &ConnectionHooks{
+			OnDial: func(addr string, dur time.Duration, err error) {
+				mu.Lock()
+				dials = append(dials, addr)
+				mu.Unlock()
+			},
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// only the control connection
+	if !reflect.DeepEqual(dials, []string{server.addr()}) {
+		t.Errorf("got %q", dials)
+	}
+}
+
+func TestConnectionHooks(t *testing.T) {
+	server, err := newFakeTLSServer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+
+	record := func(f string, args ...interface{}) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(f, args...))
+		mu.Unlock()
+	}
+
+	hooks := &ConnectionHooks{
+		OnDial: func(addr string, dur time.Duration, err error) {
+			record("dial %s %v", addr, err)
+		},
+		OnTLSHandshake: func(addr string, dur time.Duration, err error) {
+			record("tls %s %v", addr, err)
+		},
+		OnLogin: func(user string, err error) {
+			record("login %s %v", user, err)
+		},
+		OnConnClosed: func(reason string) {
+			record("closed %s", reason)
+		},
+		OnConnReused: func(idleFor time.Duration) {
+			if idleFor < 20*time.Millisecond {
+				t.Errorf("idle for %s", idleFor)
+			}
+			record("reused")
+		},
+	}
+
+	config := Config{
+		TLSConfig:       &tls.Config{InsecureSkipVerify: true},
+		ConnectionHooks: hooks,
+		IdleTimeout:     time.Second,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+
+	addr := server.addr()
+	expected := []string{
+		"dial " + addr + " <nil>",
+		"tls " + addr + " <nil>",
+		"login anonymous <nil>",
+		"reused",
+		"closed client closed",
+	}
+
+	mu.Lock()
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("got %q", events)
+	}
+	mu.Unlock()
+
+	// connecting fails
+	server.close()
+
+	events = nil
+
+	c, err = DialConfig(config, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Getwd(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	mu.Lock()
+	if len(events) != 1 || !strings.HasPrefix(events[0], "dial "+addr) || strings.HasSuffix(events[0], "<nil>") {
+		t.Errorf("got %q", events)
+	}
+	mu.Unlock()
+}
+
+func TestLookupHosts(t *testing.T) {
+	cases := []struct {
+		in  string
+		out string
+	}{
+		{"127.0.0.1", "127.0.0.1:21"},
+		{"127.0.0.1:2121", "127.0.0.1:2121"},
+		{"::1", "[::1]:21"},
+		{"[::1]", "[::1]:21"},
+		{"[::1]:2121", "[::1]:2121"},
+		{"[2001:db8::1]:21", "[2001:db8::1]:21"},
+	}
+
+	for _, c := range cases {
+		got, err := lookupHosts(context.Background(), []string{c.in}, false, "21", true)
+		if err != nil {
+			t.Errorf("%s: %s", c.in, err)
+			continue
+		}
+
+		if len(got) != 1 || got[0] != c.out {
+			t.Errorf("%s: got %v", c.in, got)
+		}
+	}
+
+	for _, bad := range []string{"127.0.0.1:", "127.0.0.1:ftp", "[::1]:99999", ""} {
+		if _, err := lookupHosts(context.Background(), []string{bad}, false, "21", true); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestDefaultPort(t *testing.T) {
+	c, err := DialConfig(Config{}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.hosts[0] != "127.0.0.1:21" {
+		t.Errorf("got %s", c.hosts[0])
+	}
+
+	config := Config{
+		TLSConfig: &tls.Config{},
+		TLSMode:   TLSImplicit,
+	}
+
+	c, err = DialConfig(config, "127.0.0.1", "127.0.0.1:2121")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.hosts[0] != "127.0.0.1:990" || c.hosts[1] != "127.0.0.1:2121" {
+		t.Errorf("got %v", c.hosts)
+	}
+}
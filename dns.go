@@ -0,0 +1,253 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DNSPolicy selects when hostnames given to Dial are resolved (see
+// Config.DNSPolicy).
+type DNSPolicy int
+
+const (
+	// DNSResolveEachConn resolves hostnames again for each new connection,
+	// so changed DNS records are picked up as connections are replaced.
+	// Each hostname is one host for ConnectionsPerHost and HostStrategy,
+	// and connections try its addresses in order.
+	DNSResolveEachConn DNSPolicy = 0
+
+	// DNSCache is like DNSResolveEachConn, but reuses a hostname's
+	// addresses for Config.DNSCacheTTL.
+	DNSCache DNSPolicy = 1
+
+	// DNSPin resolves hostnames once, in Dial, and sticks to those
+	// addresses. Each address is a host of its own for ConnectionsPerHost
+	// and HostStrategy.
+	DNSPin DNSPolicy = 2
+)
+
+// Addresses a hostname resolved to, for DNSCache.
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// The addresses to try connecting to for "host", in order: "host" itself
+// if it's an address already (or the proxy resolves it), or else what
+// its hostname resolves to, per Config.DNSPolicy.
+func (c *Client) resolveHost(ctx context.Context, host string) ([]string, error) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyResolves, _ := checkProxy(c.config)
+	if net.ParseIP(hostname) != nil || proxyResolves {
+		return []string{host}, nil
+	}
+
+	if c.config.DNSPolicy == DNSCache {
+		c.mu.Lock()
+		entry, ok := c.dnsCache[host]
+		c.mu.Unlock()
+
+		if ok && time.Now().Before(entry.expires) {
+			return entry.addrs, nil
+		}
+	}
+
+	addrs, err := lookupHosts(ctx, []string{host}, c.config.IPv6Lookup || c.config.PreferIPv6, port, true)
+	if err != nil {
+		return nil, ftpError{err: err, temporary: true}
+	}
+
+	c.debug("resolved %s to %v", hostname, addrs)
+
+	if c.config.DNSPolicy == DNSCache {
+		c.mu.Lock()
+		c.dnsCache[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.config.DNSCacheTTL)}
+		c.mu.Unlock()
+	}
+
+	return addrs, nil
+}
+
+// Head start the preferred address family gets before the other one is
+// tried too (see Config.PreferIPv4).
+const fallbackDelay = 300 * time.Millisecond
+
+// Connect to one of "addrs", recording which in pconn.addr. Addresses of
+// the preferred family are tried first, and the other family's after
+// fallbackDelay (or once the preferred ones failed), using whichever
+// connects first.
+func (pconn *persistentConn) dialFirst(ctx context.Context, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, pconn.config.ConnectTimeout)
+	defer cancel()
+
+	primaries, fallbacks := pconn.partitionAddrs(addrs)
+
+	if len(fallbacks) == 0 {
+		conn, addr, err := pconn.dialSerial(ctx, primaries)
+		if err != nil {
+			return nil, err
+		}
+
+		pconn.connectedTo(addr)
+		return conn, nil
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		addr    string
+		err     error
+		primary bool
+	}
+
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+
+	race := func(ctx context.Context, addrs []string, primary bool) {
+		conn, addr, err := pconn.dialSerial(ctx, addrs)
+		select {
+		case results <- dialResult{conn, addr, err, primary}:
+		case <-returned:
+			// the other family won
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	raceCtx, cancelRace := context.WithCancel(ctx)
+	defer cancelRace()
+
+	go race(raceCtx, primaries, true)
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var (
+		fallbackStarted         bool
+		pending                 = 1
+		primaryErr, fallbackErr error
+	)
+
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			pconn.debug("trying %v too", fallbacks)
+			go race(raceCtx, fallbacks, false)
+		}
+	}
+
+	for {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+		case res := <-results:
+			pending--
+
+			if res.err == nil {
+				pconn.connectedTo(res.addr)
+				return res.conn, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+				startFallback()
+			} else {
+				fallbackErr = res.err
+			}
+
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// Record that we connected to "addr", one of the addresses of pconn.host.
+func (pconn *persistentConn) connectedTo(addr string) {
+	pconn.addr = addr
+	if addr != pconn.host {
+		pconn.debug("connected to %s", addr)
+	}
+}
+
+// Split "addrs" into those of the preferred address family and the rest:
+// IPv4 or IPv6 per Config.PreferIPv4 and Config.PreferIPv6, or else the
+// family of the first address.
+func (pconn *persistentConn) partitionAddrs(addrs []string) (primaries, fallbacks []string) {
+	isIPv4 := func(addr string) bool {
+		host, _, _ := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		return ip == nil || ip.To4() != nil
+	}
+
+	preferIPv4 := isIPv4(addrs[0])
+	if pconn.config.PreferIPv4 {
+		preferIPv4 = true
+	} else if pconn.config.PreferIPv6 {
+		preferIPv4 = false
+	}
+
+	for _, addr := range addrs {
+		if isIPv4(addr) == preferIPv4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+
+	// nothing of the preferred family
+	if len(primaries) == 0 {
+		return fallbacks, nil
+	}
+
+	return primaries, fallbacks
+}
+
+// Connect to the first of "addrs" that works, giving each attempt an equal
+// share of what's left of "ctx"'s deadline, so one dead address doesn't use
+// it all up.
+func (pconn *persistentConn) dialSerial(ctx context.Context, addrs []string) (net.Conn, string, error) {
+	var firstErr error
+	for i, addr := range addrs {
+		deadline, _ := ctx.Deadline()
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+
+		t0 := time.Now()
+		conn, err := pconn.dial(attemptCtx, addr)
+		cancelAttempt()
+
+		pconn.config.ConnectionHooks.dialed(addr, time.Since(t0), err)
+
+		if err == nil {
+			return conn, addr, nil
+		}
+
+		if len(addrs) > 1 {
+			pconn.debug("error connecting to %s: %s", addr, err)
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, "", firstErr
+}
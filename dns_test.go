@@ -0,0 +1,247 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Make lookupIPAddr resolve "ftp.test" to whatever the returned function
+// was last called with.
+func fakeDNS(t *testing.T) func(ips ...string) {
+	var (
+		mu      sync.Mutex
+		records []net.IPAddr
+	)
+
+	orig := lookupIPAddr
+	t.Cleanup(func() { lookupIPAddr = orig })
+
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if host != "ftp.test" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return append([]net.IPAddr(nil), records...), nil
+	}
+
+	return func(ips ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		records = nil
+		for _, ip := range ips {
+			records = append(records, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+	}
+}
+
+func TestDNSPolicy(t *testing.T) {
+	first, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.close()
+
+	_, port, _ := net.SplitHostPort(first.addr())
+
+	// the same port on another loopback address
+	second, err := newFakeServerOn("127.0.0.2:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.close()
+
+	setRecords := fakeDNS(t)
+
+	cases := []struct {
+		policy DNSPolicy
+		ttl    time.Duration
+		moves  bool
+	}{
+		{DNSResolveEachConn, 0, true},
+		{DNSCache, time.Hour, false},
+		{DNSCache, time.Nanosecond, true},
+		{DNSPin, 0, false},
+	}
+
+	for _, tc := range cases {
+		setRecords("127.0.0.1")
+
+		config := Config{
+			DNSPolicy:          tc.policy,
+			DNSCacheTTL:        tc.ttl,
+			ConnectionsPerHost: 2,
+		}
+
+		c, err := DialConfig(config, "ftp.test:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the server moves
+		setRecords("127.0.0.2")
+
+		other, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "127.0.0.1:" + port
+		if tc.moves {
+			expected = "127.0.0.2:" + port
+		}
+
+		if other.addr != expected {
+			t.Errorf("policy %d, TTL %s: got %s", tc.policy, tc.ttl, other.addr)
+		}
+
+		c.returnConn(pconn)
+		c.returnConn(other)
+		c.Close()
+	}
+
+	// names that don't resolve fail early
+	if _, err := DialConfig(Config{}, "nowhere.test"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDNSDeadAddress(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	_, port, _ := net.SplitHostPort(server.addr())
+
+	setRecords := fakeDNS(t)
+	setRecords("127.0.0.3", "127.0.0.1")
+
+	config := Config{
+		ConnectTimeout: 400 * time.Millisecond,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "127.0.0.3:"+port {
+				// black hole
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	c, err := DialConfig(config, "ftp.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	t0 := time.Now()
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dead address only got half the timeout
+	if elapsed := time.Since(t0); elapsed < 150*time.Millisecond || elapsed > 350*time.Millisecond {
+		t.Errorf("took %s", elapsed)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	_, port, _ := net.SplitHostPort(server.addr())
+
+	setRecords := fakeDNS(t)
+
+	// IPv6 is advertised but broken
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "[2001:db8::1]:"+port {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	cases := []struct {
+		records    []string
+		ipv6Lookup bool
+		preferIPv4 bool
+		preferIPv6 bool
+		slow       bool
+	}{
+		// IPv6 goes first, IPv4 gets going after the head start
+		{[]string{"2001:db8::1", "127.0.0.1"}, true, false, false, true},
+		{[]string{"127.0.0.1", "2001:db8::1"}, false, false, true, true},
+
+		// IPv4 goes first
+		{[]string{"127.0.0.1", "2001:db8::1"}, true, false, false, false},
+		{[]string{"2001:db8::1", "127.0.0.1"}, true, true, false, false},
+
+		// IPv6 isn't used at all
+		{[]string{"2001:db8::1", "127.0.0.1"}, false, false, false, false},
+	}
+
+	for _, tc := range cases {
+		setRecords(tc.records...)
+
+		config := Config{
+			ConnectTimeout: 5 * time.Second,
+			DialFunc:       dial,
+			IPv6Lookup:     tc.ipv6Lookup,
+			PreferIPv4:     tc.preferIPv4,
+			PreferIPv6:     tc.preferIPv6,
+		}
+
+		c, err := DialConfig(config, "ftp.test:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t0 := time.Now()
+
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		elapsed := time.Since(t0)
+
+		if pconn.addr != "127.0.0.1:"+port {
+			t.Errorf("%+v: connected to %s", tc, pconn.addr)
+		}
+
+		if tc.slow && (elapsed < fallbackDelay || elapsed > 2*fallbackDelay) || !tc.slow && elapsed > fallbackDelay/2 {
+			t.Errorf("%+v: took %s", tc, elapsed)
+		}
+
+		c.returnConn(pconn)
+		c.Close()
+	}
+
+	if _, err := DialConfig(Config{PreferIPv4: true, PreferIPv6: true}, server.addr()); err == nil {
+		t.Error("expected error")
+	}
+}
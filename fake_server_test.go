@@ -0,0 +1,574 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A scriptable in-process FTP server for testing behavior that is hard to
+// provoke from real servers (malformed listings, unusual replies, etc.).
+type fakeServer struct {
+	listener net.Listener
+
+	mu sync.Mutex
+
+	// lines returned in response to FEAT
+	features []string
+
+	// canned replies, keyed by full command line (e.g. "SIZE foo")
+	replies map[string]fakeReply
+
+	// data sent over the data connection, keyed by full command line
+	// (e.g. "MLSD dir")
+	data map[string]string
+
+	// if set, returns the greeting for each new connection instead of 220;
+	// the server hangs up after any other code
+	greet func() fakeReply
+
+	// custom handlers, keyed by command verb (e.g. "RETR")
+	handlers map[string]func(fc *fakeConn, arg string)
+
+	// data received via STOR/APPE, keyed by path
+	stored map[string][]byte
+
+	// every command line received
+	commands []string
+
+	// remote addresses of control and data connections, in the order
+	// they were made
+	peers []string
+
+	// if set, the server supports "AUTH TLS", or with implicitTLS, speaks
+	// TLS from the start
+	tlsConfig   *tls.Config
+	implicitTLS bool
+
+	// if set, TLS data connections must resume a TLS session, like vsftpd
+	// with require_ssl_reuse
+	requireTLSReuse bool
+}
+
+type fakeReply struct {
+	code int
+	msg  string
+}
+
+type fakeConn struct {
+	server *fakeServer
+	conn   net.Conn
+	reader *textproto.Reader
+	writer *bufio.Writer
+	dataLn net.Listener
+
+	// address from the last EPRT or PORT command, to connect to instead of
+	// accepting on dataLn
+	activeAddr string
+
+	// offset from the last REST command
+	restOffset int64
+
+	// argument of the last PROT command
+	prot string
+
+	// the server's TLS settings when the connection was accepted
+	tlsConfig       *tls.Config
+	implicitTLS     bool
+	requireTLSReuse bool
+}
+
+func newFakeServer() (*fakeServer, error) {
+	return newFakeServerOn("127.0.0.1:0")
+}
+
+// Like newFakeServer, but with TLS: implicit, or explicit with "AUTH TLS".
+func newFakeTLSServer(implicit bool) (*fakeServer, error) {
+	s, err := newFakeServer()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := fakeCertificate()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.implicitTLS = implicit
+	if !implicit {
+		s.features = append(s.features, "AUTH TLS", "PBSZ", "PROT")
+	}
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+var (
+	fakeCert     tls.Certificate
+	fakeCertErr  error
+	fakeCertOnce sync.Once
+)
+
+// A self-signed certificate for 127.0.0.1.
+func fakeCertificate() (tls.Certificate, error) {
+	fakeCertOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			fakeCertErr = err
+			return
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "goftp fake server"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			fakeCertErr = err
+			return
+		}
+
+		fakeCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+
+	return fakeCert, fakeCertErr
+}
+
+// Like newFakeServer, but listening on "addr", e.g. "[::1]:0".
+func newFakeServerOn(addr string) (*fakeServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fakeServer{
+		listener: ln,
+		features: []string{"MLST type*;size*;modify*;", "SIZE", "REST STREAM", "EPSV"},
+		replies:  make(map[string]fakeReply),
+		data:     make(map[string]string),
+		handlers: make(map[string]func(fc *fakeConn, arg string)),
+		stored:   make(map[string][]byte),
+	}
+
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+}
+
+func (s *fakeServer) receivedCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.peers = append(s.peers, conn.RemoteAddr().String())
+	fc := &fakeConn{
+		server:          s,
+		tlsConfig:       s.tlsConfig,
+		implicitTLS:     s.implicitTLS,
+		requireTLSReuse: s.requireTLSReuse,
+	}
+	greet := s.greet
+	s.mu.Unlock()
+
+	if fc.implicitTLS {
+		conn = tls.Server(conn, fc.tlsConfig)
+	}
+
+	fc.setConn(conn)
+
+	defer func() {
+		if fc.dataLn != nil {
+			fc.dataLn.Close()
+		}
+	}()
+
+	greeting := fakeReply{220, "fake server ready"}
+	if greet != nil {
+		greeting = greet()
+	}
+
+	fc.reply(greeting.code, greeting.msg)
+	if greeting.code != 220 {
+		return
+	}
+
+	for {
+		line, err := fc.reader.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if space := strings.Index(line, " "); space != -1 {
+			verb, arg = line[:space], line[space+1:]
+		}
+		verb = strings.ToUpper(verb)
+
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		reply, hasReply := s.replies[line]
+		data, hasData := s.data[line]
+		handler := s.handlers[verb]
+		s.mu.Unlock()
+
+		switch {
+		case handler != nil:
+			handler(fc, arg)
+		case hasReply:
+			fc.reply(reply.code, reply.msg)
+		case hasData:
+			fc.sendData(data)
+		default:
+			if !fc.defaultCommand(verb, arg) {
+				return
+			}
+		}
+	}
+}
+
+func (fc *fakeConn) setConn(conn net.Conn) {
+	fc.conn = conn
+	fc.reader = textproto.NewReader(bufio.NewReader(conn))
+	fc.writer = bufio.NewWriter(conn)
+}
+
+// Returns false if the connection should be closed.
+func (fc *fakeConn) defaultCommand(verb, arg string) bool {
+	switch verb {
+	case "USER":
+		fc.reply(331, "password please")
+	case "PASS":
+		fc.reply(230, "logged in")
+	case "FEAT":
+		fc.server.mu.Lock()
+		features := fc.server.features
+		fc.server.mu.Unlock()
+
+		msg := "Features:\n"
+		for _, feat := range features {
+			msg += " " + feat + "\n"
+		}
+		fc.reply(211, msg+"End")
+	case "AUTH":
+		mech := strings.ToUpper(arg)
+		if fc.tlsConfig == nil || fc.implicitTLS || (mech != "TLS" && mech != "SSL") {
+			fc.reply(502, "not implemented")
+			break
+		}
+
+		fc.reply(234, "AUTH "+mech+" ok")
+		fc.setConn(tls.Server(fc.conn, fc.tlsConfig))
+	case "CCC":
+		tc, ok := fc.conn.(*tls.Conn)
+		if !ok {
+			fc.reply(533, "not using TLS")
+			break
+		}
+
+		fc.reply(200, "CCC ok")
+
+		// wait for the client's close_notify before sending ours, so the
+		// client's next (plaintext) command can't arrive in the same read
+		if _, err := io.Copy(ioutil.Discard, fc.reader.R); err != nil {
+			return false
+		}
+		tc.CloseWrite()
+		tc.NetConn().SetDeadline(time.Time{})
+		fc.setConn(tc.NetConn())
+	case "PBSZ":
+		fc.reply(200, "PBSZ=0")
+	case "PROT":
+		fc.prot = strings.ToUpper(arg)
+		fc.reply(200, "PROT ok")
+	case "ABOR":
+		fc.reply(225, "no transfer to abort")
+	case "TYPE", "NOOP", "OPTS", "MODE", "STRU":
+		fc.reply(200, "ok")
+	case "SYST":
+		fc.reply(215, "UNIX Type: L8")
+	case "PWD":
+		fc.reply(257, `"/" is the current directory`)
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			fc.reply(501, "bad offset")
+		} else {
+			fc.restOffset = offset
+			fc.reply(350, "restarting")
+		}
+	case "EPSV":
+		port, err := fc.listenData()
+		if err != nil {
+			fc.reply(425, err.Error())
+		} else {
+			fc.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		}
+	case "PASV":
+		port, err := fc.listenData()
+		if err != nil {
+			fc.reply(425, err.Error())
+		} else {
+			fc.reply(227, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xFF))
+		}
+	case "EPRT":
+		// "|1|127.0.0.1|1025|"
+		parts := strings.Split(arg, "|")
+		if len(parts) != 5 {
+			fc.reply(501, "bad EPRT")
+		} else {
+			fc.activeAddr = net.JoinHostPort(parts[2], parts[3])
+			fc.reply(200, "EPRT ok")
+		}
+	case "PORT":
+		// "127,0,0,1,4,1"
+		parts := strings.Split(arg, ",")
+		if len(parts) != 6 {
+			fc.reply(501, "bad PORT")
+			break
+		}
+
+		hi, _ := strconv.Atoi(parts[4])
+		lo, _ := strconv.Atoi(parts[5])
+		fc.activeAddr = net.JoinHostPort(strings.Join(parts[:4], "."), strconv.Itoa(hi<<8|lo))
+		fc.reply(200, "PORT ok")
+	case "STOR", "APPE":
+		fc.receiveData(arg, verb == "APPE")
+	case "RETR", "MLSD", "LIST", "NLST":
+		if fc.dataLn != nil {
+			fc.dataLn.Close()
+			fc.dataLn = nil
+		}
+		fc.reply(550, "no such file")
+	case "QUIT":
+		fc.reply(221, "bye")
+		return false
+	default:
+		fc.reply(502, "not implemented")
+	}
+
+	return true
+}
+
+func (fc *fakeConn) reply(code int, msg string) {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		if i == len(lines)-1 {
+			fmt.Fprintf(fc.writer, "%d %s\r\n", code, line)
+		} else if i == 0 {
+			fmt.Fprintf(fc.writer, "%d-%s\r\n", code, line)
+		} else {
+			fmt.Fprintf(fc.writer, "%s\r\n", line)
+		}
+	}
+	fc.writer.Flush()
+}
+
+func (fc *fakeConn) listenData() (int, error) {
+	fc.activeAddr = ""
+
+	if fc.dataLn != nil {
+		fc.dataLn.Close()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+
+	fc.dataLn = ln
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (fc *fakeConn) acceptData() (net.Conn, error) {
+	dc, err := fc.openData()
+	if err != nil {
+		return nil, err
+	}
+
+	if fc.prot == "P" || (fc.implicitTLS && fc.prot == "") {
+		dc = tls.Server(dc, fc.tlsConfig)
+	}
+
+	return dc, nil
+}
+
+// With requireTLSReuse, refuse TLS data connections that don't resume a
+// session. Returns false if the data connection was refused.
+func (fc *fakeConn) checkDataTLS(dc net.Conn) bool {
+	tc, ok := dc.(*tls.Conn)
+	if !ok || !fc.requireTLSReuse {
+		return true
+	}
+
+	if err := tc.Handshake(); err == nil && tc.ConnectionState().DidResume {
+		return true
+	}
+
+	dc.Close()
+	fc.reply(450, "TLS session of data connection has not resumed")
+	return false
+}
+
+func (fc *fakeConn) openData() (net.Conn, error) {
+	if fc.activeAddr != "" {
+		addr := fc.activeAddr
+		fc.activeAddr = ""
+
+		fc.server.mu.Lock()
+		fc.server.peers = append(fc.server.peers, addr)
+		fc.server.mu.Unlock()
+
+		return net.DialTimeout("tcp", addr, 5*time.Second)
+	}
+
+	if fc.dataLn == nil {
+		return nil, fmt.Errorf("no data listener")
+	}
+
+	defer func() {
+		fc.dataLn.Close()
+		fc.dataLn = nil
+	}()
+
+	fc.dataLn.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	dc, err := fc.dataLn.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	fc.server.mu.Lock()
+	fc.server.peers = append(fc.server.peers, dc.RemoteAddr().String())
+	fc.server.mu.Unlock()
+
+	return dc, nil
+}
+
+func (fc *fakeConn) sendData(data string) {
+	dc, err := fc.acceptData()
+	if err != nil {
+		fc.reply(425, err.Error())
+		return
+	}
+
+	if fc.restOffset > int64(len(data)) {
+		fc.restOffset = int64(len(data))
+	}
+	data = data[fc.restOffset:]
+	fc.restOffset = 0
+
+	fc.reply(150, "here it comes")
+	if !fc.checkDataTLS(dc) {
+		return
+	}
+
+	dc.Write([]byte(data))
+	dc.Close()
+	fc.reply(226, "done")
+}
+
+func (fc *fakeConn) receiveData(path string, appendData bool) {
+	dc, err := fc.acceptData()
+	if err != nil {
+		fc.reply(425, err.Error())
+		return
+	}
+
+	fc.reply(150, "send it")
+	if !fc.checkDataTLS(dc) {
+		return
+	}
+
+	got, err := ioutil.ReadAll(dc)
+	dc.Close()
+
+	if err != nil {
+		fc.reply(426, err.Error())
+		return
+	}
+
+	offset := fc.restOffset
+	fc.restOffset = 0
+
+	fc.server.mu.Lock()
+	if appendData {
+		fc.server.stored[path] = append(fc.server.stored[path], got...)
+	} else if offset > 0 && offset <= int64(len(fc.server.stored[path])) {
+		fc.server.stored[path] = append(fc.server.stored[path][:offset:offset], got...)
+	} else {
+		fc.server.stored[path] = got
+	}
+	fc.server.mu.Unlock()
+
+	fc.reply(226, "got it")
+}
+
+// Send "chunk" over the data connection until the client closes it, e.g.
+// to test aborting transfers. No final reply is sent.
+func (fc *fakeConn) sendForever(chunk string) {
+	dc, err := fc.acceptData()
+	if err != nil {
+		fc.reply(425, err.Error())
+		return
+	}
+
+	fc.reply(150, "here it comes")
+	if !fc.checkDataTLS(dc) {
+		return
+	}
+
+	for {
+		if _, err := dc.Write([]byte(chunk)); err != nil {
+			break
+		}
+	}
+	dc.Close()
+}
@@ -6,9 +6,14 @@ package goftp
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,141 +24,1100 @@ const timeFormat = "20060102150405"
 
 // Delete delets the file "path".
 func (c *Client) Delete(path string) error {
-	pconn, err := c.getIdleConn()
+	return c.withConn("DELE "+path, func(pconn *persistentConn) error {
+		return pconn.sendCommandExpected(replyFileActionOkay, "DELE %s", path)
+	})
+}
+
+// Rename renames file "from" to "to".
+func (c *Client) Rename(from, to string) error {
+	return c.withConn("RNFR "+from, func(pconn *persistentConn) error {
+		err := pconn.sendCommandExpected(replyFileActionPending, "RNFR %s", from)
+		if err != nil {
+			return err
+		}
+
+		return pconn.sendCommandExpected(replyFileActionOkay, "RNTO %s", to)
+	})
+}
+
+// ErrModTimeUnsupported is returned (wrapped in an Error) by SetModTime when
+// the server doesn't advertise the MFMT command.
+var ErrModTimeUnsupported = errors.New("setting modification time unsupported")
+
+// SetModTime sets the modification time of file "path" to "t" using the
+// MFMT command. The time is sent in UTC with second resolution. If the
+// server doesn't advertise MFMT, the returned error satisfies
+// errors.Is(err, ErrModTimeUnsupported).
+func (c *Client) SetModTime(path string, t time.Time) error {
+	return c.withConn("MFMT "+path, func(pconn *persistentConn) error {
+		if !pconn.hasFeature("MFMT") {
+			return ftpError{err: ErrModTimeUnsupported}
+		}
+
+		return pconn.sendCommandExpected(replyFileStatus, "MFMT %s %s", t.UTC().Format(timeFormat), path)
+	})
+}
+
+// ErrChmodUnsupported is returned (wrapped in an Error) by Chmod when the
+// server doesn't support "SITE CHMOD".
+var ErrChmodUnsupported = errors.New("SITE CHMOD unsupported")
+
+// Chmod changes the permissions of "path" to "mode" using
+// "SITE CHMOD <mode> <path>", with the mode in octal (e.g. "644"). The
+// setuid, setgid and sticky bits are included (e.g. "4755"). If the server
+// doesn't understand the command, the returned error satisfies
+// errors.Is(err, ErrChmodUnsupported).
+func (c *Client) Chmod(path string, mode os.FileMode) error {
+	return c.withConn("SITE CHMOD "+path, func(pconn *persistentConn) error {
+		code, msg, err := pconn.sendCommand("SITE CHMOD %s %s", formatMode(mode), path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case code == replyCommandOkay || code == replyFileActionOkay:
+			return nil
+		case commandNotSupportedReply(code):
+			return ftpError{err: ErrChmodUnsupported, code: code, msg: msg}
+		default:
+			return ftpError{code: code, msg: msg}
+		}
+	})
+}
+
+// Format "mode" in octal the way chmod(1) takes it.
+func formatMode(mode os.FileMode) string {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return fmt.Sprintf("%03o", m)
+}
+
+// Mkdir creates directory "path". The returned string is how the client
+// should refer to the created directory.
+func (c *Client) Mkdir(path string) (string, error) {
+	var dir string
+	err := c.withConn("MKD "+path, func(pconn *persistentConn) error {
+		code, msg, err := pconn.sendCommand("MKD %s", path)
+		if err != nil {
+			return err
+		}
+
+		if code != replyDirCreated {
+			return ftpError{code: code, msg: msg}
+		}
+
+		dir, err = extractDirName(msg)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// MkdirAll creates directory "dir" along with any parents that don't exist
+// yet. Directories that already exist are fine, including ones another
+// client creates concurrently. Like Mkdir, it returns how the client should
+// refer to the directory, or dir itself if it already existed. Servers
+// word "already exists" replies differently, so when MKD fails MkdirAll
+// checks whether the directory exists using Stat instead of interpreting
+// the reply.
+func (c *Client) MkdirAll(dir string) (string, error) {
+	return c.mkdirAll(path.Clean(dir))
+}
+
+func (c *Client) mkdirAll(dir string) (string, error) {
+	name, err := c.mkdirExisting(dir)
+	if err == nil || !isServerReply(err) {
+		return name, err
+	}
+
+	parent := path.Dir(dir)
+	if parent == dir || parent == "." {
+		return "", err
+	}
+
+	if _, err := c.mkdirAll(parent); err != nil {
+		return "", err
+	}
+
+	return c.mkdirExisting(dir)
+}
+
+// Create directory "dir", treating a directory that already exists as
+// success.
+func (c *Client) mkdirExisting(dir string) (string, error) {
+	name, err := c.Mkdir(dir)
+	if err == nil || !isServerReply(err) {
+		return name, err
+	}
+
+	if info, statErr := c.Stat(dir); statErr == nil && info.IsDir() {
+		return dir, nil
+	}
+
+	return "", err
+}
+
+// Rmdir removes directory "path".
+func (c *Client) Rmdir(path string) error {
+	return c.withConn("RMD "+path, func(pconn *persistentConn) error {
+		return pconn.sendCommandExpected(replyFileActionOkay, "RMD %s", path)
+	})
+}
+
+// RemoveAll removes "path" and everything in it, deleting files with DELE
+// and then each directory with RMD once it is empty. Like os.RemoveAll, it
+// returns nil if path doesn't exist, and entries that disappear while it
+// runs (e.g. deleted by another client) are ignored. Symlinks are deleted
+// themselves, never followed. If the server presents a symlinked directory
+// as a plain directory, RemoveAll can only tell if the server supports the
+// MLST "unique" fact; when it sees the same directory twice it stops with
+// an error rather than delete anything through the link. RemoveAll stops
+// at the first error.
+func (c *Client) RemoveAll(path string) error {
+	_, err := c.removeAll(path, false)
+	return err
+}
+
+// RemoveAllDryRun returns the paths RemoveAll would delete, in the order it
+// would delete them, without deleting anything.
+func (c *Client) RemoveAllDryRun(path string) ([]string, error) {
+	return c.removeAll(path, true)
+}
+
+func (c *Client) removeAll(root string, dryRun bool) ([]string, error) {
+	info, err := c.Stat(root)
+	if err != nil {
+		if c.notExist(root, err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var removed []string
+
+	remove := func(p string, dir bool) error {
+		removed = append(removed, p)
+		if dryRun {
+			return nil
+		}
+
+		var err error
+		if dir {
+			err = c.Rmdir(p)
+		} else {
+			err = c.Delete(p)
+		}
+
+		if err != nil && c.notExist(p, err) {
+			c.debug("%s already gone", p)
+			return nil
+		}
+
+		return err
+	}
+
+	err = c.removeTree(root, info, remove, make(map[string]bool))
+
+	return removed, err
+}
+
+func (c *Client) removeTree(dir string, info os.FileInfo, remove func(string, bool) error, visited map[string]bool) error {
+	if !info.IsDir() {
+		return remove(dir, false)
+	}
+
+	if facts, ok := info.Sys().(*EntryFacts); ok && facts.Unique != "" {
+		if visited[facts.Unique] {
+			return ftpError{err: fmt.Errorf("%s is a directory already being removed (symlink?)", dir)}
+		}
+		visited[facts.Unique] = true
+	}
+
+	entries, err := c.ReadDir(dir)
+	if err != nil {
+		if c.notExist(dir, err) {
+			c.debug("%s already gone", dir)
+			return nil
+		}
+		return err
+	}
+
+	sort.Sort(byName(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+
+		if err := c.removeTree(path.Join(dir, name), entry, remove, visited); err != nil {
+			return err
+		}
+	}
+
+	return remove(dir, true)
+}
+
+// Whether err, returned by an operation on "target", means target doesn't
+// exist. A 550 reply could also mean e.g. "permission denied", so in that
+// case we look for target in its parent directory's listing (and so on, in
+// case the parent doesn't exist either).
+func (c *Client) notExist(target string, err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+
+	if replyCode(err) != replyFileError {
+		return false
+	}
+
+	if _, err = c.statFromList(context.Background(), target); err == nil {
+		return false
+	}
+
+	return c.notExist(path.Dir(path.Clean(target)), err)
+}
+
+// Getwd returns the current working directory.
+func (c *Client) Getwd() (string, error) {
+	var dir string
+	err := c.withConn("PWD", func(pconn *persistentConn) error {
+		code, msg, err := pconn.sendCommand("PWD")
+		if err != nil {
+			return err
+		}
+
+		if code != replyDirCreated {
+			return ftpError{code: code, msg: msg}
+		}
+
+		dir, err = extractDirName(msg)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// ErrStopListing can be returned by the callback passed to ReadDirFunc to
+// stop the listing early. ReadDirFunc will return nil in that case.
+var ErrStopListing = errors.New("stop listing")
+
+// ReadDir fetches the contents of a directory, returning a list of
+// os.FileInfo's which are relatively easy to work with programatically. It
+// will not return entries corresponding to the current directory or parent
+// directories. The os.FileInfo's fields may be incomplete depending on what
+// the server supports.
+//
+// If the server doesn't support MLSD, ReadDir falls back to parsing the
+// output of LIST. LIST output isn't standardized, so in that case fewer
+// fields may be filled in, and times are interpreted in
+// Config.ServerLocation.
+func (c *Client) ReadDir(path string) ([]os.FileInfo, error) {
+	return c.ReadDirContext(context.Background(), path)
+}
+
+// ReadDirContext is like ReadDir, but stops when "ctx" is canceled or its
+// deadline passes. A listing in progress is aborted with ABOR, and
+// ctx.Err() is returned.
+func (c *Client) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	var ret []os.FileInfo
+	err := c.withRetries(ctx, "ReadDir "+path, func(ctx context.Context) error {
+		ret = nil
+		return c.ReadDirFuncContext(ctx, path, func(info os.FileInfo) error {
+			ret = append(ret, info)
+			return nil
+		})
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// ReadDirEntries is like ReadDir, but returns fs.DirEntry's sorted by name,
+// like fs.ReadDir. The entries' Info() method doesn't make any additional
+// requests to the server.
+func (c *Client) ReadDirEntries(path string) ([]fs.DirEntry, error) {
+	infos, err := c.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byName(infos))
+
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+
+	return entries, nil
+}
+
+// ReadDirFunc is like ReadDir, but calls "fn" with each entry as it is
+// read off the data connection instead of collecting all entries first,
+// so large directories can be listed in constant memory. If fn returns an
+// error, the listing is aborted and the error is returned, unless the error
+// is ErrStopListing, in which case ReadDirFunc returns nil.
+//
+// fn is called while the listing's connection is in use, so if it uses the
+// Client itself make sure ConnectionsPerHost allows for that. If the
+// server doesn't support MLSD, the LIST output is read in full before fn is
+// called.
+//
+// Some servers reply to listing an empty directory with an error like
+// "450 No files found". If the reply looks like that and Stat confirms
+// "path" is a directory, ReadDirFunc returns nil without calling fn.
+func (c *Client) ReadDirFunc(path string, fn func(os.FileInfo) error) error {
+	return c.ReadDirFuncContext(context.Background(), path, fn)
+}
+
+// ReadDirFuncContext is like ReadDirFunc, but stops when "ctx" is canceled
+// or its deadline passes (see ReadDirContext).
+func (c *Client) ReadDirFuncContext(ctx context.Context, path string, fn func(os.FileInfo) error) error {
+	err := c.readDirFunc(ctx, path, fn)
+	if err != nil && isNoFilesReply(err) {
+		if info, statErr := c.Stat(path); statErr == nil && info.IsDir() {
+			c.debug("treating %s as empty directory", err)
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (c *Client) readDirFunc(ctx context.Context, path string, fn func(os.FileInfo) error) error {
+	mlst, err := c.hasFeature(ctx, "MLST")
+	if err != nil {
+		return err
+	}
+
+	if !mlst {
+		c.debug("server doesn't advertise MLST, using LIST")
+		return c.readDirLIST(ctx, path, fn)
+	}
+
+	var gotEntries bool
+	err = c.dataLines(ctx, func(entry string) error {
+		gotEntries = true
+
+		if strings.TrimSpace(entry) == "" {
+			c.debug("skipping blank line in MLSD listing")
+			return nil
+		}
+
+		info, err := ParseMLST(entry)
+		if err != nil {
+			if c.config.IgnoreInvalidListEntries {
+				c.debug("ignoring invalid entry in ReadDir: %s", err)
+				return nil
+			}
+			c.debug("error in ReadDir: %s", err)
+			return err
+		}
+
+		if isSelfParentMLST(info) {
+			return nil
+		}
+
+		return fn(info)
+	}, "MLSD %s", path)
+
+	if err == ErrStopListing {
+		return nil
+	}
+
+	if fe, ok := err.(ftpError); ok && !gotEntries && commandNotSupportedReply(fe.code) {
+		c.debug("server doesn't support MLSD, using LIST")
+		return c.readDirLIST(ctx, path, fn)
+	}
+
+	return err
+}
+
+// Walk walks the file tree rooted at "root", calling walkFn for each file
+// or directory in the tree, including root, in depth-first lexical order.
+// See http://golang.org/pkg/path/filepath/#Walk for details. Paths passed
+// to walkFn are always joined with "/". An error listing a directory is
+// passed to walkFn, and the walk continues if walkFn returns nil. Each
+// directory is listed at most once.
+func (c *Client) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := c.Stat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = c.walk(root, info, walkFn, make(map[string]bool))
+	}
+
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+func (c *Client) walk(dir string, info os.FileInfo, walkFn filepath.WalkFunc, visited map[string]bool) error {
+	if !info.IsDir() {
+		return walkFn(dir, info, nil)
+	}
+
+	if visited[path.Clean(dir)] {
+		return nil
+	}
+	visited[path.Clean(dir)] = true
+
+	entries, err := c.ReadDir(dir)
+	walkErr := walkFn(dir, info, err)
+	if err != nil || walkErr != nil {
+		return walkErr
+	}
+
+	sort.Sort(byName(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+
+		err = c.walk(path.Join(dir, name), entry, walkFn, visited)
+		if err != nil && (!entry.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Glob returns the paths of all remote files matching pattern, or nil if
+// there are no matches. The pattern syntax is the same as in path.Match,
+// and may contain wildcards in any path component (e.g.
+// "/data/*/daily/*.csv"). Only the directories needed to match the pattern
+// are listed. Like filepath.Glob, errors listing directories are ignored,
+// but connection errors are returned. The only other possible error is
+// path.ErrBadPattern. Matches are sorted and use "/" as the separator.
+func (c *Client) Glob(pattern string) ([]string, error) {
+	return c.glob(pattern, false)
+}
+
+func (c *Client) glob(pattern string, dirsOnly bool) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	if !hasGlobMeta(pattern) {
+		info, err := c.Stat(pattern)
+		if err != nil {
+			if isServerReply(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		if dirsOnly && !info.IsDir() {
+			return nil, nil
+		}
+
+		return []string{pattern}, nil
+	}
+
+	dir, file := path.Split(pattern)
+	if len(dir) > 1 {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+
+	dirs := []string{dir}
+	if hasGlobMeta(dir) {
+		var err error
+		dirs, err = c.glob(dir, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var matches []string
+	for _, dir := range dirs {
+		entries, err := c.ReadDir(dir)
+		if err != nil {
+			if isServerReply(err) {
+				c.debug("ignoring error listing %s in Glob: %s", dir, err)
+				continue
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if dirsOnly && !entry.IsDir() {
+				continue
+			}
+
+			if matched, _ := path.Match(file, entry.Name()); matched {
+				matches = append(matches, path.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	sort.Strings(matches)
+
+	return matches, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// whether err came from an unexpected reply (as opposed to e.g. a network
+// error)
+func isServerReply(err error) bool {
+	fe, ok := err.(ftpError)
+	return ok && fe.code != 0
+}
+
+// The reply code of the first error in err's chain that has one, or 0.
+func replyCode(err error) int {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if fe, ok := err.(Error); ok && fe.Code() != 0 {
+			return fe.Code()
+		}
+	}
+	return 0
+}
+
+// Phrases servers use when listing an empty directory fails with 450/550.
+var noFilesReplies = []string{
+	"no files",
+	"no file found",
+	"no such files",
+	"directory is empty",
+	"empty directory",
+	"no entries",
+}
+
+// Whether err is a 450/550 reply saying there are no files to list, as
+// opposed to e.g. "550 Permission denied".
+func isNoFilesReply(err error) bool {
+	fe, ok := err.(ftpError)
+	if !ok || (fe.code != replyTransientFileError && fe.code != replyFileError) {
+		return false
+	}
+
+	msg := strings.ToLower(fe.msg)
+	for _, phrase := range noFilesReplies {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type byName []os.FileInfo
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Names fetches the names of the entries in directory "path" using NLST.
+// This is cheaper than ReadDir if you only need names, and works with
+// servers whose MLSD or LIST output can't be parsed. Some servers return
+// entries prefixed with "path" (or an absolute path); the directory part is
+// trimmed so only the names are returned. The "." and ".." entries are not
+// returned.
+func (c *Client) Names(path string) ([]string, error) {
+	entries, err := c.dataStringList(context.Background(), "NLST %s", path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, entry := range entries {
+		entry = strings.TrimSuffix(entry, "\r")
+
+		if slash := strings.LastIndex(entry, "/"); slash != -1 {
+			entry = entry[slash+1:]
+		}
+
+		if entry == "" || entry == "." || entry == ".." {
+			continue
+		}
+
+		ret = append(ret, entry)
+	}
+
+	return ret, nil
+}
+
+func (c *Client) readDirLIST(ctx context.Context, path string, fn func(os.FileInfo) error) error {
+	entries, err := c.dataStringList(ctx, "LIST %s", path)
 	if err != nil {
 		return err
 	}
 
-	defer c.returnConn(pconn)
+	return c.parseLISTEntries(entries, fn)
+}
+
+// ReadDirControl is like ReadDir, but fetches the listing with "STAT path"
+// over the control connection instead of opening a data connection. This is
+// useful when data connections can't be established (e.g. a server behind
+// broken NAT advertising an unreachable passive address). Servers may reply
+// with ls-style or MLSD-style entries; both are understood. Not all servers
+// support listing directories via STAT.
+func (c *Client) ReadDirControl(path string) ([]os.FileInfo, error) {
+	lines, err := c.controlStringList(context.Background(), "STAT %s", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// first and last lines are the 211/212/213 framing
+	if len(lines) < 3 {
+		return nil, nil
+	}
+	lines = lines[1 : len(lines)-1]
+
+	var (
+		ret     []os.FileInfo
+		entries []string
+	)
+	for _, line := range lines {
+		line = strings.TrimLeft(strings.TrimRight(line, "\r"), " ")
+		if line == "" {
+			continue
+		}
+
+		if !isMLSTEntry(line) {
+			entries = append(entries, line)
+			continue
+		}
+
+		info, err := ParseMLST(line)
+		if err != nil {
+			if c.config.IgnoreInvalidListEntries {
+				c.debug("ignoring invalid entry in ReadDirControl: %s", err)
+				continue
+			}
+			c.debug("error in ReadDirControl: %s", err)
+			return nil, err
+		}
+
+		if !isSelfParentMLST(info) {
+			ret = append(ret, info)
+		}
+	}
+
+	err = c.parseLISTEntries(entries, func(info os.FileInfo) error {
+		ret = append(ret, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Whether "entry" looks like an MLSD entry (e.g. "type=file;size=1; foo")
+// as opposed to an ls-style entry.
+func isMLSTEntry(entry string) bool {
+	_, _, ok := splitMLSTEntry(entry)
+	return ok
+}
+
+// ReadDirRecursive lists the entire tree under "path" with a single
+// "LIST -R", which saves a round trip per directory compared to Walk. The
+// result is keyed by directory path relative to "path" ("." for "path"
+// itself, "sub/dir" for nested directories). Each entry is parsed from LIST
+// output, so the os.FileInfo's are only as detailed as ReadDir's LIST
+// fallback. If the server doesn't support "-R", ReadDirRecursive falls back
+// to Walk so the result is the same either way.
+func (c *Client) ReadDirRecursive(path string) (map[string][]os.FileInfo, error) {
+	lines, err := c.dataStringList(context.Background(), "LIST -R %s", path)
+	if err != nil {
+		if isServerReply(err) {
+			c.debug("LIST -R failed (%s), walking instead", err)
+			return c.readDirRecursiveWalk(path)
+		}
+		return nil, err
+	}
+
+	sections, sawHeader := splitRecursiveLIST(lines, path)
+
+	tree := make(map[string][]os.FileInfo)
+	for _, dir := range sections.order {
+		infos := []os.FileInfo{}
+		err := c.parseLISTEntries(sections.entries[dir], func(info os.FileInfo) error {
+			if !sawHeader && info.IsDir() {
+				return errIgnoredRecursive
+			}
+			infos = append(infos, info)
+			return nil
+		})
+		if err == errIgnoredRecursive {
+			c.debug("server ignored LIST -R, walking instead")
+			return c.readDirRecursiveWalk(path)
+		} else if err != nil {
+			return nil, err
+		}
+		tree[dir] = infos
+	}
+
+	return tree, nil
+}
 
-	return pconn.sendCommandExpected(replyFileActionOkay, "DELE %s", path)
+var errIgnoredRecursive = errors.New("server ignored LIST -R")
+
+type recursiveLIST struct {
+	order   []string
+	entries map[string][]string
 }
 
-// Rename renames file "from" to "to".
-func (c *Client) Rename(from, to string) error {
-	pconn, err := c.getIdleConn()
-	if err != nil {
-		return err
+// Split "LIST -R" output into per-directory sections. Sections are
+// introduced by a "dir:" line, either first or after a blank line. Returns
+// whether any section header was seen.
+func splitRecursiveLIST(lines []string, root string) (recursiveLIST, bool) {
+	sections := recursiveLIST{
+		order:   []string{"."},
+		entries: map[string][]string{".": nil},
 	}
 
-	defer c.returnConn(pconn)
+	var (
+		dir       = "."
+		sawHeader bool
+		newBlock  = true
+	)
 
-	err = pconn.sendCommandExpected(replyFileActionPending, "RNFR %s", from)
-	if err != nil {
-		return err
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			newBlock = true
+			continue
+		}
+
+		if newBlock && strings.HasSuffix(line, ":") {
+			dir = relativeListDir(strings.TrimSuffix(line, ":"), root)
+			if _, found := sections.entries[dir]; !found {
+				sections.order = append(sections.order, dir)
+				sections.entries[dir] = nil
+			}
+			sawHeader = true
+			newBlock = false
+			continue
+		}
+		newBlock = false
+
+		sections.entries[dir] = append(sections.entries[dir], line)
 	}
 
-	return pconn.sendCommandExpected(replyFileActionOkay, "RNTO %s", to)
+	return sections, sawHeader
 }
 
-// Mkdir creates directory "path". The returned string is how the client
-// should refer to the created directory.
-func (c *Client) Mkdir(path string) (string, error) {
-	pconn, err := c.getIdleConn()
-	if err != nil {
-		return "", err
+// Make a "LIST -R" section header relative to the directory being listed.
+// Servers variously use "./sub", "sub", "root/sub" or "/abs/root/sub".
+func relativeListDir(dir, root string) string {
+	dir = path.Clean(dir)
+	root = path.Clean(root)
+
+	switch {
+	case dir == root:
+		return "."
+	case root == "/" && strings.HasPrefix(dir, "/"):
+		return dir[1:]
+	case root != "." && strings.HasPrefix(dir, root+"/"):
+		return dir[len(root)+1:]
 	}
 
-	defer c.returnConn(pconn)
+	return dir
+}
+
+// ReadDirRecursive for servers that don't support "LIST -R".
+func (c *Client) readDirRecursiveWalk(root string) (map[string][]os.FileInfo, error) {
+	tree := make(map[string][]os.FileInfo)
+	err := c.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := relativeListDir(fullPath, root)
+		if rel != "." {
+			parent := path.Dir(rel)
+			tree[parent] = append(tree[parent], info)
+		}
+
+		if info.IsDir() && tree[rel] == nil {
+			tree[rel] = []os.FileInfo{}
+		}
 
-	code, msg, err := pconn.sendCommand("MKD %s", path)
+		return nil
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if code != replyDirCreated {
-		return "", ftpError{code: code, msg: msg}
+	return tree, nil
+}
+
+// Parse LIST output, calling fn with each entry.
+func (c *Client) parseLISTEntries(entries []string, fn func(os.FileInfo) error) error {
+	times := listTimes{
+		now:             time.Now(),
+		loc:             c.config.ServerLocation,
+		futureTolerance: c.config.ListFutureTolerance,
 	}
 
-	dir, err := extractDirName(msg)
-	if err != nil {
-		return "", err
+	parse := func(entry string) (os.FileInfo, error) {
+		return parseLIST(entry, times)
 	}
 
-	return dir, nil
+	if c.config.ListFormat == ListFormatMVS || strings.HasPrefix(strings.ToUpper(c.systemType()), "MVS") {
+		parse = (&mvsListParser{times: times}).parse
+	}
+
+	head, entries, tail := trimListReplies(entries)
+	for _, lines := range [][]string{head, tail} {
+		for _, line := range lines {
+			if !isListNoise(line) {
+				c.debug("skipping server reply in listing: %q", line)
+			}
+		}
+	}
+
+	var filtered []string
+	for _, entry := range entries {
+		if isListNoise(entry) {
+			c.debug("skipping non-entry line in listing: %q", entry)
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+
+	for _, entry := range joinVMSLines(filtered) {
+		info, err := parse(entry)
+		if err != nil {
+			if c.config.IgnoreInvalidListEntries {
+				c.debug("ignoring invalid entry in ReadDir: %s", err)
+				continue
+			}
+			c.debug("error in ReadDir: %s", err)
+			return err
+		}
+
+		if info == nil {
+			continue
+		}
+
+		if err = fn(info); err == ErrStopListing {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Rmdir removes directory "path".
-func (c *Client) Rmdir(path string) error {
-	pconn, err := c.getIdleConn()
-	if err != nil {
+// Stat fetches details for a particular file. The os.FileInfo's fields may
+// be incomplete depending on what the server supports.
+//
+// If the server doesn't support the "MLST" feature, Stat falls back to
+// listing the parent directory and picking out the entry for "path". In
+// that case the details are only as good as the server's LIST output
+// (e.g. ModTime may only have minute or day resolution, and Sys() will have
+// few facts), and the root and current directories are always reported as
+// directories without any other details. If the entry isn't found, the
+// returned error satisfies errors.Is(err, os.ErrNotExist).
+func (c *Client) Stat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := c.withRetries(context.Background(), "Stat "+path, func(ctx context.Context) error {
+		var err error
+		info, err = c.stat(ctx, path)
 		return err
+	}, nil)
+	return info, err
+}
+
+func (c *Client) stat(ctx context.Context, path string) (os.FileInfo, error) {
+	mlst, err := c.hasFeature(ctx, "MLST")
+	if err != nil {
+		return nil, err
 	}
 
-	defer c.returnConn(pconn)
+	if !mlst {
+		c.debug("server doesn't advertise MLST, using directory listing")
+		return c.statFromList(ctx, path)
+	}
+
+	lines, err := c.controlStringList(ctx, "MLST %s", path)
+	if err != nil {
+		if fe, ok := err.(ftpError); ok && commandNotSupportedReply(fe.code) {
+			c.debug("server doesn't support MLST, using directory listing")
+			return c.statFromList(ctx, path)
+		}
+		return nil, err
+	}
+
+	if len(lines) != 3 {
+		return nil, ftpError{err: fmt.Errorf("unexpected MLST response: %v", lines)}
+	}
 
-	return pconn.sendCommandExpected(replyFileActionOkay, "RMD %s", path)
+	return ParseMLST(strings.TrimLeft(lines[1], " "))
 }
 
-// Getwd returns the current working directory.
-func (c *Client) Getwd() (string, error) {
+// StatLite fetches the size and modification time of "target" using the SIZE
+// and MDTM commands. This works with servers that don't allow directory
+// listings at all. The returned os.FileInfo only has the name, size and
+// modification time filled in, and a zero mode. If SIZE fails with 550 (as
+// it typically does for directories) but "target" can be changed into with
+// CWD, it is a directory and the mode will have os.ModeDir set. Other SIZE
+// errors are returned as is.
+func (c *Client) StatLite(target string) (os.FileInfo, error) {
 	pconn, err := c.getIdleConn()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	defer c.returnConn(pconn)
 
-	code, msg, err := pconn.sendCommand("PWD")
-	if err != nil {
-		return "", err
+	// size is only meaningful in binary mode (or another exact type, which
+	// saves switching back for the next transfer)
+	sizeType := pconn.config.TransferType
+	if !sizeType.exact() {
+		sizeType = TransferBinary
 	}
 
-	if code != replyDirCreated {
-		return "", ftpError{code: code, msg: msg}
+	if err = pconn.setType(sizeType); err != nil {
+		return nil, err
 	}
 
-	dir, err := extractDirName(msg)
+	info := &ftpFile{name: path.Base(target)}
+
+	sizeCode, sizeMsg, err := pconn.sendCommand("SIZE %s", target)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return dir, nil
-}
+	switch sizeCode {
+	case replyFileStatus:
+		info.size, err = strconv.ParseInt(strings.TrimSpace(sizeMsg), 10, 64)
+		if err != nil {
+			return nil, ftpError{err: fmt.Errorf("failed parsing SIZE response: %s", sizeMsg)}
+		}
+	case replyFileError:
+		isDir, err := pconn.isDir(target)
+		if err != nil {
+			return nil, err
+		}
 
-// ReadDir fetches the contents of a directory, returning a list of
-// os.FileInfo's which are relatively easy to work with programatically. It
-// will not return entries corresponding to the current directory or parent
-// directories. The os.FileInfo's fields may be incomplete depending on what
-// the server supports.
-func (c *Client) ReadDir(path string) ([]os.FileInfo, error) {
-	entries, err := c.dataStringList("MLSD %s", path)
+		if !isDir {
+			return nil, ftpError{code: sizeCode, msg: sizeMsg}
+		}
+
+		info.mode = os.ModeDir
+	default:
+		return nil, ftpError{code: sizeCode, msg: sizeMsg}
+	}
+
+	code, msg, err := pconn.sendCommand("MDTM %s", target)
 	if err != nil {
 		return nil, err
 	}
 
-	var ret []os.FileInfo
-	for _, entry := range entries {
-		info, err := parseMLST(entry, true)
+	if code == replyFileStatus {
+		info.mtime, err = parseMLSTTime(strings.TrimSpace(msg))
 		if err != nil {
-			c.debug("error in ReadDir: %s", err)
-			return nil, err
+			return nil, ftpError{err: fmt.Errorf("failed parsing MDTM response: %s", msg)}
 		}
+	}
 
-		if info == nil {
-			continue
-		}
+	return info, nil
+}
 
-		ret = append(ret, info)
+// Whether "dir" is a directory, by trying to CWD into it. The connection
+// changes back to its working directory afterwards.
+func (pconn *persistentConn) isDir(dir string) (bool, error) {
+	code, msg, err := pconn.sendCommand("PWD")
+	if err != nil {
+		return false, err
 	}
 
-	return ret, nil
+	if code != replyDirCreated {
+		return false, ftpError{code: code, msg: msg}
+	}
+
+	origDir, err := extractDirName(msg)
+	if err != nil {
+		return false, err
+	}
+
+	code, _, err = pconn.sendCommand("CWD %s", dir)
+	if err != nil {
+		return false, err
+	}
+
+	if code != replyFileActionOkay {
+		return false, nil
+	}
+
+	if err := pconn.sendCommandExpected(replyFileActionOkay, "CWD %s", origDir); err != nil {
+		pconn.debug("failed changing back to %s: %s", origDir, err)
+		pconn.broken = true
+		return false, err
+	}
+
+	return true, nil
 }
 
-// Stat fetches details for a particular file. Stat requires the server to
-// support the "MLST" feature. The os.FileInfo's fields may be incomplete
-// depending on what the server supports.
-func (c *Client) Stat(path string) (os.FileInfo, error) {
-	lines, err := c.controlStringList("MLST %s", path)
+// Stat "target" by listing its parent directory.
+func (c *Client) statFromList(ctx context.Context, target string) (os.FileInfo, error) {
+	cleaned := path.Clean(target)
+	name := path.Base(cleaned)
+
+	// there is no parent to list
+	if name == "/" || name == "." || name == ".." {
+		return &ftpFile{
+			name: name,
+			mode: os.ModeDir | 0500,
+		}, nil
+	}
+
+	dir := path.Dir(cleaned)
+	if dir == "." {
+		dir = ""
+	}
+
+	var found os.FileInfo
+	err := c.ReadDirFuncContext(ctx, dir, func(info os.FileInfo) error {
+		if info.Name() == name {
+			found = info
+			return ErrStopListing
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if len(lines) != 3 {
-		return nil, ftpError{err: fmt.Errorf("unexpected MLST response: %v", lines)}
+	// 550 like a server's own "not found", so callers checking the reply
+	// code (e.g. Glob) treat both the same
+	if found == nil {
+		pathErr := &os.PathError{Op: "stat", Path: target, Err: os.ErrNotExist}
+		return nil, ftpError{err: pathErr, code: replyFileError, msg: pathErr.Error()}
 	}
 
-	return parseMLST(strings.TrimLeft(lines[1], " "), false)
+	return found, nil
 }
 
 func extractDirName(msg string) (string, error) {
@@ -167,8 +1131,8 @@ func extractDirName(msg string) (string, error) {
 	return strings.Replace(msg[openQuote+1:closeQuote], `""`, `"`, -1), nil
 }
 
-func (c *Client) controlStringList(f string, args ...interface{}) ([]string, error) {
-	pconn, err := c.getIdleConn()
+func (c *Client) controlStringList(ctx context.Context, f string, args ...interface{}) ([]string, error) {
+	pconn, err := c.getIdleConnContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -187,40 +1151,83 @@ func (c *Client) controlStringList(f string, args ...interface{}) ([]string, err
 	return strings.Split(msg, "\n"), nil
 }
 
-func (c *Client) dataStringList(f string, args ...interface{}) ([]string, error) {
-	pconn, err := c.getIdleConn()
+func (c *Client) dataStringList(ctx context.Context, f string, args ...interface{}) ([]string, error) {
+	var res []string
+	err := c.dataLines(ctx, func(line string) error {
+		res = append(res, line)
+		return nil
+	}, f, args...)
 	if err != nil {
 		return nil, err
 	}
 
+	return res, nil
+}
+
+// Run a command whose response comes over a data connection, calling
+// "handleLine" with each line of the response. If handleLine returns an
+// error, the data connection is closed early and that error is returned. If
+// "ctx" is canceled, the transfer is aborted and ctx.Err() is returned.
+func (c *Client) dataLines(ctx context.Context, handleLine func(string) error, f string, args ...interface{}) error {
+	pconn, err := c.getIdleConnContext(ctx)
+	if err != nil {
+		return err
+	}
+
 	defer c.returnConn(pconn)
 
-	dc, err := pconn.openDataConn()
+	if err := pconn.setProtection(pconn.config.ListDataProtection); err != nil {
+		return err
+	}
+
+	dc, err := pconn.openDataConn(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// to catch early returns
 	defer dc.Close()
 
+	pconn.setTransferDeadline(dc)
+
 	cmd := fmt.Sprintf(f, args...)
 
 	err = pconn.sendCommandExpected(replyGroupPreliminaryReply, cmd)
 
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	initialBuf := 4096
+	if initialBuf > c.config.MaxListLineLen {
+		initialBuf = c.config.MaxListLineLen
 	}
 
 	scanner := bufio.NewScanner(dc)
+	scanner.Buffer(make([]byte, initialBuf), c.config.MaxListLineLen)
 	scanner.Split(bufio.ScanLines)
 
-	var res []string
+	canceled := closeOnCancel(ctx, dc)
+
+	var lineError error
 	for scanner.Scan() {
-		res = append(res, scanner.Text())
+		if lineError = handleLine(scanner.Text()); lineError != nil {
+			break
+		}
+	}
+
+	if canceled() {
+		return pconn.abort(ctx)
 	}
 
 	var dataError error
-	if err = scanner.Err(); err != nil {
+	if err = scanner.Err(); err == bufio.ErrTooLong && lineError == nil {
+		// like a handleLine error, we're abandoning the data connection
+		pconn.debug("line in %s data exceeds MaxListLineLen (%d bytes)", cmd, c.config.MaxListLineLen)
+		lineError = ftpError{
+			err: fmt.Errorf("error reading %s data: line exceeds MaxListLineLen limit of %d bytes", cmd, c.config.MaxListLineLen),
+		}
+	} else if err != nil && lineError == nil {
 		pconn.debug("error reading %s data: %s", cmd, err)
 		dataError = ftpError{
 			err:       fmt.Errorf("error reading %s data: %s", cmd, err),
@@ -235,19 +1242,64 @@ func (c *Client) dataStringList(f string, args ...interface{}) ([]string, error)
 
 	code, msg, err := pconn.readResponse()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if lineError != nil {
+		// we closed the data connection early, so the server probably
+		// complained, but the control connection is still good
+		pconn.debug("stopped reading %s data: %d-%s", cmd, code, msg)
+		return lineError
 	}
 
 	if !positiveCompletionReply(code) {
 		pconn.debug("unexpected result: %d-%s", code, msg)
-		return nil, ftpError{code: code, msg: msg}
+		return ftpError{code: code, msg: msg}
 	}
 
-	if dataError != nil {
-		return nil, dataError
-	}
+	return dataError
+}
 
-	return res, nil
+// EntryFacts holds the details about a directory entry that don't fit into
+// os.FileInfo. The Sys() method of os.FileInfo's returned by ReadDir and
+// Stat returns a *EntryFacts.
+type EntryFacts struct {
+	// The "type" fact (e.g. "file", "dir", "cdir"). For entries that didn't
+	// come from MLST/MLSD this is "file" or "dir" depending on the mode.
+	Type string
+
+	// The "unique" fact, an identifier for the file that is unique on the
+	// server. Empty if not available.
+	Unique string
+
+	// The "perm" fact (see http://tools.ietf.org/html/rfc3659#section-7.5.5).
+	// Empty if not available.
+	Perm string
+
+	// Owner and group names (or numbers, depending on the server) from the
+	// "UNIX.owner" and "UNIX.group" facts, or from the owner and group
+	// columns of LIST output. Empty if not available.
+	Owner string
+	Group string
+
+	// Numeric owner and group IDs from the "UNIX.uid" and "UNIX.gid" facts,
+	// or from numeric owner and group values. These are -1 if not available.
+	UID int
+	GID int
+
+	// The "create" fact. Zero if not available.
+	Create time.Time
+
+	// The target of a symlink (i.e. Mode() has os.ModeSymlink set), if the
+	// server reported it. Empty otherwise.
+	LinkTarget string
+
+	// The raw entry as it was received from the server.
+	Raw string
+
+	// All facts, keyed by lowercase fact name. This is nil for entries that
+	// didn't come from MLST/MLSD.
+	All map[string]string
 }
 
 type ftpFile struct {
@@ -256,6 +1308,14 @@ type ftpFile struct {
 	mode  os.FileMode
 	mtime time.Time
 	raw   string
+	owner string
+	group string
+
+	// target of a symlink, if known
+	linkTarget string
+
+	// MLST facts, keyed by lowercase fact name
+	facts map[string]string
 }
 
 func (f *ftpFile) Name() string {
@@ -278,40 +1338,181 @@ func (f *ftpFile) IsDir() bool {
 	return f.mode.IsDir()
 }
 
+// Sys returns a *EntryFacts.
 func (f *ftpFile) Sys() interface{} {
-	return f.raw
+	facts := &EntryFacts{
+		Type:   f.facts["type"],
+		Unique: f.facts["unique"],
+		Perm:   f.facts["perm"],
+		Owner:  f.owner,
+		Group:  f.group,
+		UID:    -1,
+		GID:    -1,
+		Raw:    f.raw,
+		All:    f.facts,
+
+		LinkTarget: f.linkTarget,
+	}
+
+	if facts.Type == "" {
+		if f.IsDir() {
+			facts.Type = "dir"
+		} else {
+			facts.Type = "file"
+		}
+	}
+
+	if uid, err := strconv.Atoi(f.facts["unix.uid"]); err == nil {
+		facts.UID = uid
+	} else if uid, err := strconv.Atoi(f.owner); err == nil {
+		facts.UID = uid
+	}
+
+	if gid, err := strconv.Atoi(f.facts["unix.gid"]); err == nil {
+		facts.GID = gid
+	} else if gid, err := strconv.Atoi(f.group); err == nil {
+		facts.GID = gid
+	}
+
+	if create, err := parseMLSTTime(f.facts["create"]); err == nil {
+		facts.Create = create
+	}
+
+	return facts
+}
+
+// Parse an MLST time value like "20150216084148". The value may have
+// fractional seconds of any precision, e.g. "20150216084148.500".
+func parseMLSTTime(val string) (time.Time, error) {
+	var frac string
+	if dot := strings.Index(val, "."); dot != -1 {
+		val, frac = val[:dot], val[dot+1:]
+	}
+
+	t, err := time.ParseInLocation(timeFormat, val, time.UTC)
+	if err != nil || frac == "" {
+		return t, err
+	}
+
+	for i := 0; i < len(frac); i++ {
+		if !isDigit(frac[i]) {
+			return time.Time{}, fmt.Errorf("invalid fractional seconds in %s.%s", val, frac)
+		}
+	}
+
+	// pad or truncate to nanoseconds
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	frac += strings.Repeat("0", 9-len(frac))
+
+	nanos, err := strconv.Atoi(frac)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return t.Add(time.Duration(nanos)), nil
+}
+
+// Split an MLST entry into its facts and name. The facts are the leading
+// "fact=value;" tokens, and the name follows the "; " after the last of
+// them (the name may itself contain "; " or start with a space). Some
+// servers leave out the space ("type=file;size=12;lorem.txt"), in which
+// case the name starts right after the last "fact=value;".
+func splitMLSTEntry(entry string) (string, string, bool) {
+	var end int
+	for {
+		semi := strings.Index(entry[end:], ";")
+		if semi == -1 {
+			break
+		}
+
+		if fact := entry[end : end+semi]; fact != "" && !isMLSTFact(fact) {
+			break
+		}
+
+		end += semi + 1
+	}
+
+	if strings.Trim(entry[:end], ";") == "" {
+		return "", "", false
+	}
+
+	if strings.HasPrefix(entry[end:], " ") {
+		return entry[:end-1], entry[end+1:], true
+	}
+
+	if end == len(entry) {
+		return "", "", false
+	}
+
+	// a bad fact further on, rather than a name containing "; "
+	if sep := strings.Index(entry[end:], "; "); sep != -1 {
+		sep += end
+		if isMLSTFact(entry[strings.LastIndex(entry[:sep], ";")+1 : sep]) {
+			return "", "", false
+		}
+	}
+
+	return entry[:end-1], entry[end:], true
+}
+
+// whether s looks like "fact=value"
+func isMLSTFact(s string) bool {
+	eq := strings.Index(s, "=")
+	return eq > 0 && !strings.ContainsAny(s[:eq], " \t")
+}
+
+// Whether an MLSD entry is for the current or parent directory, which
+// ReadDir leaves out.
+func isSelfParentMLST(info os.FileInfo) bool {
+	switch strings.ToLower(info.(*ftpFile).facts["type"]) {
+	case "cdir", "pdir", ".", "..":
+		return true
+	}
+	return false
 }
 
-// an entry looks something like this:
-// type=file;size=12;modify=20150216084148;UNIX.mode=0644;unique=1000004g1187ec7; lorem.txt
-func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
+// ParseMLST parses a single MLSD or MLST entry the same way ReadDir and
+// Stat do. An entry looks something like this:
+//
+//	type=file;size=12;modify=20150216084148;UNIX.mode=0644;unique=1000004g1187ec7; lorem.txt
+//
+// Entries for the current and parent directory (type=cdir and type=pdir)
+// are returned like any other entry. ParseMLST doesn't need a Client and is
+// safe for concurrent use.
+func ParseMLST(entry string) (os.FileInfo, error) {
 	parseError := ftpError{err: fmt.Errorf(`failed parsing MLST entry: %s`, entry)}
 	incompleteError := ftpError{err: fmt.Errorf(`MLST entry incomplete: %s`, entry)}
 
-	parts := strings.Split(entry, "; ")
-	if len(parts) != 2 {
+	factList, name, ok := splitMLSTEntry(entry)
+	if !ok {
 		return nil, parseError
 	}
 
 	facts := make(map[string]string)
-	for _, factPair := range strings.Split(parts[0], ";") {
-		factParts := strings.Split(factPair, "=")
+	for _, factPair := range strings.Split(factList, ";") {
+		// some servers end the facts with ";;"
+		if factPair == "" {
+			continue
+		}
+
+		// values may contain "=", e.g. "type=OS.unix=slink:/target", and
+		// may be empty, e.g. "UNIX.group=;"
+		factParts := strings.SplitN(factPair, "=", 2)
 		if len(factParts) != 2 {
 			return nil, parseError
 		}
-		facts[strings.ToLower(factParts[0])] = strings.ToLower(factParts[1])
+		// fact names are case insensitive, but values may not be
+		facts[strings.ToLower(factParts[0])] = factParts[1]
 	}
 
-	typ := facts["type"]
+	typ := strings.ToLower(facts["type"])
 
 	if typ == "" {
 		return nil, incompleteError
 	}
 
-	if skipSelfParent && (typ == "cdir" || typ == "pdir" || typ == "." || typ == "..") {
-		return nil, nil
-	}
-
 	var mode os.FileMode
 	if facts["unix.mode"] != "" {
 		m, err := strconv.ParseInt(facts["unix.mode"], 8, 32)
@@ -321,7 +1522,7 @@ func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
 		mode = os.FileMode(m)
 	} else if facts["perm"] != "" {
 		// see http://tools.ietf.org/html/rfc3659#section-7.5.5
-		for _, c := range facts["perm"] {
+		for _, c := range strings.ToLower(facts["perm"]) {
 			switch c {
 			case 'a', 'd', 'c', 'f', 'm', 'p', 'w':
 				// these suggest you have write permissions
@@ -343,38 +1544,60 @@ func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
 		mode |= os.ModeDir
 	}
 
+	// symlinks look like "OS.unix=slink:/target" or "OS.unix=symlink"
+	var linkTarget string
+	if strings.HasPrefix(typ, "os.unix=slink") || typ == "os.unix=symlink" {
+		mode |= os.ModeSymlink
+		if colon := strings.Index(facts["type"], ":"); colon != -1 {
+			linkTarget = facts["type"][colon+1:]
+		}
+	}
+
 	var (
 		size int64
 		err  error
 	)
 
+	// servers may omit size (e.g. for unreadable files), in which case
+	// Size() is 0
 	if facts["size"] != "" {
 		size, err = strconv.ParseInt(facts["size"], 10, 64)
 	} else if mode.IsDir() && facts["sizd"] != "" {
 		size, err = strconv.ParseInt(facts["sizd"], 10, 64)
-	} else if facts["type"] == "file" {
-		return nil, incompleteError
 	}
 
 	if err != nil {
 		return nil, parseError
 	}
 
-	if facts["modify"] == "" {
-		return nil, incompleteError
-	}
-
-	mtime, err := time.ParseInLocation(timeFormat, facts["modify"], time.UTC)
-	if err != nil {
-		return nil, incompleteError
+	// some servers omit modify for some entries, so leave ModTime() zero
+	var mtime time.Time
+	if facts["modify"] != "" {
+		mtime, err = parseMLSTTime(facts["modify"])
+		if err != nil {
+			return nil, parseError
+		}
 	}
 
 	info := &ftpFile{
-		name:  filepath.Base(parts[1]),
+		name:  filepath.Base(name),
 		size:  size,
 		mtime: mtime,
 		raw:   entry,
 		mode:  mode,
+		owner: facts["unix.owner"],
+		group: facts["unix.group"],
+		facts: facts,
+
+		linkTarget: linkTarget,
+	}
+
+	if facts["unix.ownername"] != "" {
+		info.owner = facts["unix.ownername"]
+	}
+
+	if facts["unix.groupname"] != "" {
+		info.group = facts["unix.groupname"]
 	}
 
 	return info, nil
@@ -6,12 +6,16 @@ package goftp
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -157,6 +161,17 @@ func TestParseMLST(t *testing.T) {
 				name:  "files",
 				mtime: mustParseTime(timeFormat, "19991014192630"),
 				mode:  os.FileMode(0755) | os.ModeDir,
+				owner: "0",
+				group: "1",
+				facts: map[string]string{
+					"modify":     "19991014192630",
+					"perm":       "fle",
+					"type":       "dir",
+					"unique":     "806U246E0B1",
+					"unix.group": "1",
+					"unix.mode":  "0755",
+					"unix.owner": "0",
+				},
 			},
 		},
 		{
@@ -167,6 +182,11 @@ func TestParseMLST(t *testing.T) {
 				mtime: mustParseTime(timeFormat, "20090426141232"),
 				mode:  os.FileMode(0400),
 				size:  1089207168,
+				facts: map[string]string{
+					"size":   "1089207168",
+					"type":   "file",
+					"modify": "20090426141232",
+				},
 			},
 		},
 	}
@@ -174,7 +194,7 @@ func TestParseMLST(t *testing.T) {
 	for _, c := range cases {
 		c.exp.raw = c.raw
 
-		got, err := parseMLST(c.raw, false)
+		got, err := ParseMLST(c.raw)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -185,6 +205,337 @@ func TestParseMLST(t *testing.T) {
 	}
 }
 
+func TestMLSTEntryFacts(t *testing.T) {
+	raw := "type=file;size=12;modify=20150216084148;create=20150215000000;perm=adfr;unique=1000004g1187ec7;UNIX.uid=1000;UNIX.gid=100; lorem.txt"
+
+	info, err := ParseMLST(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	facts, ok := info.Sys().(*EntryFacts)
+	if !ok {
+		t.Fatalf("Sys() returned %T", info.Sys())
+	}
+
+	if facts.Type != "file" || facts.Perm != "adfr" || facts.Unique != "1000004g1187ec7" {
+		t.Errorf("got %+v", facts)
+	}
+
+	if facts.UID != 1000 || facts.GID != 100 {
+		t.Errorf("got uid %d, gid %d", facts.UID, facts.GID)
+	}
+
+	if !facts.Create.Equal(mustParseTime(timeFormat, "20150215000000")) {
+		t.Errorf("got create %s", facts.Create)
+	}
+
+	if facts.Raw != raw {
+		t.Errorf("got raw %s", facts.Raw)
+	}
+
+	if facts.All["size"] != "12" {
+		t.Errorf("got facts %v", facts.All)
+	}
+
+	// entries from LIST have no facts to speak of
+	info, err = parseLIST("drwxr-xr-x 2 owner group 4096 Feb 16 08:41 subdir", testListTimes(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	facts = info.Sys().(*EntryFacts)
+	if facts.Type != "dir" || facts.UID != -1 || facts.GID != -1 || facts.All != nil {
+		t.Errorf("got %+v", facts)
+	}
+}
+
+// fact values should be kept as is
+func TestParseMLSTMixedCase(t *testing.T) {
+	raw := "type=File;size=12;modify=20150216084148;perm=ADFR;unique=AbC123;UNIX.owner=WebAdmin;UNIX.group=StaffGroup; Lorem.TXT"
+
+	info, err := ParseMLST(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name() != "Lorem.TXT" || info.Size() != 12 || info.Mode() != 0600 {
+		t.Errorf("got %+v", info)
+	}
+
+	facts := info.Sys().(*EntryFacts)
+
+	if facts.Type != "File" || facts.Unique != "AbC123" || facts.Perm != "ADFR" {
+		t.Errorf("got %+v", facts)
+	}
+
+	if facts.Owner != "WebAdmin" || facts.Group != "StaffGroup" {
+		t.Errorf("got owner %s, group %s", facts.Owner, facts.Group)
+	}
+
+	if facts.UID != -1 || facts.GID != -1 {
+		t.Errorf("got uid %d, gid %d", facts.UID, facts.GID)
+	}
+
+	if facts.All["unix.owner"] != "WebAdmin" {
+		t.Errorf("got facts %v", facts.All)
+	}
+
+	// numeric owner/group double as uid/gid
+	info, err = ParseMLST("type=dir;modify=20150216084148;UNIX.owner=1000;UNIX.group=100; Dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	facts = info.Sys().(*EntryFacts)
+	if !info.IsDir() || facts.UID != 1000 || facts.GID != 100 {
+		t.Errorf("got %+v", facts)
+	}
+}
+
+func TestParseMLSTTime(t *testing.T) {
+	base := mustParseTime(timeFormat, "20150216084148")
+
+	cases := []struct {
+		raw string
+		exp time.Time
+	}{
+		{"20150216084148", base},
+		{"20150216084148.5", base.Add(500 * time.Millisecond)},
+		{"20150216084148.500", base.Add(500 * time.Millisecond)},
+		{"20150216084148.000001", base.Add(time.Microsecond)},
+		{"20150216084148.1234567891234", base.Add(123456789 * time.Nanosecond)},
+	}
+
+	for _, c := range cases {
+		got, err := parseMLSTTime(c.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !got.Equal(c.exp) {
+			t.Errorf("%s: expected %s, got %s", c.raw, c.exp, got)
+		}
+	}
+
+	for _, raw := range []string{"", "2015021608414", "20150216084148.5x", "20150216084148.-5"} {
+		if _, err := parseMLSTTime(raw); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+
+	info, err := ParseMLST("type=file;size=12;modify=20150216084148.500;create=20150215000000.25; lorem.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.ModTime().Equal(base.Add(500 * time.Millisecond)) {
+		t.Errorf("got %s", info.ModTime())
+	}
+
+	create := info.Sys().(*EntryFacts).Create
+	if !create.Equal(mustParseTime(timeFormat, "20150215000000").Add(250 * time.Millisecond)) {
+		t.Errorf("got %s", create)
+	}
+}
+
+func TestParseMLSTOddNames(t *testing.T) {
+	for _, name := range []string{
+		"report; final.txt",
+		"a=b; c;d.txt",
+		"x;y=z; ; w",
+	} {
+		info, err := ParseMLST("type=file;size=12;modify=20150216084148; " + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Name() != name {
+			t.Errorf("expected %q, got %q", name, info.Name())
+		}
+
+		if info.Size() != 12 {
+			t.Errorf("%s: expected size 12, got %d", name, info.Size())
+		}
+	}
+}
+
+func TestParseMLSTSymlink(t *testing.T) {
+	cases := []struct {
+		raw    string
+		target string
+	}{
+		{"type=OS.unix=slink:/Some/Target;size=7;modify=20150216084148; link", "/Some/Target"},
+		{"type=OS.unix=symlink;size=7;modify=20150216084148; link", ""},
+	}
+
+	for _, c := range cases {
+		info, err := ParseMLST(c.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 || info.IsDir() {
+			t.Errorf("expected symlink mode, got %s", info.Mode())
+		}
+
+		if target := info.Sys().(*EntryFacts).LinkTarget; target != c.target {
+			t.Errorf("expected target %q, got %q", c.target, target)
+		}
+	}
+}
+
+func TestParseMLSTFactValues(t *testing.T) {
+	cases := []struct {
+		raw   string
+		name  string
+		facts map[string]string
+	}{
+		{
+			"type=OS.unix=slink:/a=b;size=7;modify=20150216084148;x.vendor=k=v; link",
+			"link",
+			map[string]string{"type": "OS.unix=slink:/a=b", "size": "7", "modify": "20150216084148", "x.vendor": "k=v"},
+		},
+		{
+			"type=file;size=7;modify=20150216084148;UNIX.group=;UNIX.owner=0; empty-group",
+			"empty-group",
+			map[string]string{"type": "file", "size": "7", "modify": "20150216084148", "unix.group": "", "unix.owner": "0"},
+		},
+		{
+			"type=file;size=7;modify=20150216084148;; trailing",
+			"trailing",
+			map[string]string{"type": "file", "size": "7", "modify": "20150216084148"},
+		},
+		{
+			"type=file;;size=7;modify=20150216084148;;; doubled",
+			"doubled",
+			map[string]string{"type": "file", "size": "7", "modify": "20150216084148"},
+		},
+	}
+
+	for _, c := range cases {
+		info, err := ParseMLST(c.raw)
+		if err != nil {
+			t.Errorf("%s: %s", c.raw, err)
+			continue
+		}
+
+		if info.Name() != c.name {
+			t.Errorf("expected name %s, got %s", c.name, info.Name())
+		}
+
+		if facts := info.Sys().(*EntryFacts).All; !reflect.DeepEqual(facts, c.facts) {
+			t.Errorf("expected facts %v, got %v", c.facts, facts)
+		}
+	}
+
+	if _, err := ParseMLST("type=file;size7;modify=20150216084148; no-equals"); err == nil {
+		t.Error("expected error for fact without =")
+	}
+}
+
+func TestParseMLSTMissingModify(t *testing.T) {
+	info, err := ParseMLST("type=file;size=12; lorem.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.ModTime().IsZero() || info.Size() != 12 {
+		t.Errorf("got %+v", info)
+	}
+
+	info, err = ParseMLST("type=dir;modify=; subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.ModTime().IsZero() || !info.IsDir() {
+		t.Errorf("got %+v", info)
+	}
+
+	if _, err := ParseMLST("type=file;size=12;modify=yesterday; lorem.txt"); err == nil {
+		t.Error("expected error for invalid modify")
+	}
+}
+
+func TestParseMLSTMissingSize(t *testing.T) {
+	for _, raw := range []string{
+		"type=file;modify=20150216084148; lorem.txt",
+		"type=file;size=;modify=20150216084148; lorem.txt",
+	} {
+		info, err := ParseMLST(raw)
+		if err != nil {
+			t.Errorf("%s: %s", raw, err)
+			continue
+		}
+
+		if info.Size() != 0 || info.IsDir() || info.Name() != "lorem.txt" {
+			t.Errorf("got %+v", info)
+		}
+	}
+
+	if _, err := ParseMLST("type=file;size=big;modify=20150216084148; lorem.txt"); err == nil {
+		t.Error("expected error for invalid size")
+	}
+}
+
+func TestParseMLSTSelfParent(t *testing.T) {
+	for _, raw := range []string{
+		"type=cdir;modify=20150216084148; /some/dir",
+		"type=pdir;modify=20150216084148; ..",
+	} {
+		info, err := ParseMLST(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.IsDir() || !isSelfParentMLST(info) {
+			t.Errorf("got %+v", info)
+		}
+	}
+}
+
+func TestParseMLSTNoSpace(t *testing.T) {
+	cases := []struct {
+		raw  string
+		name string
+		size int64
+	}{
+		{"type=file;size=12;modify=20150216084148;lorem.txt", "lorem.txt", 12},
+		{"type=file;size=12;modify=20150216084148;UNIX.mode=0644;a b.txt", "a b.txt", 12},
+		{"type=file;size=12;modify=20150216084148;;lorem.txt", "lorem.txt", 12},
+		{"type=OS.unix=slink:/x;size=7;modify=20150216084148;link", "link", 7},
+		// the usual form, with names starting with spaces
+		{"type=file;size=12;modify=20150216084148;  leading.txt", " leading.txt", 12},
+		{"type=file;size=12;modify=20150216084148; semi;colon", "semi;colon", 12},
+		// names containing "; "
+		{"type=file;size=12;modify=20150216084148;my; file.txt", "my; file.txt", 12},
+		{"type=file;size=12;modify=20150216084148; a; b.txt", "a; b.txt", 12},
+	}
+
+	for _, c := range cases {
+		info, err := ParseMLST(c.raw)
+		if err != nil {
+			t.Errorf("%s: %s", c.raw, err)
+			continue
+		}
+
+		if info.Name() != c.name || info.Size() != c.size {
+			t.Errorf("%s: got name %q size %d", c.raw, info.Name(), info.Size())
+		}
+	}
+
+	for _, raw := range []string{
+		"lorem.txt",
+		"type=file;size=12;",
+		";lorem.txt",
+	} {
+		if _, err := ParseMLST(raw); err == nil {
+			t.Errorf("%s: expected error", raw)
+		}
+	}
+}
+
 func compareFileInfos(a, b os.FileInfo) error {
 	if a.Name() != b.Name() {
 		return fmt.Errorf("Name(): %s != %s", a.Name(), b.Name())
@@ -239,7 +590,7 @@ func TestReadDir(t *testing.T) {
 			}
 
 			if err := compareFileInfos(item, expected); err != nil {
-				t.Errorf("mismatch on %s: %s (%s)", item.Name(), err, item.Sys().(string))
+				t.Errorf("mismatch on %s: %s (%s)", item.Name(), err, item.Sys().(*EntryFacts).Raw)
 			}
 
 			names = append(names, item.Name())
@@ -373,3 +724,1106 @@ func TestGetwd(t *testing.T) {
 		}
 	}
 }
+
+func TestReadDirLIST(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ConnectionsPerHost = 1
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// pretend the server doesn't support MLST so we use LIST
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(pconn.features, "MLST")
+		c.returnConn(pconn)
+
+		list, err := c.ReadDir("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+
+		for _, item := range list {
+			expected, err := os.Stat("testroot/" + item.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if item.IsDir() != expected.IsDir() {
+				t.Errorf("IsDir mismatch on %s (%s)", item.Name(), item.Sys().(*EntryFacts).Raw)
+			}
+
+			if !item.IsDir() && item.Size() != expected.Size() {
+				t.Errorf("Size mismatch on %s (%s)", item.Name(), item.Sys().(*EntryFacts).Raw)
+			}
+
+			names = append(names, item.Name())
+		}
+
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, []string{"git-ignored", "lorem.txt", "subdir"}) {
+			t.Errorf("got: %v", names)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := c.Names("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, []string{"git-ignored", "lorem.txt", "subdir"}) {
+			t.Errorf("got: %v", names)
+		}
+
+		names, err = c.Names("subdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(names, []string{"1234.bin"}) {
+			t.Errorf("got: %v", names)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestReadDirFunc(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ConnectionsPerHost = 1
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		err = c.ReadDirFunc("", func(info os.FileInfo) error {
+			names = append(names, info.Name())
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, []string{"git-ignored", "lorem.txt", "subdir"}) {
+			t.Errorf("got: %v", names)
+		}
+
+		// stop after the first entry
+		var count int
+		err = c.ReadDirFunc("", func(info os.FileInfo) error {
+			count++
+			return ErrStopListing
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != 1 {
+			t.Errorf("expected 1 entry, got %d", count)
+		}
+
+		// other errors are returned
+		myErr := errors.New("oops")
+		err = c.ReadDirFunc("", func(info os.FileInfo) error {
+			return myErr
+		})
+		if err != myErr {
+			t.Errorf("expected %v, got %v", myErr, err)
+		}
+
+		// connection should still be usable
+		list, err := c.ReadDir("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) != 3 {
+			t.Errorf("expected 3 items, got %d", len(list))
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		err = c.Walk("", func(fullPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			paths = append(paths, fullPath)
+
+			// contents depend on what other tests have done
+			if fullPath == "git-ignored" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := []string{"", "git-ignored", "lorem.txt", "subdir", "subdir/1234.bin"}
+		if !reflect.DeepEqual(paths, exp) {
+			t.Errorf("got: %v", paths)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestIgnoreInvalidListEntries(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["MLSD "] = "type=file;size=12;modify=20150216084148; good.txt\r\n" +
+		"this is garbage\r\n" +
+		"type=file;size=34;modify=20150216084148; also-good.txt\r\n"
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// strict by default
+	if _, err := c.ReadDir(""); err == nil {
+		t.Error("expected an error")
+	}
+
+	c.config.IgnoreInvalidListEntries = true
+
+	list, err := c.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 || list[0].Name() != "good.txt" || list[1].Name() != "also-good.txt" {
+		t.Errorf("got %v", list)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestListingNoise(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["MLSD mlsd"] = "type=file;size=12;modify=20150216084148; good.txt\r\n" +
+		"\r\n"
+	server.data["LIST list"] = "150 Opening data connection\r\n" +
+		"total 248\r\n" +
+		"-rw-r--r-- 1 owner group 12 Feb 16 2015 lorem.txt\r\n" +
+		"\r\n" +
+		"drwxr-xr-x 2 owner group 4096 Feb 16 2015 subdir\r\n" +
+		"226-Quota: 10% used\r\n"
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := c.ReadDir("mlsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0].Name() != "good.txt" {
+		t.Errorf("got %v", list)
+	}
+
+	var names []string
+	err = c.readDirLIST(context.Background(), "list", func(info os.FileInfo) error {
+		names = append(names, info.Name())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(names, []string{"lorem.txt", "subdir"}) {
+		t.Errorf("got %v", names)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			pattern string
+			exp     []string
+		}{
+			{"*.txt", []string{"lorem.txt"}},
+			{"lorem.txt", []string{"lorem.txt"}},
+			{"sub*/*.bin", []string{"subdir/1234.bin"}},
+			{"*/[0-9]???.bin", []string{"subdir/1234.bin"}},
+			{"subdir/*/*", nil},
+			{"does-not-exist", nil},
+			{"does-not-exist/*", nil},
+		}
+
+		for _, tc := range cases {
+			got, err := c.Glob(tc.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("%s: expected %v, got %v", tc.pattern, tc.exp, got)
+			}
+		}
+
+		if _, err := c.Glob("["); err != path.ErrBadPattern {
+			t.Errorf("expected ErrBadPattern, got %v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStatFromList(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// no MLST
+	server.features = []string{"SIZE"}
+	server.data["LIST "] = "drwxr-xr-x 2 owner group 4096 Feb 16 2015 subdir\r\n" +
+		"-rw-r--r-- 1 owner group 12 Feb 16 2015 lorem.txt\r\n"
+	server.data["LIST subdir"] = "-rw-r--r-- 1 owner group 4 Feb 16 2015 1234.bin\r\n"
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := c.Stat("lorem.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name() != "lorem.txt" || info.Size() != 12 || info.IsDir() {
+		t.Errorf("got %+v", info)
+	}
+
+	info, err = c.Stat("subdir/1234.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name() != "1234.bin" || info.Size() != 4 {
+		t.Errorf("got %+v", info)
+	}
+
+	info, err = c.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.IsDir() {
+		t.Errorf("root should be a dir")
+	}
+
+	_, err = c.Stat("nope.txt")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+
+	if code := replyCode(err); code != replyFileError {
+		t.Errorf("expected code 550, got %d", code)
+	}
+
+	matches, err := c.Glob("nope.txt")
+	if err != nil || len(matches) != 0 {
+		t.Errorf("got %v, %v", matches, err)
+	}
+
+	if err := c.RemoveAll("nope.txt"); err != nil {
+		t.Errorf("got %v", err)
+	}
+
+	// listing errors are not "not exist" errors
+	_, err = c.Stat("missing-dir/foo")
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected listing error, got %v", err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestStatLite(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["SIZE lorem.txt"] = fakeReply{213, "12"}
+	server.replies["MDTM lorem.txt"] = fakeReply{213, "20150216084148"}
+	server.replies["SIZE subdir"] = fakeReply{550, "subdir: not a regular file"}
+	server.replies["MDTM subdir"] = fakeReply{213, "20150216084148"}
+	server.replies["CWD subdir"] = fakeReply{250, "ok"}
+	server.replies["CWD /"] = fakeReply{250, "ok"}
+	server.replies["SIZE nope"] = fakeReply{550, "nope: no such file"}
+	server.replies["MDTM nope"] = fakeReply{550, "nope: no such file"}
+	server.replies["SIZE denied"] = fakeReply{530, "not logged in"}
+	server.replies["MDTM denied"] = fakeReply{213, "20150216084148"}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := mustParseTime(timeFormat, "20150216084148")
+
+	info, err := c.StatLite("lorem.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name() != "lorem.txt" || info.Size() != 12 || info.Mode() != 0 || !info.ModTime().Equal(mtime) {
+		t.Errorf("got %+v", info)
+	}
+
+	info, err = c.StatLite("subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.IsDir() || !info.ModTime().Equal(mtime) {
+		t.Errorf("got %+v", info)
+	}
+
+	_, err = c.StatLite("nope")
+	if err == nil || err.(Error).Code() != 550 {
+		t.Errorf("expected 550 error, got %v", err)
+	}
+
+	// only 550 can mean a directory
+	_, err = c.StatLite("denied")
+	if err == nil || err.(Error).Code() != 530 {
+		t.Errorf("expected 530 error, got %v", err)
+	}
+
+	var cwds []string
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "CWD ") {
+			cwds = append(cwds, cmd)
+		}
+	}
+
+	// changed back after probing subdir, and never probed "denied"
+	expected := []string{"CWD subdir", "CWD /", "CWD nope"}
+	if !reflect.DeepEqual(cwds, expected) {
+		t.Errorf("expected %v, got %v", expected, cwds)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestReadDirEntries(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := c.ReadDirEntries("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.IsDir() != info.IsDir() || entry.Type() != info.Mode().Type() {
+				t.Errorf("type mismatch for %s", entry.Name())
+			}
+		}
+
+		if !reflect.DeepEqual(names, []string{"git-ignored", "lorem.txt", "subdir"}) {
+			t.Errorf("got: %v", names)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestReadDirControl(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["STAT subdir"] = fakeReply{211, "Status of subdir:\n" +
+		" drwxr-xr-x 2 owner group 4096 Feb 16 2015 .\n" +
+		" drwxr-xr-x 2 owner group 4096 Feb 16 2015 dir\n" +
+		" -rw-r--r-- 1 owner group 12 Feb 16 2015 lorem.txt\n" +
+		"End of status"}
+	server.replies["STAT mlsd"] = fakeReply{212, "Status of mlsd:\n" +
+		" type=cdir;modify=20150216084148; .\n" +
+		" type=file;size=4;modify=20150216084148; 1234.bin\n" +
+		"End of status"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := c.ReadDirControl("subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(list))
+	}
+
+	if list[0].Name() != "dir" || !list[0].IsDir() {
+		t.Errorf("got %+v", list[0])
+	}
+
+	if list[1].Name() != "lorem.txt" || list[1].Size() != 12 {
+		t.Errorf("got %+v", list[1])
+	}
+
+	list, err = c.ReadDirControl("mlsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0].Name() != "1234.bin" || list[0].Size() != 4 {
+		t.Errorf("got %+v", list)
+	}
+
+	// fake server replies 502 to STAT by default
+	_, err = c.ReadDirControl("other")
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "EPSV") || strings.HasPrefix(cmd, "PASV") {
+			t.Errorf("unexpected data connection command %s", cmd)
+		}
+	}
+}
+
+func TestReadDirRecursive(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.features = []string{"SIZE"}
+	server.data["LIST -R data"] = "data:\r\n" +
+		"total 8\r\n" +
+		"drwxr-xr-x 2 owner group 4096 Feb 16 2015 sub\r\n" +
+		"-rw-r--r-- 1 owner group 12 Feb 16 2015 lorem.txt\r\n" +
+		"\r\n" +
+		"data/sub:\r\n" +
+		"total 4\r\n" +
+		"drwxr-xr-x 2 owner group 4096 Feb 16 2015 empty\r\n" +
+		"-rw-r--r-- 1 owner group 4 Feb 16 2015 1234.bin\r\n" +
+		"\r\n" +
+		"data/sub/empty:\r\n" +
+		"total 0\r\n"
+
+	// server ignoring -R
+	server.data["LIST -R /"] = "drwxr-xr-x 2 owner group 4096 Feb 16 2015 sub\r\n" +
+		"-rw-r--r-- 1 owner group 12 Feb 16 2015 lorem.txt\r\n"
+	server.data["LIST /"] = server.data["LIST -R /"]
+	server.data["LIST /sub"] = "-rw-r--r-- 1 owner group 4 Feb 16 2015 1234.bin\r\n"
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(tree map[string][]os.FileInfo) map[string][]string {
+		ret := make(map[string][]string)
+		for dir, infos := range tree {
+			ret[dir] = []string{}
+			for _, info := range infos {
+				ret[dir] = append(ret[dir], info.Name())
+			}
+			sort.Strings(ret[dir])
+		}
+		return ret
+	}
+
+	tree, err := c.ReadDirRecursive("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		".":         {"lorem.txt", "sub"},
+		"sub":       {"1234.bin", "empty"},
+		"sub/empty": {},
+	}
+
+	if got := names(tree); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	tree, err = c.ReadDirRecursive("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = map[string][]string{
+		".":   {"lorem.txt", "sub"},
+		"sub": {"1234.bin"},
+	}
+
+	if got := names(tree); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestRelativeListDir(t *testing.T) {
+	cases := []struct {
+		dir, root, expected string
+	}{
+		{".", "", "."},
+		{"./sub", "", "sub"},
+		{"sub/dir", ".", "sub/dir"},
+		{"data", "data", "."},
+		{"data/sub", "data", "sub"},
+		{"/pub/data/sub", "/pub/data", "sub"},
+		{"/sub", "/", "sub"},
+		{"./sub", "/pub", "sub"},
+	}
+
+	for _, c := range cases {
+		if got := relativeListDir(c.dir, c.root); got != c.expected {
+			t.Errorf("relativeListDir(%q, %q): expected %q, got %q", c.dir, c.root, c.expected, got)
+		}
+	}
+}
+
+func TestMaxListLineLen(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	longName := strings.Repeat("a", 100*1024)
+	server.data["MLSD long"] = "type=file;size=12;modify=20150216084148; " + longName + "\r\n"
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// longer than bufio.Scanner's default limit
+	list, err := c.ReadDir("long")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0].Name() != longName {
+		t.Errorf("got %d entries", len(list))
+	}
+
+	c, err = DialConfig(Config{MaxListLineLen: 1024}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ReadDir("long")
+	if err == nil || !strings.Contains(err.Error(), "MaxListLineLen") {
+		t.Errorf("expected line length error, got %v", err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestReadDirContext(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.handlers["MLSD"] = func(fc *fakeConn, arg string) {
+		fc.sendForever("type=file;size=1;modify=20150216084148; file\r\n")
+		fc.reply(426, "transfer aborted")
+	}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var entries int
+	err = c.ReadDirFuncContext(ctx, "endless", func(info os.FileInfo) error {
+		entries++
+		if entries == 100 {
+			cancel()
+		}
+		return nil
+	})
+
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if _, err := c.ReadDirContext(ctx, "endless"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	server.replies["MLST file"] = fakeReply{250, "Listing file\n type=file;size=1;modify=20150216084148; file\nEnd"}
+
+	// connection is still usable
+	if _, err := c.Stat("file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestReadDirNoFiles(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["MLSD empty"] = fakeReply{450, "No files found"}
+	server.replies["MLST empty"] = fakeReply{250, "Listing empty\n type=dir;modify=20150216084148; empty\nEnd"}
+
+	server.replies["MLSD empty550"] = fakeReply{550, "No files found"}
+	server.replies["MLST empty550"] = fakeReply{250, "Listing empty550\n type=dir;modify=20150216084148; empty550\nEnd"}
+
+	server.replies["MLSD private"] = fakeReply{550, "Permission denied"}
+	server.replies["MLST private"] = fakeReply{250, "Listing private\n type=dir;modify=20150216084148; private\nEnd"}
+
+	server.replies["MLSD file.txt"] = fakeReply{550, "No files found"}
+	server.replies["MLST file.txt"] = fakeReply{250, "Listing file.txt\n type=file;size=1;modify=20150216084148; file.txt\nEnd"}
+
+	server.replies["MLSD missing"] = fakeReply{550, "No files found"}
+	server.replies["MLST missing"] = fakeReply{550, "missing: No such file or directory"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"empty", "empty550"} {
+		list, err := c.ReadDir(dir)
+		if err != nil {
+			t.Errorf("%s: %s", dir, err)
+		}
+
+		if list != nil {
+			t.Errorf("%s: expected nil, got %v", dir, list)
+		}
+	}
+
+	for _, dir := range []string{"private", "file.txt", "missing"} {
+		if _, err := c.ReadDir(dir); err == nil {
+			t.Errorf("%s: expected error", dir)
+		}
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestIsNoFilesReply(t *testing.T) {
+	cases := []struct {
+		err error
+		exp bool
+	}{
+		{ftpError{code: 450, msg: "No files found"}, true},
+		{ftpError{code: 550, msg: "No files found"}, true},
+		{ftpError{code: 550, msg: "No files found."}, true},
+		{ftpError{code: 450, msg: "*: No such files or directories"}, true},
+		{ftpError{code: 550, msg: "Directory is empty"}, true},
+		{ftpError{code: 550, msg: "Permission denied"}, false},
+		{ftpError{code: 550, msg: "/private: Permission denied"}, false},
+		{ftpError{code: 550, msg: "Can't open /x: No such file or directory"}, false},
+		{ftpError{code: 226, msg: "No files found"}, false},
+		{errors.New("No files found"), false},
+	}
+
+	for _, c := range cases {
+		if got := isNoFilesReply(c.err); got != c.exp {
+			t.Errorf("%v: expected %v, got %v", c.err, c.exp, got)
+		}
+	}
+}
+
+// Fake server with an in-memory tree of paths and their MLST facts,
+// supporting MLST, MLSD, DELE and RMD.
+func newTreeServer(t *testing.T, tree map[string]string) *fakeServer {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.handlers["MLST"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		facts, ok := tree[arg]
+		server.mu.Unlock()
+
+		if ok {
+			fc.reply(250, "Listing\n "+facts+" "+arg+"\nEnd")
+		} else {
+			fc.reply(550, "no such file")
+		}
+	}
+
+	server.handlers["MLSD"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		_, ok := tree[arg]
+		var listing string
+		for p, facts := range tree {
+			if path.Dir(p) == arg && p != arg {
+				listing += facts + " " + path.Base(p) + "\r\n"
+			}
+		}
+		server.mu.Unlock()
+
+		if ok {
+			fc.sendData(listing)
+		} else {
+			fc.reply(550, "no such directory")
+		}
+	}
+
+	remove := func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		_, ok := tree[arg]
+		empty := true
+		for p := range tree {
+			if path.Dir(p) == arg && p != arg {
+				empty = false
+			}
+		}
+		if ok && empty {
+			delete(tree, arg)
+		}
+		server.mu.Unlock()
+
+		switch {
+		case !ok:
+			fc.reply(550, "no such file")
+		case !empty:
+			fc.reply(550, "directory not empty")
+		default:
+			fc.reply(250, "deleted")
+		}
+	}
+
+	server.handlers["DELE"] = remove
+	server.handlers["RMD"] = remove
+
+	return server
+}
+
+func TestRemoveAll(t *testing.T) {
+	tree := map[string]string{
+		"/":                 "type=dir;unique=0;",
+		"/data":             "type=dir;unique=1;",
+		"/data/a.txt":       "type=file;size=1;",
+		"/data/b.txt":       "type=file;size=1;",
+		"/data/sub":         "type=dir;unique=2;",
+		"/data/sub/c.txt":   "type=file;size=1;",
+		"/data/link":        "type=OS.unix=slink:/important;",
+		"/important":        "type=dir;unique=3;",
+		"/important/keep":   "type=file;size=1;",
+		"/loopy":            "type=dir;unique=4;",
+		"/loopy/self":       "type=dir;unique=4;",
+		"/loopy/self/a.txt": "type=file;size=1;",
+	}
+
+	server := newTreeServer(t, tree)
+	defer server.close()
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := c.RemoveAllDryRun("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"/data/a.txt", "/data/b.txt", "/data/link", "/data/sub/c.txt", "/data/sub", "/data"}
+	if !reflect.DeepEqual(paths, exp) {
+		t.Errorf("expected %v, got %v", exp, paths)
+	}
+
+	if len(tree) != 12 {
+		t.Errorf("dry run deleted something: %v", tree)
+	}
+
+	// b.txt is deleted by someone else while we're at it
+	server.handlers["DELE"] = func(handler func(*fakeConn, string)) func(*fakeConn, string) {
+		return func(fc *fakeConn, arg string) {
+			if arg == "/data/a.txt" {
+				server.mu.Lock()
+				delete(tree, "/data/b.txt")
+				server.mu.Unlock()
+			}
+			handler(fc, arg)
+		}
+	}(server.handlers["DELE"])
+
+	if err := c.RemoveAll("/data"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range exp {
+		if _, ok := tree[p]; ok {
+			t.Errorf("%s wasn't deleted", p)
+		}
+	}
+
+	if _, ok := tree["/important/keep"]; !ok {
+		t.Error("followed symlink")
+	}
+
+	// doesn't exist
+	if err := c.RemoveAll("/data"); err != nil {
+		t.Error(err)
+	}
+
+	if err := c.RemoveAll("/nope/nested"); err != nil {
+		t.Error(err)
+	}
+
+	// symlink presented as a directory
+	if err := c.RemoveAll("/loopy"); err == nil {
+		t.Error("expected error")
+	}
+
+	if _, ok := tree["/loopy/self/a.txt"]; !ok {
+		t.Error("deleted through symlink")
+	}
+
+	// real failures aren't mistaken for missing files
+	server.handlers["RMD"] = func(fc *fakeConn, arg string) {
+		fc.reply(550, "permission denied")
+	}
+
+	tree["/empty"] = "type=dir;unique=5;"
+
+	if err := c.RemoveAll("/empty"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	server, dirs := newDirServer(t, "/archive", "/archive/2024")
+	defer server.close()
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 5}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := c.MkdirAll("/archive/2024/05/17/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "/archive/2024/05/17" {
+		t.Errorf("got %s", name)
+	}
+
+	for _, dir := range []string{"/archive/2024/05", "/archive/2024/05/17"} {
+		if !dirs[dir] {
+			t.Errorf("%s wasn't created", dir)
+		}
+	}
+
+	// already exists
+	if name, err = c.MkdirAll("/archive/2024"); err != nil || name != "/archive/2024" {
+		t.Errorf("got %s, %v", name, err)
+	}
+
+	// relative
+	if name, err = c.MkdirAll("a/b"); err != nil || name != "a/b" {
+		t.Errorf("got %s, %v", name, err)
+	}
+
+	// racing with other clients creating the same tree
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := c.MkdirAll("/race/x/y/z")
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if !dirs["/race/x/y/z"] {
+		t.Error("/race/x/y/z wasn't created")
+	}
+
+	// real errors are returned
+	server.handlers["MKD"] = func(fc *fakeConn, arg string) {
+		fc.reply(550, "permission denied")
+	}
+
+	if _, err := c.MkdirAll("/private/x"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestChmod(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["SITE CHMOD 644 public"] = fakeReply{200, "SITE CHMOD command successful"}
+	server.replies["SITE CHMOD 4755 bin"] = fakeReply{250, "ok"}
+	server.replies["SITE CHMOD 644 private"] = fakeReply{550, "permission denied"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Chmod("public", 0644); err != nil {
+		t.Error(err)
+	}
+
+	if err := c.Chmod("bin", 0755|os.ModeSetuid); err != nil {
+		t.Error(err)
+	}
+
+	err = c.Chmod("private", 0644)
+	if err == nil || errors.Is(err, ErrChmodUnsupported) || err.(Error).Code() != 550 {
+		t.Errorf("got %v", err)
+	}
+
+	// default reply is 502
+	if err := c.Chmod("other", 0644); !errors.Is(err, ErrChmodUnsupported) {
+		t.Errorf("expected ErrChmodUnsupported, got %v", err)
+	}
+
+	// after every upload
+	mode := os.FileMode(0644)
+	c, err = DialConfig(Config{UploadMode: &mode}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store("public", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store("other", strings.NewReader("hello")); !errors.Is(err, ErrChmodUnsupported) {
+		t.Errorf("expected ErrChmodUnsupported, got %v", err)
+	}
+}
+
+func TestFormatMode(t *testing.T) {
+	cases := []struct {
+		mode os.FileMode
+		exp  string
+	}{
+		{0644, "644"},
+		{0, "000"},
+		{0755 | os.ModeDir, "755"},
+		{0755 | os.ModeSetuid, "4755"},
+		{0775 | os.ModeSetgid, "2775"},
+		{0777 | os.ModeSticky, "1777"},
+		{0700 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky, "7700"},
+	}
+
+	for _, c := range cases {
+		if got := formatMode(c.mode); got != c.exp {
+			t.Errorf("%s: expected %s, got %s", c.mode, c.exp, got)
+		}
+	}
+}
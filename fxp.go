@@ -0,0 +1,197 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FXPError is returned by Transfer, saying which server failed.
+type FXPError struct {
+	// "source" or "destination"
+	Side string
+
+	Err error
+}
+
+func (e *FXPError) Error() string {
+	return fmt.Sprintf("%s server: %s", e.Side, e.Err)
+}
+
+func (e *FXPError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FXPError) Temporary() bool {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Temporary()
+	}
+	return false
+}
+
+func (e *FXPError) Code() int {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Code()
+	}
+	return 0
+}
+
+func (e *FXPError) Message() string {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Message()
+	}
+	return ""
+}
+
+// Transfer copies file "srcPath" on src's server to "dstPath" on dst's
+// server directly between the servers (FXP), without the data passing
+// through this machine. The destination server is put in passive mode
+// with PASV, and the source server is told to connect to it with PORT.
+// Many servers refuse PORT addresses other than the client's (to prevent
+// "FTP bounce" attacks), in which case the source server's reply is
+// returned. Errors are returned as an *FXPError saying which server
+// failed. Waiting for the final replies isn't bounded by
+// Config.CommandTimeout, since the transfer may take a long time.
+//
+// FXP doesn't work with TLS data connections on most servers, so Transfer
+// refuses if either client uses TLS. Transfers use each client's
+// Config.TransferType. If src and dst are the same Client, it must allow at
+// least 2 connections (see ConnectionsPerHost and MaxConnections).
+func Transfer(src *Client, srcPath string, dst *Client, dstPath string) error {
+	if src.config.TLSConfig != nil || dst.config.TLSConfig != nil {
+		return ftpError{err: errors.New("server-to-server transfers aren't supported with TLS")}
+	}
+
+	if src == dst && src.maxConns() < 2 {
+		return ftpError{err: errors.New("server-to-server transfers on the same client need at least 2 connections")}
+	}
+
+	srcConn, err := src.getIdleConn()
+	if err != nil {
+		return &FXPError{Side: "source", Err: err}
+	}
+
+	defer src.returnConn(srcConn)
+
+	dstConn, err := dst.getIdleConn()
+	if err != nil {
+		return &FXPError{Side: "destination", Err: err}
+	}
+
+	defer dst.returnConn(dstConn)
+
+	return fxp(srcConn, srcPath, dstConn, dstPath)
+}
+
+func fxp(srcConn *persistentConn, srcPath string, dstConn *persistentConn, dstPath string) error {
+	srcErr := func(err error) error {
+		return &FXPError{Side: "source", Err: err}
+	}
+
+	dstErr := func(err error) error {
+		return &FXPError{Side: "destination", Err: err}
+	}
+
+	if err := srcConn.setType(srcConn.config.TransferType); err != nil {
+		return srcErr(err)
+	}
+
+	if err := dstConn.setType(dstConn.config.TransferType); err != nil {
+		return dstErr(err)
+	}
+
+	addr, err := dstConn.requestPASV()
+	if err != nil {
+		return dstErr(err)
+	}
+
+	port, err := formatPORT(addr)
+	if err != nil {
+		return dstErr(err)
+	}
+
+	if err := srcConn.sendCommandExpected(replyCommandOkay, "PORT %s", port); err != nil {
+		srcConn.debug("server refused PORT %s: %s", port, err)
+		return srcErr(err)
+	}
+
+	// Servers in passive mode may not reply to STOR until the data
+	// connection is established, so send RETR before reading STOR's reply.
+	if err := dstConn.writeCommand("STOR " + dstPath); err != nil {
+		return dstErr(err)
+	}
+
+	code, msg, err := srcConn.sendCommand("RETR %s", srcPath)
+	if err == nil && code/100 != replyGroupPreliminaryReply {
+		err = ftpError{code: code, msg: msg}
+	}
+
+	if err != nil {
+		// the destination is still waiting for the source to connect
+		dstConn.debug("source failed, discarding connection")
+		dstConn.broken = true
+		return srcErr(err)
+	}
+
+	code, msg, err = dstConn.readResponse()
+	if err == nil && code/100 != replyGroupPreliminaryReply {
+		err = ftpError{code: code, msg: msg}
+	}
+
+	if err != nil {
+		// the source's transfer has nowhere to go
+		srcConn.debug("destination failed, discarding connection")
+		srcConn.broken = true
+		return dstErr(err)
+	}
+
+	// both servers report when the data connection closes
+	code, msg, err = srcConn.readResponseWithin(0)
+	if err == nil && !positiveCompletionReply(code) {
+		err = ftpError{code: code, msg: msg}
+	}
+
+	if err != nil {
+		// the destination may never see a connection
+		dstConn.debug("source failed, discarding connection")
+		dstConn.broken = true
+		return srcErr(err)
+	}
+
+	code, msg, err = dstConn.readResponseWithin(0)
+	if err == nil && !positiveCompletionReply(code) {
+		err = ftpError{code: code, msg: msg}
+	}
+
+	if err != nil {
+		return dstErr(err)
+	}
+
+	return nil
+}
+
+// Format "ip:port" as a PORT argument, e.g. "127,0,0,1,4,1".
+func formatPORT(addr string) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", ftpError{err: err}
+	}
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return "", ftpError{err: fmt.Errorf("PORT needs an IPv4 address, got %s", host)}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", ftpError{err: err}
+	}
+
+	return fmt.Sprintf("%s,%d,%d", strings.Replace(ip.String(), ".", ",", -1), port>>8, port&0xFF), nil
+}
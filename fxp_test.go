@@ -0,0 +1,149 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake server supporting PORT, sending "data" for any RETR.
+func newActiveServer(t *testing.T, data string) *fakeServer {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var addr string
+
+	server.handlers["PORT"] = func(fc *fakeConn, arg string) {
+		parts := strings.Split(arg, ",")
+		if len(parts) != 6 {
+			fc.reply(501, "bad PORT")
+			return
+		}
+
+		hi, _ := strconv.Atoi(parts[4])
+		lo, _ := strconv.Atoi(parts[5])
+		addr = fmt.Sprintf("%s:%d", strings.Join(parts[:4], "."), hi<<8|lo)
+		fc.reply(200, "PORT ok")
+	}
+
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		dc, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			fc.reply(425, "can't open data connection")
+			return
+		}
+
+		fc.reply(150, "here it comes")
+		dc.Write([]byte(data))
+		dc.Close()
+		fc.reply(226, "done")
+	}
+
+	return server
+}
+
+func TestTransfer(t *testing.T) {
+	srcServer := newActiveServer(t, "hello world")
+	defer srcServer.close()
+
+	dstServer, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstServer.close()
+
+	src, err := DialConfig(Config{}, srcServer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := DialConfig(Config{}, dstServer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Transfer(src, "file", dst, "copy"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(dstServer.stored["copy"]); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	// connections are reusable
+	if err := Transfer(src, "file", dst, "copy2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(dstServer.stored["copy2"]); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	// destination refuses the upload
+	dstServer.handlers["STOR"] = func(fc *fakeConn, arg string) {
+		fc.reply(553, "not allowed")
+	}
+
+	err = Transfer(src, "file", dst, "copy3")
+	if fe, ok := err.(*FXPError); !ok || fe.Side != "destination" || fe.Code() != 553 {
+		t.Errorf("got %v", err)
+	}
+
+	// source refuses to connect to a foreign address
+	srcServer.handlers["PORT"] = func(fc *fakeConn, arg string) {
+		fc.reply(500, "Illegal PORT command")
+	}
+
+	err = Transfer(src, "file", dst, "copy4")
+	if fe, ok := err.(*FXPError); !ok || fe.Side != "source" || fe.Code() != 500 {
+		t.Errorf("got %v", err)
+	}
+
+	// one client can't hold both ends with a single connection
+	single, err := DialConfig(Config{ConnectionsPerHost: 5, MaxConnections: 1}, srcServer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- Transfer(single, "file", single, "copy5") }()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "at least 2 connections") {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Transfer waited for a second connection")
+	}
+
+	tlsClient, err := DialConfig(Config{TLSConfig: &tls.Config{}}, srcServer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Transfer(tlsClient, "file", dst, "copy5"); err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestFormatPORT(t *testing.T) {
+	if got, err := formatPORT("127.0.0.1:1025"); err != nil || got != "127,0,0,1,4,1" {
+		t.Errorf("got %s, %v", got, err)
+	}
+
+	if _, err := formatPORT("[::1]:1025"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -8,10 +8,12 @@ Package goftp provides a high-level FTP client for go.
 package goftp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
-	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Dial creates an FTP client using the default config. See DialConfig for
@@ -21,23 +23,88 @@ func Dial(hosts ...string) (*Client, error) {
 }
 
 // DialConfig creates an FTP client using the given config. "hosts" is a list
-// of IP addresses or hostnames with an optional port (defaults to 21).
-// Hostnames will be expanded to all the IP addresses they resolve to. The
-// client's connection pool will pick from all the addresses in a round-robin
-// fashion. If you specify multiple hosts, they should be identical mirrors of
-// each other.
+// of IP addresses or hostnames with an optional port (defaults to 21, or 990
+// with implicit FTPS). IPv6 addresses with a port must be bracketed, e.g.
+// "[::1]:2121".
+// Hostnames are resolved when connecting, per Config.DNSPolicy (unless
+// Config.Proxy resolves them), and DialConfig checks that they resolve.
+// The client's connection pool will pick from the hosts according to
+// Config.HostStrategy, avoiding those that recently failed. If you specify
+// multiple hosts, they should be identical mirrors of each other.
+// Connections are opened as operations need them, so DialConfig only
+// resolves hostnames, and a failure to connect is returned by the first
+// operation.
 func DialConfig(config Config, hosts ...string) (*Client, error) {
-	expandedHosts, err := lookupHosts(hosts, config.IPv6Lookup)
+	return DialConfigContext(context.Background(), config, hosts...)
+}
+
+// DialConfigContext is like DialConfig, but stops resolving hostnames when
+// "ctx" is done. To bound opening connections too, use the Context variants
+// of operations (e.g. RetrieveContext): those give up on dialing, the TLS
+// handshake and logging in when their context is done, and connections
+// interrupted that way are never reused.
+func DialConfigContext(ctx context.Context, config Config, hosts ...string) (*Client, error) {
+	defaultPort := "21"
+	if config.TLSConfig != nil && config.TLSMode == TLSImplicit {
+		defaultPort = "990"
+	}
+
+	proxyResolves, err := checkProxy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.LocalAddr != "" {
+		if err := checkLocalAddr(config.LocalAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PreferIPv4 && config.PreferIPv6 {
+		return nil, errors.New("can't prefer both IPv4 and IPv6")
+	}
+
+	ipv6Lookup := config.IPv6Lookup || config.PreferIPv6
+	resolve := !proxyResolves && config.DNSPolicy == DNSPin
+
+	expandedHosts, err := lookupHosts(ctx, hosts, ipv6Lookup, defaultPort, resolve)
 	if err != nil {
 		return nil, err
 	}
 
+	// connections resolve hostnames themselves, but fail early if they
+	// can't
+	if !proxyResolves && !resolve {
+		if _, err := lookupHosts(ctx, hosts, ipv6Lookup, defaultPort, true); err != nil {
+			return nil, err
+		}
+	}
+
 	return newClient(config, expandedHosts), nil
 }
 
-var hasPort = regexp.MustCompile(`^[^:]+:\d+$|\]:\d+$`)
+// Check that we can bind to local IP address "addr" (see Config.LocalAddr).
+func checkLocalAddr(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf(`invalid local address "%s"`, addr)
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return fmt.Errorf("can't use local address %s: %s", addr, err)
+	}
+	ln.Close()
 
-func lookupHosts(hosts []string, ipv6Lookup bool) ([]string, error) {
+	return nil
+}
+
+// Resolves hostnames (replaced in tests).
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// Expand "hosts" to "ip:port" addresses, or just add the default port if not
+// "resolve".
+func lookupHosts(ctx context.Context, hosts []string, ipv6Lookup bool, defaultPort string, resolve bool) ([]string, error) {
 	if len(hosts) == 0 {
 		return nil, errors.New("must specify at least one host")
 	}
@@ -47,29 +114,34 @@ func lookupHosts(hosts []string, ipv6Lookup bool) ([]string, error) {
 		ipv6 []string
 	)
 
-	for i, host := range hosts {
-		if !hasPort.MatchString(host) {
-			host = fmt.Sprintf("[%s]:21", host)
-		}
+	for _, host := range hosts {
 		hostnameOrIP, port, err := net.SplitHostPort(host)
 		if err != nil {
-			return nil, fmt.Errorf(`invalid host "%s"`, hosts[i])
+			// no port, e.g. "example.com", "::1" or "[::1]"
+			hostnameOrIP, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), defaultPort
+		}
+
+		if portNum, err := strconv.Atoi(port); err != nil || portNum <= 0 || portNum > 65535 || hostnameOrIP == "" {
+			return nil, fmt.Errorf(`invalid host "%s"`, host)
 		}
 
 		if net.ParseIP(hostnameOrIP) != nil {
 			// is IP, add to list
-			ret = append(ret, host)
+			ret = append(ret, net.JoinHostPort(hostnameOrIP, port))
+		} else if !resolve {
+			ret = append(ret, net.JoinHostPort(hostnameOrIP, port))
 		} else {
 			// not an IP, must be hostname
-			ips, err := net.LookupIP(hostnameOrIP)
+			addrs, err := lookupIPAddr(ctx, hostnameOrIP)
 
 			// consider not returning error if other hosts in the list work
 			if err != nil {
-				return nil, fmt.Errorf(`error resolving host "%s": %s`, hostnameOrIP, err)
+				return nil, fmt.Errorf(`error resolving host "%s": %w`, hostnameOrIP, err)
 			}
 
-			for _, ip := range ips {
-				ipAndPort := fmt.Sprintf("[%s]:%s", ip.String(), port)
+			for _, addr := range addrs {
+				ip := addr.IP
+				ipAndPort := net.JoinHostPort(ip.String(), port)
 				if ip.To4() == nil && !ipv6Lookup {
 					ipv6 = append(ipv6, ipAndPort)
 				} else {
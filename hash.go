@@ -0,0 +1,419 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// ErrHashUnsupported is returned (wrapped in an Error) when the server
+// doesn't advertise the HASH command, or doesn't support the requested
+// algorithm.
+var ErrHashUnsupported = errors.New("hash unsupported")
+
+// ErrHashMismatch is matched (via errors.Is) by the *HashMismatchError
+// returned when Config.VerifyHash finds a transferred file's digest
+// doesn't match the server's.
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// HashMismatchError is returned by Retrieve and Store when Config.VerifyHash
+// is set and the digest of the bytes transferred differs from the digest
+// the server reports with HASH. It satisfies the Error interface.
+type HashMismatchError struct {
+	Path      string
+	Algorithm string
+
+	// Digest of the bytes we transferred.
+	Local []byte
+
+	// Digest reported by the server.
+	Remote []byte
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s of transferred data is %x, but server says %x", e.Path, e.Algorithm, e.Local, e.Remote)
+}
+
+func (e *HashMismatchError) Is(target error) bool {
+	return target == ErrHashMismatch
+}
+
+// Temporary is always true, since the transfer may succeed if retried.
+func (e *HashMismatchError) Temporary() bool { return true }
+func (e *HashMismatchError) Code() int       { return 0 }
+func (e *HashMismatchError) Message() string { return "" }
+
+// Algorithms we can compute locally, keyed by their HASH name.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"CRC32":   func() hash.Hash { return crc32.NewIEEE() },
+	"MD5":     md5.New,
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// Hash asks the server for the digest of file "path" using the HASH command
+// (see https://tools.ietf.org/html/draft-bryan-ftpext-hash-02). "algo" is
+// the algorithm name as the server advertises it in FEAT (e.g. "SHA-256",
+// "SHA-1" or "MD5"). If it isn't the server's currently selected
+// algorithm, it is selected with "OPTS HASH" first. An empty algo uses
+// the server's current selection. If the server doesn't support HASH or
+// the algorithm, the returned error satisfies
+// errors.Is(err, ErrHashUnsupported).
+func (c *Client) Hash(path, algo string) ([]byte, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.returnConn(pconn)
+
+	return pconn.hash(path, algo)
+}
+
+func (pconn *persistentConn) hash(path, algo string) ([]byte, error) {
+	if !pconn.hasFeature("HASH") {
+		return nil, ftpError{err: ErrHashUnsupported}
+	}
+
+	if err := pconn.selectHash(algo); err != nil {
+		return nil, err
+	}
+
+	code, msg, err := pconn.sendCommand("HASH %s", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != replyFileStatus {
+		pconn.debug("unexpected HASH response: %d-%s", code, msg)
+		return nil, ftpError{code: code, msg: msg}
+	}
+
+	// reply looks like "SHA-256 0-49 169cd22282da7f147cb491e559e9dd filename"
+	fields := strings.Fields(msg)
+	if len(fields) < 3 {
+		return nil, ftpError{err: fmt.Errorf(`failed parsing HASH response "%s"`, msg)}
+	}
+
+	if algo != "" && !strings.EqualFold(fields[0], algo) {
+		return nil, ftpError{err: fmt.Errorf("asked for %s hash, got %s", algo, fields[0])}
+	}
+
+	digest, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return nil, ftpError{err: fmt.Errorf(`failed parsing HASH digest "%s": %s`, fields[2], err)}
+	}
+
+	return digest, nil
+}
+
+// Make "algo" the server's current HASH algorithm, if it isn't already.
+func (pconn *persistentConn) selectHash(algo string) error {
+	if algo == "" {
+		return nil
+	}
+
+	// the feature looks like "SHA-1;SHA-256*;MD5", where "*" indicates
+	// the currently selected algorithm
+	var available []string
+	for _, name := range strings.Split(pconn.features["HASH"], ";") {
+		name = strings.TrimSpace(name)
+		if strings.HasSuffix(name, "*") && strings.EqualFold(strings.TrimSuffix(name, "*"), algo) {
+			return nil
+		}
+
+		if name = strings.TrimSuffix(name, "*"); name != "" {
+			available = append(available, name)
+		}
+	}
+
+	match := findFold(available, algo)
+	if match == "" {
+		return ftpError{err: fmt.Errorf("%w: server doesn't support %s", ErrHashUnsupported, algo)}
+	}
+
+	err := pconn.sendCommandExpected(replyGroupPositiveCompletion, "OPTS HASH %s", match)
+	if err != nil {
+		return err
+	}
+
+	var feature []string
+	for _, name := range available {
+		if name == match {
+			name += "*"
+		}
+		feature = append(feature, name)
+	}
+	pconn.features["HASH"] = strings.Join(feature, ";")
+
+	return nil
+}
+
+// Computes Config.VerifyHash's digest of a transfer's bytes, and compares
+// it with the server's once the transfer is done. A nil *hashCheck does
+// nothing.
+type hashCheck struct {
+	path string
+	algo string
+	h    hash.Hash
+
+	// bytes fed to h so far
+	hashed int64
+
+	// set if we skipped some bytes and can't verify anymore
+	broken bool
+}
+
+// Set up Config.VerifyHash checking for a transfer of "path" starting at
+// "offset". Returns nil if there is nothing to check.
+func (c *Client) newHashCheck(path string, offset int64) (*hashCheck, error) {
+	algo := c.config.VerifyHash
+	if algo == "" {
+		return nil, nil
+	}
+
+	newHash := hashAlgorithms[strings.ToUpper(algo)]
+	if newHash == nil {
+		return nil, ftpError{err: fmt.Errorf("unknown hash algorithm %s", algo)}
+	}
+
+	if offset > 0 || !c.config.TransferType.exact() {
+		c.debug("can't verify %s hash of %s", algo, path)
+		return nil, nil
+	}
+
+	supported, err := c.hasFeature(context.Background(), "HASH")
+	if err != nil {
+		return nil, err
+	}
+
+	if !supported {
+		return nil, ftpError{err: ErrHashUnsupported}
+	}
+
+	return &hashCheck{path: path, algo: algo, h: newHash()}, nil
+}
+
+func (hc *hashCheck) writer(w io.Writer) io.Writer {
+	if hc == nil {
+		return w
+	}
+	return hashWriter{w, hc}
+}
+
+// Wrap "r", positioned at the start of the transfer, to hash the bytes
+// read from it. "seeker" is r's Seeker, if any. Seeking through the
+// returned hashReader (e.g. to resume an upload) keeps track of the
+// position, so bytes read again aren't hashed twice.
+func (hc *hashCheck) reader(r io.Reader, seeker io.Seeker) *hashReader {
+	return &hashReader{r: r, seeker: seeker, hc: hc}
+}
+
+// Hash the bytes of "buf" starting "pos" bytes into the transfer.
+func (hc *hashCheck) add(buf []byte, pos int64) {
+	if pos > hc.hashed {
+		hc.broken = true
+		return
+	}
+
+	if skip := hc.hashed - pos; skip < int64(len(buf)) {
+		hc.h.Write(buf[skip:])
+		hc.hashed += int64(len(buf)) - skip
+	}
+}
+
+// Compare our digest with the server's.
+func (hc *hashCheck) verify(c *Client) error {
+	if hc == nil {
+		return nil
+	}
+
+	if hc.broken {
+		c.debug("can't verify %s hash of %s, transfer skipped some bytes", hc.algo, hc.path)
+		return nil
+	}
+
+	remote, err := c.Hash(hc.path, hc.algo)
+	if err != nil {
+		return err
+	}
+
+	local := hc.h.Sum(nil)
+	if !bytes.Equal(local, remote) {
+		return &HashMismatchError{
+			Path:      hc.path,
+			Algorithm: hc.algo,
+			Local:     local,
+			Remote:    remote,
+		}
+	}
+
+	return nil
+}
+
+type hashWriter struct {
+	w  io.Writer
+	hc *hashCheck
+}
+
+func (hw hashWriter) Write(buf []byte) (int, error) {
+	n, err := hw.w.Write(buf)
+	hw.hc.add(buf[:n], hw.hc.hashed)
+	return n, err
+}
+
+type hashReader struct {
+	r      io.Reader
+	seeker io.Seeker
+	hc     *hashCheck
+
+	// position in r
+	pos int64
+}
+
+func (hr *hashReader) Read(buf []byte) (int, error) {
+	n, err := hr.r.Read(buf)
+	hr.hc.add(buf[:n], hr.pos)
+	hr.pos += int64(n)
+	return n, err
+}
+
+func (hr *hashReader) Seek(offset int64, whence int) (int64, error) {
+	if hr.seeker == nil {
+		return 0, errors.New("not seekable")
+	}
+
+	pos, err := hr.seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	hr.pos = pos
+	return pos, nil
+}
+
+// ErrChecksumUnsupported is returned (wrapped in an Error) by Checksum when
+// the server doesn't support the requested checksum command.
+var ErrChecksumUnsupported = errors.New("checksum command unsupported")
+
+// ChecksumAlgo selects the legacy checksum command used by Checksum.
+type ChecksumAlgo string
+
+const (
+	// ChecksumCRC32 uses XCRC.
+	ChecksumCRC32 ChecksumAlgo = "XCRC"
+
+	// ChecksumMD5 uses XMD5.
+	ChecksumMD5 ChecksumAlgo = "XMD5"
+
+	// ChecksumSHA1 uses XSHA1.
+	ChecksumSHA1 ChecksumAlgo = "XSHA1"
+)
+
+var checksumCommands = []string{string(ChecksumCRC32), string(ChecksumMD5), string(ChecksumSHA1)}
+
+// Checksum asks the server for the checksum of file "path" using the
+// non-standard XCRC, XMD5 or XSHA1 commands supported by many older
+// (mostly Windows) servers, returning it as lowercase hex. If length is
+// positive, only the "length" bytes starting at "offset" are checksummed;
+// if just offset is positive, the rest of the file from offset is. Servers
+// that advertise checksum commands in FEAT are trusted to know which ones
+// they support; otherwise the command is tried anyway. Paths containing
+// spaces are sent in double quotes, so servers can tell them apart from
+// the offsets. If the server doesn't support the command, the returned
+// error satisfies errors.Is(err, ErrChecksumUnsupported). For servers
+// supporting the standardized HASH command, see Hash.
+func (c *Client) Checksum(path string, algo ChecksumAlgo, offset, length int64) (string, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return "", err
+	}
+
+	defer c.returnConn(pconn)
+
+	cmd := string(algo)
+	if findFold(checksumCommands, cmd) == "" {
+		return "", ftpError{err: fmt.Errorf("unknown checksum algorithm %s", algo)}
+	}
+
+	var advertised bool
+	for _, name := range checksumCommands {
+		if pconn.hasFeature(name) {
+			advertised = true
+		}
+	}
+
+	if advertised && !pconn.hasFeature(cmd) {
+		return "", ftpError{err: fmt.Errorf("%w: server doesn't advertise %s", ErrChecksumUnsupported, cmd)}
+	}
+
+	arg := path
+	if strings.ContainsAny(path, " \t") {
+		arg = `"` + path + `"`
+	}
+
+	var (
+		code int
+		msg  string
+	)
+	if length > 0 {
+		code, msg, err = pconn.sendCommand("%s %s %d %d", cmd, arg, offset, offset+length)
+	} else if offset > 0 {
+		code, msg, err = pconn.sendCommand("%s %s %d", cmd, arg, offset)
+	} else {
+		code, msg, err = pconn.sendCommand("%s %s", cmd, arg)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if commandNotSupportedReply(code) {
+		pconn.debug("server doesn't support %s: %d-%s", cmd, code, msg)
+		return "", ftpError{
+			err:  fmt.Errorf("%w: %d-%s", ErrChecksumUnsupported, code, msg),
+			code: code,
+			msg:  msg,
+		}
+	}
+
+	if code != replyFileActionOkay && code != replyFileStatus {
+		pconn.debug("unexpected %s response: %d-%s", cmd, code, msg)
+		return "", ftpError{code: code, msg: msg}
+	}
+
+	return parseChecksumReply(msg)
+}
+
+// Extract the hex checksum from a reply like "B1C3E2A4" or
+// "0xB1C3E2A4 file.txt".
+func parseChecksumReply(msg string) (string, error) {
+	fields := strings.Fields(msg)
+	if len(fields) == 0 {
+		return "", ftpError{err: errors.New("empty checksum response")}
+	}
+
+	sum := strings.ToLower(fields[0])
+	sum = strings.TrimPrefix(sum, "0x")
+
+	// CRCs may have leading zeros dropped, so don't insist on whole bytes
+	if sum == "" || strings.Trim(sum, "0123456789abcdef") != "" {
+		return "", ftpError{err: fmt.Errorf(`failed parsing checksum response "%s"`, msg)}
+	}
+
+	return sum, nil
+}
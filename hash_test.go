@@ -0,0 +1,304 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func newHashServer(t *testing.T) *fakeServer {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.features = append(server.features, "HASH SHA-1;SHA-256*;MD5")
+	server.data["RETR file"] = "hello world"
+	server.data["RETR bad"] = "hello world"
+
+	algo := "SHA-256"
+	server.handlers["OPTS"] = func(fc *fakeConn, arg string) {
+		if strings.HasPrefix(arg, "HASH ") {
+			algo = strings.TrimPrefix(arg, "HASH ")
+			fc.reply(200, algo)
+		} else {
+			fc.reply(200, "ok")
+		}
+	}
+
+	server.handlers["HASH"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		content, ok := server.data["RETR "+arg]
+		if stored, found := server.stored[arg]; found {
+			content, ok = string(stored), true
+		}
+		server.mu.Unlock()
+
+		if !ok {
+			fc.reply(550, "no such file")
+			return
+		}
+
+		if arg == "bad" {
+			content = "corrupted"
+		}
+
+		var digest []byte
+		switch algo {
+		case "SHA-256":
+			sum := sha256.Sum256([]byte(content))
+			digest = sum[:]
+		case "MD5":
+			sum := md5.Sum([]byte(content))
+			digest = sum[:]
+		}
+
+		fc.reply(213, fmt.Sprintf("%s 0-%d %x %s", algo, len(content), digest, arg))
+	}
+
+	return server
+}
+
+func TestHash(t *testing.T) {
+	server := newHashServer(t)
+	defer server.close()
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha := sha256.Sum256([]byte("hello world"))
+
+	got, err := c.Hash("file", "SHA-256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, sha[:]) {
+		t.Errorf("got %x", got)
+	}
+
+	md := md5.Sum([]byte("hello world"))
+
+	got, err = c.Hash("file", "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, md[:]) {
+		t.Errorf("got %x", got)
+	}
+
+	// MD5 is selected now
+	if _, err := c.Hash("file", "MD5"); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts []string
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "OPTS HASH") {
+			opts = append(opts, cmd)
+		}
+	}
+
+	if len(opts) != 1 || opts[0] != "OPTS HASH MD5" {
+		t.Errorf("got %v", opts)
+	}
+
+	if _, err := c.Hash("file", "SHA-512"); !errors.Is(err, ErrHashUnsupported) {
+		t.Errorf("expected ErrHashUnsupported, got %v", err)
+	}
+
+	if _, err := c.Hash("missing", ""); err == nil || err.(Error).Code() != 550 {
+		t.Errorf("expected 550, got %v", err)
+	}
+
+	// no HASH
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Hash("file", "SHA-256"); !errors.Is(err, ErrHashUnsupported) {
+		t.Errorf("expected ErrHashUnsupported, got %v", err)
+	}
+}
+
+func TestVerifyHash(t *testing.T) {
+	server := newHashServer(t)
+	defer server.close()
+
+	c, err := DialConfig(Config{VerifyHash: "SHA-256"}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	err = c.Retrieve("bad", ioutil.Discard)
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+
+	hashErr := err.(*HashMismatchError)
+	if hashErr.Path != "bad" || hashErr.Algorithm != "SHA-256" || bytes.Equal(hashErr.Local, hashErr.Remote) {
+		t.Errorf("got %+v", hashErr)
+	}
+
+	if err := c.Store("upload", strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// no HASH, so we fail before transferring
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{VerifyHash: "SHA-256"}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store("upload2", strings.NewReader("hello")); !errors.Is(err, ErrHashUnsupported) {
+		t.Errorf("expected ErrHashUnsupported, got %v", err)
+	}
+
+	if _, ok := server.stored["upload2"]; ok {
+		t.Error("shouldn't have uploaded")
+	}
+}
+
+func TestHashReader(t *testing.T) {
+	hc := &hashCheck{h: sha256.New()}
+
+	src := strings.NewReader("hello world")
+	hr := hc.reader(src, src)
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(hr, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// like resuming an upload
+	if _, err := hr.Seek(2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadAll(hr); err != nil {
+		t.Fatal(err)
+	}
+
+	want := sha256.Sum256([]byte("hello world"))
+	if got := hc.h.Sum(nil); hc.broken || !bytes.Equal(got, want[:]) {
+		t.Errorf("got %x (broken=%t)", got, hc.broken)
+	}
+
+	// skipping ahead means we can't check
+	hc = &hashCheck{h: sha256.New()}
+	src = strings.NewReader("hello world")
+	hr = hc.reader(src, src)
+	hr.Seek(2, io.SeekStart)
+	ioutil.ReadAll(hr)
+
+	if !hc.broken {
+		t.Error("expected broken")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.features = append(server.features, "XCRC", "XMD5")
+	server.replies["XCRC file"] = fakeReply{250, "0D4A1185"}
+	server.replies["XMD5 file 6 11"] = fakeReply{213, "5EB63BBBE01EEED093CB22BB8F5ACDC3 file"}
+	server.replies["XCRC file 6"] = fakeReply{250, "3A2B"}
+	server.replies[`XCRC "a file"`] = fakeReply{250, "1F"}
+	server.replies[`XCRC "a file" 6 11`] = fakeReply{250, "2F"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := c.Checksum("file", ChecksumCRC32, 0, 0)
+	if err != nil || sum != "0d4a1185" {
+		t.Errorf("got %q %v", sum, err)
+	}
+
+	sum, err = c.Checksum("file", ChecksumMD5, 6, 5)
+	if err != nil || sum != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Errorf("got %q %v", sum, err)
+	}
+
+	sum, err = c.Checksum("file", ChecksumCRC32, 6, 0)
+	if err != nil || sum != "3a2b" {
+		t.Errorf("got %q %v", sum, err)
+	}
+
+	// paths with spaces are quoted, with or without offsets
+	sum, err = c.Checksum("a file", ChecksumCRC32, 0, 0)
+	if err != nil || sum != "1f" {
+		t.Errorf("got %q %v", sum, err)
+	}
+
+	sum, err = c.Checksum("a file", ChecksumCRC32, 6, 5)
+	if err != nil || sum != "2f" {
+		t.Errorf("got %q %v", sum, err)
+	}
+
+	// not advertised, so not even tried
+	if _, err := c.Checksum("file", ChecksumSHA1, 0, 0); !errors.Is(err, ErrChecksumUnsupported) {
+		t.Errorf("expected ErrChecksumUnsupported, got %v", err)
+	}
+
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "XSHA1") {
+			t.Errorf("unexpected %s", cmd)
+		}
+	}
+
+	// nothing in FEAT, so we probe
+	server.features = []string{"SIZE", "EPSV"}
+	server.replies["XSHA1 file"] = fakeReply{250, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err = c.Checksum("file", ChecksumSHA1, 0, 0)
+	if err != nil || sum != "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed" {
+		t.Errorf("got %q %v", sum, err)
+	}
+
+	if _, err := c.Checksum("file", ChecksumMD5, 0, 0); !errors.Is(err, ErrChecksumUnsupported) {
+		t.Errorf("expected ErrChecksumUnsupported, got %v", err)
+	}
+
+	server.replies["XCRC weird"] = fakeReply{250, "not a checksum"}
+	if _, err := c.Checksum("weird", ChecksumCRC32, 0, 0); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"fmt"
+	"time"
+)
+
+// HostStrategy selects which of a Client's hosts new connections go to
+// (see Config.HostStrategy). Either way, hosts that recently failed to
+// connect are avoided until their backoff (see Config.HostBackoff) has
+// passed, unless every host with room for a connection has failed.
+type HostStrategy int
+
+const (
+	// HostRoundRobin spreads new connections over the hosts in turn.
+	HostRoundRobin HostStrategy = 0
+
+	// HostPrimary opens new connections to the first host in the list,
+	// only using the next host when it has failed or already has
+	// ConnectionsPerHost connections, and so on.
+	HostPrimary HostStrategy = 1
+)
+
+// Longest a failing host is avoided for.
+const maxHostBackoff = 5 * time.Minute
+
+// HostError is returned when connecting to one of a Client's hosts fails,
+// saying which.
+type HostError struct {
+	// "ip:port" (or "hostname:port" if Config.Proxy resolves hostnames)
+	Host string
+
+	Err error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Host, e.Err)
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HostError) Temporary() bool {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Temporary()
+	}
+	return false
+}
+
+func (e *HostError) Code() int {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Code()
+	}
+	return 0
+}
+
+func (e *HostError) Message() string {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Message()
+	}
+	return ""
+}
+
+// HostStatus describes one of a Client's hosts.
+type HostStatus struct {
+	// "ip:port" (or "hostname:port" if Config.Proxy resolves hostnames)
+	Host string
+
+	// Connections open (or being opened) to the host.
+	Open int
+
+	// Failed connection attempts since the last one that worked.
+	ConsecutiveFailures int
+
+	// When connecting last failed, and why.
+	LastFailure time.Time
+	LastError   error
+
+	// When connecting last worked.
+	LastSuccess time.Time
+
+	// Until when new connections avoid the host, if it's failing.
+	RetryAt time.Time
+}
+
+// Health of a host, guarded by Client.mu.
+type hostHealth struct {
+	failures    int
+	lastFailure time.Time
+	lastErr     error
+	lastSuccess time.Time
+
+	// a connection is being opened after the backoff passed, so others
+	// keep avoiding the host until we know how it went
+	probing bool
+}
+
+// When new connections may try the host again.
+func (h *hostHealth) retryAt(initial time.Duration) time.Time {
+	if h.failures == 0 {
+		return time.Time{}
+	}
+
+	backoff := initial
+	for i := 1; i < h.failures && backoff < maxHostBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxHostBackoff {
+		backoff = maxHostBackoff
+	}
+
+	return h.lastFailure.Add(backoff)
+}
+
+// HostStatus reports the health of each host, in the order they were
+// resolved, e.g. to see which mirror is serving traffic.
+func (c *Client) HostStatus() []HostStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]HostStatus, len(c.hosts))
+	for i, host := range c.hosts {
+		statuses[i] = HostStatus{
+			Host: host,
+			Open: c.numConnsPerHost[host],
+		}
+
+		if h := c.hostHealth[host]; h != nil {
+			statuses[i].ConsecutiveFailures = h.failures
+			statuses[i].LastFailure = h.lastFailure
+			statuses[i].LastError = h.lastErr
+			statuses[i].LastSuccess = h.lastSuccess
+			statuses[i].RetryAt = h.retryAt(c.config.HostBackoff)
+		}
+	}
+
+	return statuses
+}
+
+// Pick a host with room for another connection, starting from the
+// "idx"th host for HostRoundRobin, and skipping hosts in "tried". Hosts
+// whose backoff hasn't passed are only picked if there's nothing else and
+// "fallback" is set, soonest to retry first. Returns "" if every host is
+// full, tried or (without "fallback") backing off. Must hold c.mu.
+func (c *Client) pickHost(idx int, tried map[string]bool, fallback bool) string {
+	now := time.Now()
+
+	var (
+		backingOff string
+		soonest    time.Time
+	)
+
+	for i := 0; i < len(c.hosts); i++ {
+		host := c.hosts[(idx+i)%len(c.hosts)]
+		if c.config.HostStrategy == HostPrimary {
+			host = c.hosts[i]
+		}
+
+		if tried[host] || c.numConnsPerHost[host] >= c.config.ConnectionsPerHost {
+			continue
+		}
+
+		h := c.hostHealth[host]
+		if h == nil {
+			return host
+		}
+
+		retryAt := h.retryAt(c.config.HostBackoff)
+		if !h.probing && !retryAt.After(now) {
+			if h.failures > 0 {
+				h.probing = true
+			}
+			return host
+		}
+
+		if fallback && (backingOff == "" || retryAt.Before(soonest)) {
+			backingOff, soonest = host, retryAt
+		}
+	}
+
+	return backingOff
+}
+
+// When the soonest failing host's backoff passes, or the zero time if no
+// host is backing off.
+func (c *Client) nextRetry() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	var soonest time.Time
+	for _, h := range c.hostHealth {
+		retryAt := h.retryAt(c.config.HostBackoff)
+		if retryAt.After(now) && (soonest.IsZero() || retryAt.Before(soonest)) {
+			soonest = retryAt
+		}
+	}
+
+	return soonest
+}
+
+// Stop probing "host" without learning whether it works, e.g. because the
+// operation was canceled.
+func (c *Client) endProbe(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h := c.hostHealth[host]; h != nil {
+		h.probing = false
+	}
+}
+
+// Record whether connecting to "host" worked.
+func (c *Client) recordHostResult(host string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := c.hostHealth[host]
+	if h == nil {
+		h = &hostHealth{}
+		c.hostHealth[host] = h
+	}
+
+	h.probing = false
+
+	if err == nil {
+		h.failures = 0
+		h.lastSuccess = time.Now()
+		return
+	}
+
+	h.failures++
+	h.lastFailure = time.Now()
+	h.lastErr = err
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostFailover(t *testing.T) {
+	live, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.close()
+
+	// nothing listens here
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	config := Config{
+		HostStrategy:       HostPrimary,
+		HostBackoff:        100 * time.Millisecond,
+		ConnectionsPerHost: 2,
+	}
+
+	c, err := DialConfig(config, down, live.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the primary is down, so we fail over
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	status := c.HostStatus()
+	if status[0].ConsecutiveFailures != 1 || status[0].LastError == nil || !status[0].RetryAt.After(time.Now()) {
+		t.Errorf("got %+v", status[0])
+	}
+
+	if status[1].Open != 1 || status[1].LastSuccess.IsZero() {
+		t.Errorf("got %+v", status[1])
+	}
+
+	// during its backoff, the primary is left alone
+	first, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.host != live.addr() || c.HostStatus()[0].ConsecutiveFailures != 1 {
+		t.Errorf("got %s, %+v", second.host, c.HostStatus()[0])
+	}
+
+	// after it, the primary is tried again, and its backoff doubles
+	time.Sleep(150 * time.Millisecond)
+
+	_, err = c.getIdleConn()
+
+	var hostErr *HostError
+	if !errors.As(err, &hostErr) || hostErr.Host != down {
+		t.Errorf("got %v", err)
+	}
+
+	status = c.HostStatus()
+	if status[0].ConsecutiveFailures != 2 || status[0].RetryAt.Sub(status[0].LastFailure) != 200*time.Millisecond {
+		t.Errorf("got %+v", status[0])
+	}
+
+	c.returnConn(first)
+	c.returnConn(second)
+
+	// the primary comes back
+	time.Sleep(250 * time.Millisecond)
+
+	primary, err := newFakeServerOn(down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.close()
+
+	first, _ = c.getIdleConn()
+	second, _ = c.getIdleConn()
+
+	third, err := c.getIdleConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.host != down {
+		t.Errorf("got %s", third.host)
+	}
+
+	c.returnConn(first)
+	c.returnConn(second)
+	c.returnConn(third)
+
+	status = c.HostStatus()
+	if status[0].ConsecutiveFailures != 0 || status[0].Open != 1 || !status[0].RetryAt.IsZero() {
+		t.Errorf("got %+v", status[0])
+	}
+}
@@ -0,0 +1,821 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LIST output is meant for humans, not machines, so there is no standard
+// format. These parsers are used when the server doesn't support MLSD, and
+// try to make sense of the most common formats.
+
+var listMonths = map[string]time.Month{
+	"jan": time.January,
+	"feb": time.February,
+	"mar": time.March,
+	"apr": time.April,
+	"may": time.May,
+	"jun": time.June,
+	"jul": time.July,
+	"aug": time.August,
+	"sep": time.September,
+	"oct": time.October,
+	"nov": time.November,
+	"dec": time.December,
+}
+
+// Dates in LIST entries without a year may be this far in the future
+// before we assume they're from last year, to allow for clock skew.
+const defaultListFutureTolerance = 24 * time.Hour
+
+// How to interpret LIST timestamps, which don't include a time zone and
+// may not include a year.
+type listTimes struct {
+	now time.Time
+	loc *time.Location
+
+	// dates without a year that would be more than this far in the future
+	// are assumed to be from the previous year
+	futureTolerance time.Duration
+}
+
+// ParseListLine parses a single line of LIST output the same way ReadDir
+// does for servers that don't support MLSD. UNIX ("ls -l"), DOS, EPLF and
+// VMS style entries are recognized. Timestamps are interpreted in "loc"
+// (UTC if nil), and dates without a year are assumed to be from the past
+// year. Returns a nil os.FileInfo and no error for lines that aren't
+// entries, such as "total 248", for server replies that don't parse as
+// entries, and for "." and "..". ParseListLine doesn't need a Client and is
+// safe for concurrent use.
+func ParseListLine(line string, loc *time.Location) (os.FileInfo, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	if isListNoise(line) {
+		return nil, nil
+	}
+
+	info, err := parseLIST(line, listTimes{
+		now:             time.Now(),
+		loc:             loc,
+		futureTolerance: defaultListFutureTolerance,
+	})
+	if err != nil && isListReply(line) {
+		return nil, nil
+	}
+
+	return info, err
+}
+
+// Parse a single line of LIST output. Returns a nil os.FileInfo (and no
+// error) for entries that should be skipped, such as "." and "..".
+func parseLIST(entry string, times listTimes) (os.FileInfo, error) {
+	var (
+		info *ftpFile
+		err  error
+	)
+
+	if strings.HasPrefix(entry, "+") {
+		info, err = parseEPLF(entry)
+	} else if isVMSLIST(entry) {
+		info, err = parseVMSLIST(entry, times.loc)
+	} else if isDOSLIST(entry) {
+		info, err = parseDOSLIST(entry, times.loc)
+	} else {
+		info, err = parseUnixLIST(entry, times)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.name == "." || info.name == ".." {
+		return nil, nil
+	}
+
+	return info, nil
+}
+
+var (
+	listTotalLine = regexp.MustCompile(`(?i)^total\s+\d+$`)
+	listReplyLine = regexp.MustCompile(`^[1-5]\d\d[- ]`)
+)
+
+// Whether a line of LIST output is something other than an entry, such as
+// "total 248" or a blank line.
+func isListNoise(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || listTotalLine.MatchString(line)
+}
+
+// Whether a line of LIST output looks like a server reply (e.g. "226-Quota:
+// 10% used") that ended up in the listing. Some entries look like this too,
+// so it should only be trusted at the edges of a listing.
+func isListReply(line string) bool {
+	return listReplyLine.MatchString(line)
+}
+
+// Split LIST output into leading server replies and noise, the entries, and
+// trailing server replies and noise. Reply-looking lines in the middle of the
+// listing are left alone since they could be real entries.
+func trimListReplies(lines []string) (head, entries, tail []string) {
+	skip := func(line string) bool {
+		return isListNoise(line) || isListReply(line)
+	}
+
+	start := 0
+	for start < len(lines) && skip(lines[start]) {
+		start++
+	}
+
+	end := len(lines)
+	for end > start && skip(lines[end-1]) {
+		end--
+	}
+
+	return lines[:start], lines[start:end], lines[end:]
+}
+
+// a whitespace separated field in a LIST entry, along with where it started
+type listField struct {
+	text  string
+	start int
+}
+
+func splitListFields(entry string) []listField {
+	var (
+		fields []listField
+		start  = -1
+	)
+
+	for i, c := range entry {
+		if c == ' ' || c == '\t' {
+			if start != -1 {
+				fields = append(fields, listField{entry[start:i], start})
+				start = -1
+			}
+		} else if start == -1 {
+			start = i
+		}
+	}
+
+	if start != -1 {
+		fields = append(fields, listField{entry[start:], start})
+	}
+
+	return fields
+}
+
+// a UNIX "ls -l" style entry looks something like this:
+// -rw-r--r--   1 owner    group        1234 Feb 16 08:41 lorem.txt
+// The link count and group columns aren't always present, and device
+// files have "major, minor" in place of the size.
+func parseUnixLIST(entry string, times listTimes) (*ftpFile, error) {
+	parseError := ftpError{err: fmt.Errorf(`failed parsing LIST entry: %s`, entry)}
+
+	fields := splitListFields(entry)
+	if len(fields) < 6 {
+		return nil, parseError
+	}
+
+	mode, ok := parseUnixMode(fields[0].text)
+	if !ok {
+		return nil, parseError
+	}
+
+	// the number of columns before the date varies, so look for something
+	// that looks like a date and work outwards from there
+	dateIdx := -1
+	for i := 2; i+3 < len(fields); i++ {
+		if _, found := listMonths[strings.ToLower(fields[i].text)]; !found {
+			continue
+		}
+
+		if day, err := strconv.Atoi(fields[i+1].text); err != nil || day < 1 || day > 31 {
+			continue
+		}
+
+		dateIdx = i
+		break
+	}
+
+	if dateIdx == -1 {
+		return nil, parseError
+	}
+
+	var size int64
+	sizeIdx := dateIdx - 1
+	if mode&os.ModeDevice == 0 {
+		var err error
+		size, err = strconv.ParseInt(fields[sizeIdx].text, 10, 64)
+		if err != nil {
+			return nil, parseError
+		}
+	} else if strings.HasSuffix(fields[sizeIdx-1].text, ",") {
+		// "major, minor"
+		sizeIdx--
+	}
+
+	// what's left between the mode and size is the link count, owner and
+	// group, though not all servers send all of them
+	var owner, group string
+	ownerFields := fields[1:sizeIdx]
+	if len(ownerFields) > 0 {
+		if _, err := strconv.Atoi(ownerFields[0].text); err == nil && len(ownerFields) > 1 {
+			ownerFields = ownerFields[1:]
+		}
+	}
+
+	if len(ownerFields) > 0 {
+		owner = ownerFields[0].text
+	}
+
+	if len(ownerFields) > 1 {
+		group = ownerFields[1].text
+	}
+
+	mtime, err := parseListTime(
+		listMonths[strings.ToLower(fields[dateIdx].text)],
+		fields[dateIdx+1].text,
+		fields[dateIdx+2].text,
+		times,
+	)
+	if err != nil {
+		return nil, parseError
+	}
+
+	var linkTarget string
+	name := entry[fields[dateIdx+3].start:]
+	if mode&os.ModeSymlink != 0 {
+		if arrow := strings.Index(name, " -> "); arrow != -1 {
+			name, linkTarget = name[:arrow], name[arrow+4:]
+		}
+	}
+
+	return &ftpFile{
+		name:  name,
+		size:  size,
+		mode:  mode,
+		mtime: mtime,
+		raw:   entry,
+		owner: owner,
+		group: group,
+
+		linkTarget: linkTarget,
+	}, nil
+}
+
+// Parse a mode string like "drwxr-sr-x". Some servers append an extra
+// character to indicate ACLs or extended attributes, which is ignored.
+func parseUnixMode(s string) (os.FileMode, bool) {
+	if len(s) < 10 {
+		return 0, false
+	}
+
+	var mode os.FileMode
+	switch s[0] {
+	case '-':
+	case 'd':
+		mode |= os.ModeDir
+	case 'l':
+		mode |= os.ModeSymlink
+	case 'b':
+		mode |= os.ModeDevice
+	case 'c':
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 'p':
+		mode |= os.ModeNamedPipe
+	case 's':
+		mode |= os.ModeSocket
+	default:
+		return 0, false
+	}
+
+	for i, c := range s[1:10] {
+		// which of user/group/other, and which of read/write/execute
+		who, what := uint(2-i/3), uint(2-i%3)
+		bit := os.FileMode(1) << (who*3 + what)
+
+		switch {
+		case c == '-':
+		case what == 2 && c == 'r', what == 1 && c == 'w', what == 0 && c == 'x':
+			mode |= bit
+		case what == 0 && (c == 's' || c == 'S') && who == 2:
+			mode |= os.ModeSetuid
+		case what == 0 && (c == 's' || c == 'S') && who == 1:
+			mode |= os.ModeSetgid
+		case what == 0 && (c == 't' || c == 'T') && who == 0:
+			mode |= os.ModeSticky
+		default:
+			return 0, false
+		}
+
+		// lowercase special bits mean the execute bit is also set
+		if c == 's' || c == 't' {
+			mode |= bit
+		}
+	}
+
+	return mode, true
+}
+
+// Parse the date columns of a LIST entry. Recent entries have a time but no
+// year ("Feb 16 08:41"), and older entries have a year but no time
+// ("Feb 16 2014"). When there is no year, assume the entry is from the
+// past year, allowing for it to be up to times.futureTolerance in the
+// future.
+func parseListTime(month time.Month, dayStr, timeOrYear string, times listTimes) (time.Time, error) {
+	loc := times.loc
+
+	day, err := strconv.Atoi(dayStr)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	colon := strings.Index(timeOrYear, ":")
+	if colon == -1 {
+		year, err := strconv.Atoi(timeOrYear)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), nil
+	}
+
+	hour, err := strconv.Atoi(timeOrYear[:colon])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	minute, err := strconv.Atoi(timeOrYear[colon+1:])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := times.now.In(loc)
+
+	// use the latest year that doesn't put the date too far in the future,
+	// which may be next year if the server's clock is ahead of ours
+	year := now.Year() + 1
+	t := time.Date(year, month, day, hour, minute, 0, 0, loc)
+	for t.After(now.Add(times.futureTolerance)) {
+		year--
+		t = time.Date(year, month, day, hour, minute, 0, 0, loc)
+	}
+
+	return t, nil
+}
+
+// DOS style entries start with the date, e.g. "02-16-15".
+func isDOSLIST(entry string) bool {
+	return len(entry) >= 8 &&
+		isDigit(entry[0]) && isDigit(entry[1]) &&
+		(entry[2] == '-' || entry[2] == '/')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// a DOS/IIS style entry looks something like this:
+// 02-16-15  08:41AM       <DIR>          wwwroot
+// 02-16-15  08:41AM             12345 readme.txt
+// Some servers use a 24 hour clock and/or four digit years instead.
+func parseDOSLIST(entry string, loc *time.Location) (*ftpFile, error) {
+	parseError := ftpError{err: fmt.Errorf(`failed parsing LIST entry: %s`, entry)}
+
+	fields := splitListFields(entry)
+	if len(fields) < 4 {
+		return nil, parseError
+	}
+
+	dateParts := strings.FieldsFunc(fields[0].text, func(r rune) bool {
+		return r == '-' || r == '/'
+	})
+	if len(dateParts) != 3 {
+		return nil, parseError
+	}
+
+	var dateNums [3]int
+	for i, part := range dateParts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, parseError
+		}
+		dateNums[i] = num
+	}
+
+	month, day, year := dateNums[0], dateNums[1], dateNums[2]
+	if len(dateParts[2]) == 2 {
+		// same pivot as strptime's %y
+		if year < 69 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return nil, parseError
+	}
+
+	timeStr := strings.ToUpper(fields[1].text)
+	nextField := 2
+
+	// tolerate a space between the time and AM/PM
+	if fields[2].text == "AM" || fields[2].text == "PM" {
+		timeStr += fields[2].text
+		nextField++
+	}
+
+	if len(fields) < nextField+2 {
+		return nil, parseError
+	}
+
+	var pm, twelveHour bool
+	if strings.HasSuffix(timeStr, "AM") || strings.HasSuffix(timeStr, "PM") {
+		pm = strings.HasSuffix(timeStr, "PM")
+		twelveHour = true
+		timeStr = timeStr[:len(timeStr)-2]
+	}
+
+	timeParts := strings.Split(timeStr, ":")
+	if len(timeParts) != 2 {
+		return nil, parseError
+	}
+
+	hour, err := strconv.Atoi(timeParts[0])
+	if err != nil || hour > 23 {
+		return nil, parseError
+	}
+
+	minute, err := strconv.Atoi(timeParts[1])
+	if err != nil || minute > 59 {
+		return nil, parseError
+	}
+
+	if twelveHour {
+		if hour < 1 || hour > 12 {
+			return nil, parseError
+		}
+
+		if hour == 12 {
+			hour = 0
+		}
+
+		if pm {
+			hour += 12
+		}
+	}
+
+	var (
+		size int64
+		mode os.FileMode = 0400
+	)
+
+	if sizeOrDir := fields[nextField].text; strings.ToUpper(sizeOrDir) == "<DIR>" {
+		mode |= os.ModeDir
+	} else {
+		size, err = strconv.ParseInt(strings.Replace(sizeOrDir, ",", "", -1), 10, 64)
+		if err != nil {
+			return nil, parseError
+		}
+	}
+
+	return &ftpFile{
+		name:  entry[fields[nextField+1].start:],
+		size:  size,
+		mode:  mode,
+		mtime: time.Date(year, time.Month(month), day, hour, minute, 0, 0, loc),
+		raw:   entry,
+	}, nil
+}
+
+// an EPLF (http://cr.yp.to/ftp/list/eplf.html) entry looks like this:
+// +i8388621.29609,m824255902,/,\tdirname
+// Facts we don't know about are ignored.
+func parseEPLF(entry string) (*ftpFile, error) {
+	parseError := ftpError{err: fmt.Errorf(`failed parsing EPLF entry: %s`, entry)}
+
+	tab := strings.Index(entry, "\t")
+	if tab == -1 || tab == len(entry)-1 {
+		return nil, parseError
+	}
+
+	var (
+		size      int64
+		mode      os.FileMode
+		mtime     time.Time
+		unixPerms = -1
+	)
+
+	for _, fact := range strings.Split(entry[1:tab], ",") {
+		if fact == "" {
+			continue
+		}
+
+		switch fact[0] {
+		case '/':
+			// CWD might be successful
+			mode |= os.ModeDir | 0500
+		case 'r':
+			// RETR might be successful
+			mode |= 0400
+		case 's':
+			var err error
+			size, err = strconv.ParseInt(fact[1:], 10, 64)
+			if err != nil {
+				return nil, parseError
+			}
+		case 'm':
+			secs, err := strconv.ParseInt(fact[1:], 10, 64)
+			if err != nil {
+				return nil, parseError
+			}
+			mtime = time.Unix(secs, 0).UTC()
+		case 'u':
+			// "up" followed by octal UNIX permissions
+			if strings.HasPrefix(fact, "up") {
+				perms, err := strconv.ParseInt(fact[2:], 8, 32)
+				if err != nil {
+					return nil, parseError
+				}
+				unixPerms = int(perms)
+			}
+		}
+	}
+
+	if unixPerms != -1 {
+		mode = mode&os.ModeType | os.FileMode(unixPerms)&os.ModePerm
+	}
+
+	return &ftpFile{
+		name:  entry[tab+1:],
+		size:  size,
+		mode:  mode,
+		mtime: mtime,
+		raw:   entry,
+	}, nil
+}
+
+// Approximate capacity of a 3390 track in bytes, used to turn the "Used"
+// column (in tracks) of MVS dataset listings into a size.
+const mvsBytesPerTrack = 56664
+
+// MVS listings have a header line that determines the layout of the
+// following entries, so the parser must see the entries in order.
+type mvsListParser struct {
+	times listTimes
+
+	// set once we've seen a header
+	datasets bool
+	members  bool
+
+	// where the dataset columns are, from the header
+	columns mvsDatasetColumns
+}
+
+// Positions of the dataset columns we use, counted from the end of the
+// line since leading columns (e.g. "MIGRAT") may be blank. -1 if the header
+// doesn't have the column.
+type mvsDatasetColumns struct {
+	referred int
+	used     int
+	dsorg    int
+}
+
+// Find the dataset columns in header "fields".
+func mvsColumns(fields []listField) mvsDatasetColumns {
+	cols := mvsDatasetColumns{referred: -1, used: -1, dsorg: -1}
+
+	for i, field := range fields {
+		fromEnd := len(fields) - 1 - i
+		switch strings.ToUpper(field.text) {
+		case "REFERRED", "REFDATE":
+			cols.referred = fromEnd
+		case "USED":
+			cols.used = fromEnd
+		case "DSORG":
+			cols.dsorg = fromEnd
+		}
+	}
+
+	return cols
+}
+
+// Parse a single line of MVS LIST output. Dataset listings look like this:
+//
+//	Volume Unit    Referred Ext Used Recfm Lrecl BlkSz Dsorg Dsname
+//	WYOSPT 3390   2015/02/16  1   15  FB      80  3120  PO  PDS.LIB
+//	WYOSPT 3390   2015/02/16  1    2  FB      80 27920  PS  SEQ.DATA
+//	Migrated                                                ARCHIVED.DATA
+//
+// though some servers have other columns (e.g. "MIGRAT VOLSER UNIT REFDATE
+// ..."), so the header is recognized by its trailing Dsorg and Dsname, and
+// the columns are found from it. PDS member listings look like this:
+//
+//	Name      VV.MM   Created       Changed      Size  Init   Mod   Id
+//	MEMBER1    01.03 2015/02/12 2015/02/16 08:41    80    55     0 USER
+//
+// If no header has been seen (e.g. z/OS listing a UNIX directory), the
+// entry is parsed like any other LIST entry.
+func (p *mvsListParser) parse(entry string) (os.FileInfo, error) {
+	fields := splitListFields(entry)
+	if len(fields) == 0 {
+		return nil, ftpError{err: fmt.Errorf(`failed parsing MVS entry: %s`, entry)}
+	}
+
+	first := strings.ToUpper(fields[0].text)
+	last := strings.ToUpper(fields[len(fields)-1].text)
+
+	switch {
+	case len(fields) > 1 && strings.ToUpper(fields[len(fields)-2].text) == "DSORG" && last == "DSNAME":
+		p.datasets, p.members = true, false
+		p.columns = mvsColumns(fields)
+		return nil, nil
+	case first == "NAME" && len(fields) > 1:
+		p.datasets, p.members = false, true
+		return nil, nil
+	case p.datasets:
+		return parseMVSDataset(entry, fields, p.columns, p.times.loc), nil
+	case p.members:
+		return parseMVSMember(entry, fields, p.times.loc), nil
+	default:
+		return parseLIST(entry, p.times)
+	}
+}
+
+// Parse an MVS dataset entry with the header's columns. Datasets that
+// aren't on disk (migrated, archived, etc.) have fewer columns, in which
+// case we only know the name.
+func parseMVSDataset(entry string, fields []listField, cols mvsDatasetColumns, loc *time.Location) *ftpFile {
+	info := &ftpFile{
+		name: fields[len(fields)-1].text,
+		mode: 0400,
+		raw:  entry,
+	}
+
+	for _, col := range []int{cols.referred, cols.used, cols.dsorg} {
+		if col >= len(fields)-1 {
+			return info
+		}
+	}
+
+	column := func(fromEnd int) string {
+		if fromEnd < 0 {
+			return ""
+		}
+		return fields[len(fields)-1-fromEnd].text
+	}
+
+	// "Referred" is the last reference date, the closest thing to an mtime
+	if t, err := time.ParseInLocation("2006/01/02", column(cols.referred), loc); err == nil {
+		info.mtime = t
+	}
+
+	if tracks, err := strconv.ParseInt(column(cols.used), 10, 64); err == nil {
+		info.size = tracks * mvsBytesPerTrack
+	}
+
+	// partitioned datasets contain members, so treat them like directories
+	if strings.HasPrefix(strings.ToUpper(column(cols.dsorg)), "PO") {
+		info.mode |= os.ModeDir
+	}
+
+	return info
+}
+
+// Parse a PDS member entry. Members without ISPF statistics only have a
+// name.
+func parseMVSMember(entry string, fields []listField, loc *time.Location) *ftpFile {
+	info := &ftpFile{
+		name: fields[0].text,
+		mode: 0400,
+		raw:  entry,
+	}
+
+	if len(fields) >= 5 {
+		changed := fields[3].text + " " + fields[4].text
+		if t, err := time.ParseInLocation("2006/01/02 15:04", changed, loc); err == nil {
+			info.mtime = t
+		}
+	}
+
+	return info
+}
+
+// VMS file names have a version suffix, e.g. "LOGIN.COM;3"
+var vmsName = regexp.MustCompile(`^[^\s;]+;\d+$`)
+
+func isVMSLIST(entry string) bool {
+	fields := splitListFields(entry)
+	return len(fields) > 0 && fields[0].start == 0 && vmsName.MatchString(fields[0].text)
+}
+
+// VMS servers wrap entries with long names onto a second line, so a line
+// with only a name is joined with the following (indented) line.
+func joinVMSLines(entries []string) []string {
+	var ret []string
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+
+		fields := splitListFields(entry)
+		if len(fields) == 1 && isVMSLIST(entry) && i+1 < len(entries) {
+			next := entries[i+1]
+			if next != "" && (next[0] == ' ' || next[0] == '\t') {
+				entry = strings.TrimRight(entry, " \t") + " " + strings.TrimLeft(next, " \t")
+				i++
+			}
+		}
+
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// a VMS entry looks something like this:
+// LOGIN.COM;3   1  16-FEB-2015 08:41:48  [GROUP,USER]  (RWED,RWED,RE,)
+// The size is in 512 byte blocks, optionally followed by "/<allocated>".
+func parseVMSLIST(entry string, loc *time.Location) (*ftpFile, error) {
+	parseError := ftpError{err: fmt.Errorf(`failed parsing VMS entry: %s`, entry)}
+
+	fields := splitListFields(entry)
+	if len(fields) < 4 {
+		return nil, parseError
+	}
+
+	name := fields[0].text
+	name = name[:strings.LastIndex(name, ";")]
+
+	var mode os.FileMode
+	if strings.HasSuffix(strings.ToUpper(name), ".DIR") {
+		mode |= os.ModeDir
+	}
+
+	blocks := fields[1].text
+	if slash := strings.Index(blocks, "/"); slash != -1 {
+		blocks = blocks[:slash]
+	}
+
+	numBlocks, err := strconv.ParseInt(blocks, 10, 64)
+	if err != nil {
+		return nil, parseError
+	}
+
+	dateTime := fields[2].text + " " + fields[3].text
+	mtime, err := time.ParseInLocation("2-Jan-2006 15:04:05", dateTime, loc)
+	if err != nil {
+		mtime, err = time.ParseInLocation("2-Jan-2006 15:04", dateTime, loc)
+		if err != nil {
+			return nil, parseError
+		}
+	}
+
+	// protection is "(system,owner,group,world)"
+	var foundPerms bool
+	for _, field := range fields[4:] {
+		if !strings.HasPrefix(field.text, "(") || !strings.HasSuffix(field.text, ")") {
+			continue
+		}
+
+		classes := strings.Split(field.text[1:len(field.text)-1], ",")
+		if len(classes) != 4 {
+			continue
+		}
+
+		for i, perms := range classes[1:] {
+			shift := uint(2-i) * 3
+			for _, c := range perms {
+				switch c {
+				case 'R':
+					mode |= 04 << shift
+				case 'W':
+					mode |= 02 << shift
+				case 'E':
+					mode |= 01 << shift
+				}
+			}
+		}
+		foundPerms = true
+	}
+
+	if !foundPerms {
+		mode |= 0400
+	}
+
+	return &ftpFile{
+		name:  name,
+		size:  numBlocks * 512,
+		mode:  mode,
+		mtime: mtime,
+		raw:   entry,
+	}, nil
+}
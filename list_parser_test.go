@@ -0,0 +1,630 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the defaults the Client uses
+func testListTimes(now time.Time) listTimes {
+	return listTimes{now: now, loc: time.UTC, futureTolerance: defaultListFutureTolerance}
+}
+
+func TestParseUnixLIST(t *testing.T) {
+	now := time.Date(2015, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		raw string
+		exp *ftpFile
+	}{
+		{
+			"-rw-r--r-- 1 owner group 1234 Feb 16 08:41 lorem.txt",
+			&ftpFile{
+				name:  "lorem.txt",
+				size:  1234,
+				mode:  0644,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+				owner: "owner",
+				group: "group",
+			},
+		},
+		{
+			// date in the "future" is from last year
+			"-rw-r--r-- 1 owner group 1234 Dec 24 08:41 lorem.txt",
+			&ftpFile{
+				name:  "lorem.txt",
+				size:  1234,
+				mode:  0644,
+				mtime: time.Date(2014, time.December, 24, 8, 41, 0, 0, time.UTC),
+				owner: "owner",
+				group: "group",
+			},
+		},
+		{
+			// old files have a year instead of a time
+			"drwxr-sr-x   12 owner    group        4096 Jun  3  2009 some dir",
+			&ftpFile{
+				name:  "some dir",
+				size:  4096,
+				mode:  0755 | os.ModeDir | os.ModeSetgid,
+				mtime: time.Date(2009, time.June, 3, 0, 0, 0, 0, time.UTC),
+				owner: "owner",
+				group: "group",
+			},
+		},
+		{
+			// no group column
+			"-rw-------   1 owner        12 Feb 16 08:41 lorem.txt",
+			&ftpFile{
+				name:  "lorem.txt",
+				size:  12,
+				mode:  0600,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+				owner: "owner",
+			},
+		},
+		{
+			"lrwxrwxrwx 1 owner group 7 Feb 16 08:41 link -> lorem.txt",
+			&ftpFile{
+				name:  "link",
+				size:  7,
+				mode:  0777 | os.ModeSymlink,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+				owner: "owner",
+				group: "group",
+
+				linkTarget: "lorem.txt",
+			},
+		},
+		{
+			"crw-rw-rw- 1 root root 1, 3 Feb 16 08:41 null",
+			&ftpFile{
+				name:  "null",
+				mode:  0666 | os.ModeDevice | os.ModeCharDevice,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+				owner: "root",
+				group: "root",
+			},
+		},
+		{
+			"drwxrwxrwt+ 2 owner group 4096 Feb 16 08:41 tmp",
+			&ftpFile{
+				name:  "tmp",
+				size:  4096,
+				mode:  0777 | os.ModeDir | os.ModeSticky,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+				owner: "owner",
+				group: "group",
+			},
+		},
+		{
+			// multiple spaces in filename
+			"-rw-r--r-- 1 owner group 0 Feb 16 08:41 a  b   c",
+			&ftpFile{
+				name:  "a  b   c",
+				mode:  0644,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+				owner: "owner",
+				group: "group",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c.exp.raw = c.raw
+
+		got, err := parseLIST(c.raw, testListTimes(now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFile := got.(*ftpFile)
+		if !reflect.DeepEqual(gotFile, c.exp) {
+			t.Errorf("exp %+v\n got %+v", c.exp, gotFile)
+		}
+	}
+}
+
+func TestParseListTimeYearRollover(t *testing.T) {
+	newYears := time.Date(2016, time.January, 1, 0, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		raw       string
+		now       time.Time
+		tolerance time.Duration
+		exp       time.Time
+	}{
+		// late December seen just after new year is last year
+		{"Dec 31 23:50", newYears, 24 * time.Hour, time.Date(2015, time.December, 31, 23, 50, 0, 0, time.UTC)},
+		{"Dec 20 10:00", newYears, 24 * time.Hour, time.Date(2015, time.December, 20, 10, 0, 0, 0, time.UTC)},
+		// early January seen just before new year (server clock ahead)
+		{"Jan  1 00:10", newYears.Add(-time.Hour), 24 * time.Hour, time.Date(2016, time.January, 1, 0, 10, 0, 0, time.UTC)},
+		// ...unless the tolerance doesn't allow it
+		{"Jan  1 00:10", newYears.Add(-time.Hour), 30 * time.Minute, time.Date(2015, time.January, 1, 0, 10, 0, 0, time.UTC)},
+		// larger tolerance keeps dates in the current year
+		{"Jan 10 12:00", newYears, 10 * 24 * time.Hour, time.Date(2016, time.January, 10, 12, 0, 0, 0, time.UTC)},
+		{"Jan 10 12:00", newYears, 24 * time.Hour, time.Date(2015, time.January, 10, 12, 0, 0, 0, time.UTC)},
+		// explicit year is used as is
+		{"Dec 31  2015", newYears, 24 * time.Hour, time.Date(2015, time.December, 31, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		times := listTimes{now: c.now, loc: time.UTC, futureTolerance: c.tolerance}
+		info, err := parseLIST("-rw-r--r-- 1 owner group 0 "+c.raw+" file", times)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.ModTime().Equal(c.exp) {
+			t.Errorf("%s (now=%s, tolerance=%s): expected %s, got %s", c.raw, c.now, c.tolerance, c.exp, info.ModTime())
+		}
+	}
+}
+
+func TestParseListTimeLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+10", 10*60*60)
+
+	// it's already January 1st at the server, but not in UTC
+	now := time.Date(2015, time.December, 31, 20, 0, 0, 0, time.UTC)
+
+	times := listTimes{now: now, loc: loc, futureTolerance: 24 * time.Hour}
+	info, err := parseLIST("-rw-r--r-- 1 owner group 0 Jan  1 05:00 file", times)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Date(2015, time.December, 31, 19, 0, 0, 0, time.UTC)
+	if !info.ModTime().Equal(exp) {
+		t.Errorf("expected %s, got %s", exp, info.ModTime().UTC())
+	}
+
+	// DOS entries are in the server's zone too
+	info, err = parseLIST("02-16-15  08:41AM                 12 lorem.txt", times)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp = time.Date(2015, time.February, 15, 22, 41, 0, 0, time.UTC)
+	if !info.ModTime().Equal(exp) {
+		t.Errorf("expected %s, got %s", exp, info.ModTime().UTC())
+	}
+}
+
+func TestParseLISTSkipsSelfParent(t *testing.T) {
+	for _, raw := range []string{
+		"drwxr-xr-x 2 owner group 4096 Feb 16 08:41 .",
+		"drwxr-xr-x 2 owner group 4096 Feb 16 08:41 ..",
+	} {
+		info, err := parseLIST(raw, testListTimes(time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info != nil {
+			t.Errorf("expected %s to be skipped", raw)
+		}
+	}
+}
+
+func TestParseLISTInvalid(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"hello there",
+		"-rw-r--r-- 1 owner group 1234 Foo 16 08:41 lorem.txt",
+		"-rw-r--r-- 1 owner group abc Feb 16 08:41 lorem.txt",
+		"?rw-r--r-- 1 owner group 1234 Feb 16 08:41 lorem.txt",
+	} {
+		if _, err := parseLIST(raw, testListTimes(time.Now())); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestParseDOSLIST(t *testing.T) {
+	cases := []struct {
+		raw string
+		exp *ftpFile
+	}{
+		{
+			// IIS
+			"02-16-15  08:41AM       <DIR>          wwwroot",
+			&ftpFile{
+				name:  "wwwroot",
+				mode:  0400 | os.ModeDir,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+			},
+		},
+		{
+			"02-16-15  08:41PM             12345 readme.txt",
+			&ftpFile{
+				name:  "readme.txt",
+				size:  12345,
+				mode:  0400,
+				mtime: time.Date(2015, time.February, 16, 20, 41, 0, 0, time.UTC),
+			},
+		},
+		{
+			"11-30-98  12:05AM                 0 old  file  name.txt",
+			&ftpFile{
+				name:  "old  file  name.txt",
+				mode:  0400,
+				mtime: time.Date(1998, time.November, 30, 0, 5, 0, 0, time.UTC),
+			},
+		},
+		{
+			"06-01-10  12:30PM       <DIR>          aspnet_client",
+			&ftpFile{
+				name:  "aspnet_client",
+				mode:  0400 | os.ModeDir,
+				mtime: time.Date(2010, time.June, 1, 12, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			// 24 hour clock with four digit year
+			"02-16-2015  20:41              1,234 data.csv",
+			&ftpFile{
+				name:  "data.csv",
+				size:  1234,
+				mode:  0400,
+				mtime: time.Date(2015, time.February, 16, 20, 41, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c.exp.raw = c.raw
+
+		got, err := parseLIST(c.raw, testListTimes(time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFile := got.(*ftpFile)
+		if !reflect.DeepEqual(gotFile, c.exp) {
+			t.Errorf("exp %+v\n got %+v", c.exp, gotFile)
+		}
+	}
+
+	for _, raw := range []string{
+		"13-16-15  08:41AM       <DIR>          wwwroot",
+		"02-16-15  13:41AM       <DIR>          wwwroot",
+		"02-16-15  08:41AM       lots          wwwroot",
+		"02-16-15  08:41AM       <DIR>",
+	} {
+		if _, err := parseLIST(raw, testListTimes(time.Now())); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestParseEPLF(t *testing.T) {
+	cases := []struct {
+		raw string
+		exp *ftpFile
+	}{
+		{
+			"+i8388621.29609,m824255902,/,\tdirname",
+			&ftpFile{
+				name:  "dirname",
+				mode:  0500 | os.ModeDir,
+				mtime: time.Unix(824255902, 0).UTC(),
+			},
+		},
+		{
+			"+i8388621.44468,m839956783,r,s10376,\tRFCEPLF",
+			&ftpFile{
+				name:  "RFCEPLF",
+				size:  10376,
+				mode:  0400,
+				mtime: time.Unix(839956783, 0).UTC(),
+			},
+		},
+		{
+			// unknown facts are ignored, "up" gives UNIX permissions
+			"+r,s12,up644,x-whatever,\tsome file",
+			&ftpFile{
+				name: "some file",
+				size: 12,
+				mode: 0644,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c.exp.raw = c.raw
+
+		got, err := parseLIST(c.raw, testListTimes(time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFile := got.(*ftpFile)
+		if !reflect.DeepEqual(gotFile, c.exp) {
+			t.Errorf("exp %+v\n got %+v", c.exp, gotFile)
+		}
+	}
+
+	for _, raw := range []string{
+		"+i8388621.29609,m824255902,/,",
+		"+s12x,r,\tfoo",
+		"+m12x,r,\tfoo",
+	} {
+		if _, err := parseLIST(raw, testListTimes(time.Now())); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestParseMVSLIST(t *testing.T) {
+	listing := []string{
+		"Volume Unit    Referred Ext Used Recfm Lrecl BlkSz Dsorg Dsname",
+		"WYOSPT 3390   2015/02/16  1   15  FB      80  3120  PO  PDS.LIB",
+		"WYOSPT 3390   2015/02/15  1    2  FB      80 27920  PS  SEQ.DATA",
+		"Migrated                                                ARCHIVED.DATA",
+		"ARCIVE Not Direct Access Device                         KJ.IOP998.ERROR",
+		" Name     VV.MM   Created       Changed      Size  Init   Mod   Id",
+		"MEMBER1    01.03 2015/02/12 2015/02/16 08:41    80    55     0 USER",
+		"MEMBER2",
+	}
+
+	expected := []*ftpFile{
+		{
+			name:  "PDS.LIB",
+			size:  15 * mvsBytesPerTrack,
+			mode:  0400 | os.ModeDir,
+			mtime: time.Date(2015, time.February, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "SEQ.DATA",
+			size:  2 * mvsBytesPerTrack,
+			mode:  0400,
+			mtime: time.Date(2015, time.February, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "ARCHIVED.DATA",
+			mode: 0400,
+		},
+		{
+			name: "KJ.IOP998.ERROR",
+			mode: 0400,
+		},
+		{
+			name:  "MEMBER1",
+			mode:  0400,
+			mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+		},
+		{
+			name: "MEMBER2",
+			mode: 0400,
+		},
+	}
+
+	parser := &mvsListParser{times: testListTimes(time.Now())}
+
+	var got []*ftpFile
+	for _, entry := range listing {
+		info, err := parser.parse(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info != nil {
+			got = append(got, info.(*ftpFile))
+		}
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(got))
+	}
+
+	for i, exp := range expected {
+		exp.raw = got[i].raw
+		if !reflect.DeepEqual(got[i], exp) {
+			t.Errorf("exp %+v\n got %+v", exp, got[i])
+		}
+	}
+
+	// other columns, found from the header
+	parser = &mvsListParser{times: testListTimes(time.Now())}
+	listing = []string{
+		"MIGRAT VOLSER  UNIT  REFDATE EXT USED RECFM LRECL BLKSZ DSORG DSNAME",
+		"       WYOSPT  3390 2015/02/16  1   15  FB      80  3120  PO   PDS.LIB",
+		"NO     WYOSPT  3390 2015/02/15  1    2  FB      80 27920  PS   SEQ.DATA",
+		"YES    MIGRAT                                                  ARCHIVED.DATA",
+	}
+
+	got = nil
+	for _, entry := range listing {
+		info, err := parser.parse(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info != nil {
+			got = append(got, info.(*ftpFile))
+		}
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(got))
+	}
+
+	for i, exp := range expected[:3] {
+		exp.raw = got[i].raw
+		if !reflect.DeepEqual(got[i], exp) {
+			t.Errorf("exp %+v\n got %+v", exp, got[i])
+		}
+	}
+
+	// no header means it's a regular listing
+	parser = &mvsListParser{times: testListTimes(time.Now())}
+	info, err := parser.parse("-rw-r--r-- 1 owner group 1234 Feb 16 2015 lorem.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name() != "lorem.txt" || info.Size() != 1234 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestParseVMSLIST(t *testing.T) {
+	cases := []struct {
+		raw string
+		exp *ftpFile
+	}{
+		{
+			"LOGIN.COM;3   1  16-FEB-2015 08:41:48  [GROUP,USER]  (RWED,RWED,RE,)",
+			&ftpFile{
+				name:  "LOGIN.COM",
+				size:  512,
+				mode:  0750,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 48, 0, time.UTC),
+			},
+		},
+		{
+			"SUBDIR.DIR;1  3/9  16-FEB-2015 08:41  [USER]  (RWE,RWE,RE,E)",
+			&ftpFile{
+				name:  "SUBDIR.DIR",
+				size:  3 * 512,
+				mode:  0751 | os.ModeDir,
+				mtime: time.Date(2015, time.February, 16, 8, 41, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c.exp.raw = c.raw
+
+		got, err := parseLIST(c.raw, testListTimes(time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFile := got.(*ftpFile)
+		if !reflect.DeepEqual(gotFile, c.exp) {
+			t.Errorf("exp %+v\n got %+v", c.exp, gotFile)
+		}
+	}
+}
+
+func TestJoinVMSLines(t *testing.T) {
+	got := joinVMSLines([]string{
+		"A_VERY_LONG_FILE_NAME_THAT_WRAPS.TXT;12",
+		"                  5  16-FEB-2015 08:41:48  [GROUP,USER]  (RWED,RWED,RE,)",
+		"LOGIN.COM;3   1  16-FEB-2015 08:41:48  [GROUP,USER]  (RWED,RWED,RE,)",
+	})
+
+	exp := []string{
+		"A_VERY_LONG_FILE_NAME_THAT_WRAPS.TXT;12 5  16-FEB-2015 08:41:48  [GROUP,USER]  (RWED,RWED,RE,)",
+		"LOGIN.COM;3   1  16-FEB-2015 08:41:48  [GROUP,USER]  (RWED,RWED,RE,)",
+	}
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %q", got)
+	}
+
+	info, err := parseLIST(got[0], testListTimes(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name() != "A_VERY_LONG_FILE_NAME_THAT_WRAPS.TXT" || info.Size() != 5*512 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestIsListNoise(t *testing.T) {
+	noise := []string{
+		"",
+		"   ",
+		"\r",
+		"total 248",
+		"Total 0",
+	}
+
+	for _, line := range noise {
+		if !isListNoise(line) {
+			t.Errorf("expected %q to be noise", line)
+		}
+	}
+
+	entries := []string{
+		"-rw-r--r-- 1 owner group 12 Feb 16 08:41 total 248",
+		"02-16-15  08:41AM                 12 lorem.txt",
+		"+i8388621.48594,m825718503,r,s280,\tdjb.html",
+		"                  500  16-FEB-2015 08:41:48  [GROUP,USER]  (RWED,RWED,RE,)",
+		"226-Quota: 10% used",
+	}
+
+	for _, line := range entries {
+		if isListNoise(line) {
+			t.Errorf("expected %q not to be noise", line)
+		}
+	}
+}
+
+func TestTrimListReplies(t *testing.T) {
+	lines := []string{
+		"150 Opening data connection",
+		"",
+		"-rw-r--r-- 1 owner group 12 Feb 16 2015 lorem.txt",
+		"100 Feb 16 2015 ipsum.txt",
+		"-rw-r--r-- 1 owner group 12 Feb 16 2015 dolor.txt",
+		"226-Quota: 10% used",
+		"",
+	}
+
+	head, entries, tail := trimListReplies(lines)
+
+	if !reflect.DeepEqual(head, lines[:2]) {
+		t.Errorf("got head %q", head)
+	}
+
+	if !reflect.DeepEqual(entries, lines[2:5]) {
+		t.Errorf("got entries %q", entries)
+	}
+
+	if !reflect.DeepEqual(tail, lines[5:]) {
+		t.Errorf("got tail %q", tail)
+	}
+
+	head, entries, tail = trimListReplies([]string{"226 Transfer complete"})
+	if len(head) != 1 || len(entries) != 0 || len(tail) != 0 {
+		t.Errorf("got %q %q %q", head, entries, tail)
+	}
+}
+
+func TestParseListLine(t *testing.T) {
+	info, err := ParseListLine("-rw-r--r-- 1 owner group 12 Feb 16  2015 lorem.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name() != "lorem.txt" || info.Size() != 12 || !info.ModTime().Equal(time.Date(2015, time.February, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %+v", info)
+	}
+
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	info, err = ParseListLine("02-16-15  08:41AM                 12 lorem.txt", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := time.Date(2015, time.February, 16, 13, 41, 0, 0, time.UTC); !info.ModTime().Equal(exp) {
+		t.Errorf("expected %s, got %s", exp, info.ModTime())
+	}
+
+	for _, line := range []string{"total 248", "", "226-Quota: 10% used", "drwxr-xr-x 2 owner group 4096 Feb 16  2015 .."} {
+		info, err := ParseListLine(line, nil)
+		if err != nil || info != nil {
+			t.Errorf("%q: expected nil, nil, got %v, %v", line, info, err)
+		}
+	}
+
+	if _, err := ParseListLine("garbage", nil); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How deep MirrorToLocal descends before assuming it is in a symlink loop
+// the server doesn't let us detect.
+const maxMirrorDepth = 64
+
+// MirrorOptions configures MirrorToLocal.
+type MirrorOptions struct {
+	// Number of files to download concurrently. Each download uses a
+	// connection from the Client's pool. Defaults to
+	// Config.ConnectionsPerHost.
+	Concurrency int
+
+	// If set, downloaded files get the remote file's modification time,
+	// and files are considered up to date only if their modification time
+	// matches the remote one exactly (to the second). Otherwise files are
+	// up to date if they aren't older than the remote file.
+	PreserveModTime bool
+
+	// If set, errors listing directories or downloading files are
+	// collected in MirrorReport.Failed and mirroring continues. By default
+	// the first error stops mirroring and is returned.
+	ContinueOnError bool
+}
+
+// MirrorReport describes what MirrorToLocal did. Paths are remote paths.
+type MirrorReport struct {
+	// Files downloaded.
+	Transferred []string
+
+	// Files that were already up to date, and symlinks, which aren't
+	// followed.
+	Skipped []string
+
+	// Files and directories that failed, with their errors.
+	Failed map[string]error
+
+	// Total bytes downloaded.
+	Bytes int64
+}
+
+// MirrorToLocal makes local directory "localRoot" a copy of remote directory
+// "remoteRoot", creating local directories as needed and downloading files
+// that are missing locally or whose size or modification time differ (see
+// MirrorOptions). Nothing is deleted locally. Files are downloaded like
+// with RetrieveFile, so a failed download never leaves a partial file
+// behind.
+// Symlinks are not followed, and directories the server identifies as
+// already visited (via the MLST "unique" fact) are skipped, so symlinked
+// directories can't cause infinite recursion. The report is returned even
+// if mirroring stopped because of an error.
+func (c *Client) MirrorToLocal(remoteRoot, localRoot string, opts MirrorOptions) (MirrorReport, error) {
+	m := &mirror{
+		client:  c,
+		opts:    opts,
+		visited: make(map[string]bool),
+		jobs:    make(chan mirrorJob),
+		report:  MirrorReport{Failed: make(map[string]error)},
+	}
+
+	root, err := c.Stat(remoteRoot)
+	if err != nil {
+		return m.report, err
+	}
+
+	if !root.IsDir() {
+		return m.report, ftpError{err: fmt.Errorf("%s is not a directory", remoteRoot)}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = c.config.ConnectionsPerHost
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range m.jobs {
+				m.download(job)
+			}
+		}()
+	}
+
+	m.walk(remoteRoot, localRoot, root, 0)
+
+	close(m.jobs)
+	wg.Wait()
+
+	sort.Strings(m.report.Transferred)
+	sort.Strings(m.report.Skipped)
+
+	return m.report, m.err
+}
+
+type mirrorJob struct {
+	remote string
+	local  string
+	info   os.FileInfo
+}
+
+type mirror struct {
+	client *Client
+	opts   MirrorOptions
+
+	// directories listed so far, by MLST unique fact
+	visited map[string]bool
+
+	jobs chan mirrorJob
+
+	mu     sync.Mutex
+	report MirrorReport
+
+	// first error, if we aren't continuing on errors
+	err error
+}
+
+// Record an error for "remotePath". Returns false if mirroring should stop.
+func (m *mirror) fail(remotePath string, err error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.client.debug("error mirroring %s: %s", remotePath, err)
+	m.report.Failed[remotePath] = err
+
+	if !m.opts.ContinueOnError && m.err == nil {
+		m.err = err
+	}
+
+	return m.opts.ContinueOnError
+}
+
+func (m *mirror) stopped() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err != nil
+}
+
+func (m *mirror) walk(remoteDir, localDir string, info os.FileInfo, depth int) bool {
+	if facts, ok := info.Sys().(*EntryFacts); ok && facts.Unique != "" {
+		if m.visited[facts.Unique] {
+			m.client.debug("already mirrored %s, skipping", remoteDir)
+			return true
+		}
+		m.visited[facts.Unique] = true
+	}
+
+	if depth > maxMirrorDepth {
+		return m.fail(remoteDir, ftpError{err: fmt.Errorf("directory tree deeper than %d levels (symlink loop?)", maxMirrorDepth)})
+	}
+
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return m.fail(remoteDir, err)
+	}
+
+	entries, err := m.client.ReadDir(remoteDir)
+	if err != nil {
+		return m.fail(remoteDir, err)
+	}
+
+	sort.Sort(byName(entries))
+
+	for _, entry := range entries {
+		if m.stopped() {
+			return false
+		}
+
+		name := entry.Name()
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+
+		remotePath := path.Join(remoteDir, name)
+		localPath := filepath.Join(localDir, filepath.FromSlash(name))
+
+		switch {
+		case entry.Mode()&os.ModeSymlink != 0:
+			m.skip(remotePath)
+		case entry.IsDir():
+			if !m.walk(remotePath, localPath, entry, depth+1) {
+				return false
+			}
+		case m.upToDate(localPath, entry):
+			m.skip(remotePath)
+		default:
+			m.jobs <- mirrorJob{remote: remotePath, local: localPath, info: entry}
+		}
+	}
+
+	return true
+}
+
+func (m *mirror) skip(remotePath string) {
+	m.mu.Lock()
+	m.report.Skipped = append(m.report.Skipped, remotePath)
+	m.mu.Unlock()
+}
+
+func (m *mirror) upToDate(localPath string, remote os.FileInfo) bool {
+	local, err := os.Stat(localPath)
+	if err != nil || !local.Mode().IsRegular() || local.Size() != remote.Size() {
+		return false
+	}
+
+	if remote.ModTime().IsZero() {
+		return true
+	}
+
+	localTime := local.ModTime().Truncate(time.Second)
+	remoteTime := remote.ModTime().Truncate(time.Second)
+
+	if m.opts.PreserveModTime {
+		return localTime.Equal(remoteTime)
+	}
+
+	return !localTime.Before(remoteTime)
+}
+
+func (m *mirror) download(job mirrorJob) {
+	if m.stopped() {
+		return
+	}
+
+	attrs := m.client.localFileAttrs(job.info, m.opts.PreserveModTime)
+	n, err := m.client.downloadFile(job.remote, job.local, false, attrs)
+	if err != nil {
+		m.fail(job.remote, err)
+		return
+	}
+
+	m.mu.Lock()
+	m.report.Transferred = append(m.report.Transferred, job.remote)
+	m.report.Bytes += n
+	m.mu.Unlock()
+}
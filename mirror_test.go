@@ -0,0 +1,171 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newMirrorServer(t *testing.T) *fakeServer {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.replies["MLST root"] = fakeReply{250, "Listing root\n type=dir;unique=r1;modify=20150216084148; root\nEnd"}
+
+	server.data["MLSD root"] = "type=file;size=5;modify=20150216084148; a.txt\r\n" +
+		"type=file;size=3;modify=20150216084148; b.txt\r\n" +
+		"type=dir;unique=s1;modify=20150216084148; sub\r\n" +
+		"type=OS.unix=slink:/root;modify=20150216084148; link\r\n"
+
+	// "loop" is a symlink to root the server presents as a plain directory
+	server.data["MLSD root/sub"] = "type=file;size=2;modify=20150216084148; c.txt\r\n" +
+		"type=dir;unique=r1;modify=20150216084148; loop\r\n"
+
+	server.data["RETR root/a.txt"] = "hello"
+	server.data["RETR root/b.txt"] = "foo"
+	server.data["RETR root/sub/c.txt"] = "hi"
+
+	return server
+}
+
+func TestMirrorToLocal(t *testing.T) {
+	server := newMirrorServer(t)
+	defer server.close()
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// changed since it was listed
+	server.data["RETR root/sub/c.txt"] = "hi there"
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 2}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b.txt is already up to date
+	if err := os.MkdirAll(filepath.Join(dir, "root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "root", "b.txt"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.MirrorToLocal("root", filepath.Join(dir, "root"), MirrorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := []string{"root/a.txt", "root/sub/c.txt"}; !reflect.DeepEqual(report.Transferred, exp) {
+		t.Errorf("expected %v, got %v", exp, report.Transferred)
+	}
+
+	if exp := []string{"root/b.txt", "root/link"}; !reflect.DeepEqual(report.Skipped, exp) {
+		t.Errorf("expected %v, got %v", exp, report.Skipped)
+	}
+
+	// what was downloaded, not the listed sizes
+	if len(report.Failed) != 0 || report.Bytes != 13 {
+		t.Errorf("got %+v", report)
+	}
+
+	for path, exp := range map[string]string{"a.txt": "hello", "b.txt": "foo", "sub/c.txt": "hi there"} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, "root", path)); string(got) != exp {
+			t.Errorf("%s: expected %q, got %q", path, exp, got)
+		}
+	}
+
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "MLSD root/sub/loop" || cmd == "MLSD root/link" {
+			t.Errorf("unexpected %s", cmd)
+		}
+	}
+
+	server.mu.Lock()
+	server.data["RETR root/sub/c.txt"] = "hi"
+	server.mu.Unlock()
+
+	// preserving mtimes
+	report, err = c.MirrorToLocal("root", filepath.Join(dir, "preserved"), MirrorOptions{PreserveModTime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "preserved", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := time.Date(2015, 2, 16, 8, 41, 48, 0, time.UTC); !info.ModTime().Equal(exp) {
+		t.Errorf("expected %s, got %s", exp, info.ModTime())
+	}
+
+	// second run has nothing to do
+	report, err = c.MirrorToLocal("root", filepath.Join(dir, "preserved"), MirrorOptions{PreserveModTime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Transferred) != 0 || len(report.Skipped) != 4 {
+		t.Errorf("got %+v", report)
+	}
+}
+
+func TestMirrorToLocalErrors(t *testing.T) {
+	server := newMirrorServer(t)
+	defer server.close()
+
+	delete(server.data, "RETR root/a.txt")
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.MirrorToLocal("root", filepath.Join(dir, "continue"), MirrorOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Failed) != 1 || report.Failed["root/a.txt"] == nil {
+		t.Errorf("got %v", report.Failed)
+	}
+
+	if exp := []string{"root/b.txt", "root/sub/c.txt"}; !reflect.DeepEqual(report.Transferred, exp) {
+		t.Errorf("expected %v, got %v", exp, report.Transferred)
+	}
+
+	// single connection, so nothing after a.txt is downloaded
+	report, err = c.MirrorToLocal("root", filepath.Join(dir, "abort"), MirrorOptions{Concurrency: 1})
+	if err == nil || err.(Error).Code() != 550 {
+		t.Errorf("expected 550 error, got %v", err)
+	}
+
+	if report.Failed["root/a.txt"] == nil || len(report.Transferred) > 1 {
+		t.Errorf("got %+v", report)
+	}
+
+	server.replies["MLST root/b.txt"] = fakeReply{250, "Listing\n type=file;size=3; root/b.txt\nEnd"}
+
+	if _, err := c.MirrorToLocal("root/b.txt", dir, MirrorOptions{}); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -6,10 +6,15 @@ package goftp
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -41,9 +46,36 @@ type persistentConn struct {
 	features map[string]string
 
 	// tracks the current type (e.g. ASCII/Image) of connection
-	currentType string
+	currentType TransferType
 
+	// PROT level last set, or empty if none has been (in which case data
+	// connections use TLS)
+	currentProt DataProtection
+
+	// server's SYST reply, fetched lazily
+	systemType string
+
+	// server said it doesn't implement EPRT
+	eprtUnsupported bool
+
+	// server said it doesn't implement EPSV, or its reply made no sense
+	epsvUnsupported bool
+
+	// the host in Client.hosts this connection counts against
 	host string
+
+	// the address we connected to: "host" with its hostname resolved
+	// (unless the proxy resolves it)
+	addr string
+
+	// when the connection was last returned to the pool
+	idleSince time.Time
+
+	// when a keepalive NOOP last succeeded
+	keptAlive time.Time
+
+	// when the connection is too old to reuse (see Config.MaxConnectionAge)
+	retireAt time.Time
 }
 
 func (pconn *persistentConn) setControlConn(conn net.Conn) {
@@ -63,6 +95,19 @@ func (pconn *persistentConn) close() {
 	}
 }
 
+// When the connection was last used or kept alive.
+func (pconn *persistentConn) lastActive() time.Time {
+	if pconn.keptAlive.After(pconn.idleSince) {
+		return pconn.keptAlive
+	}
+	return pconn.idleSince
+}
+
+// Politely say goodbye, without waiting for the reply.
+func (pconn *persistentConn) quit() {
+	pconn.writeCommand("QUIT")
+}
+
 func (pconn *persistentConn) sendCommandExpected(expected int, f string, args ...interface{}) error {
 	code, msg, err := pconn.sendCommand(f, args...)
 	if err != nil {
@@ -87,23 +132,8 @@ func (pconn *persistentConn) sendCommandExpected(expected int, f string, args ..
 func (pconn *persistentConn) sendCommand(f string, args ...interface{}) (int, string, error) {
 	cmd := fmt.Sprintf(f, args...)
 
-	logName := cmd
-	if strings.HasPrefix(cmd, "PASS") {
-		logName = "PASS ******"
-	}
-
-	pconn.debug("sending command %s", logName)
-
-	pconn.controlConn.SetWriteDeadline(time.Now().Add(pconn.config.Timeout))
-	err := pconn.writer.PrintfLine(cmd)
-
-	if err != nil {
-		pconn.broken = true
-		pconn.debug(`error sending command "%s": %s`, logName, err)
-		return 0, "", ftpError{
-			err:       fmt.Errorf("error writing command: %s", err),
-			temporary: true,
-		}
+	if err := pconn.writeCommand(cmd); err != nil {
+		return 0, "", err
 	}
 
 	code, msg, err := pconn.readResponse()
@@ -123,8 +153,43 @@ func (pconn *persistentConn) sendCommand(f string, args ...interface{}) (int, st
 	return code, msg, err
 }
 
+// Send "cmd" without reading the reply.
+func (pconn *persistentConn) writeCommand(cmd string) error {
+	logName := cmd
+	if strings.HasPrefix(cmd, "PASS") || strings.HasPrefix(cmd, "ACCT") {
+		logName = cmd[:4] + " ******"
+	}
+
+	pconn.debug("sending command %s", logName)
+
+	pconn.controlConn.SetWriteDeadline(time.Now().Add(pconn.config.CommandTimeout))
+	err := pconn.writer.PrintfLine("%s", cmd)
+
+	if err != nil {
+		pconn.broken = true
+		pconn.debug(`error sending command "%s": %s`, logName, err)
+		return ftpError{
+			err:       fmt.Errorf("error writing command: %s", err),
+			temporary: true,
+		}
+	}
+
+	return nil
+}
+
 func (pconn *persistentConn) readResponse() (int, string, error) {
-	pconn.controlConn.SetReadDeadline(time.Now().Add(pconn.config.Timeout))
+	return pconn.readResponseWithin(pconn.config.CommandTimeout)
+}
+
+// Like readResponse, but wait up to "timeout" for the reply, or forever if
+// timeout is 0.
+func (pconn *persistentConn) readResponseWithin(timeout time.Duration) (int, string, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	pconn.controlConn.SetReadDeadline(deadline)
 	code, msg, err := pconn.reader.ReadResponse(0)
 	if err != nil {
 		pconn.broken = true
@@ -133,6 +198,9 @@ func (pconn *persistentConn) readResponse() (int, string, error) {
 			err:       fmt.Errorf("error reading response: %s", err),
 			temporary: true,
 		}
+	} else if code == replyServiceNotAvailable {
+		// the server is closing the connection
+		pconn.broken = true
 	}
 	return code, msg, err
 }
@@ -174,6 +242,98 @@ func (pconn *persistentConn) fetchFeatures() error {
 	return nil
 }
 
+// Ask the server to send the MLST facts we want (see Config.MLSTFacts).
+// The server refusing isn't fatal, we just get its default facts.
+func (pconn *persistentConn) negotiateMLSTFacts() error {
+	supported, found := pconn.features["MLST"]
+	if !found || len(pconn.config.MLSTFacts) == 0 {
+		return nil
+	}
+
+	// the feature looks like "type*;size*;modify*;perm;", where "*"
+	// indicates facts that are currently enabled
+	var available []string
+	for _, fact := range strings.Split(supported, ";") {
+		if fact = strings.TrimSuffix(fact, "*"); fact != "" {
+			available = append(available, fact)
+		}
+	}
+
+	var want []string
+	for _, fact := range pconn.config.MLSTFacts {
+		if match := findFold(available, fact); match != "" {
+			want = append(want, match)
+		}
+	}
+
+	if len(want) == 0 {
+		pconn.debug("server doesn't support any of the MLST facts we want")
+		return nil
+	}
+
+	code, msg, err := pconn.sendCommand("OPTS MLST %s;", strings.Join(want, ";"))
+	if err != nil {
+		return err
+	}
+
+	if !positiveCompletionReply(code) {
+		pconn.debug("server didn't accept OPTS MLST: %d-%s", code, msg)
+		return nil
+	}
+
+	// reply should look like "MLST OPTS type;size;modify;"
+	agreed := want
+	if idx := strings.Index(strings.ToUpper(msg), "MLST OPTS"); idx != -1 {
+		agreed = nil
+		for _, fact := range strings.Split(strings.TrimSpace(msg[idx+len("MLST OPTS"):]), ";") {
+			if fact != "" {
+				agreed = append(agreed, fact)
+			}
+		}
+	}
+
+	var feature string
+	for _, fact := range available {
+		feature += fact
+		if findFold(agreed, fact) != "" {
+			feature += "*"
+		}
+		feature += ";"
+	}
+	pconn.features["MLST"] = feature
+
+	return nil
+}
+
+// find "s" in "list" case insensitively, returning the version from list
+func findFold(list []string, s string) string {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return item
+		}
+	}
+	return ""
+}
+
+func (pconn *persistentConn) fetchSystemType() string {
+	if pconn.systemType != "" {
+		return pconn.systemType
+	}
+
+	code, msg, err := pconn.sendCommand("SYST")
+	if err != nil {
+		return ""
+	}
+
+	if code != replySystemType {
+		pconn.debug("server doesn't support SYST: %d-%s", code, msg)
+		return ""
+	}
+
+	pconn.systemType = msg
+	return msg
+}
+
 func (pconn *persistentConn) hasFeature(name string) bool {
 	_, found := pconn.features[name]
 	return found
@@ -184,6 +344,71 @@ func (pconn *persistentConn) hasFeatureWithArg(name, arg string) bool {
 	return found && strings.ToUpper(arg) == val
 }
 
+// ErrServiceNotReady is matched (via errors.Is) by the *ServiceNotReadyError
+// returned when the server isn't accepting connections yet.
+var ErrServiceNotReady = errors.New("service not ready")
+
+// ServiceNotReadyError is returned (wrapped in a *HostError) when a server
+// greets a new connection with 120 ("service ready in nnn minutes"), and
+// waiting for it (see Config.MaxServiceWait) didn't help. It satisfies the
+// Error interface.
+type ServiceNotReadyError struct {
+	// The delay the server gave, or 0 if it didn't say.
+	Delay time.Duration
+
+	// The server's reply text.
+	Msg string
+}
+
+func (e *ServiceNotReadyError) Error() string {
+	return fmt.Sprintf("%s: %d-%s", ErrServiceNotReady, replyReadyInNMinutes, e.Msg)
+}
+
+func (e *ServiceNotReadyError) Is(target error) bool {
+	return target == ErrServiceNotReady
+}
+
+// Temporary is always true, since the server should be ready later.
+func (e *ServiceNotReadyError) Temporary() bool { return true }
+func (e *ServiceNotReadyError) Code() int       { return replyReadyInNMinutes }
+func (e *ServiceNotReadyError) Message() string { return e.Msg }
+
+// How long to wait for a server that replied 120 without saying how long.
+const defaultServiceWait = 30 * time.Second
+
+// Matches the delay in a 120 reply, e.g. "ready in 2 minutes". Other
+// numbers in the text (e.g. "node 3 is down") aren't delays.
+var readyDelayRegex = regexp.MustCompile(`(?i)\bin\s+(\d+)\s*(sec|min|h)?`)
+
+// Parse the delay ("in N ...") out of a 120 reply's text, in minutes unless
+// it says otherwise. Returns 0 if there isn't one, so the caller waits
+// defaultServiceWait.
+func parseReadyDelay(msg string) time.Duration {
+	match := readyDelayRegex.FindStringSubmatch(msg)
+	if match == nil {
+		return 0
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+
+	unit := time.Minute
+	switch strings.ToLower(match[2]) {
+	case "sec":
+		unit = time.Second
+	case "h":
+		unit = time.Hour
+	}
+
+	return time.Duration(n) * unit
+}
+
+// ErrAccountRequired is returned (wrapped in an Error) when the server asks
+// for an account (ACCT) to log in, but Config.Account isn't set.
+var ErrAccountRequired = errors.New("server requires an account")
+
 func (pconn *persistentConn) logIn() error {
 	if pconn.config.User == "" {
 		return nil
@@ -202,6 +427,17 @@ func (pconn *persistentConn) logIn() error {
 		}
 	}
 
+	if code == replyNeedAccount {
+		if pconn.config.Account == "" {
+			return ftpError{err: ErrAccountRequired}
+		}
+
+		code, msg, err = pconn.sendCommand("ACCT %s", pconn.config.Account)
+		if err != nil {
+			return err
+		}
+	}
+
 	if !positiveCompletionReply(code) {
 		return ftpError{code: code, msg: msg}
 	}
@@ -211,50 +447,112 @@ func (pconn *persistentConn) logIn() error {
 
 // Request that the server enters passive mode, allowing us to connect to it.
 // This lets transfers work with the client behind NAT, so you almost always
-// want it. First try EPSV, then fall back to PASV.
+// want it. First try EPSV, then fall back to PASV (see Config.PassiveMode).
 func (pconn *persistentConn) requestPassive() (string, error) {
-	var (
-		startIdx   int
-		endIdx     int
-		port       int
-		remoteHost string
-	)
+	// the address we dialed, rather than the control connection's remote
+	// address, which may be a proxy's or meaningless (see Config.DialFunc)
+	remoteHost, _, err := net.SplitHostPort(pconn.addr)
+	if err != nil {
+		return "", ftpError{err: fmt.Errorf("failed determining remote host: %s", err)}
+	}
+
+	// PASV can only express IPv4 addresses (a hostname resolved by a proxy
+	// could be either)
+	ip := net.ParseIP(remoteHost)
+	ipv6 := ip != nil && ip.To4() == nil
+
+	mode := pconn.config.PassiveMode
+	if mode == PassiveAuto && pconn.epsvUnsupported && !ipv6 {
+		mode = PassivePASV
+	}
+
+	if mode != PassivePASV {
+		port, err := pconn.requestEPSV()
+		if err == nil {
+			return net.JoinHostPort(remoteHost, strconv.Itoa(port)), nil
+		}
+
+		if _, fallback := err.(epsvUnsupportedError); !fallback || mode == PassiveEPSV || ipv6 {
+			return "", err
+		}
 
-	// Extended PaSsiVe (same idea as PASV, but works with IPv6).
-	// See http://tools.ietf.org/html/rfc2428.
+		pconn.debug("%s, trying PASV", err)
+	} else if ipv6 {
+		return "", ftpError{err: errors.New("PASV doesn't work over IPv6")}
+	}
+
+	return pconn.requestPASV()
+}
+
+// Returned by requestEPSV when PASV should be tried instead.
+type epsvUnsupportedError struct {
+	ftpError
+}
+
+// Request passive mode using Extended PaSsiVe (same idea as PASV, but works
+// with IPv6), returning the port the server listens on. See
+// http://tools.ietf.org/html/rfc2428.
+func (pconn *persistentConn) requestEPSV() (int, error) {
 	code, msg, err := pconn.sendCommand("EPSV")
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 
 	if code != replyEnteringExtendedPassiveMode {
-		pconn.debug("server doesn't support EPSV: %d-%s", code, msg)
-		goto PASV
-	}
+		if code/100 == 4 {
+			return 0, ftpError{code: code, msg: msg}
+		}
 
-	startIdx = strings.Index(msg, "|||")
-	endIdx = strings.LastIndex(msg, "|")
-	if startIdx == -1 || endIdx == -1 || startIdx+3 > endIdx {
-		pconn.debug("failed parsing EPSV response: %s", msg)
-		goto PASV
+		if commandNotSupportedReply(code) {
+			pconn.epsvUnsupported = true
+		}
+
+		return 0, epsvUnsupportedError{ftpError{code: code, msg: msg}}
 	}
 
-	port, err = strconv.Atoi(msg[startIdx+3 : endIdx])
+	port, err := parseEPSV(msg)
 	if err != nil {
-		pconn.debug("EPSV response didn't contain port: %s", msg)
-		goto PASV
+		pconn.epsvUnsupported = true
+		return 0, epsvUnsupportedError{ftpError{err: err}}
 	}
 
-	remoteHost, _, err = net.SplitHostPort(pconn.controlConn.RemoteAddr().String())
-	if err != nil {
-		pconn.debug("failed determining remote host: %s", err)
-		goto PASV
+	return port, nil
+}
+
+// Parse the port from an EPSV reply, e.g. "Entering Extended Passive Mode
+// (|||6446|)". Some servers put spaces around the parts, or use a delimiter
+// other than "|".
+func parseEPSV(msg string) (int, error) {
+	parseError := fmt.Errorf("error parsing EPSV response (%s)", msg)
+
+	startIdx := strings.Index(msg, "(")
+	endIdx := strings.LastIndex(msg, ")")
+	if startIdx == -1 || endIdx == -1 || startIdx > endIdx {
+		return 0, parseError
+	}
+
+	inner := strings.Replace(msg[startIdx+1:endIdx], " ", "", -1)
+	if len(inner) < 5 {
+		return 0, parseError
+	}
+
+	delim := inner[0]
+	if inner[1] != delim || inner[2] != delim || inner[len(inner)-1] != delim {
+		return 0, parseError
 	}
 
-	return fmt.Sprintf("[%s]:%d", remoteHost, port), nil
+	port, err := strconv.Atoi(inner[3 : len(inner)-1])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, parseError
+	}
+
+	return port, nil
+}
 
-PASV:
-	code, msg, err = pconn.sendCommand("PASV")
+// Request passive mode using PASV, returning the "ip:port" the server
+// listens on.
+func (pconn *persistentConn) requestPASV() (string, error) {
+	code, msg, err := pconn.sendCommand("PASV")
 	if err != nil {
 		return "", err
 	}
@@ -268,8 +566,8 @@ PASV:
 	}
 
 	// "Entering Passive Mode (162,138,208,11,223,57)."
-	startIdx = strings.Index(msg, "(")
-	endIdx = strings.LastIndex(msg, ")")
+	startIdx := strings.Index(msg, "(")
+	endIdx := strings.LastIndex(msg, ")")
 	if startIdx == -1 || endIdx == -1 || startIdx > endIdx {
 		return "", parseError
 	}
@@ -284,7 +582,7 @@ PASV:
 		return "", parseError
 	}
 
-	port = 0
+	var port int
 	for i, part := range addrParts[4:6] {
 		portOctet, err := strconv.Atoi(part)
 		if err != nil {
@@ -293,17 +591,235 @@ PASV:
 		port |= portOctet << (byte(1-i) * 8)
 	}
 
-	return fmt.Sprintf("%s:%d", ip.String(), port), nil
+	// the address we dialed, as in requestPassive
+	remoteHost, _, err := net.SplitHostPort(pconn.addr)
+	if err != nil {
+		return "", ftpError{err: fmt.Errorf("failed determining remote host: %s", err)}
+	}
+
+	if remoteIP := net.ParseIP(remoteHost); remoteIP != nil {
+		if pconn.ignorePASVAddress(ip, remoteIP) {
+			pconn.debug("ignoring PASV address %s, using %s", ip, remoteIP)
+			return net.JoinHostPort(remoteIP.String(), strconv.Itoa(port)), nil
+		}
+	} else if pconn.config.IgnorePassiveAddress {
+		// a hostname for the proxy to resolve
+		pconn.debug("ignoring PASV address %s, using %s", ip, remoteHost)
+		return net.JoinHostPort(remoteHost, strconv.Itoa(port)), nil
+	}
+
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	if err := pconn.checkDataAddress(ip, addr); err != nil {
+		return "", err
+	}
+
+	return addr, nil
+}
+
+// ErrForeignDataAddress is matched (via errors.Is) by the *DataAddressError
+// returned when a PASV reply points somewhere other than the server.
+var ErrForeignDataAddress = errors.New("data address isn't the server's")
+
+// DataAddressError is returned when a PASV reply advertises an address
+// other than the server's (see Config.AllowForeignDataAddress). It
+// satisfies the Error interface.
+type DataAddressError struct {
+	// The "ip:port" the server advertised.
+	Addr string
+
+	// The server's IP address.
+	ServerIP string
+}
+
+func (e *DataAddressError) Error() string {
+	return fmt.Sprintf("refusing data connection to %s: not the server's address (%s)", e.Addr, e.ServerIP)
+}
+
+func (e *DataAddressError) Is(target error) bool {
+	return target == ErrForeignDataAddress
+}
+
+func (e *DataAddressError) Temporary() bool { return false }
+func (e *DataAddressError) Code() int       { return 0 }
+func (e *DataAddressError) Message() string { return "" }
+
+// Check that "ip", advertised as "addr" by PASV, is the address we
+// connected to the server at (unless Config.AllowForeignDataAddress).
+func (pconn *persistentConn) checkDataAddress(ip net.IP, addr string) error {
+	if pconn.config.AllowForeignDataAddress {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(pconn.addr)
+	if err != nil {
+		return ftpError{err: fmt.Errorf("failed determining remote host: %s", err)}
+	}
+
+	// a hostname the proxy resolved
+	server := net.ParseIP(host)
+	if server == nil || ip.Equal(server) {
+		return nil
+	}
+
+	pconn.debug("PASV address %s isn't the server's (%s), refusing it", addr, server)
+
+	return &DataAddressError{Addr: addr, ServerIP: server.String()}
+}
+
+// Whether to connect to the address the control connection dialed,
+// "control", rather than address "advertised" from a PASV reply (see
+// Config.IgnorePassiveAddress).
+func (pconn *persistentConn) ignorePASVAddress(advertised, control net.IP) bool {
+	if advertised.Equal(control) {
+		return false
+	}
+
+	if pconn.config.IgnorePassiveAddress {
+		return true
+	}
+
+	// probably a server behind NAT telling us its private address
+	return (advertised.IsPrivate() || advertised.IsUnspecified()) && isPublicIP(control)
 }
 
-func (pconn *persistentConn) openDataConn() (net.Conn, error) {
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Open a TCP connection to "addr" with Config.DialFunc, through
+// Config.Proxy if set, giving up after Config.ConnectTimeout or when "ctx"
+// is done.
+func (pconn *persistentConn) dial(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, pconn.config.ConnectTimeout)
+	defer cancel()
+
+	dial := pconn.config.DialFunc
+	if dial == nil {
+		dialer := &net.Dialer{}
+		if ip := net.ParseIP(pconn.config.LocalAddr); ip != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		dial = dialer.DialContext
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if pconn.config.Proxy != nil {
+		conn, err = dialProxy(ctx, dial, pconn.config.Proxy, addr)
+	} else {
+		conn, err = dial(ctx, "tcp", addr)
+	}
+
+	return conn, err
+}
+
+// Start TLS on control connection "conn".
+func (pconn *persistentConn) handshakeTLS(conn net.Conn) (net.Conn, error) {
+	tc := tls.Client(conn, pconn.config.TLSConfig)
+
+	t0 := time.Now()
+
+	conn.SetDeadline(t0.Add(pconn.config.ConnectTimeout))
+	err := tc.Handshake()
+
+	pconn.config.ConnectionHooks.handshook(pconn.host, time.Since(t0), err)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	pconn.config.ConnectionHooks.tlsState("control", tc.ConnectionState())
+
+	return tc, nil
+}
+
+// A TLS data connection reporting its state to
+// ConnectionHooks.OnTLSConnectionState once the handshake, which happens
+// on first use, is done.
+type reportingTLSConn struct {
+	*tls.Conn
+	hooks    *ConnectionHooks
+	reported bool
+}
+
+func (c *reportingTLSConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.report()
+	return n, err
+}
+
+func (c *reportingTLSConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.report()
+	return n, err
+}
+
+func (c *reportingTLSConn) report() {
+	if c.reported {
+		return
+	}
+
+	if state := c.Conn.ConnectionState(); state.HandshakeComplete {
+		c.reported = true
+		c.hooks.tlsState("data", state)
+	}
+}
+
+func (pconn *persistentConn) openDataConn(ctx context.Context) (net.Conn, error) {
+	var (
+		dc  net.Conn
+		err error
+	)
+	if pconn.config.ActiveTransfers {
+		dc, err = pconn.openActiveDataConn()
+	} else {
+		dc, err = pconn.openPassiveDataConn(ctx)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pconn.config.TLSConfig != nil && pconn.currentProt != DataClear {
+		pconn.debug("upgrading data connection to TLS")
+		tc := tls.Client(dc, pconn.config.TLSConfig)
+
+		if hooks := pconn.config.ConnectionHooks; hooks.wantsTLSState() {
+			dc = &reportingTLSConn{Conn: tc, hooks: hooks}
+		} else {
+			dc = tc
+		}
+	}
+
+	pconn.dataConn = dc
+	return dc, nil
+}
+
+// Bound the whole transfer over "dc" by Config.Timeout, if set. Returns
+// the deadline, or the zero Time if there is none.
+func (pconn *persistentConn) setTransferDeadline(dc net.Conn) time.Time {
+	if pconn.config.Timeout <= 0 {
+		return time.Time{}
+	}
+
+	deadline := time.Now().Add(pconn.config.Timeout)
+	dc.SetDeadline(deadline)
+	return deadline
+}
+
+func (pconn *persistentConn) openPassiveDataConn(ctx context.Context) (net.Conn, error) {
 	host, err := pconn.requestPassive()
 	if err != nil {
 		return nil, err
 	}
 
 	pconn.debug("opening data connection to %s", host)
-	dc, err := net.DialTimeout("tcp", host, pconn.config.Timeout)
+	dc, err := pconn.dial(ctx, host)
 
 	if err != nil {
 		var isTemporary bool
@@ -313,51 +829,344 @@ func (pconn *persistentConn) openDataConn() (net.Conn, error) {
 		return nil, ftpError{err: err, temporary: isTemporary}
 	}
 
-	if pconn.config.TLSConfig != nil {
-		pconn.debug("upgrading data connection to TLS")
-		dc = tls.Client(dc, pconn.config.TLSConfig)
-	}
-
-	pconn.dataConn = dc
 	return dc, nil
 }
 
-func (pconn *persistentConn) setType(t string) error {
+func (pconn *persistentConn) setType(t TransferType) error {
 	if pconn.currentType == t {
 		pconn.debug("type already set to %s", t)
 		return nil
 	}
+
 	err := pconn.sendCommandExpected(replyCommandOkay, "TYPE %s", t)
 	if err != nil {
-		pconn.currentType = t
+		if isServerReply(err) {
+			return &TransferTypeError{Type: t, Err: err}
+		}
+		return err
 	}
-	return err
+
+	pconn.currentType = t
+	return nil
 }
 
-func (pconn *persistentConn) logInTLS() error {
-	err := pconn.sendCommandExpected(replyAuthOkayNoDataNeeded, "AUTH TLS")
+// Tell the server to reserve "size" bytes for the next upload.
+func (pconn *persistentConn) allocate(size int64) error {
+	code, msg, err := pconn.sendCommand("ALLO %d", size)
 	if err != nil {
 		return err
 	}
 
-	pconn.setControlConn(tls.Client(pconn.controlConn, pconn.config.TLSConfig))
+	if code != replyCommandOkay && code != replyCommandOkayNotImplemented {
+		return &AllocateError{Size: size, Err: ftpError{code: code, msg: msg}}
+	}
+
+	return nil
+}
+
+// Close connection "dc" if "ctx" is canceled before the returned function
+// is called. The returned function reports whether that happened, and may
+// only be called once.
+func closeOnCancel(ctx context.Context, dc net.Conn) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	done := make(chan struct{})
+	canceled := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			dc.Close()
+			canceled <- true
+		case <-done:
+			canceled <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-canceled
+	}
+}
+
+// Send NOOP on the control connection every "interval" (see
+// Config.ControlKeepalive) until the returned function is called, which
+// returns how many were sent. Their replies are left for
+// readTransferResponse.
+func (pconn *persistentConn) keepaliveDuringTransfer(interval time.Duration) func() int {
+	if interval <= 0 {
+		return func() int { return 0 }
+	}
+
+	done := make(chan struct{})
+	sent := make(chan int, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var n int
+		for {
+			select {
+			case <-ticker.C:
+				pconn.debug("sending keepalive NOOP during transfer")
+				pconn.controlConn.SetWriteDeadline(time.Now().Add(pconn.config.CommandTimeout))
+				if err := pconn.writer.PrintfLine("NOOP"); err != nil {
+					pconn.debug("error sending keepalive NOOP: %s", err)
+					sent <- n
+					<-done
+					return
+				}
+				n++
+			case <-done:
+				sent <- n
+				return
+			}
+		}
+	}()
+
+	return func() int {
+		close(done)
+		return <-sent
+	}
+}
+
+// Read the final reply to a transfer command, along with the replies to
+// "noops" keepalive NOOPs sent during the transfer. Servers answer the NOOPs
+// either during the transfer or after it, so the replies can come in any
+// order. NOOP replies are 200, or an error for servers that don't accept
+// commands during transfers; the transfer's reply is the first one that
+// isn't one of those.
+func (pconn *persistentConn) readTransferResponse(noops int) (int, string, error) {
+	var (
+		code  int
+		msg   string
+		found bool
+	)
+
+	for i := 0; i <= noops; i++ {
+		c, m, err := pconn.readResponse()
+		if err != nil {
+			return 0, "", err
+		}
+
+		if found {
+			continue
+		}
+
+		noopReply := c == replyCommandOkay || c == replyBadCommandSequence || commandNotSupportedReply(c)
+		if !noopReply || i == noops {
+			code, msg, found = c, m, true
+		}
+	}
+
+	return code, msg, nil
+}
+
+// Abort the transfer in progress because "ctx" was canceled, returning
+// ctx.Err(). The data connection must already be closed. We expect the
+// transfer command's final reply (e.g. 426, or 226 if it finished anyway)
+// followed by ABOR's reply. If we don't get them, the connection is marked
+// broken so it isn't reused.
+func (pconn *persistentConn) abort(ctx context.Context) error {
+	pconn.debug("aborting transfer: %s", ctx.Err())
+	pconn.sendAbort()
+	return ctx.Err()
+}
+
+// Send ABOR for the transfer in progress and read the transfer's and
+// ABOR's replies, marking the connection broken if that fails.
+func (pconn *persistentConn) sendAbort() {
+	code, msg, err := pconn.sendCommand("ABOR")
+	if err != nil {
+		pconn.debug("error sending ABOR: %s", err)
+		pconn.broken = true
+		return
+	}
+
+	if code == replyDataConnectionOpen {
+		// no transfer reply, server already considered it done
+		return
+	}
+
+	pconn.debug("aborted transfer reply: %d-%s", code, msg)
+
+	code, msg, err = pconn.readResponse()
+	if err != nil {
+		pconn.debug("error reading ABOR reply: %s", err)
+		pconn.broken = true
+		return
+	}
+
+	if !positiveCompletionReply(code) {
+		pconn.debug("unexpected ABOR reply: %d-%s", code, msg)
+		pconn.broken = true
+	}
+}
+
+// Upgrade to TLS with AUTH and log in. If "sslFirst" is set, AUTH SSL is
+// tried before AUTH TLS (see Config.TLSAuth). Reports whether AUTH SSL
+// was used.
+func (pconn *persistentConn) logInTLS(sslFirst bool) (bool, error) {
+	usedSSL, err := pconn.auth(sslFirst)
+	if err != nil {
+		return false, err
+	}
+
+	tc, err := pconn.handshakeTLS(pconn.controlConn)
+	if err != nil {
+		return false, ftpError{err: err}
+	}
+
+	pconn.setControlConn(tc)
 
 	err = pconn.logIn()
 	if err != nil {
+		return false, err
+	}
+
+	err = pconn.protectData()
+	if err != nil {
+		return false, err
+	}
+
+	pconn.debug("successfully upgraded to TLS")
+
+	return usedSSL, nil
+}
+
+// Send "AUTH TLS" or "AUTH SSL", or both if the first isn't recognized.
+// Reports whether AUTH SSL worked.
+func (pconn *persistentConn) auth(sslFirst bool) (bool, error) {
+	var mechs []string
+	switch pconn.config.TLSAuth {
+	case TLSAuthTLS:
+		mechs = []string{"TLS"}
+	case TLSAuthSSL:
+		mechs = []string{"SSL"}
+	default:
+		if sslFirst {
+			mechs = []string{"SSL", "TLS"}
+		} else {
+			mechs = []string{"TLS", "SSL"}
+		}
+	}
+
+	var refused []string
+	for i, mech := range mechs {
+		code, msg, err := pconn.sendCommand("AUTH %s", mech)
+		if err != nil {
+			return false, err
+		}
+
+		if code == replyAuthOkayNoDataNeeded {
+			return mech == "SSL", nil
+		}
+
+		unrecognized := code == replyCommandSyntaxError ||
+			code == replyCommandNotImplemented ||
+			code == replyCommandNotImplementedForParameter
+
+		if i == 0 && (!unrecognized || len(mechs) == 1) {
+			return false, ftpError{code: code, msg: msg}
+		}
+
+		refused = append(refused, fmt.Sprintf("AUTH %s: %d-%s", mech, code, msg))
+
+		if i < len(mechs)-1 {
+			pconn.debug("server refused AUTH %s, trying AUTH %s: %d-%s", mech, mechs[i+1], code, msg)
+		}
+	}
+
+	return false, ftpError{err: fmt.Errorf("server refused TLS (%s)", strings.Join(refused, "; "))}
+}
+
+// Log in over an implicit TLS control connection.
+func (pconn *persistentConn) logInImplicitTLS() error {
+	if err := pconn.logIn(); err != nil {
 		return err
 	}
 
-	err = pconn.sendCommandExpected(replyGroupPositiveCompletion, "PBSZ 0")
+	// Implicit FTPS servers protect data connections anyway, but some
+	// want to be told.
+	if err := pconn.protectData(); err != nil {
+		pconn.debug("ignoring error protecting data connections: %s", err)
+	}
+
+	return nil
+}
+
+// Send CCC and go back to plaintext on the control connection, leaving data
+// connections protected (see Config.ClearControlChannel).
+func (pconn *persistentConn) clearControlChannel() error {
+	tc, ok := pconn.controlConn.(*tls.Conn)
+	if !ok {
+		return ftpError{err: errors.New("control connection isn't using TLS")}
+	}
+
+	code, msg, err := pconn.sendCommand("CCC")
 	if err != nil {
 		return err
 	}
 
-	err = pconn.sendCommandExpected(replyGroupPositiveCompletion, "PROT P")
+	if code != replyCommandOkay {
+		return ftpError{code: code, msg: msg}
+	}
+
+	// End TLS with a close_notify each way, without closing the TCP
+	// connection. The server won't send anything else until our next
+	// command, so no plaintext can get mixed up with the TLS records.
+	if err := tc.CloseWrite(); err != nil {
+		pconn.broken = true
+		return ftpError{err: fmt.Errorf("error ending TLS after CCC: %s", err)}
+	}
+
+	tc.SetReadDeadline(time.Now().Add(pconn.config.CommandTimeout))
+	if _, err := io.Copy(ioutil.Discard, pconn.reader.R); err != nil {
+		pconn.broken = true
+		return ftpError{
+			err:       fmt.Errorf("error waiting for server to end TLS after CCC: %s", err),
+			temporary: true,
+		}
+	}
+
+	// CloseWrite leaves an expired write deadline behind
+	raw := tc.NetConn()
+	raw.SetDeadline(time.Time{})
+
+	pconn.controlConn = raw
+	pconn.reader.R.Reset(raw)
+	pconn.writer.W.Reset(raw)
+
+	pconn.debug("control connection is back to plaintext")
+
+	return nil
+}
+
+// Tell the server data connections will use TLS, or whatever
+// Config.DataProtection says.
+func (pconn *persistentConn) protectData() error {
+	err := pconn.sendCommandExpected(replyGroupPositiveCompletion, "PBSZ 0")
 	if err != nil {
 		return err
 	}
 
-	pconn.debug("successfully upgraded to TLS")
+	return pconn.setProtection(pconn.config.DataProtection)
+}
+
+// Set the PROT level for data connections, unless it's already set.
+func (pconn *persistentConn) setProtection(prot DataProtection) error {
+	if pconn.config.TLSConfig == nil || pconn.currentProt == prot {
+		return nil
+	}
+
+	err := pconn.sendCommandExpected(replyGroupPositiveCompletion, "PROT %s", prot)
+	if err != nil {
+		return err
+	}
 
+	pconn.currentProt = prot
 	return nil
 }
@@ -0,0 +1,188 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// TransferDirection is the direction of a transfer reported to
+// Config.TransferObserver.
+type TransferDirection int
+
+const (
+	// TransferDownload is a transfer from the server (e.g. Retrieve).
+	TransferDownload TransferDirection = 0
+
+	// TransferUpload is a transfer to the server (e.g. Store).
+	TransferUpload TransferDirection = 1
+)
+
+// TransferInfo describes the progress of a transfer. It is passed to
+// Config.TransferObserver.
+type TransferInfo struct {
+	// Remote path being transferred.
+	Path string
+
+	Direction TransferDirection
+
+	// Bytes transferred so far. For transfers starting at an offset (e.g.
+	// RetrieveFrom), this includes the offset.
+	Bytes int64
+
+	// Total size of the file, or -1 if unknown. Downloads use SIZE, uploads
+	// use the size of the source if it is an *os.File or io.Seeker.
+	Total int64
+
+	// Time since the transfer started.
+	Elapsed time.Duration
+
+	// Set for the final call once the transfer has finished, along with Err
+	// if the transfer failed.
+	Done bool
+	Err  error
+}
+
+// Tracks progress of a single transfer and calls the observer. A nil
+// *transferProgress does nothing, so there is no overhead without an
+// observer.
+type transferProgress struct {
+	observer  func(TransferInfo)
+	interval  time.Duration
+	byteStep  int64
+	info      TransferInfo
+	start     time.Time
+	lastCall  time.Time
+	lastBytes int64
+}
+
+func (c *Client) newTransferProgress(path string, direction TransferDirection, offset, total int64) *transferProgress {
+	if c.config.TransferObserver == nil {
+		return nil
+	}
+
+	now := time.Now()
+	return &transferProgress{
+		observer: c.config.TransferObserver,
+		interval: c.config.TransferObserverInterval,
+		byteStep: c.config.TransferObserverBytes,
+		info: TransferInfo{
+			Path:      path,
+			Direction: direction,
+			Bytes:     offset,
+			Total:     total,
+		},
+		start:     now,
+		lastCall:  now,
+		lastBytes: offset,
+	}
+}
+
+func (p *transferProgress) add(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+
+	p.info.Bytes += int64(n)
+
+	now := time.Now()
+	if (p.byteStep > 0 && p.info.Bytes-p.lastBytes >= p.byteStep) ||
+		(p.interval > 0 && now.Sub(p.lastCall) >= p.interval) {
+		p.lastCall = now
+		p.lastBytes = p.info.Bytes
+		p.info.Elapsed = now.Sub(p.start)
+		p.observer(p.info)
+	}
+}
+
+// Used when resuming, where the transfer restarts from "bytes".
+func (p *transferProgress) set(bytes int64) {
+	if p == nil {
+		return
+	}
+
+	p.info.Bytes = bytes
+	p.lastBytes = bytes
+}
+
+func (p *transferProgress) done(err error) {
+	if p == nil {
+		return
+	}
+
+	p.info.Done = true
+	p.info.Err = err
+	p.info.Elapsed = time.Since(p.start)
+	p.observer(p.info)
+}
+
+func (p *transferProgress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return progressWriter{w, p}
+}
+
+func (p *transferProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return progressReader{r, p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *transferProgress
+}
+
+func (pw progressWriter) Write(buf []byte) (int, error) {
+	n, err := pw.w.Write(buf)
+	pw.p.add(n)
+	return n, err
+}
+
+type progressReader struct {
+	r io.Reader
+	p *transferProgress
+}
+
+func (pr progressReader) Read(buf []byte) (int, error) {
+	n, err := pr.r.Read(buf)
+	pr.p.add(n)
+	return n, err
+}
+
+// Figure out the total size of an upload from "src" starting at "offset",
+// or -1 if we can't tell.
+func uploadSize(src io.Reader, offset int64) int64 {
+	if f, ok := src.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+
+	seeker, ok := src.(io.Seeker)
+	if !ok {
+		return -1
+	}
+
+	cur, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+
+	if _, err := seeker.Seek(cur, io.SeekStart); err != nil {
+		return -1
+	}
+
+	return offset + end - cur
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTransferObserver(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["SIZE file"] = fakeReply{213, "11"}
+
+	var calls []TransferInfo
+	config := Config{
+		TransferObserver: func(info TransferInfo) {
+			calls = append(calls, info)
+		},
+		TransferObserverBytes: 1,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) < 2 {
+		t.Fatalf("expected at least 2 calls, got %d", len(calls))
+	}
+
+	last := calls[len(calls)-1]
+	if !last.Done || last.Err != nil || last.Bytes != 11 || last.Total != 11 || last.Path != "file" || last.Direction != TransferDownload {
+		t.Errorf("got %+v", last)
+	}
+
+	for _, info := range calls[:len(calls)-1] {
+		if info.Done || info.Bytes <= 0 || info.Bytes > 11 {
+			t.Errorf("got %+v", info)
+		}
+	}
+
+	calls = nil
+
+	if err := c.Store("upload", strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+
+	last = calls[len(calls)-1]
+	if !last.Done || last.Err != nil || last.Bytes != 11 || last.Total != 11 || last.Direction != TransferUpload {
+		t.Errorf("got %+v", last)
+	}
+
+	// failures are reported too
+	calls = nil
+
+	if err := c.Retrieve("missing", buf); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if len(calls) != 1 || !calls[0].Done || calls[0].Err == nil || calls[0].Total != -1 {
+		t.Errorf("got %+v", calls)
+	}
+}
+
+func TestUploadSize(t *testing.T) {
+	if size := uploadSize(strings.NewReader("hello"), 0); size != 5 {
+		t.Errorf("got %d", size)
+	}
+
+	r := strings.NewReader("hello world")
+	r.Seek(6, os.SEEK_SET)
+	if size := uploadSize(r, 6); size != 11 {
+		t.Errorf("got %d", size)
+	}
+
+	if n, _ := r.Seek(0, os.SEEK_CUR); n != 6 {
+		t.Errorf("position changed to %d", n)
+	}
+
+	if size := uploadSize(bytes.NewBufferString("hello"), 0); size != -1 {
+		t.Errorf("got %d", size)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Check Config.Proxy, returning whether hostnames should be resolved by
+// the proxy.
+func checkProxy(config Config) (bool, error) {
+	if config.Proxy == nil {
+		return false, nil
+	}
+
+	if config.ActiveTransfers {
+		return false, errors.New("active transfers don't work through a proxy")
+	}
+
+	switch config.Proxy.Scheme {
+	case "socks5":
+		return false, nil
+	case "socks5h", "http":
+		return true, nil
+	default:
+		return false, fmt.Errorf(`unsupported proxy scheme "%s"`, config.Proxy.Scheme)
+	}
+}
+
+// Connects to an address before "ctx" is done (see Config.DialFunc).
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Connect to "addr" through "proxy" (see Config.Proxy), reaching the proxy
+// with "dial". "ctx"'s deadline covers the whole exchange with the proxy.
+func dialProxy(ctx context.Context, dial dialFunc, proxy *url.URL, addr string) (net.Conn, error) {
+	if proxy.Scheme == "http" {
+		return dialHTTPConnect(ctx, dial, proxy, addr)
+	}
+	return dialSOCKS5(ctx, dial, proxy, addr)
+}
+
+// Connect to "addr" through an HTTP proxy with CONNECT, using Basic
+// authentication if the proxy URL has a username.
+func dialHTTPConnect(ctx context.Context, dial dialFunc, proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", proxyAddr, err)
+	}
+
+	// the server may speak first (e.g. its 220 greeting), so keep whatever
+	// gets buffered after the response
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", proxyAddr, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s refused CONNECT to %s: %s %s", proxyAddr, addr, resp.Proto, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &proxiedConn{Conn: conn, remote: remoteAddr(addr), reader: br}, nil
+}
+
+// Connect to "addr" through SOCKS5 proxy "proxy" (RFC 1928), using the
+// username and password from the URL if it has any (RFC 1929).
+func dialSOCKS5(ctx context.Context, dial dialFunc, proxy *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "1080")
+	}
+
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := socks5Handshake(conn, proxy.User, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", proxyAddr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &proxiedConn{Conn: conn, remote: remoteAddr(addr)}, nil
+}
+
+// The address of a proxied connection to "addr".
+func remoteAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return hostAddr(addr)
+	}
+
+	ip := net.ParseIP(host)
+	portNum, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return hostAddr(addr)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: portNum}
+}
+
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	methods := []byte{0} // no authentication
+	if user != nil {
+		methods = []byte{2} // username and password
+	}
+
+	greeting := append([]byte{5, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	if buf[0] != 5 {
+		return fmt.Errorf("unexpected version %d", buf[0])
+	}
+
+	switch {
+	case buf[1] == 0 && user == nil:
+	case buf[1] == 2 && user != nil:
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("username or password too long")
+		}
+
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+
+		if buf[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	req := []byte{5, 1, 0} // CONNECT
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname too long: %s", host)
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		msg, ok := socks5Replies[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", reply[1])
+		}
+		return fmt.Errorf("can't connect to %s: %s", net.JoinHostPort(host, strconv.Itoa(port)), msg)
+	}
+
+	// skip the bound address and port
+	var skip int
+	switch reply[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0]) + 2
+	default:
+		return fmt.Errorf("unexpected address type %d", reply[3])
+	}
+
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// A connection through a proxy, whose remote address is the address we
+// asked the proxy to connect to, not the proxy's.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+
+	// if set, reads come from here (buffered over Conn)
+	reader *bufio.Reader
+}
+
+func (p *proxiedConn) Read(buf []byte) (int, error) {
+	if p.reader != nil {
+		return p.reader.Read(buf)
+	}
+	return p.Conn.Read(buf)
+}
+
+func (p *proxiedConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+// A "host:port" address whose host wasn't resolved locally.
+type hostAddr string
+
+func (a hostAddr) Network() string {
+	return "tcp"
+}
+
+func (a hostAddr) String() string {
+	return string(a)
+}
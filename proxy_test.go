@@ -0,0 +1,417 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal SOCKS5 proxy resolving every hostname to 127.0.0.1.
+type fakeSOCKS5 struct {
+	listener net.Listener
+	user     string
+	password string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newFakeSOCKS5(user, password string) (*fakeSOCKS5, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &fakeSOCKS5{listener: ln, user: user, password: password}
+	go p.serve()
+	return p, nil
+}
+
+func (p *fakeSOCKS5) url(scheme string) *url.URL {
+	u := &url.URL{Scheme: scheme, Host: p.listener.Addr().String()}
+	if p.user != "" {
+		u.User = url.UserPassword(p.user, p.password)
+	}
+	return u
+}
+
+func (p *fakeSOCKS5) close() {
+	p.listener.Close()
+}
+
+func (p *fakeSOCKS5) receivedTargets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *fakeSOCKS5) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *fakeSOCKS5) handle(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+
+	want := byte(0)
+	if p.user != "" {
+		want = 2
+	}
+
+	if bytes.IndexByte(buf[:buf[1]], want) == -1 {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, want})
+
+	if want == 2 {
+		readString := func() string {
+			io.ReadFull(conn, buf[:1])
+			s := make([]byte, buf[0])
+			io.ReadFull(conn, s)
+			return string(s)
+		}
+
+		io.ReadFull(conn, buf[:1])
+		user, password := readString(), readString()
+		if user != p.user || password != p.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	io.ReadFull(conn, buf[:2])
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))
+
+	p.mu.Lock()
+	p.targets = append(p.targets, net.JoinHostPort(host, port))
+	p.mu.Unlock()
+
+	target, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go func() {
+		io.Copy(target, conn)
+		target.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(conn, target)
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+
+	proxy, err := newFakeSOCKS5("user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.close()
+
+	_, port, _ := net.SplitHostPort(server.addr())
+
+	for _, scheme := range []string{"socks5", "socks5h"} {
+		host := server.addr()
+		if scheme == "socks5h" {
+			// only the proxy can resolve this
+			host = "ftp.invalid:" + port
+		}
+
+		before := len(proxy.receivedTargets())
+
+		c, err := DialConfig(Config{Proxy: proxy.url(scheme)}, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("file", buf); err != nil {
+			t.Fatalf("%s: %s", scheme, err)
+		}
+
+		if buf.String() != "hello world" {
+			t.Errorf("got %q", buf.String())
+		}
+
+		if err := c.Store("upload", strings.NewReader("data")); err != nil {
+			t.Fatalf("%s: %s", scheme, err)
+		}
+
+		c.Close()
+
+		// the control connection and both data connections
+		targets := proxy.receivedTargets()[before:]
+		if len(targets) != 3 || targets[0] != host {
+			t.Errorf("%s: got %v", scheme, targets)
+		}
+
+		for _, target := range targets[1:] {
+			if !strings.HasPrefix(target, host[:strings.LastIndex(host, ":")]) {
+				t.Errorf("%s: data connection to %s", scheme, target)
+			}
+		}
+	}
+
+	// wrong password
+	u := proxy.url("socks5")
+	u.User = url.UserPassword("user", "wrong")
+
+	c, err := DialConfig(Config{Proxy: u}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Getwd(); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("got %v", err)
+	}
+
+	// active mode can't work through a proxy
+	if _, err := DialConfig(Config{Proxy: u, ActiveTransfers: true}, server.addr()); err == nil {
+		t.Error("expected error")
+	}
+
+	if _, err := DialConfig(Config{Proxy: &url.URL{Scheme: "ftp", Host: "proxy"}}, server.addr()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// A minimal HTTP CONNECT proxy resolving every hostname to 127.0.0.1.
+type fakeHTTPProxy struct {
+	listener      net.Listener
+	authorization string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newFakeHTTPProxy(authorization string) (*fakeHTTPProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &fakeHTTPProxy{listener: ln, authorization: authorization}
+	go p.serve()
+	return p, nil
+}
+
+func (p *fakeHTTPProxy) close() {
+	p.listener.Close()
+}
+
+func (p *fakeHTTPProxy) receivedTargets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *fakeHTTPProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *fakeHTTPProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+
+	if req.Method != "CONNECT" {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+
+	if req.Header.Get("Proxy-Authorization") != p.authorization {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+
+	p.mu.Lock()
+	p.targets = append(p.targets, req.Host)
+	p.mu.Unlock()
+
+	_, port, _ := net.SplitHostPort(req.Host)
+	target, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	go func() {
+		io.Copy(target, br)
+		target.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(conn, target)
+}
+
+func TestProxyHTTPConnect(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+
+	// "user:secret"
+	proxy, err := newFakeHTTPProxy("Basic dXNlcjpzZWNyZXQ=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.close()
+
+	_, port, _ := net.SplitHostPort(server.addr())
+
+	u := &url.URL{
+		Scheme: "http",
+		Host:   proxy.listener.Addr().String(),
+		User:   url.UserPassword("user", "secret"),
+	}
+
+	// only the proxy can resolve this
+	host := "ftp.invalid:" + port
+
+	c, err := DialConfig(Config{Proxy: u, PassiveMode: PassivePASV}, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	c.Close()
+
+	// the data connection goes to the literal PASV address
+	targets := proxy.receivedTargets()
+	if len(targets) != 2 || targets[0] != host || !strings.HasPrefix(targets[1], "127.0.0.1:") {
+		t.Errorf("got %v", targets)
+	}
+
+	u.User = url.UserPassword("user", "wrong")
+
+	c, err = DialConfig(Config{Proxy: u}, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Getwd(); err == nil || !strings.Contains(err.Error(), "HTTP/1.1 407 Proxy Authentication Required") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestProxySOCKS5Timeout(t *testing.T) {
+	// a proxy that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := Config{
+		Proxy:   &url.URL{Scheme: "socks5", Host: ln.Addr().String()},
+		Timeout: 100 * time.Millisecond,
+	}
+
+	c, err := DialConfig(config, "127.0.0.1:21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	t0 := time.Now()
+	if _, err := c.Getwd(); err == nil {
+		t.Error("expected error")
+	}
+
+	if time.Since(t0) > time.Second {
+		t.Errorf("took %s", time.Since(t0))
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// PutTreeOptions configures PutTree.
+type PutTreeOptions struct {
+	// Number of files to upload concurrently. Each upload uses a connection
+	// from the Client's pool. Defaults to Config.ConnectionsPerHost.
+	Concurrency int
+
+	// If set, symlinks are followed: a symlink to a file is uploaded as a
+	// regular file, and a symlink to a directory is uploaded as a
+	// directory. Directories already being uploaded are not entered again,
+	// so symlink loops are harmless. By default symlinks are skipped.
+	FollowSymlinks bool
+}
+
+// PutTreeError is returned by PutTree when some files or directories could
+// not be uploaded. Everything else was still uploaded.
+type PutTreeError struct {
+	// Errors keyed by local path.
+	Failed map[string]error
+}
+
+func (e *PutTreeError) Error() string {
+	paths := make([]string, 0, len(e.Failed))
+	for p := range e.Failed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	if len(paths) == 1 {
+		return fmt.Sprintf("error uploading %s: %s", paths[0], e.Failed[paths[0]])
+	}
+
+	return fmt.Sprintf("error uploading %d paths, first %s: %s", len(paths), paths[0], e.Failed[paths[0]])
+}
+
+// PutTree uploads local directory "localRoot" and everything in it to
+// remote directory "remoteRoot". Remote directories are created as needed,
+// including remoteRoot and its parents; directories that already exist are
+// fine. Existing remote files are overwritten. Sockets, devices, named
+// pipes and (unless PutTreeOptions.FollowSymlinks is set) symlinks are
+// skipped. A failure uploading one file doesn't stop the others; if
+// anything failed, a *PutTreeError listing each failure is returned.
+// Errors creating the parents of remoteRoot are returned as is.
+func (c *Client) PutTree(localRoot, remoteRoot string, opts PutTreeOptions) error {
+	info, err := os.Stat(localRoot)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return ftpError{err: fmt.Errorf("%s is not a directory", localRoot)}
+	}
+
+	p := &putTree{
+		client:  c,
+		opts:    opts,
+		visited: make(map[string]bool),
+		jobs:    make(chan putTreeJob),
+		failed:  make(map[string]error),
+	}
+
+	if _, err := c.MkdirAll(remoteRoot); err != nil {
+		return err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = c.config.ConnectionsPerHost
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range p.jobs {
+				p.upload(job)
+			}
+		}()
+	}
+
+	p.walk(localRoot, remoteRoot)
+
+	close(p.jobs)
+	wg.Wait()
+
+	if len(p.failed) > 0 {
+		return &PutTreeError{Failed: p.failed}
+	}
+
+	return nil
+}
+
+type putTreeJob struct {
+	local  string
+	remote string
+}
+
+type putTree struct {
+	client *Client
+	opts   PutTreeOptions
+
+	// local directories entered so far, symlinks resolved
+	visited map[string]bool
+
+	jobs chan putTreeJob
+
+	mu     sync.Mutex
+	failed map[string]error
+}
+
+func (p *putTree) fail(localPath string, err error) {
+	p.client.debug("error uploading %s: %s", localPath, err)
+
+	p.mu.Lock()
+	p.failed[localPath] = err
+	p.mu.Unlock()
+}
+
+func (p *putTree) walk(localDir, remoteDir string) {
+	if realDir, err := filepath.EvalSymlinks(localDir); err == nil {
+		if p.visited[realDir] {
+			p.client.debug("already uploading %s, skipping", localDir)
+			return
+		}
+		p.visited[realDir] = true
+	}
+
+	if _, err := p.client.mkdirExisting(remoteDir); err != nil {
+		p.fail(localDir, err)
+		return
+	}
+
+	entries, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		p.fail(localDir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		localPath := filepath.Join(localDir, entry.Name())
+		remotePath := path.Join(remoteDir, entry.Name())
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if !p.opts.FollowSymlinks {
+				p.client.debug("skipping symlink %s", localPath)
+				continue
+			}
+
+			if entry, err = os.Stat(localPath); err != nil {
+				p.fail(localPath, err)
+				continue
+			}
+		}
+
+		switch {
+		case entry.IsDir():
+			p.walk(localPath, remotePath)
+		case entry.Mode().IsRegular():
+			p.jobs <- putTreeJob{local: localPath, remote: remotePath}
+		default:
+			p.client.debug("skipping %s (%s)", localPath, entry.Mode())
+		}
+	}
+}
+
+func (p *putTree) upload(job putTreeJob) {
+	f, err := os.Open(job.local)
+	if err != nil {
+		p.fail(job.local, err)
+		return
+	}
+	defer f.Close()
+
+	if err := p.client.Store(job.remote, f); err != nil {
+		p.fail(job.local, err)
+	}
+}
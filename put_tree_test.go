@@ -0,0 +1,208 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Fake server keeping track of directories created with MKD.
+func newDirServer(t *testing.T, existing ...string) (*fakeServer, map[string]bool) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := make(map[string]bool)
+	for _, dir := range existing {
+		dirs[dir] = true
+	}
+
+	server.handlers["MKD"] = func(fc *fakeConn, arg string) {
+		parent := path.Dir(arg)
+
+		server.mu.Lock()
+		exists := dirs[arg]
+		ok := !exists && (dirs[parent] || parent == "/" || parent == ".")
+		if ok {
+			dirs[arg] = true
+		}
+		server.mu.Unlock()
+
+		if !ok {
+			fc.reply(550, "can't create directory")
+		} else {
+			fc.reply(257, `"`+arg+`" created`)
+		}
+	}
+
+	server.handlers["MLST"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		exists := dirs[arg]
+		server.mu.Unlock()
+
+		if exists {
+			fc.reply(250, "Listing\n type=dir; "+arg+"\nEnd")
+		} else {
+			fc.reply(550, "no such file")
+		}
+	}
+
+	return server, dirs
+}
+
+func TestPutTree(t *testing.T) {
+	server, dirs := newDirServer(t, "/deploy")
+	defer server.close()
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"site/css/index.html":     "hello",
+		"site/css/site.css":       "body {}",
+		"site/js/lib/deep/app.js": "alert(1)",
+		"site/empty/.x":           "",
+		"outside/secret.txt":      "secret",
+	}
+
+	for name, contents := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := filepath.Join(dir, "site")
+
+	// links out of the tree, and back into it
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(root, "outside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(root, "js", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 3}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.PutTree(root, "/deploy/2015/site", PutTreeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]string{
+		"/deploy/2015/site/css/index.html":     "hello",
+		"/deploy/2015/site/css/site.css":       "body {}",
+		"/deploy/2015/site/js/lib/deep/app.js": "alert(1)",
+		"/deploy/2015/site/empty/.x":           "",
+	}
+
+	checkStored := func() {
+		got := make(map[string]string)
+		for name, data := range server.stored {
+			got[name] = string(data)
+		}
+
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("expected %v, got %v", exp, got)
+		}
+	}
+
+	checkStored()
+
+	var gotDirs []string
+	for dir := range dirs {
+		gotDirs = append(gotDirs, dir)
+	}
+	sort.Strings(gotDirs)
+
+	expDirs := []string{
+		"/deploy",
+		"/deploy/2015",
+		"/deploy/2015/site",
+		"/deploy/2015/site/css",
+		"/deploy/2015/site/empty",
+		"/deploy/2015/site/js",
+		"/deploy/2015/site/js/lib",
+		"/deploy/2015/site/js/lib/deep",
+	}
+
+	if !reflect.DeepEqual(gotDirs, expDirs) {
+		t.Errorf("expected %v, got %v", expDirs, gotDirs)
+	}
+
+	// again, following symlinks; existing directories are fine
+	server.stored = make(map[string][]byte)
+
+	if err := c.PutTree(root, "/deploy/2015/site", PutTreeOptions{FollowSymlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp["/deploy/2015/site/outside/secret.txt"] = "secret"
+	checkStored()
+}
+
+func TestPutTreeErrors(t *testing.T) {
+	server, _ := newDirServer(t)
+	defer server.close()
+
+	server.handlers["STOR"] = func(fc *fakeConn, arg string) {
+		if arg == "/up/bad" {
+			fc.reply(553, "not allowed")
+		} else {
+			fc.receiveData(arg, false)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"bad", "good", "zzz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.PutTree(dir, "/up", PutTreeOptions{Concurrency: 1})
+
+	treeErr, ok := err.(*PutTreeError)
+	if !ok {
+		t.Fatalf("expected *PutTreeError, got %v", err)
+	}
+
+	if len(treeErr.Failed) != 1 || treeErr.Failed[filepath.Join(dir, "bad")] == nil {
+		t.Errorf("got %v", treeErr.Failed)
+	}
+
+	if string(server.stored["/up/good"]) != "good" || string(server.stored["/up/zzz"]) != "zzz" {
+		t.Errorf("got %v", server.stored)
+	}
+
+	if err := c.PutTree(filepath.Join(dir, "good"), "/up", PutTreeOptions{}); err == nil {
+		t.Error("expected error")
+	}
+}
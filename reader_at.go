@@ -0,0 +1,236 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Most transfers an OpenReaderAt reader keeps open between ReadAt calls.
+const readerAtTransfers = 4
+
+// ReaderAtCloser is returned by OpenReaderAt.
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size of the file, as of OpenReaderAt.
+	Size() int64
+}
+
+// OpenReaderAt returns an io.ReaderAt over remote file "path", e.g. for
+// archive/zip.NewReader. The file's size is fetched up front with SIZE (or
+// Stat if the server doesn't support SIZE). Each ReadAt is served by a
+// transfer started at the right offset with "REST <offset>", which is kept
+// open afterwards with a read-ahead buffer, so a ReadAt continuing where an
+// earlier one stopped (or shortly after) doesn't start a new transfer. Up to
+// a few transfers are kept open at once, each holding a connection, until
+// Close. ReadAt may be called concurrently; concurrent calls use separate
+// connections. Reading at a non-zero offset requires the server to support
+// "REST STREAM" (see ErrResumeUnsupported).
+func (c *Client) OpenReaderAt(path string) (ReaderAtCloser, error) {
+	size, err := c.size(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < 0 {
+		info, err := c.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size()
+	}
+
+	canResume, err := c.canResume(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &readerAt{client: c, path: path, size: size, canResume: canResume}, nil
+}
+
+type readerAt struct {
+	client    *Client
+	path      string
+	size      int64
+	canResume bool
+
+	mu   sync.Mutex
+	idle []*readerAtTransfer
+
+	// number of ReadAt calls starting a transfer, which may be waiting for
+	// an idle transfer's connection
+	starting int
+
+	closed bool
+}
+
+// A transfer in progress, positioned at file offset "pos".
+type readerAtTransfer struct {
+	r   *retrieveReader
+	br  *bufio.Reader
+	pos int64
+}
+
+func (t *readerAtTransfer) close() {
+	t.r.Close()
+}
+
+func (ra *readerAt) Size() int64 {
+	return ra.size
+}
+
+func (ra *readerAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ftpError{err: errors.New("negative offset")}
+	}
+
+	if off >= ra.size {
+		return 0, io.EOF
+	}
+
+	want := buf
+	if remaining := ra.size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+
+	t, reused, err := ra.transferAt(off)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(t.br, want)
+	t.pos += int64(n)
+
+	if err != nil && reused && n == 0 {
+		// the transfer may have timed out while idle
+		ra.client.debug("error reading %s from an idle transfer, restarting: %s", ra.path, err)
+		t.close()
+
+		if t, _, err = ra.transferAt(off); err != nil {
+			return 0, err
+		}
+
+		n, err = io.ReadFull(t.br, want)
+		t.pos += int64(n)
+	}
+
+	if err != nil {
+		t.close()
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = ftpError{err: errors.New("file ended early (did it shrink?)"), temporary: true}
+		}
+		return n, err
+	}
+
+	ra.release(t)
+
+	if len(want) < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Take an idle transfer we can read from at "off" without starting over,
+// or start a new one. Also reports whether the transfer was idle.
+func (ra *readerAt) transferAt(off int64) (*readerAtTransfer, bool, error) {
+	ra.mu.Lock()
+
+	if ra.closed {
+		ra.mu.Unlock()
+		return nil, false, ftpError{err: errors.New("read from closed reader")}
+	}
+
+	best := -1
+	for i, t := range ra.idle {
+		if t.pos <= off && off-t.pos <= seekBufferSize && (best < 0 || t.pos > ra.idle[best].pos) {
+			best = i
+		}
+	}
+
+	var stale *readerAtTransfer
+	if best < 0 && len(ra.idle) > 0 {
+		// give a connection back before starting another transfer
+		stale = ra.idle[0]
+		ra.idle = ra.idle[1:]
+	}
+
+	var t *readerAtTransfer
+	if best >= 0 {
+		t = ra.idle[best]
+		ra.idle = append(ra.idle[:best], ra.idle[best+1:]...)
+	} else {
+		ra.starting++
+	}
+
+	ra.mu.Unlock()
+
+	if stale != nil {
+		stale.close()
+	}
+
+	if t != nil {
+		if _, err := t.br.Discard(int(off - t.pos)); err != nil {
+			t.close()
+			return nil, false, err
+		}
+		t.pos = off
+		return t, true, nil
+	}
+
+	defer func() {
+		ra.mu.Lock()
+		ra.starting--
+		ra.mu.Unlock()
+	}()
+
+	if off > 0 && !ra.canResume {
+		return nil, false, ftpError{err: ErrResumeUnsupported}
+	}
+
+	r, err := ra.client.open(ra.path, off)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &readerAtTransfer{r: r, br: bufio.NewReaderSize(r, seekBufferSize), pos: off}, false, nil
+}
+
+// Keep transfer "t" for later reads, unless we have enough already or
+// another ReadAt may need its connection.
+func (ra *readerAt) release(t *readerAtTransfer) {
+	ra.mu.Lock()
+
+	if ra.closed || t.pos >= ra.size || ra.starting > 0 || len(ra.idle) >= readerAtTransfers {
+		ra.mu.Unlock()
+		t.close()
+		return
+	}
+
+	ra.idle = append(ra.idle, t)
+	ra.mu.Unlock()
+}
+
+// Close ends any transfers kept open between reads, returning their
+// connections. ReadAt calls in progress finish, but later ones fail.
+func (ra *readerAt) Close() error {
+	ra.mu.Lock()
+	idle := ra.idle
+	ra.idle = nil
+	ra.closed = true
+	ra.mu.Unlock()
+
+	for _, t := range idle {
+		t.close()
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOpenReaderAt(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	data := make([]byte, 200*1024)
+	randomBytes(data)
+
+	server.data["RETR file"] = string(data)
+	server.replies["SIZE file"] = fakeReply{213, strconv.Itoa(len(data))}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 2}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ra, err := c.OpenReaderAt("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ra.Size() != int64(len(data)) {
+		t.Errorf("got size %d", ra.Size())
+	}
+
+	retrs := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if strings.HasPrefix(cmd, "RETR ") {
+				n++
+			}
+		}
+		return n
+	}
+
+	readAt := func(off int64, length int) {
+		t.Helper()
+
+		buf := make([]byte, length)
+		n, err := ra.ReadAt(buf, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf[:n], data[off:off+int64(length)]) {
+			t.Errorf("wrong bytes at %d", off)
+		}
+	}
+
+	readAt(1000, 10)
+
+	// continuing, and skipping a little, reuse the transfer
+	readAt(1010, 10)
+	readAt(1100, 10)
+
+	if got := retrs(); got != 1 {
+		t.Errorf("expected 1 RETR, got %d", got)
+	}
+
+	// backwards needs a new transfer
+	readAt(0, 10)
+
+	if got := retrs(); got != 2 {
+		t.Errorf("expected 2 RETRs, got %d", got)
+	}
+
+	// past the end
+	buf := make([]byte, 100)
+	n, err := ra.ReadAt(buf, int64(len(data)-50))
+	if n != 50 || err != io.EOF || !bytes.Equal(buf[:n], data[len(data)-50:]) {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	if n, err := ra.ReadAt(buf, int64(len(data))); n != 0 || err != io.EOF {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	// more concurrent reads than connections
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+
+			buf := make([]byte, 1000)
+			if _, err := ra.ReadAt(buf, off); err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(buf, data[off:off+1000]) {
+				t.Errorf("wrong bytes at %d", off)
+			}
+		}(int64(i) * 20000)
+	}
+	wg.Wait()
+
+	if err := ra.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ra.ReadAt(buf, 0); err == nil {
+		t.Error("expected error after Close")
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestOpenReaderAtZip(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	zipped := new(bytes.Buffer)
+	zw := zip.NewWriter(zipped)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(strings.Repeat(name, 1000)))
+	}
+	zw.Close()
+
+	server.data["RETR file.zip"] = zipped.String()
+
+	// no SIZE, so Stat is used
+	server.features = []string{"MLST type*;size*;modify*;", "REST STREAM", "EPSV"}
+	server.replies["MLST file.zip"] = fakeReply{250, "Listing\n type=file;size=" + strconv.Itoa(zipped.Len()) + "; file.zip\nEnd"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ra, err := c.OpenReaderAt("file.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+
+	zr, err := zip.NewReader(ra, ra.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zr.File) != 2 || zr.File[1].Name != "b.txt" {
+		t.Fatalf("got %v", zr.File)
+	}
+
+	rc, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != strings.Repeat("b.txt", 1000) {
+		t.Errorf("got %d bytes", len(got))
+	}
+}
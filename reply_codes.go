@@ -73,3 +73,8 @@ func positivePreliminaryReply(code int) bool {
 func transientNegativeCompletionReply(code int) bool {
 	return code/100 == 4
 }
+
+// whether the reply means the server doesn't know the command at all
+func commandNotSupportedReply(code int) bool {
+	return code == replyCommandSyntaxError || code == replyCommandNotImplemented
+}
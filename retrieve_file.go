@@ -0,0 +1,239 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Suffix of the temporary file RetrieveFile downloads into.
+const retrieveFileSuffix = ".goftp-tmp"
+
+// RetrieveFile downloads "remotePath" to local file "localPath" without
+// ever leaving a partial file at localPath. The file is first written to
+// localPath+".goftp-tmp", synced to disk, and only renamed into place once
+// the transfer (including any size or hash verification) has succeeded.
+// On error the temporary file is removed. An existing file at localPath is
+// replaced.
+//
+// The remote file is looked up with Stat first, and the local file gets
+// its modification time and, if the server reports the UNIX.mode fact, its
+// permission bits. Either is left alone if the server doesn't report it
+// (or Stat fails). See Config.SkipDownloadModTime and
+// Config.SkipDownloadMode to turn this off.
+func (c *Client) RetrieveFile(remotePath, localPath string) error {
+	return c.retrieveFile(remotePath, localPath, false)
+}
+
+// RetrieveFileResume is like RetrieveFile, but if the temporary file is
+// left over from an earlier attempt, the download continues where it left
+// off (using "REST <offset>") instead of starting over. If the server
+// doesn't support resuming, or the temporary file is larger than the remote
+// file, the download starts over. On error the temporary file is kept so a
+// later call can resume it.
+func (c *Client) RetrieveFileResume(remotePath, localPath string) error {
+	return c.retrieveFile(remotePath, localPath, true)
+}
+
+// RetrieveIfChanged is like RetrieveFile, but first compares the remote
+// file with local file "localPath" (see Config.CompareMode and
+// Config.ModTimeTolerance), and skips the download if they match. It
+// returns whether the file was downloaded. Comparing modification times
+// relies on RetrieveFile having given the local file the remote file's
+// modification time, so it doesn't work with Config.SkipDownloadModTime.
+// If the server doesn't report a modification time, the file is considered
+// changed unless only sizes are compared.
+func (c *Client) RetrieveIfChanged(remotePath, localPath string) (bool, error) {
+	info, err := c.Stat(remotePath)
+	if err != nil {
+		return false, err
+	}
+
+	if local, err := os.Stat(localPath); err == nil && c.unchanged(local, info) {
+		c.debug("%s hasn't changed, not downloading", remotePath)
+		return false, nil
+	}
+
+	_, err = c.downloadFile(remotePath, localPath, false, c.localFileAttrs(info, !c.config.SkipDownloadModTime))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Whether local file "local" matches remote file "remote" according to
+// Config.CompareMode and Config.ModTimeTolerance.
+func (c *Client) unchanged(local, remote os.FileInfo) bool {
+	if !local.Mode().IsRegular() {
+		return false
+	}
+
+	mode := c.config.CompareMode
+
+	if mode != CompareModTime && local.Size() != remote.Size() {
+		return false
+	}
+
+	if mode != CompareSize {
+		if remote.ModTime().IsZero() {
+			return false
+		}
+
+		// servers rarely report fractional seconds
+		diff := local.ModTime().Truncate(time.Second).Sub(remote.ModTime().Truncate(time.Second))
+		if diff < 0 {
+			diff = -diff
+		}
+
+		if diff > c.config.ModTimeTolerance {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Attributes of a remote file to give its local copy.
+type localFileAttrs struct {
+	// zero means leave alone
+	modTime time.Time
+
+	// whether to set mode
+	setMode bool
+	mode    os.FileMode
+}
+
+// The attributes of remote file "info" to give its local copy, as far as
+// they are known and wanted.
+func (c *Client) localFileAttrs(info os.FileInfo, modTime bool) localFileAttrs {
+	var attrs localFileAttrs
+	if info == nil {
+		return attrs
+	}
+
+	if modTime {
+		attrs.modTime = info.ModTime()
+	}
+
+	if facts, ok := info.Sys().(*EntryFacts); ok && facts.All["unix.mode"] != "" && !c.config.SkipDownloadMode {
+		attrs.setMode = true
+		attrs.mode = info.Mode().Perm()
+	}
+
+	return attrs
+}
+
+func (c *Client) retrieveFile(remotePath, localPath string, resume bool) error {
+	var info os.FileInfo
+	if !c.config.SkipDownloadModTime || !c.config.SkipDownloadMode {
+		var err error
+		if info, err = c.Stat(remotePath); err != nil {
+			c.debug("couldn't stat %s, not preserving its attributes: %s", remotePath, err)
+		}
+	}
+
+	_, err := c.downloadFile(remotePath, localPath, resume, c.localFileAttrs(info, !c.config.SkipDownloadModTime))
+	return err
+}
+
+// Download "remotePath" to "localPath" via a temporary file, returning the
+// number of bytes written to it.
+func (c *Client) downloadFile(remotePath, localPath string, resume bool, attrs localFileAttrs) (n int64, err error) {
+	tmpPath := localPath + retrieveFileSuffix
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(tmpPath, flags, 0644)
+	if err != nil {
+		return n, err
+	}
+
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+
+		if err != nil && !resume {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	var offset int64
+	if resume {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			return n, err
+		}
+	}
+
+	if offset > 0 {
+		var size int64
+		if size, err = c.size(context.Background(), remotePath); err != nil {
+			return n, err
+		}
+
+		// e.g. the remote file was replaced by a smaller one
+		if size >= 0 && offset > size {
+			c.debug("%s is larger than %s (%d > %d bytes), starting over", tmpPath, remotePath, offset, size)
+			offset = 0
+		}
+	}
+
+	if offset > 0 {
+		c.debug("resuming download of %s at %d", remotePath, offset)
+		n, err = c.RetrieveFrom(remotePath, f, offset)
+		if errors.Is(err, ErrResumeUnsupported) {
+			c.debug("can't resume download of %s, starting over", remotePath)
+			offset = 0
+		}
+	}
+
+	if offset == 0 {
+		if err = f.Truncate(0); err != nil {
+			return n, err
+		}
+
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return n, err
+		}
+
+		n, err = c.RetrieveN(remotePath, f)
+	}
+
+	if err != nil {
+		return n, err
+	}
+
+	if err = f.Sync(); err != nil {
+		return n, err
+	}
+
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return n, err
+	}
+
+	if attrs.setMode {
+		if err = os.Chmod(tmpPath, attrs.mode); err != nil {
+			return n, err
+		}
+	}
+
+	if !attrs.modTime.IsZero() {
+		if err = os.Chtimes(tmpPath, attrs.modTime, attrs.modTime); err != nil {
+			return n, err
+		}
+	}
+
+	return n, os.Rename(tmpPath, localPath)
+}
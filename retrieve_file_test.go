@@ -0,0 +1,325 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetrieveFile(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["SIZE file"] = fakeReply{213, "11"}
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(dir, "file")
+
+	// replaces what's there
+	if err := ioutil.WriteFile(local, []byte("old contents, longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RetrieveFile("file", local); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := ioutil.ReadFile(local); string(got) != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	if _, err := os.Stat(local + ".goftp-tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+
+	// failure leaves neither file behind
+	missing := filepath.Join(dir, "missing")
+	if err := c.RetrieveFile("missing", missing); err == nil {
+		t.Error("expected error")
+	}
+
+	for _, path := range []string{missing, missing + ".goftp-tmp"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists: %v", path, err)
+		}
+	}
+}
+
+func TestRetrieveFileResume(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["SIZE file"] = fakeReply{213, "11"}
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(dir, "file")
+
+	// left over from an interrupted download
+	if err := ioutil.WriteFile(local+".goftp-tmp", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RetrieveFileResume("file", local); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := ioutil.ReadFile(local); string(got) != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	var sawRest bool
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "REST 5" {
+			sawRest = true
+		}
+	}
+
+	if !sawRest {
+		t.Error("expected REST 5")
+	}
+
+	// temp file is kept for next time
+	missing := filepath.Join(dir, "missing")
+	if err := c.RetrieveFileResume("missing", missing); err == nil {
+		t.Error("expected error")
+	}
+
+	if _, err := os.Stat(missing + ".goftp-tmp"); err != nil {
+		t.Error(err)
+	}
+
+	// a temp file larger than the remote file is started over
+	if err := ioutil.WriteFile(local+".goftp-tmp", []byte("hello world, and then some"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RetrieveFileResume("file", local); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := ioutil.ReadFile(local); string(got) != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	// without REST STREAM we start over
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(local+".goftp-tmp", []byte("garbage, longer than the file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RetrieveFileResume("file", local); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := ioutil.ReadFile(local); string(got) != "hello world" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRetrieveFileAttributes(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["MLST file"] = fakeReply{250, "Listing file\n type=file;size=11;modify=20150216084148;UNIX.mode=4640; file\nEnd"}
+	server.data["RETR bare"] = "hello world"
+	server.replies["MLST bare"] = fakeReply{250, "Listing bare\n type=file;size=11; bare\nEnd"}
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(dir, "file")
+	if err := c.RetrieveFile("file", local); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2015, 2, 16, 8, 41, 48, 0, time.UTC)
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("expected %s, got %s", mtime, info.ModTime())
+	}
+
+	// setuid bit dropped
+	if info.Mode() != 0640 {
+		t.Errorf("got %s", info.Mode())
+	}
+
+	// missing facts leave the local defaults
+	bare := filepath.Join(dir, "bare")
+	if err := c.RetrieveFile("bare", bare); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err = os.Stat(bare); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(info.ModTime()) > time.Minute {
+		t.Errorf("got %s", info.ModTime())
+	}
+
+	// turned off
+	c, err = DialConfig(Config{SkipDownloadModTime: true, SkipDownloadMode: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RetrieveFile("file", local); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err = os.Stat(local); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.ModTime().Equal(mtime) || info.Mode() == 0640 {
+		t.Errorf("got %s, %s", info.ModTime(), info.Mode())
+	}
+}
+
+func TestRetrieveIfChanged(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["MLST file"] = fakeReply{250, "Listing file\n type=file;size=11;modify=20150216084148; file\nEnd"}
+
+	dir, err := ioutil.TempDir("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(dir, "file")
+	mtime := time.Date(2015, 2, 16, 8, 41, 48, 0, time.UTC)
+
+	check := func(exp bool) {
+		t.Helper()
+
+		got, err := c.RetrieveIfChanged("file", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != exp {
+			t.Errorf("expected %t, got %t", exp, got)
+		}
+	}
+
+	// missing locally
+	check(true)
+
+	if got, _ := ioutil.ReadFile(local); string(got) != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	check(false)
+
+	// different size
+	ioutil.WriteFile(local, []byte("hello"), 0644)
+	os.Chtimes(local, mtime, mtime)
+	check(true)
+
+	// different mtime
+	os.Chtimes(local, mtime.Add(-time.Second), mtime.Add(-time.Second))
+	check(true)
+	check(false)
+
+	// within tolerance
+	c.config.ModTimeTolerance = 2 * time.Second
+	os.Chtimes(local, mtime.Add(time.Second), mtime.Add(time.Second))
+	check(false)
+	c.config.ModTimeTolerance = 0
+
+	// size only
+	c.config.CompareMode = CompareSize
+	os.Chtimes(local, mtime.Add(time.Hour), mtime.Add(time.Hour))
+	check(false)
+
+	// mtime only
+	c.config.CompareMode = CompareModTime
+	ioutil.WriteFile(local, []byte("hello world\r\n"), 0644)
+	os.Chtimes(local, mtime, mtime)
+	check(false)
+
+	os.Chtimes(local, mtime.Add(time.Hour), mtime.Add(time.Hour))
+	check(true)
+
+	var retrs int
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "RETR file" {
+			retrs++
+		}
+	}
+
+	if retrs != 4 {
+		t.Errorf("expected 4 downloads, got %d", retrs)
+	}
+
+	if _, err := c.RetrieveIfChanged("missing", local); err == nil {
+		t.Error("expected error")
+	}
+}
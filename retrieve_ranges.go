@@ -0,0 +1,262 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ByteRange is a range of bytes in a file, for RetrieveRanges.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+func (r ByteRange) end() int64 {
+	return r.Offset + r.Length
+}
+
+// RangesError is returned by RetrieveRanges when some ranges could not be
+// fetched. The ranges are those RetrieveRanges actually requested, i.e.
+// after sorting and coalescing, so retrying just the failed ones is enough.
+type RangesError struct {
+	// Ranges written to dest in full.
+	Done []ByteRange
+
+	// Errors keyed by range.
+	Failed map[ByteRange]error
+}
+
+func (e *RangesError) Error() string {
+	failed := make([]ByteRange, 0, len(e.Failed))
+	for r := range e.Failed {
+		failed = append(failed, r)
+	}
+	sortRanges(failed)
+
+	first := failed[0]
+	return fmt.Sprintf("error fetching %d of %d ranges, first %d+%d: %s", len(failed), len(failed)+len(e.Done), first.Offset, first.Length, e.Failed[first])
+}
+
+// RetrieveRanges fetches "ranges" of file "path", writing each at its
+// offset in "dest". Ranges are sorted, and overlapping or adjacent ranges
+// are merged, before being fetched concurrently with RetrieveRange over up
+// to Config.ConnectionsPerHost connections. Each range is tried a few times
+// before giving up. If the server doesn't support "REST STREAM", the file
+// is instead read once from the start, writing the bytes in the ranges and
+// discarding the rest, until the last range is done. If only some ranges
+// fail, the others are still written and a *RangesError says which is
+// which. Empty ranges are ignored.
+func (c *Client) RetrieveRanges(path string, dest io.WriterAt, ranges []ByteRange) error {
+	merged, err := coalesceRanges(ranges)
+	if err != nil || len(merged) == 0 {
+		return err
+	}
+
+	canResume, err := c.canResume(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var failed map[ByteRange]error
+	if canResume {
+		failed = c.retrieveRangesParallel(path, dest, merged)
+	} else {
+		c.debug("server doesn't support resuming, reading %s sequentially", path)
+		failed = c.retrieveRangesSequential(path, dest, merged)
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	rangesErr := &RangesError{Failed: failed}
+	for _, r := range merged {
+		if _, ok := failed[r]; !ok {
+			rangesErr.Done = append(rangesErr.Done, r)
+		}
+	}
+
+	return rangesErr
+}
+
+// Sort "ranges" and merge any that overlap or touch, dropping empty ones.
+func coalesceRanges(ranges []ByteRange) ([]ByteRange, error) {
+	sorted := make([]ByteRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 {
+			return nil, ftpError{err: fmt.Errorf("invalid range %d+%d", r.Offset, r.Length)}
+		}
+
+		if r.Length > 0 {
+			sorted = append(sorted, r)
+		}
+	}
+
+	sortRanges(sorted)
+
+	var merged []ByteRange
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.Offset <= merged[n-1].end() {
+			if r.end() > merged[n-1].end() {
+				merged[n-1].Length = r.end() - merged[n-1].Offset
+			}
+			continue
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged, nil
+}
+
+func sortRanges(ranges []ByteRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Offset < ranges[j].Offset
+	})
+}
+
+// Fetch each of "ranges" with RetrieveRange, returning the errors of those
+// that failed.
+func (c *Client) retrieveRangesParallel(path string, dest io.WriterAt, ranges []ByteRange) map[ByteRange]error {
+	workers := c.config.ConnectionsPerHost
+	if workers > len(ranges) {
+		workers = len(ranges)
+	}
+
+	type result struct {
+		r   ByteRange
+		err error
+	}
+
+	jobs := make(chan ByteRange)
+	results := make(chan result)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for r := range jobs {
+				results <- result{r, c.retrieveByteRange(path, dest, r)}
+			}
+		}()
+	}
+
+	go func() {
+		for _, r := range ranges {
+			jobs <- r
+		}
+		close(jobs)
+	}()
+
+	failed := make(map[ByteRange]error)
+	for range ranges {
+		if res := <-results; res.err != nil {
+			failed[res.r] = res.err
+		}
+	}
+
+	return failed
+}
+
+// Fetch range "r" of "path" into "dest", retrying failures.
+func (c *Client) retrieveByteRange(path string, dest io.WriterAt, r ByteRange) error {
+	var err error
+	for attempt := 0; attempt < parallelSegmentAttempts; attempt++ {
+		err = c.RetrieveRange(path, io.NewOffsetWriter(dest, r.Offset), r.Offset, r.end()-1)
+		if err == nil {
+			return nil
+		}
+
+		c.debug("error fetching %s range %d+%d (attempt %d): %s", path, r.Offset, r.Length, attempt+1, err)
+	}
+
+	return err
+}
+
+// Read "path" from the start, writing the bytes in "ranges" and aborting
+// the transfer after the last one. Returns the errors of ranges that
+// weren't finished.
+func (c *Client) retrieveRangesSequential(path string, dest io.WriterAt, ranges []ByteRange) map[ByteRange]error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &rangesWriter{dest: dest, ranges: ranges, done: cancel}
+
+	_, err := c.retrieve(ctx, path, w, 0)
+	if err == context.Canceled && w.pos >= ranges[len(ranges)-1].end() {
+		// we stopped the transfer ourselves
+		err = nil
+	}
+
+	failed := make(map[ByteRange]error)
+	for _, r := range ranges {
+		if w.pos >= r.end() && (w.err == nil || r.end() <= w.errPos) {
+			continue
+		}
+
+		if w.err != nil {
+			failed[r] = w.err
+		} else if err != nil {
+			failed[r] = err
+		} else {
+			failed[r] = ftpError{err: fmt.Errorf("file ended at %d", w.pos)}
+		}
+	}
+
+	return failed
+}
+
+// Writes the bytes of a file that fall within "ranges" (sorted and not
+// overlapping) to "dest" at their offsets, discarding the rest, and calls
+// "done" once past the last range.
+type rangesWriter struct {
+	dest   io.WriterAt
+	ranges []ByteRange
+	done   func()
+
+	// offset in the file of the next byte written
+	pos int64
+
+	// first error writing to dest, and where
+	err    error
+	errPos int64
+}
+
+func (rw *rangesWriter) Write(buf []byte) (int, error) {
+	start, end := rw.pos, rw.pos+int64(len(buf))
+	rw.pos = end
+
+	if rw.err != nil {
+		return len(buf), nil
+	}
+
+	for _, r := range rw.ranges {
+		from, to := r.Offset, r.end()
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+
+		if from >= to {
+			continue
+		}
+
+		if _, err := rw.dest.WriteAt(buf[from-start:to-start], from); err != nil {
+			rw.err, rw.errPos = err, from
+			rw.done()
+			return len(buf), nil
+		}
+	}
+
+	if end >= rw.ranges[len(rw.ranges)-1].end() {
+		rw.done()
+	}
+
+	return len(buf), nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An io.WriterAt over a fixed size buffer.
+type bufferAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return copy(b.buf[off:], p), nil
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	cases := []struct {
+		in  []ByteRange
+		out []ByteRange
+	}{
+		{nil, nil},
+		{[]ByteRange{{5, 0}}, nil},
+		{[]ByteRange{{10, 5}, {0, 5}}, []ByteRange{{0, 5}, {10, 5}}},
+		{[]ByteRange{{0, 5}, {5, 5}}, []ByteRange{{0, 10}}},
+		{[]ByteRange{{0, 10}, {2, 3}, {8, 4}}, []ByteRange{{0, 12}}},
+	}
+
+	for _, c := range cases {
+		got, err := coalesceRanges(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, c.out) {
+			t.Errorf("%v: got %v, expected %v", c.in, got, c.out)
+		}
+	}
+
+	if _, err := coalesceRanges([]ByteRange{{-1, 5}}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRetrieveRanges(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	data := strings.Repeat("0123456789", 100)
+	server.data["RETR file"] = data
+
+	ranges := []ByteRange{{500, 10}, {10, 5}, {15, 5}, {12, 2}, {900, 0}}
+
+	for _, rest := range []bool{true, false} {
+		if !rest {
+			server.features = []string{"SIZE", "EPSV"}
+		}
+
+		c, err := DialConfig(Config{ConnectionsPerHost: 2}, server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := len(server.receivedCommands())
+
+		dest := &bufferAt{buf: make([]byte, len(data))}
+		if err := c.RetrieveRanges("file", dest, ranges); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(dest.buf[10:20]); got != data[10:20] {
+			t.Errorf("got %q", got)
+		}
+
+		if got := string(dest.buf[500:510]); got != data[500:510] {
+			t.Errorf("got %q", got)
+		}
+
+		if got := string(dest.buf[20:500]); got != strings.Repeat("\x00", 480) {
+			t.Errorf("unexpected bytes written outside the ranges")
+		}
+
+		var rests, retrs int
+		for _, cmd := range server.receivedCommands()[before:] {
+			if strings.HasPrefix(cmd, "REST ") {
+				rests++
+			} else if strings.HasPrefix(cmd, "RETR ") {
+				retrs++
+			}
+		}
+
+		if rest && (rests != 2 || retrs != 2) {
+			t.Errorf("expected 2 RESTs and RETRs, got %d and %d", rests, retrs)
+		} else if !rest && (rests != 0 || retrs != 1) {
+			t.Errorf("expected 1 RETR without REST, got %d and %d", retrs, rests)
+		}
+
+		// past the end of the file
+		err = c.RetrieveRanges("file", dest, []ByteRange{{995, 10}, {10, 10}})
+
+		var rangesErr *RangesError
+		if !errors.As(err, &rangesErr) {
+			t.Fatalf("expected *RangesError, got %v", err)
+		}
+
+		if !reflect.DeepEqual(rangesErr.Done, []ByteRange{{10, 10}}) {
+			t.Errorf("got %v", rangesErr.Done)
+		}
+
+		if len(rangesErr.Failed) != 1 || rangesErr.Failed[ByteRange{995, 10}] == nil {
+			t.Errorf("got %v", rangesErr.Failed)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+
+		c.Close()
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures automatic retries of operations that fail with
+// transient errors (see Config.RetryPolicy). Only operations that are safe
+// to repeat are retried: ReadDir, Stat, Retrieve (only if nothing was
+// written to the destination yet) and Store (only if the source is an
+// io.Seeker, which is rewound before each retry). Idle connections used by
+// a failed attempt are closed before retrying, so each retry starts on a
+// fresh connection.
+//
+// Regardless of RetryPolicy, an operation the server answers with 421
+// (service not available, e.g. because it's shutting down or over its
+// session limit) is retried once right away on another connection, if
+// it's safe to repeat as above or is a simple command such as Delete,
+// Rename, Mkdir, Rmdir or Getwd.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one. Values below 2
+	// mean no retries.
+	MaxAttempts int
+
+	// Backoff before the first retry. It doubles for each retry after that,
+	// up to MaxBackoff. The actual wait is chosen randomly between zero and
+	// the backoff ("full jitter"), so many clients don't retry in lockstep.
+	// Defaults to 100 milliseconds.
+	InitialBackoff time.Duration
+
+	// Upper limit for the backoff. Defaults to 10 seconds.
+	MaxBackoff time.Duration
+
+	// Decides whether an error is worth retrying. Defaults to
+	// IsRetryableError.
+	Retryable func(error) bool
+}
+
+// IsRetryableError is the default RetryPolicy.Retryable. It returns true
+// for Errors that are temporary, which includes timeouts, broken
+// connections and 4xx replies.
+func IsRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var fe Error
+	if !errors.As(err, &fe) {
+		return false
+	}
+
+	return fe.Temporary() || transientNegativeCompletionReply(fe.Code())
+}
+
+// RetryError is returned when an operation still failed after being
+// retried. It satisfies the Error interface, delegating to the last
+// attempt's error.
+type RetryError struct {
+	// Number of attempts made.
+	Attempts int
+
+	// The last attempt's error.
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s (after %d attempts)", e.Err, e.Attempts)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RetryError) Temporary() bool {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Temporary()
+	}
+	return false
+}
+
+func (e *RetryError) Code() int {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Code()
+	}
+	return 0
+}
+
+func (e *RetryError) Message() string {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Message()
+	}
+	return ""
+}
+
+// Connections an attempt of withRetries got from the pool, so they can be
+// closed if it fails rather than used again by the retry.
+type attemptConns struct {
+	mu    sync.Mutex
+	conns []*persistentConn
+}
+
+type attemptConnsKey struct{}
+
+// Record that the attempt "ctx" belongs to (if any) used "pconn".
+func trackAttemptConn(ctx context.Context, pconn *persistentConn) {
+	if ac, ok := ctx.Value(attemptConnsKey{}).(*attemptConns); ok {
+		ac.mu.Lock()
+		ac.conns = append(ac.conns, pconn)
+		ac.mu.Unlock()
+	}
+}
+
+// Close the connections in "used" that are idle. Any that another
+// operation has taken since are left alone.
+func (c *Client) closeAttemptConns(used *attemptConns) {
+	used.mu.Lock()
+	failed := make(map[*persistentConn]bool, len(used.conns))
+	for _, pconn := range used.conns {
+		failed[pconn] = true
+	}
+	used.mu.Unlock()
+
+	var idle []*persistentConn
+
+	c.mu.Lock()
+	for n := len(c.freeConnCh); n > 0; n-- {
+		pconn := <-c.freeConnCh
+
+		if failed[pconn] {
+			idle = append(idle, pconn)
+		} else {
+			c.freeConnCh <- pconn
+		}
+	}
+	c.mu.Unlock()
+
+	for _, pconn := range idle {
+		c.debug("#%d was used by a failed attempt, closing", pconn.idx)
+		c.quitConn(pconn, "failed attempt")
+	}
+}
+
+// Call "attempt" until it succeeds or Config.RetryPolicy gives up. Each
+// call gets a context derived from "ctx" which records the connections it
+// uses (see trackAttemptConn), so they aren't reused by the next attempt.
+// If "prepare" is non-nil, it is called before each retry, and returns
+// false if it isn't safe to retry anymore (e.g. a download already wrote
+// some bytes).
+func (c *Client) withRetries(ctx context.Context, name string, attempt func(context.Context) error, prepare func() bool) error {
+	policy := c.config.RetryPolicy
+
+	var used *attemptConns
+	try := func() error {
+		used = &attemptConns{}
+		return attempt(context.WithValue(ctx, attemptConnsKey{}, used))
+	}
+
+	err := c.retryUnavailable(name, try, prepare)
+	if err == nil || policy == nil || policy.MaxAttempts < 2 {
+		return err
+	}
+
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryableError
+	}
+
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+
+	attempts := 1
+	for ; err != nil && attempts < policy.MaxAttempts; attempts++ {
+		if !retryable(err) || ctx.Err() != nil {
+			break
+		}
+
+		if prepare != nil && !prepare() {
+			c.debug("%s isn't safe to retry: %s", name, err)
+			break
+		}
+
+		c.closeAttemptConns(used)
+
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		c.debug("%s failed (attempt %d), retrying in %s: %s", name, attempts, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		err = try()
+	}
+
+	if err != nil && attempts > 1 {
+		return &RetryError{Attempts: attempts, Err: err}
+	}
+
+	return err
+}
+
+// Whether "err" is the server replying 421 (service not available) to an
+// operation, which it sends before closing the control connection. The
+// command wasn't carried out, so repeating it on another connection is
+// safe. A 421 while connecting is left to host failover (see HostError).
+func serviceUnavailable(err error) bool {
+	var hostErr *HostError
+	if errors.As(err, &hostErr) {
+		return false
+	}
+
+	var fe Error
+	return errors.As(err, &fe) && fe.Code() == replyServiceNotAvailable
+}
+
+// Call "attempt", and if the server replied 421, call it once more, on
+// another connection since the 421 marked the first one broken. "prepare"
+// is as for withRetries.
+func (c *Client) retryUnavailable(name string, attempt func() error, prepare func() bool) error {
+	err := attempt()
+	if !serviceUnavailable(err) {
+		return err
+	}
+
+	if prepare != nil && !prepare() {
+		c.debug("%s got 421, but isn't safe to retry: %s", name, err)
+		return err
+	}
+
+	c.debug("%s got 421, retrying on another connection: %s", name, err)
+	return attempt()
+}
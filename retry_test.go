@@ -0,0 +1,382 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// fails "failures" times with 450, then succeeds
+	failures := map[string]int{"flaky": 2, "down": 100}
+	server.handlers["MLST"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		fail := failures[arg] > 0
+		failures[arg]--
+		server.mu.Unlock()
+
+		if arg == "missing" {
+			fc.reply(550, "no such file")
+		} else if fail {
+			fc.reply(450, "try again later")
+		} else {
+			fc.reply(250, "Listing "+arg+"\n type=file;size=5;modify=20150216084148; "+arg+"\nEnd")
+		}
+	}
+
+	config := Config{
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Stat("flaky"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Stat("down")
+
+	retryErr, ok := err.(*RetryError)
+	if !ok {
+		t.Fatalf("expected *RetryError, got %v", err)
+	}
+
+	if retryErr.Attempts != 3 || retryErr.Code() != 450 {
+		t.Errorf("got %+v", retryErr)
+	}
+
+	// permanent errors aren't retried
+	_, err = c.Stat("missing")
+	if _, ok := err.(*RetryError); ok || err == nil || err.(Error).Code() != 550 {
+		t.Errorf("got %v", err)
+	}
+
+	var mlsts int
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "MLST missing" {
+			mlsts++
+		}
+	}
+
+	if mlsts != 1 {
+		t.Errorf("expected 1 attempt, got %d", mlsts)
+	}
+
+	// ReadDirContext is retried like ReadDir
+	failures["dir"] = 2
+	server.handlers["MLSD"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		fail := failures[arg] > 0
+		failures[arg]--
+		server.mu.Unlock()
+
+		if fail {
+			fc.reply(450, "try again later")
+		} else {
+			fc.sendData("type=file;size=5;modify=20150216084148; file\r\n")
+		}
+	}
+
+	list, err := c.ReadDirContext(context.Background(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0].Name() != "file" {
+		t.Errorf("got %v", list)
+	}
+
+	// no policy, no retries
+	failures["flaky"] = 1
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Stat("flaky"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRetryTransfers(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// no REST STREAM, so failed transfers aren't resumed
+	server.features = []string{"SIZE", "EPSV"}
+
+	var retrFailures, storFailures int
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		if retrFailures > 0 {
+			retrFailures--
+			fc.reply(425, "can't open data connection")
+			return
+		}
+		fc.sendData("hello world")
+	}
+	server.handlers["STOR"] = func(fc *fakeConn, arg string) {
+		if storFailures > 0 {
+			storFailures--
+
+			dc, err := fc.acceptData()
+			if err != nil {
+				fc.reply(425, err.Error())
+				return
+			}
+
+			fc.reply(150, "send it")
+			ioutil.ReadAll(dc)
+			dc.Close()
+			fc.reply(451, "disk hiccup")
+			return
+		}
+		fc.receiveData(arg, false)
+	}
+
+	var done []TransferInfo
+
+	config := Config{
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+		},
+		TransferObserver: func(info TransferInfo) {
+			if info.Done {
+				done = append(done, info)
+			}
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retrFailures = 1
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	// only the final result is reported
+	if len(done) != 1 || done[0].Err != nil || done[0].Bytes != 11 {
+		t.Errorf("got %+v", done)
+	}
+
+	// the retry didn't reuse the failed connection
+	var logins int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "USER ") {
+			logins++
+		}
+	}
+
+	if logins != 2 || c.numOpenConns() != 1 {
+		t.Errorf("got %d logins, %d open connections", logins, c.numOpenConns())
+	}
+
+	// source is rewound before retrying
+	storFailures = 1
+
+	if err := c.Store("upload", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["upload"]); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+
+	// can't rewind
+	storFailures = 1
+
+	if err := c.Store("upload", bytes.NewBufferString("hello")); err == nil {
+		t.Error("expected error")
+	}
+
+	// canceled while waiting to retry
+	c.config.RetryPolicy.InitialBackoff = time.Hour
+	retrFailures = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.RetrieveContext(ctx, "file", ioutil.Discard); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{ftpError{code: 450, msg: "busy"}, true},
+		{ftpError{code: 421, msg: "closing"}, true},
+		{ftpError{code: 550, msg: "no such file"}, false},
+		{ftpError{err: errors.New("reset"), temporary: true}, true},
+		{ftpError{err: errors.New("bad")}, false},
+		{&TransferError{Bytes: 5, Err: ftpError{code: 426, msg: "aborted"}}, true},
+		{errors.New("not ours"), false},
+		{context.Canceled, false},
+	}
+
+	for _, c := range cases {
+		if got := IsRetryableError(c.err); got != c.want {
+			t.Errorf("%v: got %t", c.err, got)
+		}
+	}
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// replies 421 and hangs up "unavailable" times
+	var unavailable int
+	goingAway := func(fc *fakeConn) bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		if unavailable == 0 {
+			return false
+		}
+
+		unavailable--
+		fc.reply(421, "shutting down")
+		fc.conn.Close()
+		return true
+	}
+
+	server.handlers["DELE"] = func(fc *fakeConn, arg string) {
+		if !goingAway(fc) {
+			fc.reply(250, "deleted")
+		}
+	}
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		if !goingAway(fc) {
+			fc.sendData("hello world")
+		}
+	}
+
+	log := new(bytes.Buffer)
+
+	c, err := DialConfig(Config{Logger: log}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	unavailable = 1
+
+	if err := c.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(log.String(), "DELE foo got 421, retrying on another connection") {
+		t.Errorf("retry not logged:\n%s", log)
+	}
+
+	// the broken connection wasn't pooled
+	if got := c.PoolStats(); got.Open != 1 || got.Idle != 1 {
+		t.Errorf("got %+v", got)
+	}
+
+	// transfers are retried too, without a RetryPolicy
+	unavailable = 1
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	// but only once
+	unavailable = 2
+
+	if err := c.Delete("foo"); err == nil || err.(Error).Code() != 421 {
+		t.Errorf("got %v", err)
+	}
+
+	// four control connections and RETR's data connection
+	server.mu.Lock()
+	if len(server.peers) != 5 {
+		t.Errorf("expected 5 connections, got %v", server.peers)
+	}
+	server.mu.Unlock()
+}
+
+func TestServiceUnavailableLogin(t *testing.T) {
+	full, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer full.close()
+
+	full.handlers["USER"] = func(fc *fakeConn, arg string) {
+		fc.reply(421, "too many users")
+		fc.conn.Close()
+	}
+
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	config := Config{
+		User:         "goftp",
+		Password:     "rocks",
+		HostStrategy: HostPrimary,
+	}
+
+	c, err := DialConfig(config, full.addr(), server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the first host is full, so we move on to the next
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	status := c.HostStatus()
+	if status[0].ConsecutiveFailures != 1 || status[0].LastError.(Error).Code() != 421 || status[1].Open != 1 {
+		t.Errorf("got %+v", status)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// How many recently read bytes a seekReader keeps around. Seeking back
+// within this window, or forward by less than it, doesn't restart the
+// transfer.
+const seekBufferSize = 64 * 1024
+
+// OpenSeek is like Open, but the returned reader also implements io.Seeker
+// (it is an io.ReadSeekCloser). Seeking is lazy; the next Read after a
+// Seek closes the current transfer and starts a new one at the new
+// position using "REST <offset>". Small seeks are served from an internal
+// buffer instead. Seeking relative to the end issues SIZE once (closing
+// any transfer in progress) and caches the result. Seeking to a non-zero
+// offset requires the server to support "REST STREAM" (see
+// ErrResumeUnsupported). Like Open, the reader holds a connection while a
+// transfer is in progress and must be closed.
+func (c *Client) OpenSeek(path string) (io.ReadSeekCloser, error) {
+	r, err := c.open(path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seekReader{
+		client:    c,
+		path:      path,
+		size:      -1,
+		r:         r,
+		eofOffset: -1,
+	}, nil
+}
+
+type seekReader struct {
+	client *Client
+	path   string
+
+	// current position as seen by the caller
+	offset int64
+
+	// file size, or -1 if we haven't asked for it yet
+	size int64
+
+	// the current transfer, if any, and the file position it is at
+	r       *retrieveReader
+	rOffset int64
+
+	// bytes most recently read from transfers, ending at rOffset
+	history []byte
+
+	// position where the file ended, or -1 if we haven't seen the end
+	eofOffset int64
+
+	closed bool
+}
+
+func (s *seekReader) Read(buf []byte) (int, error) {
+	if s.closed {
+		return 0, ftpError{err: errors.New("read from closed reader")}
+	}
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	if s.offset < s.rOffset && s.rOffset-s.offset <= int64(len(s.history)) {
+		// backward seek within our buffer
+		n := copy(buf, s.history[int64(len(s.history))-(s.rOffset-s.offset):])
+		s.offset += int64(n)
+		return n, nil
+	}
+
+	if s.eofOffset >= 0 && s.offset >= s.eofOffset || s.size >= 0 && s.offset >= s.size {
+		return 0, io.EOF
+	}
+
+	if s.r != nil && s.offset > s.rOffset && s.offset-s.rOffset <= seekBufferSize {
+		// small forward seek, read our way there
+		skip := make([]byte, 4096)
+		for s.offset > s.rOffset {
+			want := s.offset - s.rOffset
+			if want > int64(len(skip)) {
+				want = int64(len(skip))
+			}
+
+			if _, err := s.readTransfer(skip[:want]); err != nil {
+				if err == io.EOF {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+		}
+	}
+
+	if s.r == nil || s.offset != s.rOffset {
+		if err := s.restart(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.readTransfer(buf)
+	s.offset += int64(n)
+	return n, err
+}
+
+// Read from the current transfer, remembering what we read. At the end of
+// the transfer, the transfer is closed to check the server's final reply.
+func (s *seekReader) readTransfer(buf []byte) (int, error) {
+	if s.r == nil {
+		return 0, io.EOF
+	}
+
+	n, err := s.r.Read(buf)
+	s.rOffset += int64(n)
+
+	s.history = append(s.history, buf[:n]...)
+	if len(s.history) > seekBufferSize {
+		s.history = s.history[len(s.history)-seekBufferSize:]
+	}
+
+	if err == io.EOF {
+		s.eofOffset = s.rOffset
+		closeErr := s.r.Close()
+		s.r = nil
+		if closeErr != nil {
+			return n, closeErr
+		}
+
+		if n > 0 {
+			err = nil
+		}
+	}
+
+	return n, err
+}
+
+// Close the current transfer and start a new one at our offset.
+func (s *seekReader) restart() error {
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+
+	if s.offset > 0 {
+		canResume, err := s.client.canResume(context.Background())
+		if err != nil {
+			return err
+		}
+
+		if !canResume {
+			return ftpError{err: ErrResumeUnsupported}
+		}
+	}
+
+	r, err := s.client.open(s.path, s.offset)
+	if err != nil {
+		return err
+	}
+
+	s.r = r
+	s.rOffset = s.offset
+	s.history = s.history[:0]
+
+	return nil
+}
+
+func (s *seekReader) Seek(offset int64, whence int) (int64, error) {
+	if s.closed {
+		return 0, ftpError{err: errors.New("seek on closed reader")}
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		if s.size < 0 {
+			// SIZE needs a connection, so give ours back first
+			if s.r != nil {
+				s.r.Close()
+				s.r = nil
+			}
+
+			size, err := s.client.size(context.Background(), s.path)
+			if err != nil {
+				return 0, err
+			}
+
+			if size < 0 {
+				return 0, ftpError{err: errors.New("can't seek relative to end: unknown file size")}
+			}
+
+			s.size = size
+		}
+		offset += s.size
+	default:
+		return 0, ftpError{err: errors.New("invalid whence")}
+	}
+
+	if offset < 0 {
+		return 0, ftpError{err: errors.New("negative position")}
+	}
+
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *seekReader) Close() error {
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	if s.r != nil {
+		err := s.r.Close()
+		s.r = nil
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestOpenSeek(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["SIZE file"] = fakeReply{213, "11"}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countRetrs := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if cmd == "RETR file" {
+				n++
+			}
+		}
+		return n
+	}
+
+	r, err := c.OpenSeek("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readString := func(n int) string {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	if got := readString(5); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+
+	// small seeks don't start a new transfer
+	if pos, err := r.Seek(-4, io.SeekCurrent); err != nil || pos != 1 {
+		t.Fatalf("got %d %v", pos, err)
+	}
+
+	if got := readString(4); got != "ello" {
+		t.Errorf("got %q", got)
+	}
+
+	if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readString(3); got != "wor" {
+		t.Errorf("got %q", got)
+	}
+
+	if n := countRetrs(); n != 1 {
+		t.Errorf("expected 1 RETR, got %d", n)
+	}
+
+	// seeking from the end uses SIZE, then the buffered "wor" is reused and
+	// the transfer restarts at offset 9
+	if pos, err := r.Seek(-5, io.SeekEnd); err != nil || pos != 6 {
+		t.Fatalf("got %d %v", pos, err)
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rest) != "world" {
+		t.Errorf("got %q", rest)
+	}
+
+	if n := countRetrs(); n != 2 {
+		t.Errorf("expected 2 RETRs, got %d", n)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(all) != "hello world" {
+		t.Errorf("got %q", all)
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected error")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sawRest bool
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "REST 9" {
+			sawRest = true
+		}
+	}
+
+	if !sawRest {
+		t.Error("expected REST 9")
+	}
+
+	// no REST STREAM
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = c.OpenSeek("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Seek(2*seekBufferSize, io.SeekStart)
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrResumeUnsupported) {
+		t.Errorf("expected ErrResumeUnsupported, got %v", err)
+	}
+
+	r.Close()
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Longest Tail waits before retrying after a transient error.
+const maxTailBackoff = time.Minute
+
+// TailOptions configures Tail.
+type TailOptions struct {
+	// How often to check whether the file has grown. Defaults to 1 second.
+	Poll time.Duration
+
+	// Where to start following the file. Negative means the file's size
+	// when Tail starts, i.e. only bytes appended after that are copied.
+	// Defaults to 0, meaning the whole file is copied first.
+	Offset int64
+
+	// If set, called with the file's new size when it shrinks (e.g.
+	// because it was truncated or replaced by log rotation). Tail then
+	// starts over from the beginning of the file.
+	OnTruncate func(size int64)
+}
+
+// Tail follows remote file "path" as it grows, like "tail -f", copying
+// bytes appended to it to "out". It checks the file's size every
+// TailOptions.Poll (using SIZE, or Stat if the server doesn't support
+// SIZE), and downloads only the new bytes using "REST <offset>", so the
+// server must support "REST STREAM". Transient errors (see
+// IsRetryableError) are retried with exponential backoff, up to a minute
+// between attempts. Tail runs until "ctx" is done, returning ctx.Err(), or
+// until a permanent error occurs.
+func (c *Client) Tail(ctx context.Context, path string, out io.Writer, opts TailOptions) error {
+	poll := opts.Poll
+	if poll <= 0 {
+		poll = time.Second
+	}
+
+	offset := opts.Offset
+	wait := time.Duration(0)
+	backoff := poll
+
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err := c.tailOnce(ctx, path, out, &offset, opts.OnTruncate)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == nil {
+			wait, backoff = poll, poll
+			continue
+		}
+
+		if !IsRetryableError(err) {
+			return err
+		}
+
+		c.debug("error following %s, retrying in %s: %s", path, backoff, err)
+
+		wait = backoff
+		if backoff *= 2; backoff > maxTailBackoff {
+			backoff = maxTailBackoff
+		}
+	}
+}
+
+// Copy any bytes of "path" past "*offset" to "out", advancing *offset.
+func (c *Client) tailOnce(ctx context.Context, path string, out io.Writer, offset *int64, onTruncate func(int64)) error {
+	size, err := c.size(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if size < 0 {
+		info, err := c.Stat(path)
+		if err != nil {
+			return err
+		}
+		size = info.Size()
+	}
+
+	if *offset < 0 {
+		*offset = size
+	}
+
+	if size < *offset {
+		c.debug("%s shrank from %d to %d bytes, starting over", path, *offset, size)
+		*offset = 0
+		if onTruncate != nil {
+			onTruncate(size)
+		}
+	}
+
+	if size == *offset {
+		return nil
+	}
+
+	if *offset > 0 {
+		canResume, err := c.canResume(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !canResume {
+			return ftpError{err: ErrResumeUnsupported}
+		}
+	}
+
+	// the file may have grown since, so don't check the size
+	n, err := c.transferFromOffset(ctx, "RETR", path, out, nil, *offset, nil)
+	*offset += n
+	return err
+}
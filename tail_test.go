@@ -0,0 +1,196 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTail(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	var (
+		contents     = "line 1\n"
+		retrFailures int
+	)
+
+	setContents := func(s string) {
+		server.mu.Lock()
+		contents = s
+		server.mu.Unlock()
+	}
+
+	server.handlers["SIZE"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		size := len(contents)
+		server.mu.Unlock()
+		fc.reply(213, strconv.Itoa(size))
+	}
+
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		data := contents
+		fail := retrFailures > 0
+		if fail {
+			retrFailures--
+		}
+		server.mu.Unlock()
+
+		if fail {
+			fc.reply(425, "can't open data connection")
+			return
+		}
+
+		fc.sendData(data)
+	}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		out       = &syncBuffer{}
+		truncated = make(chan int64, 1)
+		done      = make(chan error, 1)
+	)
+
+	go func() {
+		done <- c.Tail(ctx, "log", out, TailOptions{
+			Poll:       5 * time.Millisecond,
+			OnTruncate: func(size int64) { truncated <- size },
+		})
+	}()
+
+	waitFor := func(exp string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for out.String() != exp {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q, got %q", exp, out.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitFor("line 1\n")
+
+	setContents("line 1\nline 2\n")
+	waitFor("line 1\nline 2\n")
+
+	// transient failure is retried
+	server.mu.Lock()
+	retrFailures = 1
+	server.mu.Unlock()
+
+	setContents("line 1\nline 2\nline 3\n")
+	waitFor("line 1\nline 2\nline 3\n")
+
+	// rotated
+	setContents("new\n")
+
+	select {
+	case size := <-truncated:
+		if size != 4 {
+			t.Errorf("got %d", size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("truncation not noticed")
+	}
+
+	waitFor("line 1\nline 2\nline 3\nnew\n")
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tail didn't return")
+	}
+
+	// only bytes appended after starting
+	setContents("old\n")
+
+	sizes := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if cmd == "SIZE log" {
+				n++
+			}
+		}
+		return n
+	}
+
+	before := sizes()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	var newOut syncBuffer
+	go func() {
+		done <- c.Tail(ctx, "log", &newOut, TailOptions{Offset: -1, Poll: 5 * time.Millisecond})
+	}()
+
+	for sizes() == before {
+		time.Sleep(time.Millisecond)
+	}
+
+	setContents("old\nnew\n")
+
+	out = &newOut
+	waitFor("new\n")
+
+	cancel()
+	<-done
+
+	// permanent errors end it
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Tail(context.Background(), "log", ioutil.Discard, TailOptions{Offset: 2})
+	if !errors.Is(err, ErrResumeUnsupported) {
+		t.Errorf("expected ErrResumeUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"io"
+	"time"
+)
+
+// A token bucket limiting throughput to "rate" bytes per second, with bursts
+// of up to one second's worth of bytes.
+type rateLimiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+
+	// for testing
+	sleep func(time.Duration)
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+		sleep:  time.Sleep,
+	}
+}
+
+// Largest amount of bytes to move at once.
+func (l *rateLimiter) burst() int {
+	return int(l.rate)
+}
+
+// Take "n" tokens, sleeping until they are available. The bucket may go
+// into debt, which later calls pay off.
+func (l *rateLimiter) wait(n int) {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		l.sleep(time.Duration(-l.tokens / float64(l.rate) * float64(time.Second)))
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (tr throttledReader) Read(buf []byte) (int, error) {
+	if len(buf) > tr.l.burst() {
+		buf = buf[:tr.l.burst()]
+	}
+
+	n, err := tr.r.Read(buf)
+	tr.l.wait(n)
+	return n, err
+}
+
+type throttledWriter struct {
+	w io.Writer
+	l *rateLimiter
+}
+
+func (tw throttledWriter) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > tw.l.burst() {
+			chunk = chunk[:tw.l.burst()]
+		}
+
+		tw.l.wait(len(chunk))
+
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		buf = buf[n:]
+	}
+
+	return written, nil
+}
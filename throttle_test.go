@@ -0,0 +1,107 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var slept time.Duration
+	l := newRateLimiter(100)
+	l.sleep = func(d time.Duration) {
+		slept += d
+		// pretend time passed
+		l.last = l.last.Add(-d)
+	}
+
+	// one second's worth of burst is free
+	l.wait(100)
+	if slept > 10*time.Millisecond {
+		t.Errorf("slept %s", slept)
+	}
+
+	// the next second's worth has to wait
+	l.wait(100)
+	if slept < 900*time.Millisecond || slept > 1100*time.Millisecond {
+		t.Errorf("slept %s", slept)
+	}
+}
+
+func TestThrottledReaderWriter(t *testing.T) {
+	l := newRateLimiter(10)
+	var slept time.Duration
+	l.sleep = func(d time.Duration) {
+		slept += d
+		l.last = l.last.Add(-d)
+	}
+
+	buf := make([]byte, 100)
+	n, err := throttledReader{strings.NewReader(strings.Repeat("a", 100)), l}.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 10 {
+		t.Errorf("read should be capped at burst size, got %d", n)
+	}
+
+	out := new(bytes.Buffer)
+	n, err = throttledWriter{out, l}.Write([]byte(strings.Repeat("b", 35)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 35 || out.Len() != 35 {
+		t.Errorf("wrote %d", n)
+	}
+
+	// 45 bytes with 10 free at 10 bytes/s
+	if slept < 3*time.Second || slept > 4*time.Second {
+		t.Errorf("slept %s", slept)
+	}
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = strings.Repeat("a", 300)
+
+	c, err := DialConfig(Config{MaxBytesPerSecond: 1000}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Now()
+
+	// 1000 byte burst, then 500 bytes at 1000/s
+	if err := c.Store("upload", strings.NewReader(strings.Repeat("b", 1500))); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(t0); elapsed < 400*time.Millisecond {
+		t.Errorf("upload too fast: %s", elapsed)
+	}
+
+	if len(server.stored["upload"]) != 1500 {
+		t.Errorf("stored %d bytes", len(server.stored["upload"]))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 300 {
+		t.Errorf("got %d bytes", buf.Len())
+	}
+}
@@ -5,86 +5,1122 @@
 package goftp
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"path"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrResumeUnsupported is returned (wrapped in an Error) when asked to
+// resume a transfer at an offset on a server that doesn't support
+// "REST STREAM".
+var ErrResumeUnsupported = errors.New(`server doesn't support resuming transfers ("REST STREAM")`)
+
+// ErrTransferStalled is returned (wrapped in a *TransferError) when no data
+// moved for Config.StallTimeout.
+var ErrTransferStalled = errors.New("transfer stalled")
+
+// ErrTransferTimeout is returned (wrapped in an Error) when a transfer
+// didn't finish within Config.Timeout.
+var ErrTransferTimeout = errors.New("transfer timed out")
+
+// ErrUploadSizeMismatch is matched (via errors.Is) by the *UploadSizeError
+// returned when the size of an uploaded file doesn't match the number of
+// bytes sent.
+var ErrUploadSizeMismatch = errors.New("uploaded file size mismatch")
+
+// UploadSizeError is returned by Store and its variants when the server's
+// SIZE for the uploaded file differs from the number of bytes sent, e.g.
+// because the server truncated the file when it ran out of quota. It
+// satisfies the Error interface.
+type UploadSizeError struct {
+	Path string
+
+	// Number of bytes sent, including any offset the upload started at.
+	Sent int64
+
+	// Size reported by the server.
+	Size int64
+}
+
+func (e *UploadSizeError) Error() string {
+	return fmt.Sprintf("%s: sent %d bytes, but size is %d", e.Path, e.Sent, e.Size)
+}
+
+func (e *UploadSizeError) Is(target error) bool {
+	return target == ErrUploadSizeMismatch
+}
+
+// Temporary is always true, since the upload may succeed if retried.
+func (e *UploadSizeError) Temporary() bool { return true }
+func (e *UploadSizeError) Code() int       { return 0 }
+func (e *UploadSizeError) Message() string { return "" }
+
+// ErrSizeLimitExceeded is matched (via errors.Is) by the *SizeLimitError
+// returned when a download is bigger than Config.MaxRetrieveBytes.
+var ErrSizeLimitExceeded = errors.New("download size limit exceeded")
+
+// SizeLimitError is returned by Retrieve and its variants when the file
+// being downloaded is bigger than Config.MaxRetrieveBytes. It satisfies the
+// Error interface.
+type SizeLimitError struct {
+	Path string
+
+	Limit int64
+
+	// Number of bytes written before the transfer was aborted. Zero if SIZE
+	// showed the file was too big before the transfer started.
+	Bytes int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("%s: more than %d bytes (after %d bytes)", e.Path, e.Limit, e.Bytes)
+}
+
+func (e *SizeLimitError) Is(target error) bool {
+	return target == ErrSizeLimitExceeded
+}
+
+func (e *SizeLimitError) Temporary() bool { return false }
+func (e *SizeLimitError) Code() int       { return 0 }
+func (e *SizeLimitError) Message() string { return "" }
+
+// TransferError is returned when a transfer fails part way through. It
+// satisfies the Error interface, delegating to the underlying error where
+// possible.
+type TransferError struct {
+	// Number of bytes transferred before the failure.
+	Bytes int64
+
+	// The underlying error.
+	Err error
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("%s (after %d bytes)", e.Err, e.Bytes)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary is true unless the underlying error is a permanent Error.
+func (e *TransferError) Temporary() bool {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Temporary()
+	}
+	return true
+}
+
+// Timeout is true if the underlying error is a timeout, e.g. a stalled
+// transfer.
+func (e *TransferError) Timeout() bool {
+	if te, ok := e.Err.(interface{ Timeout() bool }); ok {
+		return te.Timeout()
+	}
+	return false
+}
+
+func (e *TransferError) Code() int {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Code()
+	}
+	return 0
+}
+
+func (e *TransferError) Message() string {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Message()
+	}
+	return ""
+}
+
+// TransferTypeError is returned when the server rejects the TYPE command,
+// e.g. because it doesn't support Config.TransferType. It satisfies the
+// Error interface, delegating to the server's reply.
+type TransferTypeError struct {
+	Type TransferType
+
+	// The underlying error.
+	Err error
+}
+
+func (e *TransferTypeError) Error() string {
+	return fmt.Sprintf("server rejected TYPE %s: %s", e.Type, e.Err)
+}
+
+func (e *TransferTypeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransferTypeError) Temporary() bool {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Temporary()
+	}
+	return false
+}
+
+func (e *TransferTypeError) Code() int {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Code()
+	}
+	return 0
+}
+
+func (e *TransferTypeError) Message() string {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Message()
+	}
+	return ""
+}
+
+// AllocateError is returned when the server rejects "ALLO" (see
+// Config.Allocate), e.g. because it doesn't have enough space. It satisfies
+// the Error interface, delegating to the server's reply.
+type AllocateError struct {
+	Size int64
+
+	// The underlying error.
+	Err error
+}
+
+func (e *AllocateError) Error() string {
+	return fmt.Sprintf("server rejected ALLO %d: %s", e.Size, e.Err)
+}
+
+func (e *AllocateError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AllocateError) Temporary() bool {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Temporary()
+	}
+	return false
+}
+
+func (e *AllocateError) Code() int {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Code()
+	}
+	return 0
+}
+
+func (e *AllocateError) Message() string {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Message()
+	}
+	return ""
+}
+
 // Retrieve file "path" from server and write bytes to "dest". If the
 // server supports resuming stream transfers, Retrieve will continue
 // resuming a failed download as long as it continues making progress.
 // Retrieve will also verify the file's size after the transfer if the
 // server supports the SIZE command.
 func (c *Client) Retrieve(path string, dest io.Writer) error {
+	_, err := c.RetrieveFrom(path, dest, 0)
+	return err
+}
+
+// RetrieveFrom is like Retrieve, but starts "offset" bytes into the file
+// using "REST <offset>", e.g. to continue a download that was interrupted.
+// It returns the number of bytes written to "dest". If offset is non-zero
+// and the server doesn't advertise "REST STREAM", the returned error
+// satisfies errors.Is(err, ErrResumeUnsupported).
+func (c *Client) RetrieveFrom(path string, dest io.Writer, offset int64) (int64, error) {
+	return c.retrieve(context.Background(), path, dest, offset)
+}
+
+// RetrieveN is like Retrieve, but also returns the number of bytes read
+// from the data connection, even if the download failed, e.g. because the
+// server sent fewer bytes than SIZE said.
+func (c *Client) RetrieveN(path string, dest io.Writer) (int64, error) {
+	return c.RetrieveFrom(path, dest, 0)
+}
+
+// RetrieveContext is like Retrieve, but stops when "ctx" is canceled or its
+// deadline passes. The transfer in progress is aborted with ABOR, and
+// ctx.Err() is returned. The connection is reused if the server
+// acknowledges the abort, and discarded otherwise.
+func (c *Client) RetrieveContext(ctx context.Context, path string, dest io.Writer) error {
+	_, err := c.retrieve(ctx, path, dest, 0)
+	return err
+}
+
+func (c *Client) retrieve(ctx context.Context, path string, dest io.Writer, offset int64) (int64, error) {
+	var (
+		n        int64
+		progress *transferProgress
+	)
+	err := c.withRetries(ctx, "RETR "+path, func(ctx context.Context) error {
+		var err error
+		n, progress, err = c.retrieveOnce(ctx, path, dest, offset)
+		return err
+	}, func() bool {
+		// don't write the same bytes to dest twice
+		return n == 0
+	})
+	progress.done(err)
+	return n, err
+}
+
+// Retrieve "path" once, without retries. The returned progress, if any, is
+// left for the caller to finish with the final result.
+func (c *Client) retrieveOnce(ctx context.Context, path string, dest io.Writer, offset int64) (int64, *transferProgress, error) {
+	canResume, err := c.canResume(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if offset > 0 && !canResume {
+		return 0, nil, ftpError{err: ErrResumeUnsupported}
+	}
+
 	// fetch file size to check against how much we transferred
-	size, err := c.size(path)
+	size, err := c.size(ctx, path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	limit := c.config.MaxRetrieveBytes
+	if limit > 0 && size-offset > limit {
+		return 0, nil, &SizeLimitError{Path: path, Limit: limit}
+	}
+
+	check, err := c.newHashCheck(path, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	progress := c.newTransferProgress(path, TransferDownload, offset, size)
+	dest = check.writer(progress.writer(dest))
+
+	var capped *cappedWriter
+	if limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		capped = &cappedWriter{w: dest, remaining: limit, exceeded: cancel}
+		dest = capped
+	}
+
+	n, err := c.retrieveFrom(ctx, path, dest, offset, size, canResume)
+	if capped != nil && capped.over {
+		err = &SizeLimitError{Path: path, Limit: limit, Bytes: limit - capped.remaining}
+	} else if err == nil {
+		err = check.verify(c)
+	}
+	return n, progress, err
+}
+
+// Writes up to "remaining" bytes. Once more are written, it calls
+// "exceeded" (to abort the transfer) and discards them.
+type cappedWriter struct {
+	w         io.Writer
+	remaining int64
+	exceeded  func()
+	over      bool
+}
+
+func (cw *cappedWriter) Write(buf []byte) (int, error) {
+	if cw.over {
+		return len(buf), nil
+	}
+
+	full := len(buf)
+	if int64(len(buf)) > cw.remaining {
+		buf = buf[:cw.remaining]
+		cw.over = true
+	}
+
+	n, err := cw.w.Write(buf)
+	cw.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if cw.over {
+		cw.exceeded()
+	}
+
+	return full, nil
+}
+
+func (c *Client) retrieveFrom(ctx context.Context, path string, dest io.Writer, offset, size int64, canResume bool) (int64, error) {
+	bytesSoFar := offset
+	for {
+		n, err := c.transferFromOffset(ctx, "RETR", path, dest, nil, bytesSoFar, nil)
+
+		bytesSoFar += n
+
+		if err == nil {
+			break
+		} else if ctx.Err() != nil || errors.Is(err, ErrTransferTimeout) {
+			return bytesSoFar - offset, err
+		} else if stalled := stalledError(err, bytesSoFar-offset); stalled != nil && (n == 0 || !canResume) {
+			return bytesSoFar - offset, stalled
+		} else if n == 0 {
+			return bytesSoFar - offset, err
+		} else if !canResume {
+			return bytesSoFar - offset, ftpError{
+				err:       fmt.Errorf("%s (can't resume)", err),
+				temporary: true,
+			}
+		}
+	}
+
+	if size != -1 && bytesSoFar != size {
+		return bytesSoFar - offset, ftpError{
+			err:       fmt.Errorf("expected %d bytes, got %d", size, bytesSoFar),
+			temporary: true,
+		}
+	}
+
+	return bytesSoFar - offset, nil
+}
+
+// How many times RetrieveParallel tries each segment before giving up.
+const parallelSegmentAttempts = 3
+
+// RetrieveParallel is like Retrieve, but splits the file into "segments"
+// ranges which are fetched concurrently over separate connections (using
+// "REST <offset>"), writing each at its offset in "dest". This can be much
+// faster than Retrieve for large files from high latency servers. If
+// "segments" is <= 0, it defaults to Config.ConnectionsPerHost. Each segment
+// is retried (resuming where it left off) before RetrieveParallel gives up.
+// If the server doesn't support SIZE or "REST STREAM", RetrieveParallel
+// falls back to a normal Retrieve.
+func (c *Client) RetrieveParallel(path string, dest io.WriterAt, segments int) error {
+	if segments <= 0 {
+		segments = c.config.ConnectionsPerHost
+	}
+
+	size, err := c.size(context.Background(), path)
 	if err != nil {
 		return err
 	}
 
-	canResume := c.canResume()
+	canResume, err := c.canResume(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if size <= 0 || segments == 1 || !canResume {
+		c.debug("can't split %s into segments, using Retrieve", path)
+		return c.Retrieve(path, io.NewOffsetWriter(dest, 0))
+	}
+
+	if int64(segments) > size {
+		segments = int(size)
+	}
+
+	segmentSize := (size + int64(segments) - 1) / int64(segments)
+
+	errs := make(chan error, segments)
+	for start := int64(0); start < size; start += segmentSize {
+		length := segmentSize
+		if start+length > size {
+			length = size - start
+		}
+
+		go func(start, length int64) {
+			errs <- c.retrieveSegment(path, dest, start, length)
+		}(start, length)
+	}
+
+	var firstErr error
+	for start := int64(0); start < size; start += segmentSize {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Fetch "length" bytes of "path" starting at "start", retrying failures.
+func (c *Client) retrieveSegment(path string, dest io.WriterAt, start, length int64) error {
+	var (
+		done int64
+		err  error
+	)
+
+	for attempt := 0; attempt < parallelSegmentAttempts; attempt++ {
+		var n int64
+		n, err = c.retrieveRange(path, dest, start+done, length-done)
+		done += n
+
+		if err == nil {
+			return nil
+		}
+
+		c.debug("error fetching %s segment at %d (attempt %d): %s", path, start, attempt+1, err)
+	}
+
+	return err
+}
+
+// Fetch "length" bytes of "path" starting at "offset" into "dest". Once
+// it has them, the rest of the transfer is aborted with ABOR, keeping the
+// connection usable. Returns how many bytes of the range were written.
+func (c *Client) retrieveRange(path string, dest io.WriterAt, offset, length int64) (int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &limitedWriter{w: io.NewOffsetWriter(dest, offset), remaining: length, done: cancel}
+
+	_, err := c.transferFromOffset(ctx, "RETR", path, w, nil, offset, nil)
+
+	n := length - w.remaining
+	if w.remaining == 0 {
+		return n, nil
+	}
+
+	if err == nil {
+		err = ftpError{
+			err:       fmt.Errorf("expected %d bytes at offset %d, got %d", length, offset, n),
+			temporary: true,
+		}
+	}
+
+	return n, err
+}
+
+// RetrieveRange writes bytes "start" through "end" (inclusive, like HTTP
+// Range requests) of file "path" to "dest". If the server advertises RANG,
+// the range is requested with "RANG <start> <end>". Otherwise RetrieveRange
+// starts at "start" using "REST <start>" (which requires "REST STREAM"),
+// and aborts the transfer with ABOR once it has enough bytes, keeping the
+// connection usable. It returns an error if fewer than end-start+1 bytes
+// were retrieved, e.g. because the range extends past the end of the file.
+func (c *Client) RetrieveRange(path string, dest io.Writer, start, end int64) error {
+	if start < 0 || end < start {
+		return ftpError{err: fmt.Errorf("invalid range %d-%d", start, end)}
+	}
+
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return err
+	}
+
+	defer c.returnConn(pconn)
+
+	length := end - start + 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &limitedWriter{w: dest, remaining: length, done: cancel}
+
+	if pconn.hasFeature("RANG") {
+		// only abort if the server sends more than the range
+		w.exact = true
+
+		if err := pconn.setType(pconn.config.TransferType); err != nil {
+			return err
+		}
+
+		err = pconn.sendCommandExpected(replyFileActionPending, "RANG %d %d", start, end)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = pconn.transfer(ctx, "RETR", path, w, nil, 0)
+	} else {
+		if start > 0 && (!pconn.hasFeatureWithArg("REST", "STREAM") || !pconn.config.TransferType.exact()) {
+			return ftpError{err: ErrResumeUnsupported}
+		}
+
+		_, _, err = pconn.transfer(ctx, "RETR", path, w, nil, start)
+	}
+
+	if err == context.Canceled && w.remaining == 0 {
+		// we stopped the transfer ourselves
+		err = nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if w.remaining != 0 {
+		return ftpError{
+			err:       fmt.Errorf("expected %d bytes at offset %d, got %d", length, start, length-w.remaining),
+			temporary: true,
+		}
+	}
+
+	return nil
+}
+
+// Writes up to "remaining" bytes, then calls "done" and discards the rest.
+// If "exact" is set, the server should send just "remaining" bytes, so
+// "done" is only called if more arrive.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+	done      func()
+	exact     bool
+}
+
+func (lw *limitedWriter) Write(buf []byte) (int, error) {
+	full := len(buf)
+	if int64(len(buf)) > lw.remaining {
+		buf = buf[:lw.remaining]
+		if lw.exact {
+			lw.done()
+		}
+	}
+
+	if len(buf) == 0 {
+		return full, nil
+	}
+
+	n, err := lw.w.Write(buf)
+	lw.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if lw.remaining == 0 && !lw.exact {
+		lw.done()
+	}
+
+	return full, nil
+}
+
+// Open starts retrieving file "path" from the server, returning a reader
+// for its contents. The reader holds on to one of the Client's connections,
+// so it must be closed. Close reads the server's final reply, returning an
+// error if the transfer failed (e.g. was truncated), and returns the
+// connection to the pool. Closing before reading everything aborts the
+// transfer. Unlike Retrieve, Open doesn't resume failed transfers.
+func (c *Client) Open(path string) (io.ReadCloser, error) {
+	return c.open(path, 0)
+}
+
+// Start retrieving "path" at "offset" on an idle connection.
+func (c *Client) open(path string, offset int64) (*retrieveReader, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = pconn.setType(pconn.config.TransferType); err != nil {
+		c.returnConn(pconn)
+		return nil, err
+	}
+
+	if err = pconn.setProtection(pconn.config.DataProtection); err != nil {
+		c.returnConn(pconn)
+		return nil, err
+	}
+
+	if offset > 0 {
+		err = pconn.sendCommandExpected(replyFileActionPending, "REST %d", offset)
+		if err != nil {
+			c.returnConn(pconn)
+			return nil, err
+		}
+	}
+
+	dc, err := pconn.openDataConn(context.Background())
+	if err != nil {
+		pconn.debug("error opening data connection: %s", err)
+		c.returnConn(pconn)
+		return nil, err
+	}
+
+	pconn.setTransferDeadline(dc)
+
+	err = pconn.sendCommandExpected(replyGroupPreliminaryReply, "RETR %s", path)
+	if err != nil {
+		dc.Close()
+		c.returnConn(pconn)
+		return nil, err
+	}
+
+	r := &retrieveReader{
+		client: c,
+		pconn:  pconn,
+		dc:     dc,
+	}
+
+	// don't leak the connection if the reader is never closed
+	runtime.SetFinalizer(r, (*retrieveReader).abandon)
+
+	return r, nil
+}
+
+type retrieveReader struct {
+	client *Client
+	pconn  *persistentConn
+	dc     net.Conn
+	eof    bool
+	closed bool
+}
+
+func (r *retrieveReader) Read(buf []byte) (int, error) {
+	if r.closed {
+		return 0, ftpError{err: errors.New("read from closed reader")}
+	}
+
+	n, err := r.dc.Read(buf)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *retrieveReader) Close() error {
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+	runtime.SetFinalizer(r, nil)
+
+	defer r.client.returnConn(r.pconn)
+
+	if err := r.dc.Close(); err != nil {
+		r.pconn.debug("error closing data connection: %s", err)
+	}
+
+	if !r.eof {
+		// make sure the server is done with the transfer before the
+		// connection is reused
+		r.pconn.debug("closed RETR early, aborting")
+		r.pconn.sendAbort()
+		return nil
+	}
+
+	code, msg, err := r.pconn.readResponse()
+	if err != nil {
+		r.pconn.debug("error reading response after RETR: %s", err)
+		return err
+	}
+
+	if !positiveCompletionReply(code) {
+		r.pconn.debug("unexpected response after RETR: %d (%s)", code, msg)
+		return ftpError{code: code, msg: msg}
+	}
+
+	return nil
+}
+
+func (r *retrieveReader) abandon() {
+	r.pconn.debug("reader was never closed, discarding connection")
+	r.pconn.broken = true
+	r.dc.Close()
+	r.client.returnConn(r.pconn)
+}
+
+// Store bytes read from "src" into file "path" on the server. If the
+// server supports resuming stream transfers and "src" is an io.Seeker
+// (*os.File is an io.Seeker), Store will continue resuming a failed upload
+// as long as it continues making progress. Store will not attempt to
+// resume an upload if the client is connected to multiple servers. Store
+// will also verify the remote file's size after the transfer if the server
+// supports the SIZE command, returning an *UploadSizeError if it doesn't
+// match the number of bytes sent (see Config.SkipUploadVerification).
+//
+// Sources that can't seek (e.g. a pipe, including an *os.File for one) are
+// read at most once: a failed upload is neither resumed nor retried with
+// Config.RetryPolicy once any bytes have been read from "src", and if some
+// were sent the error is a *TransferError reporting how many.
+func (c *Client) Store(path string, src io.Reader) error {
+	return c.StoreFrom(path, src, 0)
+}
+
+// StoreFile uploads local file "localPath" to "remotePath" using Store. See
+// Config.PreserveModTime for keeping the file's modification time.
+func (c *Client) StoreFile(localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.Store(remotePath, f)
+}
+
+// StoreFileIfChanged is like StoreFile, but first compares local file
+// "localPath" with remote file "remotePath" (see Config.CompareMode and
+// Config.ModTimeTolerance), and skips the upload if they match. It returns
+// whether the file was uploaded. Unless only sizes are compared, the
+// uploaded file's modification time is set to the local file's (see
+// SetModTime) even without Config.PreserveModTime, since otherwise the
+// times would never match. See StoreFileIfChangedInfo to avoid looking up
+// each remote file separately.
+func (c *Client) StoreFileIfChanged(localPath, remotePath string) (bool, error) {
+	remote, err := c.Stat(remotePath)
+	if err != nil {
+		if !c.notExist(remotePath, err) {
+			return false, err
+		}
+		remote = nil
+	}
+
+	return c.StoreFileIfChangedInfo(localPath, remotePath, remote)
+}
+
+// StoreFileIfChangedInfo is like StoreFileIfChanged, but compares with
+// "remote" (e.g. from an earlier ReadDir of the target directory) instead
+// of looking up the remote file. A nil remote means the remote file doesn't
+// exist.
+func (c *Client) StoreFileIfChangedInfo(localPath, remotePath string, remote os.FileInfo) (bool, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	local, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if remote != nil && c.unchanged(local, remote) {
+		c.debug("%s hasn't changed, not uploading", localPath)
+		return false, nil
+	}
+
+	if err := c.Store(remotePath, f); err != nil {
+		return false, err
+	}
+
+	if c.config.CompareMode != CompareSize && !c.config.PreserveModTime {
+		if err := c.preserveModTime(remotePath, f); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// StoreFrom is like Store, but writes "src" starting "offset" bytes into
+// the remote file using "REST <offset>", e.g. to continue an upload that was
+// interrupted. The caller is responsible for positioning "src" at the
+// matching offset (e.g. by seeking it to "offset") before calling StoreFrom.
+// If offset is non-zero and the server doesn't advertise "REST STREAM", the
+// returned error satisfies errors.Is(err, ErrResumeUnsupported). See
+// StoreResume for a version that discovers the offset itself.
+func (c *Client) StoreFrom(path string, src io.Reader, offset int64) error {
+	_, err := c.store(context.Background(), path, src, offset, -1)
+	return err
+}
+
+// StoreN is like Store, but also returns the number of bytes of "src" sent
+// to the server, even if the upload failed. If a failed transfer was
+// resumed, bytes the server hadn't stored before the failure aren't
+// counted twice, so after a failure the count is where to resume from (see
+// StoreFrom), provided the server kept everything it received.
+func (c *Client) StoreN(path string, src io.Reader) (int64, error) {
+	return c.store(context.Background(), path, src, 0, -1)
+}
+
+// StoreWithSize is like Store, but for sources whose size is known although
+// they aren't an *os.File or io.Seeker, e.g. a pipe. "size" is sent with
+// ALLO if Config.Allocate is set, and reported to Config.TransferObserver.
+func (c *Client) StoreWithSize(path string, src io.Reader, size int64) error {
+	_, err := c.store(context.Background(), path, src, 0, size)
+	return err
+}
+
+// StoreContext is like Store, but stops when "ctx" is canceled or its
+// deadline passes. The transfer in progress is aborted with ABOR, and
+// ctx.Err() is returned. The partially uploaded file is left on the server.
+// The connection is reused if the server acknowledges the abort, and
+// discarded otherwise.
+func (c *Client) StoreContext(ctx context.Context, path string, src io.Reader) error {
+	_, err := c.store(ctx, path, src, 0, -1)
+	return err
+}
+
+// Store "src" to "path" from "offset". "size" is the size of the whole file,
+// or -1 if it should be worked out from "src". Returns the number of bytes
+// of "src" sent.
+func (c *Client) store(ctx context.Context, path string, src io.Reader, offset, size int64) (int64, error) {
+	if c.config.AtomicUploads && offset == 0 {
+		return c.storeAtomic(ctx, path, src, size)
+	}
+
+	return c.storeTo(ctx, path, src, offset, size)
+}
+
+// UploadCleanupError is returned when an upload with Config.AtomicUploads
+// failed and its temporary file couldn't be deleted either. It satisfies
+// the Error interface, delegating to the upload's error.
+type UploadCleanupError struct {
+	// The temporary file left behind.
+	TempPath string
+
+	// Why the upload failed.
+	Err error
+
+	// Why deleting TempPath failed.
+	CleanupErr error
+}
+
+func (e *UploadCleanupError) Error() string {
+	return fmt.Sprintf("%s (and deleting temporary file %s failed: %s)", e.Err, e.TempPath, e.CleanupErr)
+}
+
+func (e *UploadCleanupError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UploadCleanupError) Temporary() bool {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Temporary()
+	}
+	return false
+}
+
+func (e *UploadCleanupError) Code() int {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Code()
+	}
+	return 0
+}
+
+func (e *UploadCleanupError) Message() string {
+	if fe, ok := e.Err.(Error); ok {
+		return fe.Message()
+	}
+	return ""
+}
+
+// Store "src" under a temporary name, then rename it to "path" (see
+// Config.AtomicUploads).
+func (c *Client) storeAtomic(ctx context.Context, path string, src io.Reader, size int64) (int64, error) {
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return 0, err
+	}
+
+	tmpPath := path + c.config.AtomicUploadSuffix + hex.EncodeToString(random[:])
+
+	n, err := c.storeTo(ctx, tmpPath, src, 0, size)
+	if err == nil {
+		err = c.renameOver(tmpPath, path)
+	}
+
+	if err == nil {
+		return n, nil
+	}
+
+	if delErr := c.Delete(tmpPath); delErr != nil && !c.notExist(tmpPath, delErr) {
+		c.debug("error deleting temporary file %s: %s", tmpPath, delErr)
+		return n, &UploadCleanupError{TempPath: tmpPath, Err: err, CleanupErr: delErr}
+	}
+
+	return n, err
+}
+
+// Rename "from" to "to". If the server refuses and
+// Config.AtomicUploadOverwrite is set, delete "to" and try again.
+func (c *Client) renameOver(from, to string) error {
+	err := c.Rename(from, to)
+	if err == nil || !c.config.AtomicUploadOverwrite || !isServerReply(err) {
+		return err
+	}
+
+	c.debug("error renaming %s to %s, deleting %s first: %s", from, to, to, err)
 
-	var bytesSoFar int64
-	for {
-		n, err := c.transferFromOffset(path, dest, nil, bytesSoFar)
+	if delErr := c.Delete(to); delErr != nil && !c.notExist(to, delErr) {
+		return err
+	}
 
-		bytesSoFar += n
+	return c.Rename(from, to)
+}
 
-		if err == nil {
-			break
-		} else if n == 0 {
-			return err
-		} else if !canResume {
-			return ftpError{
-				err:       fmt.Errorf("%s (can't resume)", err),
-				temporary: true,
-			}
+func (c *Client) storeTo(ctx context.Context, path string, src io.Reader, offset, size int64) (int64, error) {
+	var (
+		counter *countingReader
+		upload  = src
+	)
+
+	seeker, startPos, ok := seekable(src)
+	if !ok {
+		// only safe to retry if nothing was read
+		counter = &countingReader{r: src}
+		upload = counter
+	}
+
+	var (
+		n        int64
+		progress *transferProgress
+	)
+	err := c.withRetries(ctx, "STOR "+path, func(ctx context.Context) error {
+		var err error
+		n, progress, err = c.storeOnce(ctx, path, upload, offset, size)
+		return err
+	}, func() bool {
+		if counter != nil {
+			return counter.n == 0
+		}
+
+		if seeker == nil {
+			return false
 		}
+
+		_, err := seeker.Seek(startPos, io.SeekStart)
+		return err == nil
+	})
+	progress.done(err)
+	if err != nil {
+		return n, err
 	}
 
-	if size != -1 && bytesSoFar != size {
-		return ftpError{
-			err:       fmt.Errorf("expected %d bytes, got %d", size, bytesSoFar),
-			temporary: true,
+	if c.config.UploadMode != nil {
+		if err := c.Chmod(path, *c.config.UploadMode); err != nil {
+			return n, err
 		}
 	}
 
-	return nil
+	if f, ok := src.(*os.File); ok && c.config.PreserveModTime {
+		return n, c.preserveModTime(path, f)
+	}
+
+	return n, nil
 }
 
-// Store bytes read from "src" into file "path" on the server. If the
-// server supports resuming stream transfers and "src" is an io.Seeker
-// (*os.File is an io.Seeker), Store will continue resuming a failed upload
-// as long as it continues making progress. Store will not attempt to
-// resume an upload if the client is connected to multiple servers. Store
-// will also verify the remote file's size after the transfer if the server
-// supports the SIZE command.
-func (c *Client) Store(path string, src io.Reader) error {
+// Return "src" as an io.Seeker along with its current position, if it can
+// actually seek. An *os.File is an io.Seeker even when it's a pipe, which
+// fails to seek.
+func seekable(src io.Reader) (io.Seeker, int64, bool) {
+	s, ok := src.(io.Seeker)
+	if !ok {
+		return nil, 0, false
+	}
+
+	pos, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	return s, pos, true
+}
+
+// Counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(buf []byte) (int, error) {
+	n, err := cr.r.Read(buf)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Set the modification time of remote file "path" to that of "f", if the
+// server supports it.
+func (c *Client) preserveModTime(path string, f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		// e.g. a pipe
+		return nil
+	}
+
+	err = c.SetModTime(path, info.ModTime())
+	if errors.Is(err, ErrModTimeUnsupported) {
+		c.debug("server doesn't support MFMT, not setting modification time of %s", path)
+		return nil
+	}
+
+	return err
+}
+
+// Store "src" to "path" once, without retries. The returned progress, if
+// any, is left for the caller to finish with the final result.
+func (c *Client) storeOnce(ctx context.Context, path string, src io.Reader, offset, size int64) (int64, *transferProgress, error) {
+	resumable, err := c.canResume(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if offset > 0 && !resumable {
+		return 0, nil, ftpError{err: ErrResumeUnsupported}
+	}
 
-	canResume := len(c.hosts) == 1 && c.canResume()
+	canResume := len(c.hosts) == 1 && resumable
 
-	seeker, ok := src.(io.Seeker)
+	seeker, _, ok := seekable(src)
 	if !ok {
 		canResume = false
 	}
 
+	check, err := c.newHashCheck(path, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if size < 0 && (c.config.Allocate || c.config.TransferObserver != nil) {
+		size = uploadSize(src, offset)
+	}
+
+	var progress *transferProgress
+	if c.config.TransferObserver != nil {
+		progress = c.newTransferProgress(path, TransferUpload, offset, size)
+		src = progress.reader(src)
+	}
+
+	if check != nil {
+		hr := check.reader(src, seeker)
+		src = hr
+		if seeker != nil {
+			seeker = hr
+		}
+	}
+
+	n, err := c.storeFrom(ctx, path, src, seeker, offset, size, canResume, progress)
+	if err == nil {
+		err = check.verify(c)
+	}
+	return n, progress, err
+}
+
+func (c *Client) storeFrom(ctx context.Context, path string, src io.Reader, seeker io.Seeker, offset, size int64, canResume bool, progress *transferProgress) (int64, error) {
+	allocate := int64(-1)
+	if c.config.Allocate {
+		allocate = size
+	}
+
 	var (
-		bytesSoFar int64
+		bytesSoFar = offset
+		retrying   bool
 		err        error
 		n          int64
 	)
 	for {
-		if bytesSoFar > 0 {
-			size, sizeErr := c.size(path)
+		if retrying {
+			size, sizeErr := c.size(ctx, path)
 			if sizeErr != nil {
-				return ftpError{
+				return bytesSoFar - offset, ftpError{
 					err:       sizeErr,
 					temporary: true,
 				}
 			}
 			if size == -1 {
-				return ftpError{
+				return bytesSoFar - offset, ftpError{
 					err:       fmt.Errorf("%s (resume failed)", err),
 					temporary: true,
 				}
@@ -97,97 +1133,266 @@ func (c *Client) Store(path string, src io.Reader) error {
 					path,
 					err,
 				)
-				return ftpError{
+				return bytesSoFar - offset, ftpError{
 					err:       fmt.Errorf("%s (resume failed)", err),
 					temporary: true,
 				}
 			}
 			bytesSoFar = size
+			progress.set(size)
 		}
 
-		n, err = c.transferFromOffset(path, nil, src, bytesSoFar)
+		n, err = c.storeData(ctx, path, src, bytesSoFar, allocate)
 
 		bytesSoFar += n
+		retrying = true
 
 		if err == nil {
 			break
+		} else if ctx.Err() != nil {
+			return bytesSoFar - offset, ctx.Err()
+		} else if errors.Is(err, ErrTransferTimeout) {
+			return bytesSoFar - offset, err
+		} else if _, ok := err.(*AllocateError); ok {
+			return bytesSoFar - offset, err
+		} else if stalled := stalledError(err, bytesSoFar-offset); stalled != nil && (n == 0 || !canResume) {
+			return bytesSoFar - offset, stalled
 		} else if n == 0 {
-			return ftpError{
+			return bytesSoFar - offset, ftpError{
 				err:       err,
 				temporary: true,
 			}
 		} else if !canResume {
-			return ftpError{
-				err:       fmt.Errorf("%s (can't resume)", err),
-				temporary: true,
+			return bytesSoFar - offset, &TransferError{
+				Bytes: bytesSoFar - offset,
+				Err: ftpError{
+					err:       fmt.Errorf("%s (can't resume)", err),
+					temporary: true,
+				},
 			}
 		}
 	}
 
+	if c.config.SkipUploadVerification {
+		return bytesSoFar - offset, nil
+	}
+
 	// fetch file size to check against how much we transferred
-	size, err := c.size(path)
+	remoteSize, err := c.size(ctx, path)
 	if err != nil {
+		return bytesSoFar - offset, err
+	}
+
+	if remoteSize == -1 {
+		c.debug("not verifying size of %s", path)
+	} else if remoteSize != bytesSoFar {
+		return bytesSoFar - offset, &UploadSizeError{Path: path, Sent: bytesSoFar, Size: remoteSize}
+	}
+
+	return bytesSoFar - offset, nil
+}
+
+// StoreAppend appends bytes read from "src" to file "path" on the server
+// using APPE. Servers create the file if it doesn't exist. Unlike Store,
+// StoreAppend doesn't try to resume a failed transfer. If the transfer fails
+// after some bytes were sent, the error is a *TransferError reporting how
+// many.
+func (c *Client) StoreAppend(path string, src io.Reader) error {
+	n, err := c.transferFromOffset(context.Background(), "APPE", path, nil, src, 0, nil)
+	if _, ok := err.(*TransferError); ok {
 		return err
+	} else if err != nil && n > 0 {
+		return &TransferError{Bytes: n, Err: err}
 	}
-	if size != -1 && size != bytesSoFar {
-		return ftpError{
-			err:       fmt.Errorf("sent %d bytes, but size is %d", bytesSoFar, size),
-			temporary: true,
-		}
+	return err
+}
+
+// StoreResume continues uploading "src" to "path" from wherever a previous
+// attempt left off. It fetches the size of the remote file (starting from
+// scratch if it doesn't exist), seeks "src" to that offset and continues
+// with StoreFrom. Other errors fetching the size (e.g. permission denied)
+// are returned rather than overwriting the file.
+func (c *Client) StoreResume(path string, src io.ReadSeeker) error {
+	var offset int64
+
+	info, err := c.Stat(path)
+	if err == nil {
+		offset = info.Size()
+	} else if !c.notExist(path, err) {
+		return err
 	}
 
-	return nil
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return ftpError{err: fmt.Errorf("failed seeking to %d: %s", offset, err)}
+	}
+
+	return c.StoreFrom(path, src, offset)
 }
 
-func (c *Client) transferFromOffset(path string, dest io.Writer, src io.Reader, offset int64) (int64, error) {
-	pconn, err := c.getIdleConn()
+// Run transfer command "cmd" (e.g. "RETR") for "path", copying from the
+// data connection to "dest", or from "src" to the data connection. If
+// "prepare" isn't nil, it's run on the connection first (e.g. to send ALLO).
+func (c *Client) transferFromOffset(ctx context.Context, cmd, path string, dest io.Writer, src io.Reader, offset int64, prepare func(*persistentConn) error) (int64, error) {
+	pconn, err := c.getIdleConnContext(ctx)
 	if err != nil {
 		return 0, err
 	}
 
 	defer c.returnConn(pconn)
 
-	if err = pconn.setType("I"); err != nil {
-		return 0, err
+	if prepare != nil {
+		if err := prepare(pconn); err != nil {
+			return 0, err
+		}
+	}
+
+	n, _, err := pconn.transfer(ctx, cmd, path, dest, src, offset)
+	return n, err
+}
+
+// Upload "src" to "path" from "offset" with STOR, first sending
+// "ALLO <allocate>" on the same connection unless allocate is negative.
+func (c *Client) storeData(ctx context.Context, path string, src io.Reader, offset, allocate int64) (int64, error) {
+	var prepare func(*persistentConn) error
+	if allocate >= 0 {
+		prepare = func(pconn *persistentConn) error {
+			return pconn.allocate(allocate)
+		}
+	}
+
+	return c.transferFromOffset(ctx, "STOR", path, nil, src, offset, prepare)
+}
+
+// Like Client.transferFromOffset, but on a particular connection. Also
+// returns the text of the preliminary and final replies. If "path" is
+// empty, "cmd" is sent without an argument. If "ctx" is canceled, the
+// transfer is aborted and ctx.Err() is returned.
+func (pconn *persistentConn) transfer(ctx context.Context, cmd, path string, dest io.Writer, src io.Reader, offset int64) (int64, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	if err := pconn.setType(pconn.config.TransferType); err != nil {
+		return 0, nil, err
+	}
+
+	if err := pconn.setProtection(pconn.config.DataProtection); err != nil {
+		return 0, nil, err
 	}
 
 	if offset > 0 {
 		err := pconn.sendCommandExpected(replyFileActionPending, "REST %d", offset)
 		if err != nil {
-			return 0, err
+			return 0, nil, err
 		}
 	}
 
-	dc, err := pconn.openDataConn()
+	dc, err := pconn.openDataConn(ctx)
 	if err != nil {
 		pconn.debug("error opening data connection: %s", err)
-		return 0, err
+		return 0, nil, err
 	}
 
 	// to catch early returns
 	defer dc.Close()
 
-	var cmd string
+	deadline := pconn.setTransferDeadline(dc)
+
+	var conn io.ReadWriter = dc
+
+	var stall *stallConn
+	if pconn.config.StallTimeout > 0 {
+		stall = &stallConn{Conn: dc, timeout: pconn.config.StallTimeout, deadline: deadline}
+		conn = stall
+	}
+
+	var limiter *rateLimiter
+	if pconn.config.MaxBytesPerSecond > 0 {
+		limiter = newRateLimiter(pconn.config.MaxBytesPerSecond)
+	}
+
 	if dest == nil && src != nil {
-		dest = dc
-		cmd = "STOR"
+		dest = conn
+		if limiter != nil {
+			dest = throttledWriter{conn, limiter}
+		}
 	} else if dest != nil && src == nil {
-		src = dc
-		cmd = "RETR"
+		src = conn
+		if limiter != nil {
+			src = throttledReader{conn, limiter}
+		}
 	} else {
 		panic("this shouldn't happen")
 	}
 
-	err = pconn.sendCommandExpected(replyGroupPreliminaryReply, "%s %s", cmd, path)
+	cmdLine := cmd
+	if path != "" {
+		cmdLine = cmd + " " + path
+	}
+
+	code, msg, err := pconn.sendCommand("%s", cmdLine)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
+	}
+
+	if code/100 != replyGroupPreliminaryReply {
+		return 0, nil, ftpError{code: code, msg: msg}
 	}
 
+	msgs := []string{msg}
+
+	canceled := closeOnCancel(ctx, dc)
+
+	// The server connects once it has replied. Accept now, since a
+	// transfer without any data (e.g. an empty upload) never uses the
+	// connection.
+	if active, ok := activeConnOf(dc); ok {
+		if _, err := active.accept(); err != nil {
+			pconn.broken = true
+			if canceled() {
+				return 0, msgs, ctx.Err()
+			}
+			return 0, msgs, err
+		}
+	}
+
+	stopKeepalive := pconn.keepaliveDuringTransfer(pconn.config.ControlKeepalive)
+
 	n, err := io.Copy(dest, src)
 
+	noops := stopKeepalive()
+
+	if canceled() {
+		if noops > 0 {
+			// can't tell ABOR's replies from the NOOPs'
+			pconn.broken = true
+			return n, msgs, ctx.Err()
+		}
+		return n, msgs, pconn.abort(ctx)
+	}
+
 	if err != nil {
 		pconn.broken = true
-		return n, err
+
+		if stall != nil && stall.stalled {
+			pconn.debug("no data transferred for %s, giving up", stall.timeout)
+			err = &TransferError{
+				Bytes: n,
+				Err: ftpError{
+					err:       fmt.Errorf("%w: no data for %s", ErrTransferStalled, stall.timeout),
+					timeout:   true,
+					temporary: true,
+				},
+			}
+		} else if pastDeadline(deadline, err) {
+			pconn.debug("transfer didn't finish within %s, giving up", pconn.config.Timeout)
+			err = ftpError{
+				err:     fmt.Errorf("%w: didn't finish within %s", ErrTransferTimeout, pconn.config.Timeout),
+				timeout: true,
+			}
+		}
+
+		return n, msgs, err
 	}
 
 	err = dc.Close()
@@ -195,24 +1400,201 @@ func (c *Client) transferFromOffset(path string, dest io.Writer, src io.Reader,
 		pconn.debug("error closing data connection: %s", err)
 	}
 
-	code, msg, err := pconn.readResponse()
+	code, msg, err = pconn.readTransferResponse(noops)
 	if err != nil {
 		pconn.debug("error reading response after %s: %s", cmd, err)
-		return n, err
+		return n, msgs, err
 	}
 
+	msgs = append(msgs, msg)
+
 	if !positiveCompletionReply(code) {
 		pconn.debug("unexpected response after %s: %d (%s)", cmd, code, msg)
-		return n, ftpError{code: code, msg: msg}
+		return n, msgs, ftpError{code: code, msg: msg}
 	}
 
-	return n, nil
+	return n, msgs, nil
 }
 
-// Fetch SIZE of file. Returns error only on underlying connection error.
-// If the server doesn't support size, it returns -1 and no error.
-func (c *Client) size(path string) (int64, error) {
+// If "err" is a stalled transfer, return it updated to report "n" bytes
+// transferred in total, e.g. across resumed attempts. Otherwise nil.
+func stalledError(err error, n int64) *TransferError {
+	te, ok := err.(*TransferError)
+	if !ok || !errors.Is(te.Err, ErrTransferStalled) {
+		return nil
+	}
+
+	return &TransferError{Bytes: n, Err: te.Err}
+}
+
+// Largest write stallConn makes at once, so the deadline of a single write
+// doesn't have to cover a huge buffer.
+const stallWriteChunk = 32 * 1024
+
+// Whether "err" is a timeout from reaching the overall transfer
+// "deadline" (see setTransferDeadline).
+func pastDeadline(deadline time.Time, err error) bool {
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return false
+	}
+
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// A data connection whose reads and writes time out once no bytes have
+// moved for "timeout". Each read or write pushes the deadline back, but
+// never past the overall transfer "deadline", if any.
+type stallConn struct {
+	net.Conn
+	timeout  time.Duration
+	deadline time.Time
+	stalled  bool
+}
+
+// Deadline for the next read or write.
+func (sc *stallConn) nextDeadline() time.Time {
+	next := time.Now().Add(sc.timeout)
+	if !sc.deadline.IsZero() && sc.deadline.Before(next) {
+		return sc.deadline
+	}
+	return next
+}
+
+func (sc *stallConn) Read(buf []byte) (int, error) {
+	sc.Conn.SetReadDeadline(sc.nextDeadline())
+	n, err := sc.Conn.Read(buf)
+	sc.checkStalled(err)
+	return n, err
+}
+
+func (sc *stallConn) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > stallWriteChunk {
+			chunk = chunk[:stallWriteChunk]
+		}
+
+		sc.Conn.SetWriteDeadline(sc.nextDeadline())
+		n, err := sc.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			sc.checkStalled(err)
+			return written, err
+		}
+
+		buf = buf[n:]
+	}
+
+	return written, nil
+}
+
+func (sc *stallConn) checkStalled(err error) {
+	if pastDeadline(sc.deadline, err) {
+		return
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		sc.stalled = true
+	}
+}
+
+// StoreUnique stores bytes read from "src" into a new file in directory
+// "dir" on the server using STOU, letting the server pick a name that
+// doesn't collide with existing files. It returns the path of the new file
+// (joined with "dir", unless the server reported an absolute path). Use ""
+// for "dir" to store in the current directory. If the name can't be found
+// in the server's replies, the raw reply text is returned instead.
+func (c *Client) StoreUnique(dir string, src io.Reader) (string, error) {
 	pconn, err := c.getIdleConn()
+	if err != nil {
+		return "", err
+	}
+
+	defer c.returnConn(pconn)
+
+	// STOU always stores into the current directory, so temporarily change
+	// to "dir", making sure to change back before the connection is reused
+	if dir != "" {
+		code, msg, err := pconn.sendCommand("PWD")
+		if err != nil {
+			return "", err
+		}
+
+		if code != replyDirCreated {
+			return "", ftpError{code: code, msg: msg}
+		}
+
+		origDir, err := extractDirName(msg)
+		if err != nil {
+			return "", err
+		}
+
+		if err := pconn.sendCommandExpected(replyFileActionOkay, "CWD %s", dir); err != nil {
+			return "", err
+		}
+
+		defer func() {
+			if err := pconn.sendCommandExpected(replyFileActionOkay, "CWD %s", origDir); err != nil {
+				pconn.debug("failed changing back to %s: %s", origDir, err)
+				pconn.broken = true
+			}
+		}()
+	}
+
+	n, msgs, err := pconn.transfer(context.Background(), "STOU", "", nil, src, 0)
+	if err != nil {
+		if n > 0 {
+			return "", &TransferError{Bytes: n, Err: err}
+		}
+		return "", err
+	}
+
+	name := parseSTOUName(msgs)
+	if dir != "" && !strings.HasPrefix(name, "/") {
+		name = path.Join(dir, name)
+	}
+
+	return name, nil
+}
+
+var stouNamePatterns = []*regexp.Regexp{
+	// "150 FILE: name" (RFC 1123)
+	regexp.MustCompile(`(?i)\bFILE:\s*(.+?)\s*$`),
+	// "226 Transfer complete (unique file name:name)."
+	regexp.MustCompile(`(?i)unique file name:\s*([^)]+?)\s*\)`),
+	// `150 Opening data connection for "name"`
+	regexp.MustCompile(`"((?:[^"]|"")+)"`),
+	// "150 Opening BINARY mode data connection for name (0 bytes)."
+	regexp.MustCompile(`(?i)data connection for\s+(\S+?)(?:\s+\(.*)?\.?\s*$`),
+}
+
+// Find the generated file name in the replies to STOU.
+func parseSTOUName(msgs []string) string {
+	for _, pattern := range stouNamePatterns {
+		for _, msg := range msgs {
+			for _, line := range strings.Split(msg, "\n") {
+				if m := pattern.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+					return strings.Replace(m[1], `""`, `"`, -1)
+				}
+			}
+		}
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// Fetch SIZE of file. Returns error only on underlying connection error.
+// If the server doesn't support size, or transfers aren't byte for byte (see
+// Config.TransferType), it returns -1 and no error.
+func (c *Client) size(ctx context.Context, path string) (int64, error) {
+	if !c.config.TransferType.exact() {
+		c.debug("not using SIZE for TYPE %s transfers", c.config.TransferType)
+		return -1, nil
+	}
+
+	pconn, err := c.getIdleConnContext(ctx)
 	if err != nil {
 		return -1, err
 	}
@@ -224,7 +1606,9 @@ func (c *Client) size(path string) (int64, error) {
 		return -1, nil
 	}
 
-	if err = pconn.setType("I"); err != nil {
+	// exact types (checked above) give the same size as TYPE I, so don't
+	// switch back and forth between SIZE and the transfer
+	if err = pconn.setType(pconn.config.TransferType); err != nil {
 		return 0, err
 	}
 
@@ -247,13 +1631,19 @@ func (c *Client) size(path string) (int64, error) {
 	return size, nil
 }
 
-func (c *Client) canResume() bool {
-	pconn, err := c.getIdleConn()
+// Whether transfers can start at an offset (REST STREAM). Errors getting a
+// connection are returned, as for hasFeature.
+func (c *Client) canResume(ctx context.Context) (bool, error) {
+	if !c.config.TransferType.exact() {
+		return false, nil
+	}
+
+	pconn, err := c.getIdleConnContext(ctx)
 	if err != nil {
-		return false
+		return false, err
 	}
 
 	defer c.returnConn(pconn)
 
-	return pconn.hasFeatureWithArg("REST", "STREAM")
+	return pconn.hasFeatureWithArg("REST", "STREAM"), nil
 }
@@ -6,13 +6,22 @@ package goftp
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -50,242 +59,2530 @@ func TestRetrieve(t *testing.T) {
 	}
 }
 
-func TestRetrievePASV(t *testing.T) {
+func TestRetrieveFrom(t *testing.T) {
 	for _, addr := range ftpdAddrs {
-		if strings.HasPrefix(addr, "[::1]") {
-			// PASV can't work with IPv6
-			continue
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+
+		n, err := c.RetrieveFrom("subdir/1234.bin", buf, 2)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 2 || !bytes.Equal([]byte{3, 4}, buf.Bytes()) {
+			t.Errorf("Got %d %v", n, buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestPercentInPath(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR a%20b"] = "hello world"
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("a%20b", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	if err := c.Store("up%sload", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	if got := string(server.stored["up%sload"]); got != "data" {
+		t.Errorf("got %q", got)
+	}
+	server.mu.Unlock()
+}
+
+func TestRetrieveFromFake(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["SIZE file"] = fakeReply{213, "11"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	n, err := c.RetrieveFrom("file", buf, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 5 || buf.String() != "world" {
+		t.Errorf("got %d %q", n, buf.String())
+	}
+
+	var sawRest bool
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "REST 6" {
+			sawRest = true
+		}
+	}
+
+	if !sawRest {
+		t.Error("expected REST 6")
+	}
+
+	// no REST STREAM
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.RetrieveFrom("file", buf, 6)
+	if !errors.Is(err, ErrResumeUnsupported) {
+		t.Errorf("expected ErrResumeUnsupported, got %v", err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestRetrieveParallel(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	data := make([]byte, 100*1024)
+	randomBytes(data)
+
+	server.data["RETR big"] = string(data)
+	server.replies["SIZE big"] = fakeReply{213, "102400"}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 4}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := c.RetrieveParallel("big", f, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, mismatch", len(got))
+	}
+
+	var rests int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "REST ") {
+			rests++
+		}
+	}
+
+	if rests != 3 {
+		t.Errorf("expected 3 REST commands, got %d", rests)
+	}
+
+	logins := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if strings.HasPrefix(cmd, "USER ") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// segments' connections are kept for reuse
+	before := logins()
+	if open := c.numOpenConns(); open != before || len(c.freeConnCh) != open {
+		t.Errorf("expected %d idle connections, got %d of %d", before, len(c.freeConnCh), open)
+	}
+
+	if err := c.RetrieveParallel("big", f, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := logins(); n != before {
+		t.Errorf("expected no new logins, got %d", n-before)
+	}
+
+	// falls back to Retrieve without REST STREAM
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{ConnectionsPerHost: 4}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := ioutil.TempFile("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f2.Name())
+	defer f2.Close()
+
+	if err := c.RetrieveParallel("big", f2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = ioutil.ReadFile(f2.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, mismatch", len(got))
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestRetrieveRange(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.data["RETR big"] = strings.Repeat("0123456789", 1024*1024)
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// REST, then ABOR once we have enough
+	buf := new(bytes.Buffer)
+	if err := c.RetrieveRange("big", buf, 12, 21); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "2345678901" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := c.RetrieveRange("file", buf, 6, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	// past the end of the file
+	if err := c.RetrieveRange("file", ioutil.Discard, 6, 20); err == nil {
+		t.Error("expected error")
+	}
+
+	if err := c.RetrieveRange("file", ioutil.Discard, 5, 4); err == nil {
+		t.Error("expected error")
+	}
+
+	var logins int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "USER ") {
+			logins++
+		}
+	}
+
+	if logins != 1 {
+		t.Errorf("expected connection to be reused, got %d logins", logins)
+	}
+
+	server.features = append(server.features, "RANG STREAM")
+
+	var rangStart, rangEnd int
+	server.handlers["RANG"] = func(fc *fakeConn, arg string) {
+		fmt.Sscanf(arg, "%d %d", &rangStart, &rangEnd)
+		fc.reply(350, "Restarting at start. End byte range at end.")
+	}
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		fc.sendData(server.data["RETR "+arg][rangStart : rangEnd+1])
+	}
+
+	c, err = DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(server.receivedCommands())
+
+	buf.Reset()
+	if err := c.RetrieveRange("file", buf, 0, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	var sawRang bool
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "RANG 0 4" {
+			sawRang = true
+		}
+	}
+
+	if !sawRang {
+		t.Error("expected RANG 0 4")
+	}
+
+	// the server sent just the range, so there was nothing to abort
+	for _, cmd := range server.receivedCommands()[before:] {
+		if cmd == "ABOR" {
+			t.Error("unexpected ABOR")
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.data["RETR big"] = strings.Repeat("x", 10*1024*1024)
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		if data, ok := server.data["RETR "+arg]; ok {
+			fc.sendData(data)
+			return
+		} else if arg != "truncated" {
+			fc.reply(550, "no such file")
+			return
+		}
+
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
+		}
+
+		fc.reply(150, "here it comes")
+		dc.Write([]byte("hel"))
+		dc.Close()
+		fc.reply(451, "local error")
+	}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing early aborts the transfer, and the connection is reusable
+	r, err = c.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var aborts, logins int
+	for _, cmd := range server.receivedCommands() {
+		switch {
+		case cmd == "ABOR":
+			aborts++
+		case strings.HasPrefix(cmd, "USER "):
+			logins++
+		}
+	}
+
+	if aborts != 1 || logins != 1 || c.numOpenConns() != 1 {
+		t.Errorf("got %d ABORs, %d logins, %d connections", aborts, logins, c.numOpenConns())
+	}
+
+	r, err = c.Open("truncated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.ReadAll(r)
+
+	if err := r.Close(); err == nil || err.(Error).Code() != 451 {
+		t.Errorf("expected 451 error, got %v", err)
+	}
+
+	if _, err := c.Open("missing"); err == nil {
+		t.Error("expected error")
+	}
+
+	gotBuf := new(bytes.Buffer)
+	if err := c.Retrieve("file", gotBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestTransferType(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.replies["TYPE L 8"] = fakeReply{504, "type not implemented"}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1, TransferType: TransferEBCDIC}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("file", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != "hello world" {
+			t.Errorf("got %q", buf.String())
+		}
+	}
+
+	var types []string
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "TYPE ") || strings.HasPrefix(cmd, "SIZE ") {
+			types = append(types, cmd)
+		}
+	}
+
+	// only set once, and no SIZE since the sizes won't match
+	if !reflect.DeepEqual(types, []string{"TYPE E"}) {
+		t.Errorf("got %v", types)
+	}
+
+	c, err = DialConfig(Config{ConnectionsPerHost: 1, TransferType: TransferLocal8}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = c.Retrieve("file", new(bytes.Buffer))
+
+		typeErr, ok := err.(*TransferTypeError)
+		if !ok {
+			t.Fatalf("expected *TransferTypeError, got %v", err)
+		}
+
+		if typeErr.Type != TransferLocal8 || typeErr.Code() != 504 {
+			t.Errorf("got %+v", typeErr)
+		}
+	}
+
+	var sent int
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "TYPE L 8" {
+			sent++
+		}
+	}
+
+	// a rejected type isn't remembered
+	if sent != 2 {
+		t.Errorf("expected 2 TYPE L 8, got %d", sent)
+	}
+
+	// SIZE doesn't switch to TYPE I and back for exact types
+	server.mu.Lock()
+	delete(server.replies, "TYPE L 8")
+	server.replies["SIZE file"] = fakeReply{213, "11"}
+	server.mu.Unlock()
+
+	before := len(server.receivedCommands())
+
+	c, err = DialConfig(Config{ConnectionsPerHost: 1, TransferType: TransferLocal8}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Retrieve("file", new(bytes.Buffer)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	types = nil
+	for _, cmd := range server.receivedCommands()[before:] {
+		if strings.HasPrefix(cmd, "TYPE ") {
+			types = append(types, cmd)
+		}
+	}
+
+	if !reflect.DeepEqual(types, []string{"TYPE L 8"}) {
+		t.Errorf("got %v", types)
+	}
+}
+
+// Calls "cb" once at least "after" bytes have been written.
+type callbackWriter struct {
+	after   int
+	written int
+	cb      func()
+}
+
+func (w *callbackWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	if w.written >= w.after && w.cb != nil {
+		w.cb()
+		w.cb = nil
+	}
+	return len(p), nil
+}
+
+func TestRetrieveContext(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		if data, ok := server.data["RETR "+arg]; ok {
+			fc.sendData(data)
+		} else {
+			fc.sendForever(strings.Repeat("x", 1024))
+		}
+	}
+	server.handlers["ABOR"] = func(fc *fakeConn, arg string) {
+		fc.reply(426, "transfer aborted")
+		fc.reply(226, "abort successful")
+	}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = c.RetrieveContext(ctx, "endless", &callbackWriter{after: 10000, cb: cancel})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.RetrieveContext(ctx, "endless", ioutil.Discard)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// already canceled
+	err = c.RetrieveContext(ctx, "file", ioutil.Discard)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.RetrieveContext(context.Background(), "file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	var logins int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "USER ") {
+			logins++
 		}
+	}
+
+	// the connection survived the aborts
+	if logins != 1 {
+		t.Errorf("expected 1 login, got %d", logins)
+	}
+
+	// without a proper reply to ABOR, the connection is discarded
+	server.handlers["ABOR"] = func(fc *fakeConn, arg string) {
+		fc.reply(500, "what?")
+		fc.reply(500, "what?")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	err = c.RetrieveContext(ctx, "endless", &callbackWriter{after: 10000, cb: cancel})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if err := c.Retrieve("file", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	logins = 0
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "USER ") {
+			logins++
+		}
+	}
+
+	if logins != 2 {
+		t.Errorf("expected connection to be replaced, got %d logins", logins)
+	}
+}
+
+func TestRetrieveContextDataDial(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR file"] = "hello world"
+
+	var dials int32
+
+	config := Config{
+		ConnectTimeout: 5 * time.Second,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// data connections never connect
+			if atomic.AddInt32(&dials, 1) > 1 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	t0 := time.Now()
+	err = c.RetrieveContext(ctx, "file", ioutil.Discard)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v", err)
+	}
+
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("took %s", d)
+	}
+}
+
+func TestRetrievePASV(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		if strings.HasPrefix(addr, "[::1]") {
+			// PASV can't work with IPv6
+			continue
+		}
+
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// server doesn't support EPSV
+		c.config.stubResponses = map[string]stubResponse{
+			"EPSV": stubResponse{500, `'EPSV': command not understood.`},
+		}
+
+		buf := new(bytes.Buffer)
+		err = c.Retrieve("subdir/1234.bin", buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+// io.Writer used to simulate various exceptional cases during
+// file downloads
+type testWriter struct {
+	writes [][]byte
+	cb     func([]byte) (int, error)
+}
+
+func (tb *testWriter) Write(p []byte) (int, error) {
+	n, err := tb.cb(p)
+	if n > 0 {
+		tb.writes = append(tb.writes, p[0:n])
+	}
+	return n, err
+}
+
+// pure-ftpd supports "REST STREAM", so make sure we can resume downloads.
+// In this test we are simulating a client write error.
+func TestResumeRetrieveOnWriteError(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(testWriter)
+
+		buf.cb = func(p []byte) (int, error) {
+			if len(p) <= 2 {
+				return len(p), nil
+			}
+			return 2, errors.New("too many bytes to handle")
+		}
+
+		err = c.Retrieve("subdir/1234.bin", buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual([][]byte{[]byte{1, 2}, []byte{3, 4}}, buf.writes) {
+			t.Errorf("Got %v", buf.writes)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+// In this test we simulate a read error by closing all connections
+// part way through the download.
+func TestResumeRetrieveOnReadError(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(testWriter)
+
+		buf.cb = func(p []byte) (int, error) {
+			if len(p) <= 2 {
+				return len(p), nil
+			}
+			// close all the connections, then reset closed so we
+			// can keep using this client
+			c.Close()
+			c.closed = false
+			return 2, errors.New("too many bytes to handle")
+		}
+
+		err = c.Retrieve("subdir/1234.bin", buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual([][]byte{[]byte{1, 2}, []byte{3, 4}}, buf.writes) {
+			t.Errorf("Got %v", buf.writes)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		toSend, err := os.Open("testroot/subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/foo")
+
+		err = c.Store("git-ignored/foo", toSend)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := ioutil.ReadFile("testroot/git-ignored/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, stored) {
+			t.Errorf("Got %v", stored)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+// io.Reader that also implements io.Seeker interface like
+// *os.File (used to test resuming uploads)
+type testSeeker struct {
+	buf   *bytes.Reader
+	soFar int
+	cb    func(int)
+}
+
+func (ts *testSeeker) Read(p []byte) (int, error) {
+	n, err := ts.buf.Read(p)
+	ts.soFar += n
+	ts.cb(ts.soFar)
+	return n, err
+}
+
+func (ts *testSeeker) Seek(offset int64, whence int) (int64, error) {
+	return ts.buf.Seek(offset, whence)
+}
+
+func randomBytes(b []byte) {
+	for i := 0; i < len(b); i++ {
+		b[i] = byte(rand.Int31n(256))
+	}
+}
+
+// kill connections part way through upload - show we can restart if src
+// is an io.Seeker
+func TestStoreFrom(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.stored["file"] = []byte("hello ")
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.StoreFrom("file", strings.NewReader("world"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["file"]); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	// StoreResume figures out the offset itself
+	server.stored["partial"] = []byte("hello")
+	server.replies["MLST partial"] = fakeReply{250, "Listing partial\n type=file;size=5;modify=20150216084148; partial\nEnd"}
+
+	err = c.StoreResume("partial", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["partial"]); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	// and starts from scratch for files that don't exist
+	server.replies["MLST new"] = fakeReply{550, "no such file"}
+	server.data["MLSD "] = "type=file;size=5;modify=20150216084148; partial\r\n" +
+		"type=file;size=5;modify=20150216084148; locked\r\n"
+
+	err = c.StoreResume("new", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["new"]); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+
+	// but not for other errors
+	server.replies["MLST locked"] = fakeReply{550, "permission denied"}
+	server.replies["MLST busy"] = fakeReply{450, "try again later"}
+
+	for _, name := range []string{"locked", "busy"} {
+		err = c.StoreResume(name, strings.NewReader("hello world"))
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+
+		if _, ok := server.stored[name]; ok {
+			t.Errorf("%s: shouldn't have stored", name)
+		}
+	}
+
+	// no REST STREAM
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.StoreFrom("file", strings.NewReader("world"), 6)
+	if !errors.Is(err, ErrResumeUnsupported) {
+		t.Errorf("expected ErrResumeUnsupported, got %v", err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+// Reads zeros forever, calling "cb" once at least "after" bytes have been
+// read.
+type callbackReader struct {
+	after int
+	read  int
+	cb    func()
+}
+
+func (r *callbackReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	r.read += len(p)
+	if r.read >= r.after && r.cb != nil {
+		r.cb()
+		r.cb = nil
+	}
+	return len(p), nil
+}
+
+func TestStoreContext(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = c.StoreContext(ctx, "endless", &callbackReader{after: 10000, cb: cancel})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if err := c.StoreContext(context.Background(), "file", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["file"]); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+
+	if c.numOpenConns() != 1 || len(c.freeConnCh) != 1 {
+		t.Error("expected connection to be reused")
+	}
+}
+
+func TestStallTimeout(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	// sends "hello", then stalls, unless resuming
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		if fc.restOffset > 0 {
+			fc.sendData("hello world")
+			return
+		}
+
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
+		}
+
+		fc.reply(150, "here it comes")
+		dc.Write([]byte("hello"))
+		ioutil.ReadAll(dc)
+		dc.Close()
+	}
+
+	// never reads
+	server.handlers["STOR"] = func(fc *fakeConn, arg string) {
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
+		}
+
+		fc.reply(150, "send it")
+		<-unblock
+		dc.Close()
+	}
+
+	config := Config{StallTimeout: 100 * time.Millisecond}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resumed after the stall
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	err = c.Store("file", &callbackReader{})
+
+	te, ok := err.(*TransferError)
+	if !ok {
+		t.Fatalf("expected *TransferError, got %v", err)
+	}
+
+	if te.Bytes <= 0 || !te.Temporary() || !te.Timeout() || !errors.Is(err, ErrTransferStalled) {
+		t.Errorf("got %+v", te)
+	}
+
+	// no REST STREAM
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	err = c.Retrieve("file", buf)
+
+	te, ok = err.(*TransferError)
+	if !ok {
+		t.Fatalf("expected *TransferError, got %v", err)
+	}
+
+	if te.Bytes != 5 || !te.Temporary() || !errors.Is(err, ErrTransferStalled) {
+		t.Errorf("got %+v", te)
+	}
+}
+
+func TestStoreVerification(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// server silently truncated the upload
+	server.replies["SIZE file"] = fakeReply{213, "3"}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not a Seeker
+	err = c.Store("file", bytes.NewBufferString("hello"))
+	if !errors.Is(err, ErrUploadSizeMismatch) {
+		t.Fatalf("expected ErrUploadSizeMismatch, got %v", err)
+	}
+
+	sizeErr := err.(*UploadSizeError)
+	if sizeErr.Path != "file" || sizeErr.Sent != 5 || sizeErr.Size != 3 || !sizeErr.Temporary() {
+		t.Errorf("got %+v", sizeErr)
+	}
+
+	c, err = DialConfig(Config{SkipUploadVerification: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store("file", bytes.NewBufferString("hello")); err != nil {
+		t.Error(err)
+	}
+
+	// no SIZE, so nothing to check
+	server.features = []string{"EPSV"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store("file", bytes.NewBufferString("hello")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreAppend(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.stored["log"] = []byte("one\n")
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.StoreAppend("log", strings.NewReader("two\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["log"]); got != "one\ntwo\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// server creates missing files
+	if err := c.StoreAppend("new", strings.NewReader("one\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["new"]); got != "one\n" {
+		t.Errorf("got %q", got)
+	}
+
+	src := io.MultiReader(strings.NewReader("three\n"), iotest.ErrReader(errors.New("read failed")))
+	err = c.StoreAppend("log", src)
+
+	var te *TransferError
+	if !errors.As(err, &te) || te.Bytes != 6 {
+		t.Errorf("expected TransferError after 6 bytes, got %v", err)
+	}
+
+	if _, ok := err.(Error); !ok {
+		t.Errorf("expected Error, got %T", err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestStoreUnique(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.replies["CWD inbox"] = fakeReply{250, "ok"}
+	server.replies["CWD /"] = fakeReply{250, "ok"}
+	server.handlers["STOU"] = func(fc *fakeConn, arg string) {
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
+		}
+
+		fc.reply(150, "FILE: upload.1")
+		got, _ := ioutil.ReadAll(dc)
+		dc.Close()
+
+		fc.server.mu.Lock()
+		fc.server.stored["upload.1"] = got
+		fc.server.mu.Unlock()
+
+		fc.reply(226, "Transfer complete")
+	}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := c.StoreUnique("inbox", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "inbox/upload.1" {
+		t.Errorf("got %q", name)
+	}
+
+	if got := string(server.stored["upload.1"]); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+
+	name, err = c.StoreUnique("", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "upload.1" {
+		t.Errorf("got %q", name)
+	}
+
+	var cmds []string
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "CWD") || strings.HasPrefix(cmd, "STOU") {
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	if exp := []string{"CWD inbox", "STOU", "CWD /", "STOU"}; !reflect.DeepEqual(cmds, exp) {
+		t.Errorf("expected %v, got %v", exp, cmds)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestParseSTOUName(t *testing.T) {
+	cases := []struct {
+		msgs []string
+		exp  string
+	}{
+		{[]string{"FILE: ftp_1234.tmp", "Transfer complete"}, "ftp_1234.tmp"},
+		{[]string{"Opening BINARY mode data connection", "Transfer complete (unique file name:FTP0042.TMP)."}, "FTP0042.TMP"},
+		{[]string{`Opening data connection for "my file.1"`, "Transfer complete"}, "my file.1"},
+		{[]string{`Data connection open`, `File "/inbox/a""b" stored`}, `/inbox/a"b`},
+		{[]string{"Opening BINARY mode data connection for stou.42 (5 bytes).", "Transfer complete"}, "stou.42"},
+		{[]string{"Opening BINARY mode data connection for stou.42.", "Transfer complete"}, "stou.42"},
+		{[]string{"Ok to send data", "Transfer complete"}, "Ok to send data\nTransfer complete"},
+	}
+
+	for _, c := range cases {
+		if got := parseSTOUName(c.msgs); got != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.msgs, c.exp, got)
+		}
+	}
+}
+
+func TestResumeStoreOnWriteError(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 10MB of random data
+		buf := make([]byte, 10*1024*1024)
+		randomBytes(buf)
+
+		closed := false
+
+		seeker := &testSeeker{
+			buf: bytes.NewReader(buf),
+			cb: func(readSoFar int) {
+				if readSoFar > 5*1024*1024 && !closed {
+					// close all connections half way through upload
+
+					// if you don't wait a bit here, proftpd deletes the
+					// partially uploaded file for some reason
+					time.Sleep(100 * time.Millisecond)
+
+					c.Close()
+					c.closed = false
+					closed = true
+				}
+			},
+		}
+
+		os.Remove("testroot/git-ignored/big")
+
+		err = c.Store("git-ignored/big", seeker)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := ioutil.ReadFile("testroot/git-ignored/big")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf, stored) {
+			t.Errorf("buf was %d, stored was %d", len(buf), len(stored))
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStoreFilePreserveModTime(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.features = append(server.features, "MFMT")
+	server.replies["MFMT 20150216084148 upload"] = fakeReply{213, "Modify=20150216084148; upload"}
+
+	f, err := ioutil.TempFile("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("hello")
+	f.Close()
+
+	// local time zone must not matter
+	mtime := time.Date(2015, 2, 16, 8, 41, 48, 0, time.UTC).In(time.FixedZone("UTC+5", 5*3600))
+	if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	mfmts := func() []string {
+		var cmds []string
+		for _, cmd := range server.receivedCommands() {
+			if strings.HasPrefix(cmd, "MFMT") {
+				cmds = append(cmds, cmd)
+			}
+		}
+		return cmds
+	}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.StoreFile(f.Name(), "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(server.stored["upload"]); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+
+	if cmds := mfmts(); len(cmds) != 0 {
+		t.Errorf("unexpected %v", cmds)
+	}
+
+	c, err = DialConfig(Config{PreserveModTime: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.StoreFile(f.Name(), "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cmds := mfmts(); !reflect.DeepEqual(cmds, []string{"MFMT 20150216084148 upload"}) {
+		t.Errorf("got %v", cmds)
+	}
+
+	// MFMT failing fails the upload
+	if err := c.StoreFile(f.Name(), "other"); err == nil {
+		t.Error("expected error")
+	}
+
+	// skipped without MFMT
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{PreserveModTime: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.StoreFile(f.Name(), "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetModTime("upload", mtime); !errors.Is(err, ErrModTimeUnsupported) {
+		t.Errorf("expected ErrModTimeUnsupported, got %v", err)
+	}
+
+	if cmds := mfmts(); len(cmds) != 2 {
+		t.Errorf("got %v", cmds)
+	}
+}
+
+func TestControlKeepalive(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	// sends "hello world" a byte every 10ms
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
+		}
+
+		fc.reply(150, "here it comes")
+		for _, b := range []byte("hello world") {
+			dc.Write([]byte{b})
+			time.Sleep(10 * time.Millisecond)
+		}
+		dc.Close()
+		fc.reply(226, "done")
+	}
+
+	server.replies["SIZE file"] = fakeReply{213, "11"}
+
+	c, err := DialConfig(Config{ControlKeepalive: 20 * time.Millisecond}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noops := func() int {
+		var n int
+		for _, cmd := range server.receivedCommands() {
+			if cmd == "NOOP" {
+				n++
+			}
+		}
+		return n
+	}
+
+	for i := 0; i < 2; i++ {
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("file", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != "hello world" {
+			t.Errorf("got %q", buf.String())
+		}
+	}
+
+	if n := noops(); n < 2 {
+		t.Errorf("expected NOOPs, got %d", n)
+	}
+
+	// replies are still in sync
+	if size, err := c.size(context.Background(), "file"); err != nil || size != 11 {
+		t.Errorf("got %d, %v", size, err)
+	}
+
+	if c.numOpenConns() != 1 {
+		t.Errorf("expected 1 connection, got %d", c.numOpenConns())
+	}
+
+	// servers rejecting commands during transfers
+	server.replies["NOOP"] = fakeReply{500, "transfer in progress"}
+
+	if err := c.Retrieve("file", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if size, err := c.size(context.Background(), "file"); err != nil || size != 11 {
+		t.Errorf("got %d, %v", size, err)
+	}
+
+	// off by default
+	before := noops()
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Retrieve("file", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := noops(); n != before {
+		t.Errorf("expected no NOOPs, got %d", n-before)
+	}
+}
+
+func TestAtomicUploads(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	var (
+		renameFrom       string
+		refuseOverwrite  bool
+		refuseDeleteTemp bool
+	)
+
+	server.handlers["RNFR"] = func(fc *fakeConn, arg string) {
+		renameFrom = arg
+		fc.reply(350, "go on")
+	}
+
+	server.handlers["RNTO"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		if _, exists := server.stored[arg]; exists && refuseOverwrite {
+			fc.reply(553, "file exists")
+			return
+		}
+
+		server.stored[arg] = server.stored[renameFrom]
+		delete(server.stored, renameFrom)
+		fc.reply(250, "renamed")
+	}
+
+	server.handlers["DELE"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		_, exists := server.stored[arg]
+		if exists && !(refuseDeleteTemp && strings.Contains(arg, ".part-")) {
+			delete(server.stored, arg)
+		} else {
+			exists = false
+		}
+		server.mu.Unlock()
+
+		if exists {
+			fc.reply(250, "deleted")
+		} else {
+			fc.reply(550, "can't delete")
+		}
+	}
+
+	server.handlers["STOR"] = func(fc *fakeConn, arg string) {
+		if strings.HasPrefix(arg, "bad") {
+			// fails after writing the file
+			server.mu.Lock()
+			server.replies["SIZE "+arg] = fakeReply{213, "1000"}
+			server.mu.Unlock()
+			fc.receiveData(arg, false)
+			return
+		}
+
+		if !strings.HasPrefix(arg, "upload.part-") && !strings.HasPrefix(arg, "bad.part-") {
+			t.Errorf("unexpected STOR %s", arg)
+		}
+
+		fc.receiveData(arg, false)
+	}
+
+	c, err := DialConfig(Config{AtomicUploads: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store("upload", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func() []string {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		var names []string
+		for name := range server.stored {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if names := stored(); !reflect.DeepEqual(names, []string{"upload"}) || string(server.stored["upload"]) != "hello" {
+		t.Errorf("got %v", names)
+	}
+
+	// server refuses to overwrite
+	refuseOverwrite = true
+
+	if err := c.Store("upload", strings.NewReader("again")); err == nil {
+		t.Error("expected error")
+	}
+
+	if names := stored(); !reflect.DeepEqual(names, []string{"upload"}) || string(server.stored["upload"]) != "hello" {
+		t.Errorf("got %v", names)
+	}
+
+	c.config.AtomicUploadOverwrite = true
+
+	if err := c.Store("upload", strings.NewReader("again")); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := stored(); !reflect.DeepEqual(names, []string{"upload"}) || string(server.stored["upload"]) != "again" {
+		t.Errorf("got %v", names)
+	}
+
+	// verification fails, and the temporary file can't be deleted
+	refuseDeleteTemp = true
+
+	err = c.Store("bad", strings.NewReader("hello"))
+
+	cleanupErr, ok := err.(*UploadCleanupError)
+	if !ok {
+		t.Fatalf("expected *UploadCleanupError, got %v", err)
+	}
+
+	if !errors.Is(err, ErrUploadSizeMismatch) || !strings.HasPrefix(cleanupErr.TempPath, "bad.part-") || !strings.Contains(err.Error(), cleanupErr.TempPath) {
+		t.Errorf("got %v", err)
+	}
+
+	if names := stored(); !reflect.DeepEqual(names, []string{cleanupErr.TempPath, "upload"}) {
+		t.Errorf("got %v", names)
+	}
+}
+
+func TestStoreFileIfChanged(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.features = append(server.features, "MFMT")
+
+	mtimes := make(map[string]string)
+
+	server.handlers["MFMT"] = func(fc *fakeConn, arg string) {
+		parts := strings.SplitN(arg, " ", 2)
+		server.mu.Lock()
+		mtimes[parts[1]] = parts[0]
+		server.mu.Unlock()
+		fc.reply(213, "Modify="+parts[0]+"; "+parts[1])
+	}
+
+	server.handlers["MLST"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		data, ok := server.stored[arg]
+		mtime := mtimes[arg]
+		server.mu.Unlock()
+
+		if !ok {
+			fc.reply(550, "no such file")
+			return
+		}
+
+		fc.reply(250, fmt.Sprintf("Listing\n type=file;size=%d;modify=%s; %s\nEnd", len(data), mtime, arg))
+	}
+
+	server.handlers["MLSD"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		var listing string
+		for name, data := range server.stored {
+			listing += fmt.Sprintf("type=file;size=%d;modify=%s; %s\r\n", len(data), mtimes[name], name)
+		}
+		server.mu.Unlock()
+
+		fc.sendData(listing)
+	}
+
+	f, err := ioutil.TempFile("", "goftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("hello")
+	f.Close()
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(exp bool) {
+		t.Helper()
+
+		got, err := c.StoreFileIfChanged(f.Name(), "upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != exp {
+			t.Errorf("expected %t, got %t", exp, got)
+		}
+	}
+
+	// doesn't exist yet
+	check(true)
+
+	if string(server.stored["upload"]) != "hello" {
+		t.Errorf("got %q", server.stored["upload"])
+	}
+
+	// mtime was preserved, so nothing to do
+	check(false)
+
+	// changed locally
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(f.Name(), later, later)
+	check(true)
+	check(false)
+
+	// from a listing
+	info, err := c.Stat("upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploaded, err := c.StoreFileIfChangedInfo(f.Name(), "upload", info); err != nil || uploaded {
+		t.Errorf("got %t, %v", uploaded, err)
+	}
+
+	if uploaded, err := c.StoreFileIfChangedInfo(f.Name(), "other", nil); err != nil || !uploaded {
+		t.Errorf("got %t, %v", uploaded, err)
+	}
+
+	var stors int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "STOR") {
+			stors++
+		}
+	}
+
+	if stors != 3 {
+		t.Errorf("expected 3 uploads, got %d", stors)
+	}
+}
+
+func TestStoreAllocate(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	alloCode := 200
+	server.handlers["ALLO"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		code := alloCode
+		server.mu.Unlock()
+		fc.reply(code, "ALLO "+arg)
+	}
+
+	c, err := DialConfig(Config{Allocate: true}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// ALLO and STOR commands received since the last call
+	var seen int
+	lastUpload := func() []string {
+		cmds := server.receivedCommands()
+		var got []string
+		for _, cmd := range cmds[seen:] {
+			if strings.HasPrefix(cmd, "ALLO ") || strings.HasPrefix(cmd, "STOR ") {
+				got = append(got, cmd)
+			}
+		}
+		seen = len(cmds)
+		return got
+	}
+
+	if err := c.Store("seeker", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, exp := lastUpload(), []string{"ALLO 5", "STOR seeker"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+
+	if err := c.StoreWithSize("sized", iotest.OneByteReader(strings.NewReader("hi")), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, exp := lastUpload(), []string{"ALLO 2", "STOR sized"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+
+	// size unknown
+	if err := c.Store("unsized", iotest.OneByteReader(strings.NewReader("hi"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, exp := lastUpload(), []string{"STOR unsized"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+
+	server.mu.Lock()
+	alloCode = 202
+	server.mu.Unlock()
+
+	if err := c.Store("superfluous", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	lastUpload()
+
+	server.mu.Lock()
+	alloCode = 552
+	server.mu.Unlock()
+
+	err = c.Store("full", bytes.NewReader([]byte("hello")))
+
+	var allocErr *AllocateError
+	if !errors.As(err, &allocErr) || allocErr.Size != 5 || allocErr.Code() != 552 {
+		t.Fatalf("got %v, expected *AllocateError for 552", err)
+	}
+
+	if got, exp := lastUpload(), []string{"ALLO 5"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+
+	server.mu.Lock()
+	_, stored := server.stored["full"]
+	server.mu.Unlock()
+
+	if stored {
+		t.Error("file shouldn't have been stored")
+	}
+}
+
+func TestStoreNonSeekable(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	var (
+		stors   int
+		failAt  = map[int]int{}
+		storErr = 451
+	)
+
+	server.handlers["STOR"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		stors++
+		code := failAt[stors]
+		server.mu.Unlock()
+
+		switch code {
+		case 0:
+			fc.receiveData(arg, false)
+		case 425:
+			// before any data is read
+			fc.reply(425, "can't open data connection")
+		default:
+			dc, err := fc.acceptData()
+			if err != nil {
+				fc.reply(425, err.Error())
+				return
+			}
+
+			fc.reply(150, "send it")
+			ioutil.ReadAll(dc)
+			dc.Close()
+			fc.reply(code, "local error")
+		}
+	}
+
+	config := Config{
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+		},
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// an *os.File, but it can't seek
+	pipe := func(data string) *os.File {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			w.WriteString(data)
+			w.Close()
+		}()
+
+		return r
+	}
+
+	// failed after reading "src", so not retried
+	failAt[1] = storErr
+
+	r := pipe("hello world")
+	err = c.Store("piped", r)
+	r.Close()
+
+	var te *TransferError
+	if !errors.As(err, &te) || te.Bytes != 11 || !strings.Contains(err.Error(), "451") {
+		t.Fatalf("expected TransferError after 11 bytes, got %v", err)
+	}
+
+	// failed before reading "src", so retried
+	server.mu.Lock()
+	if stors != 1 {
+		t.Errorf("expected 1 STOR, got %d", stors)
+	}
+	stors = 0
+	failAt = map[int]int{1: 425}
+	server.mu.Unlock()
+
+	r = pipe("hello world")
+	err = c.Store("piped", r)
+	r.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if stors != 2 {
+		t.Errorf("expected 2 STORs, got %d", stors)
+	}
+
+	if got := string(server.stored["piped"]); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMaxRetrieveBytes(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	server.data["RETR small"] = "hello"
+	server.replies["SIZE small"] = fakeReply{213, "5"}
+	server.replies["SIZE big"] = fakeReply{213, "100"}
+
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		if data, ok := server.data["RETR "+arg]; ok {
+			fc.sendData(data)
+		} else {
+			fc.sendForever(strings.Repeat("x", 1024))
+		}
+	}
+	server.handlers["ABOR"] = func(fc *fakeConn, arg string) {
+		fc.reply(426, "transfer aborted")
+		fc.reply(226, "abort successful")
+	}
+
+	c, err := DialConfig(Config{ConnectionsPerHost: 1, MaxRetrieveBytes: 10}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("small", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	// too big according to SIZE
+	buf.Reset()
+	err = c.Retrieve("big", buf)
 
-		c, err := DialConfig(goftpConfig, addr)
-		if err != nil {
-			t.Fatal(err)
-		}
+	var sle *SizeLimitError
+	if !errors.As(err, &sle) || !errors.Is(err, ErrSizeLimitExceeded) || sle.Bytes != 0 || sle.Limit != 10 {
+		t.Fatalf("expected SizeLimitError, got %v", err)
+	}
 
-		// server doesn't support EPSV
-		c.config.stubResponses = map[string]stubResponse{
-			"EPSV": stubResponse{500, `'EPSV': command not understood.`},
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "RETR big" {
+			t.Error("big shouldn't have been retrieved")
 		}
+	}
 
-		buf := new(bytes.Buffer)
-		err = c.Retrieve("subdir/1234.bin", buf)
+	// no SIZE, so aborted part way through
+	err = c.Retrieve("endless", buf)
+	if !errors.As(err, &sle) || sle.Bytes != 10 {
+		t.Fatalf("expected SizeLimitError after 10 bytes, got %v", err)
+	}
 
-		if err != nil {
-			t.Fatal(err)
-		}
+	if buf.Len() != 10 {
+		t.Errorf("expected 10 bytes written, got %d", buf.Len())
+	}
 
-		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
-			t.Errorf("Got %v", buf.Bytes())
-		}
+	// the connection survived the abort
+	buf.Reset()
+	if err := c.Retrieve("small", buf); err != nil {
+		t.Fatal(err)
+	}
 
-		if c.numOpenConns() != len(c.freeConnCh) {
-			t.Error("Leaked a connection")
+	var logins int
+	for _, cmd := range server.receivedCommands() {
+		if strings.HasPrefix(cmd, "USER ") {
+			logins++
 		}
 	}
-}
 
-// io.Writer used to simulate various exceptional cases during
-// file downloads
-type testWriter struct {
-	writes [][]byte
-	cb     func([]byte) (int, error)
+	if logins != 1 {
+		t.Errorf("expected 1 login, got %d", logins)
+	}
 }
 
-func (tb *testWriter) Write(p []byte) (int, error) {
-	n, err := tb.cb(p)
-	if n > 0 {
-		tb.writes = append(tb.writes, p[0:n])
+func TestTransferByteCounts(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
 	}
-	return n, err
-}
+	defer server.close()
 
-// pure-ftpd supports "REST STREAM", so make sure we can resume downloads.
-// In this test we are simulating a client write error.
-func TestResumeRetrieveOnWriteError(t *testing.T) {
-	for _, addr := range ftpdAddrs {
-		c, err := DialConfig(goftpConfig, addr)
+	server.data["RETR file"] = "hello world"
+	server.replies["SIZE file"] = fakeReply{213, "11"}
 
+	// closes the data connection early but claims success
+	server.data["RETR short"] = "hello"
+	server.replies["SIZE short"] = fakeReply{213, "11"}
+
+	var failedResume bool
+
+	server.handlers["RETR"] = func(fc *fakeConn, arg string) {
+		if arg != "broken" {
+			fc.sendData(server.data["RETR "+arg])
+			return
+		}
+
+		dc, err := fc.acceptData()
 		if err != nil {
-			t.Fatal(err)
+			fc.reply(425, err.Error())
+			return
 		}
 
-		buf := new(testWriter)
+		fc.reply(150, "here it comes")
+		dc.Write([]byte("hello"))
+		dc.Close()
+		fc.reply(426, "connection closed")
+	}
 
-		buf.cb = func(p []byte) (int, error) {
-			if len(p) <= 2 {
-				return len(p), nil
-			}
-			return 2, errors.New("too many bytes to handle")
+	server.handlers["SIZE"] = func(fc *fakeConn, arg string) {
+		if reply, ok := server.replies["SIZE "+arg]; ok {
+			fc.reply(reply.code, reply.msg)
+			return
 		}
 
-		err = c.Retrieve("subdir/1234.bin", buf)
+		server.mu.Lock()
+		data, ok := server.stored[arg]
+		server.mu.Unlock()
 
-		if err != nil {
-			t.Fatal(err)
+		if ok {
+			fc.reply(213, strconv.Itoa(len(data)))
+		} else {
+			fc.reply(550, "no such file")
+		}
+	}
+
+	server.handlers["STOR"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		fail := arg == "fail" || (arg == "resume" && !failedResume)
+		failedResume = failedResume || arg == "resume"
+		server.mu.Unlock()
+
+		if !fail {
+			fc.receiveData(arg, false)
+			return
 		}
 
-		if !reflect.DeepEqual([][]byte{[]byte{1, 2}, []byte{3, 4}}, buf.writes) {
-			t.Errorf("Got %v", buf.writes)
+		dc, err := fc.acceptData()
+		if err != nil {
+			fc.reply(425, err.Error())
+			return
 		}
 
-		if c.numOpenConns() != len(c.freeConnCh) {
-			t.Error("Leaked a connection")
+		fc.reply(150, "send it")
+
+		// keep only the first 5 bytes
+		got, _ := ioutil.ReadAll(dc)
+		dc.Close()
+
+		server.mu.Lock()
+		server.stored[arg] = got[:5]
+		server.mu.Unlock()
+
+		fc.reply(451, "local error")
+	}
+
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n, err := c.RetrieveN("file", ioutil.Discard)
+	if err != nil || n != 11 {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	n, err = c.RetrieveN("short", ioutil.Discard)
+	if err == nil || n != 5 {
+		t.Errorf("expected error after 5 bytes, got %d, %v", n, err)
+	}
+
+	n, err = c.StoreN("file", bytes.NewReader([]byte("hello world")))
+	if err != nil || n != 11 {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	// resumed from the 5 bytes the server kept
+	n, err = c.StoreN("resume", bytes.NewReader([]byte("hello world")))
+	if err != nil || n != 11 {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	server.mu.Lock()
+	if got := string(server.stored["resume"]); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+	server.mu.Unlock()
+
+	// can't resume from a non-seekable source
+	n, err = c.StoreN("fail", iotest.OneByteReader(strings.NewReader("hello world")))
+	if err == nil || n != 11 {
+		t.Errorf("expected error after 11 bytes, got %d, %v", n, err)
+	}
+
+	// no REST STREAM
+	server.features = []string{"SIZE", "EPSV"}
+
+	c, err = DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n, err = c.RetrieveN("broken", ioutil.Discard)
+	if err == nil || n != 5 {
+		t.Errorf("expected error after 5 bytes, got %d, %v", n, err)
+	}
+}
+
+func TestParseEPSV(t *testing.T) {
+	cases := []struct {
+		msg  string
+		port int
+	}{
+		{"Entering Extended Passive Mode (|||6446|)", 6446},
+		{"Entering Extended Passive Mode (|||6446|).", 6446},
+		{"Entering Extended Passive Mode ( |||6446| )", 6446},
+		{"Entering Extended Passive Mode (| | | 6446 |)", 6446},
+		{"Entering Extended Passive Mode (!!!6446!)", 6446},
+		{"Entering Extended Passive Mode (|||0|)", 0},
+		{"Entering Extended Passive Mode (|||99999|)", 0},
+		{"Entering Extended Passive Mode (||6446|)", 0},
+		{"Entering Extended Passive Mode (|||x|)", 0},
+		{"Entering Extended Passive Mode", 0},
+	}
+
+	for _, c := range cases {
+		port, err := parseEPSV(c.msg)
+		if c.port == 0 && err == nil {
+			t.Errorf("%q: expected error, got %d", c.msg, port)
+		} else if c.port != 0 && (err != nil || port != c.port) {
+			t.Errorf("%q: got %d, %v", c.msg, port, err)
 		}
 	}
 }
 
-// In this test we simulate a read error by closing all connections
-// part way through the download.
-func TestResumeRetrieveOnReadError(t *testing.T) {
-	for _, addr := range ftpdAddrs {
-		c, err := DialConfig(goftpConfig, addr)
+func TestPassiveMode(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
 
-		if err != nil {
-			t.Fatal(err)
+	server.data["RETR file"] = "hello world"
+
+	var epsvReply *fakeReply
+	server.handlers["EPSV"] = func(fc *fakeConn, arg string) {
+		server.mu.Lock()
+		reply := epsvReply
+		server.mu.Unlock()
+
+		if reply != nil {
+			fc.reply(reply.code, reply.msg)
+		} else {
+			fc.defaultCommand("EPSV", arg)
 		}
+	}
 
-		buf := new(testWriter)
+	setEPSV := func(reply *fakeReply) {
+		server.mu.Lock()
+		epsvReply = reply
+		server.mu.Unlock()
+	}
 
-		buf.cb = func(p []byte) (int, error) {
-			if len(p) <= 2 {
-				return len(p), nil
+	// counts EPSV and PASV commands sent by "f"
+	count := func(f func()) (int, int) {
+		before := len(server.receivedCommands())
+		f()
+
+		var epsvs, pasvs int
+		for _, cmd := range server.receivedCommands()[before:] {
+			if cmd == "EPSV" {
+				epsvs++
+			} else if cmd == "PASV" {
+				pasvs++
 			}
-			// close all the connections, then reset closed so we
-			// can keep using this client
-			c.Close()
-			c.closed = false
-			return 2, errors.New("too many bytes to handle")
 		}
+		return epsvs, pasvs
+	}
 
-		err = c.Retrieve("subdir/1234.bin", buf)
+	retrieveTwice := func(config Config) func() {
+		return func() {
+			config.ConnectionsPerHost = 1
 
-		if err != nil {
-			t.Fatal(err)
-		}
+			c, err := DialConfig(config, server.addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
 
-		if !reflect.DeepEqual([][]byte{[]byte{1, 2}, []byte{3, 4}}, buf.writes) {
-			t.Errorf("Got %v", buf.writes)
+			for i := 0; i < 2; i++ {
+				buf := new(bytes.Buffer)
+				if err := c.Retrieve("file", buf); err != nil {
+					t.Fatal(err)
+				} else if buf.String() != "hello world" {
+					t.Errorf("got %q", buf.String())
+				}
+			}
 		}
+	}
 
-		if c.numOpenConns() != len(c.freeConnCh) {
-			t.Error("Leaked a connection")
+	if epsvs, pasvs := count(retrieveTwice(Config{})); epsvs != 2 || pasvs != 0 {
+		t.Errorf("got %d EPSVs and %d PASVs", epsvs, pasvs)
+	}
+
+	// not supported, so only tried once
+	setEPSV(&fakeReply{502, "not implemented"})
+	if epsvs, pasvs := count(retrieveTwice(Config{})); epsvs != 1 || pasvs != 2 {
+		t.Errorf("got %d EPSVs and %d PASVs", epsvs, pasvs)
+	}
+
+	setEPSV(&fakeReply{229, "Entering Extended Passive Mode (nonsense)"})
+	if epsvs, pasvs := count(retrieveTwice(Config{})); epsvs != 1 || pasvs != 2 {
+		t.Errorf("got %d EPSVs and %d PASVs", epsvs, pasvs)
+	}
+
+	setEPSV(nil)
+	if epsvs, pasvs := count(retrieveTwice(Config{PassiveMode: PassivePASV})); epsvs != 0 || pasvs != 2 {
+		t.Errorf("got %d EPSVs and %d PASVs", epsvs, pasvs)
+	}
+
+	setEPSV(&fakeReply{502, "not implemented"})
+
+	c, err := DialConfig(Config{PassiveMode: PassiveEPSV}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	epsvs, pasvs := count(func() {
+		if err := c.Retrieve("file", ioutil.Discard); err == nil {
+			t.Error("expected error")
 		}
+	})
+
+	if epsvs != 1 || pasvs != 0 {
+		t.Errorf("got %d EPSVs and %d PASVs", epsvs, pasvs)
 	}
 }
 
-func TestStore(t *testing.T) {
-	for _, addr := range ftpdAddrs {
-		c, err := DialConfig(goftpConfig, addr)
+func TestPassiveModeIPv6(t *testing.T) {
+	server, err := newFakeServerOn("[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6:", err)
+	}
+	defer server.close()
 
-		if err != nil {
-			t.Fatal(err)
-		}
+	server.replies["EPSV"] = fakeReply{502, "not implemented"}
 
-		toSend, err := os.Open("testroot/subdir/1234.bin")
-		if err != nil {
-			t.Fatal(err)
+	c, err := DialConfig(Config{}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Retrieve("file", ioutil.Discard); err == nil {
+		t.Error("expected error")
+	}
+
+	for _, cmd := range server.receivedCommands() {
+		if cmd == "PASV" {
+			t.Error("PASV shouldn't be tried over IPv6")
 		}
+	}
 
-		os.Remove("testroot/git-ignored/foo")
+	c, err = DialConfig(Config{PassiveMode: PassivePASV}, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
 
-		err = c.Store("git-ignored/foo", toSend)
+	if err := c.Retrieve("file", ioutil.Discard); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestIgnorePassiveAddress(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
 
+	server.data["RETR file"] = "hello world"
+
+	// a server behind NAT
+	server.handlers["PASV"] = func(fc *fakeConn, arg string) {
+		port, err := fc.listenData()
 		if err != nil {
-			t.Fatal(err)
+			fc.reply(425, err.Error())
+		} else {
+			fc.reply(227, fmt.Sprintf("Entering Passive Mode (10,1,2,3,%d,%d)", port>>8, port&0xFF))
 		}
+	}
 
-		stored, err := ioutil.ReadFile("testroot/git-ignored/foo")
+	config := Config{
+		PassiveMode:          PassivePASV,
+		IgnorePassiveAddress: true,
+		Timeout:              100 * time.Millisecond,
+	}
+
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	// the control connection's remote address doesn't matter (e.g. a
+	// tunnel), the address dialed does
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
 		if err != nil {
-			t.Fatal(err)
+			return nil, err
 		}
+		return tunnelConn{conn}, nil
+	}
 
-		if !bytes.Equal([]byte{1, 2, 3, 4}, stored) {
-			t.Errorf("Got %v", stored)
-		}
+	c, err = DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
 
-		if c.numOpenConns() != len(c.freeConnCh) {
-			t.Error("Leaked a connection")
-		}
+	buf.Reset()
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
 	}
-}
 
-// io.Reader that also implements io.Seeker interface like
-// *os.File (used to test resuming uploads)
-type testSeeker struct {
-	buf   *bytes.Reader
-	soFar int
-	cb    func(int)
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	cases := []struct {
+		advertised, control string
+		force, ignore       bool
+	}{
+		{"10.1.2.3", "203.0.113.5", false, true},
+		{"192.168.1.1", "203.0.113.5", false, true},
+		{"0.0.0.0", "203.0.113.5", false, true},
+		{"198.51.100.7", "203.0.113.5", false, false},
+		{"10.1.2.3", "10.9.9.9", false, false},
+		{"10.1.2.3", "127.0.0.1", false, false},
+		{"198.51.100.7", "203.0.113.5", true, true},
+		{"203.0.113.5", "203.0.113.5", true, false},
+	}
+
+	for _, tc := range cases {
+		pconn := &persistentConn{config: Config{IgnorePassiveAddress: tc.force}}
+		if got := pconn.ignorePASVAddress(net.ParseIP(tc.advertised), net.ParseIP(tc.control)); got != tc.ignore {
+			t.Errorf("%s via %s (forced %v): got %v", tc.advertised, tc.control, tc.force, got)
+		}
+	}
 }
 
-func (ts *testSeeker) Read(p []byte) (int, error) {
-	n, err := ts.buf.Read(p)
-	ts.soFar += n
-	ts.cb(ts.soFar)
-	return n, err
+// A connection through a tunnel, whose remote address is the tunnel's.
+type tunnelConn struct {
+	net.Conn
 }
 
-func (ts *testSeeker) Seek(offset int64, whence int) (int64, error) {
-	return ts.buf.Seek(offset, whence)
+func (tunnelConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("198.51.100.9"), Port: 2121}
 }
 
-func randomBytes(b []byte) {
-	for i := 0; i < len(b); i++ {
-		b[i] = byte(rand.Int31n(256))
+func TestForeignDataAddress(t *testing.T) {
+	server, err := newFakeServer()
+	if err != nil {
+		t.Fatal(err)
 	}
-}
+	defer server.close()
 
-// kill connections part way through upload - show we can restart if src
-// is an io.Seeker
-func TestResumeStoreOnWriteError(t *testing.T) {
-	for _, addr := range ftpdAddrs {
-		c, err := DialConfig(goftpConfig, addr)
+	server.data["RETR file"] = "hello world"
 
+	// points data connections at someone else
+	server.handlers["PASV"] = func(fc *fakeConn, arg string) {
+		port, err := fc.listenData()
 		if err != nil {
-			t.Fatal(err)
+			fc.reply(425, err.Error())
+		} else {
+			fc.reply(227, fmt.Sprintf("Entering Passive Mode (192,0,2,1,%d,%d)", port>>8, port&0xFF))
 		}
+	}
 
-		// 10MB of random data
-		buf := make([]byte, 10*1024*1024)
-		randomBytes(buf)
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
 
-		closed := false
+	config := Config{
+		PassiveMode: PassivePASV,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
 
-		seeker := &testSeeker{
-			buf: bytes.NewReader(buf),
-			cb: func(readSoFar int) {
-				if readSoFar > 5*1024*1024 && !closed {
-					// close all connections half way through upload
+			// where the data connection is actually listening
+			if host, port, _ := net.SplitHostPort(addr); host == "192.0.2.1" {
+				addr = net.JoinHostPort("127.0.0.1", port)
+			}
 
-					// if you don't wait a bit here, proftpd deletes the
-					// partially uploaded file for some reason
-					time.Sleep(100 * time.Millisecond)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
 
-					c.Close()
-					c.closed = false
-					closed = true
-				}
-			},
-		}
+	c, err := DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		os.Remove("testroot/git-ignored/big")
+	err = c.Retrieve("file", ioutil.Discard)
 
-		err = c.Store("git-ignored/big", seeker)
+	var addrErr *DataAddressError
+	if !errors.Is(err, ErrForeignDataAddress) || !errors.As(err, &addrErr) {
+		t.Fatalf("got %v", err)
+	}
 
-		if err != nil {
-			t.Fatal(err)
-		}
+	if !strings.HasPrefix(addrErr.Addr, "192.0.2.1:") || addrErr.ServerIP != "127.0.0.1" {
+		t.Errorf("got %+v", addrErr)
+	}
 
-		stored, err := ioutil.ReadFile("testroot/git-ignored/big")
-		if err != nil {
-			t.Fatal(err)
-		}
+	mu.Lock()
+	if len(dialed) != 1 {
+		t.Errorf("expected only the control connection, got %v", dialed)
+	}
+	mu.Unlock()
 
-		if !bytes.Equal(buf, stored) {
-			t.Errorf("buf was %d, stored was %d", len(buf), len(stored))
-		}
+	c.Close()
 
-		if c.numOpenConns() != len(c.freeConnCh) {
-			t.Error("Leaked a connection")
-		}
+	// opted out
+	config.AllowForeignDataAddress = true
+
+	c, err = DialConfig(config, server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("file", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Errorf("got %q", buf.String())
 	}
 }